@@ -4,6 +4,7 @@
 package irc
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/subtle"
 	"encoding/hex"
@@ -11,12 +12,14 @@ import (
 	"errors"
 	"fmt"
 	"net/smtp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/oragono/oragono/irc/caps"
+	"github.com/oragono/oragono/irc/history"
 	"github.com/oragono/oragono/irc/passwd"
 	"github.com/tidwall/buntdb"
 )
@@ -31,6 +34,26 @@ const (
 	keyAccountCredentials      = "account.credentials %s"
 	keyAccountAdditionalNicks  = "account.additionalnicks %s"
 	keyCertToAccount           = "account.creds.certfp %s"
+	keyAccountVHost            = "account.vhost %s"
+	keyAccountSuspended        = "account.suspended %s"
+	keyAccountIgnoreLists      = "account.ignorelists %s"
+	keyAccountAlwaysOn         = "account.alwayson %s"
+	keyAccountAlwaysOnState    = "account.alwaysonstate %s"
+	keyAccountResetCode        = "account.resetcode %s"
+	keyAccountResetSent        = "account.resetsent %s"
+
+	// direct messages are keyed by the (sorted) pair of accounts, then
+	// by the zero-padded time and msgid so that they sort chronologically
+	keyAccountDirectMessage = "account.directmessage %s %s %s"
+	// the number of messages stored for each pair of accounts
+	keyAccountDirectMessageCount = "account.directmessagecount %s %s"
+
+	maxCertfpsPerAccount = 5
+
+	// how long a passphrase reset code can be used for
+	resetCodeExpiry = time.Hour
+	// how long an account has to wait between passphrase reset e-mails
+	resetThrottleInterval = 10 * time.Minute
 )
 
 // everything about accounts is persistent; therefore, the database is the authoritative
@@ -43,6 +66,8 @@ type AccountManager struct {
 	// track clients logged in to accounts
 	accountToClients map[string][]*Client
 	nickToAccount    map[string]string
+	// authProvider is an optional external source of accounts
+	authProvider AuthProvider
 }
 
 func NewAccountManager(server *Server) *AccountManager {
@@ -56,6 +81,27 @@ func NewAccountManager(server *Server) *AccountManager {
 	return &am
 }
 
+// SetAuthProvider sets (or, if `provider` is nil, removes) the external source of accounts
+// that's consulted before our own credentials.
+func (am *AccountManager) SetAuthProvider(provider AuthProvider) {
+	am.Lock()
+	defer am.Unlock()
+	am.authProvider = provider
+}
+
+func (am *AccountManager) getAuthProvider() AuthProvider {
+	am.RLock()
+	defer am.RUnlock()
+	return am.authProvider
+}
+
+// LoggedInCount returns how many accounts have at least one client logged in to them.
+func (am *AccountManager) LoggedInCount() int {
+	am.RLock()
+	defer am.RUnlock()
+	return len(am.accountToClients)
+}
+
 func (am *AccountManager) buildNickToAccountIndex() {
 	if !am.server.AccountConfig().NickReservation.Enabled {
 		return
@@ -136,13 +182,20 @@ func (am *AccountManager) Register(client *Client, account string, callbackNames
 		return errAccountCreation
 	}
 	// it's fine if this is empty, that just means no certificate is authorized
-	creds.Certificate = certfp
+	if certfp != "" {
+		creds.Certificates = []string{certfp}
+	}
 	if passphrase != "" {
 		creds.PassphraseHash, err = am.server.passwords.GenerateFromPassword(creds.PassphraseSalt, passphrase)
 		if err != nil {
 			am.server.logger.Error("internal", fmt.Sprintf("could not hash password: %v", err))
 			return errAccountCreation
 		}
+		scram, err := passwd.NewScramCredentials(passphrase, passwd.DefaultScramIterations)
+		if err != nil {
+			return errAccountCreation
+		}
+		creds.Scram = &scram
 	}
 
 	credText, err := json.Marshal(creds)
@@ -216,20 +269,24 @@ func (am *AccountManager) dispatchCallback(client *Client, casefoldedAccount str
 	if callbackNamespace == "*" || callbackNamespace == "none" {
 		return "", nil
 	} else if callbackNamespace == "mailto" {
-		return am.dispatchMailtoCallback(client, casefoldedAccount, callbackValue)
+		return am.dispatchMailtoCallback(client, casefoldedAccount, callbackValue, false)
 	} else {
 		return "", errors.New(fmt.Sprintf("Callback not implemented: %s", callbackNamespace))
 	}
 }
 
-func (am *AccountManager) dispatchMailtoCallback(client *Client, casefoldedAccount string, callbackValue string) (code string, err error) {
+// dispatchMailtoCallback e-mails a new code to the given address, either to verify a
+// new account or, if `reset` is true, to reset the passphrase of an existing one.
+func (am *AccountManager) dispatchMailtoCallback(client *Client, casefoldedAccount string, callbackValue string, reset bool) (code string, err error) {
 	config := am.server.AccountConfig().Registration.Callbacks.Mailto
 	buf := make([]byte, 16)
 	rand.Read(buf)
 	code = hex.EncodeToString(buf)
 
 	subject := config.VerifyMessageSubject
-	if subject == "" {
+	if reset {
+		subject = fmt.Sprintf(client.t("Reset your passphrase on %s"), am.server.name)
+	} else if subject == "" {
 		subject = fmt.Sprintf(client.t("Verify your account on %s"), am.server.name)
 	}
 	messageStrings := []string{
@@ -238,10 +295,21 @@ func (am *AccountManager) dispatchMailtoCallback(client *Client, casefoldedAccou
 		fmt.Sprintf("Subject: %s\r\n", subject),
 		"\r\n", // end headers, begin message body
 		fmt.Sprintf(client.t("Account: %s"), casefoldedAccount) + "\r\n",
-		fmt.Sprintf(client.t("Verification code: %s"), code) + "\r\n",
-		"\r\n",
-		client.t("To verify your account, issue one of these commands:") + "\r\n",
-		fmt.Sprintf("/MSG NickServ VERIFY %s %s", casefoldedAccount, code) + "\r\n",
+	}
+	if reset {
+		messageStrings = append(messageStrings,
+			fmt.Sprintf(client.t("Reset code: %s"), code)+"\r\n",
+			"\r\n",
+			client.t("To choose a new passphrase, issue this command:")+"\r\n",
+			fmt.Sprintf("/MSG NickServ RESETPASS %s %s <new passphrase>", casefoldedAccount, code)+"\r\n",
+		)
+	} else {
+		messageStrings = append(messageStrings,
+			fmt.Sprintf(client.t("Verification code: %s"), code)+"\r\n",
+			"\r\n",
+			client.t("To verify your account, issue one of these commands:")+"\r\n",
+			fmt.Sprintf("/MSG NickServ VERIFY %s %s", casefoldedAccount, code)+"\r\n",
+		)
 	}
 
 	var message []byte
@@ -319,12 +387,11 @@ func (am *AccountManager) Verify(client *Client, account string, code string) er
 			tx.Set(callbackKey, raw.Callback, nil)
 			tx.Set(credentialsKey, raw.Credentials, nil)
 
-			var creds AccountCredentials
 			// XXX we shouldn't do (de)serialization inside the txn,
 			// but this is like 2 usec on my system
-			json.Unmarshal([]byte(raw.Credentials), &creds)
-			if creds.Certificate != "" {
-				certFPKey := fmt.Sprintf(keyCertToAccount, creds.Certificate)
+			creds, _ := unmarshalCredentials(raw.Credentials)
+			for _, certfp := range creds.Certificates {
+				certFPKey := fmt.Sprintf(keyCertToAccount, certfp)
 				tx.Set(certFPKey, casefoldedAccount, nil)
 			}
 
@@ -448,7 +515,277 @@ func (am *AccountManager) SetNickReserved(client *Client, nick string, saUnreser
 	return nil
 }
 
+// modifyCredentials atomically updates the credentials of a verified account,
+// keeping the certificate fingerprint index in sync with its certificates.
+func (am *AccountManager) modifyCredentials(account string, modify func(creds *AccountCredentials) error) error {
+	casefoldedAccount, err := CasefoldName(account)
+	if err != nil {
+		return errAccountDoesNotExist
+	}
+	credentialsKey := fmt.Sprintf(keyAccountCredentials, casefoldedAccount)
+
+	am.serialCacheUpdateMutex.Lock()
+	defer am.serialCacheUpdateMutex.Unlock()
+
+	return am.server.store.Update(func(tx *buntdb.Tx) error {
+		raw, err := am.loadRawAccount(tx, casefoldedAccount)
+		if err != nil {
+			return err
+		} else if !raw.Verified {
+			return errAccountUnverified
+		}
+		creds, err := unmarshalCredentials(raw.Credentials)
+		if err != nil {
+			return err
+		}
+
+		oldCertfps := append([]string(nil), creds.Certificates...)
+		err = modify(&creds)
+		if err != nil {
+			return err
+		}
+
+		for _, certfp := range creds.Certificates {
+			if containsString(oldCertfps, certfp) {
+				continue
+			}
+			certFPKey := fmt.Sprintf(keyCertToAccount, certfp)
+			if owner, err := tx.Get(certFPKey); err == nil && owner != casefoldedAccount {
+				return errCertfpAlreadyExists
+			}
+			tx.Set(certFPKey, casefoldedAccount, nil)
+		}
+		for _, certfp := range oldCertfps {
+			if containsString(creds.Certificates, certfp) {
+				continue
+			}
+			certFPKey := fmt.Sprintf(keyCertToAccount, certfp)
+			if owner, err := tx.Get(certFPKey); err == nil && owner == casefoldedAccount {
+				tx.Delete(certFPKey)
+			}
+		}
+
+		credText, err := json.Marshal(creds)
+		if err != nil {
+			am.server.logger.Error("internal", fmt.Sprintf("could not marshal credentials: %v", err))
+			return err
+		}
+		_, _, err = tx.Set(credentialsKey, string(credText), nil)
+		return err
+	})
+}
+
+// SetPassphrase replaces the passphrase of an account.
+func (am *AccountManager) SetPassphrase(account string, passphrase string) error {
+	salt, err := passwd.NewSalt()
+	if err != nil {
+		return err
+	}
+	hash, err := am.server.passwords.GenerateFromPassword(salt, passphrase)
+	if err != nil {
+		am.server.logger.Error("internal", fmt.Sprintf("could not hash password: %v", err))
+		return err
+	}
+	scram, err := passwd.NewScramCredentials(passphrase, passwd.DefaultScramIterations)
+	if err != nil {
+		return err
+	}
+
+	return am.modifyCredentials(account, func(creds *AccountCredentials) error {
+		creds.PassphraseSalt = salt
+		creds.PassphraseHash = hash
+		creds.Scram = &scram
+		return nil
+	})
+}
+
+// ChangePassphrase replaces the passphrase of an account, after checking its current one.
+func (am *AccountManager) ChangePassphrase(account string, oldPassphrase string, newPassphrase string) error {
+	result, err := am.LoadAccount(account)
+	if err != nil {
+		return err
+	}
+	err = am.server.passwords.CompareHashAndPassword(result.Credentials.PassphraseHash, result.Credentials.PassphraseSalt, oldPassphrase)
+	if err != nil {
+		return errAccountInvalidCredentials
+	}
+	return am.SetPassphrase(account, newPassphrase)
+}
+
+// StartPassphraseReset sends a code to the e-mail address an account was registered with,
+// which can then be used with ResetPassphrase to set a new passphrase.
+func (am *AccountManager) StartPassphraseReset(client *Client, account string) error {
+	casefoldedAccount, err := CasefoldName(account)
+	if err != nil {
+		return errAccountDoesNotExist
+	}
+	resetCodeKey := fmt.Sprintf(keyAccountResetCode, casefoldedAccount)
+	resetSentKey := fmt.Sprintf(keyAccountResetSent, casefoldedAccount)
+
+	var raw rawClientAccount
+	am.server.store.View(func(tx *buntdb.Tx) error {
+		raw, err = am.loadRawAccount(tx, casefoldedAccount)
+		return nil
+	})
+	if err != nil {
+		return err
+	} else if !raw.Verified {
+		return errAccountUnverified
+	}
+
+	callbackNamespace, callbackValue := parseCallback(raw.Callback, am.server.AccountConfig())
+	if callbackNamespace != "mailto" {
+		return errAccountNoResetCallback
+	}
+
+	// only one e-mail is sent to each account per throttle interval, so that
+	// RESETPASS can't be used to flood someone's inbox
+	err = am.server.store.Update(func(tx *buntdb.Tx) error {
+		if _, err := tx.Get(resetSentKey); err == nil {
+			return errAccountResetThrottled
+		}
+		_, _, err := tx.Set(resetSentKey, "1", &buntdb.SetOptions{Expires: true, TTL: resetThrottleInterval})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	code, err := am.dispatchMailtoCallback(client, casefoldedAccount, callbackValue, true)
+	if err != nil {
+		return errCallbackFailed
+	}
+
+	return am.server.store.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(resetCodeKey, code, &buntdb.SetOptions{Expires: true, TTL: resetCodeExpiry})
+		return err
+	})
+}
+
+// ResetPassphrase sets a new passphrase for an account, given a code from StartPassphraseReset.
+func (am *AccountManager) ResetPassphrase(account string, code string, passphrase string) error {
+	casefoldedAccount, err := CasefoldName(account)
+	if err != nil {
+		return errAccountDoesNotExist
+	}
+	resetCodeKey := fmt.Sprintf(keyAccountResetCode, casefoldedAccount)
+
+	err = am.server.store.Update(func(tx *buntdb.Tx) error {
+		storedCode, err := tx.Get(resetCodeKey)
+		if err != nil || storedCode == "" || subtle.ConstantTimeCompare([]byte(code), []byte(storedCode)) != 1 {
+			return errAccountVerificationInvalidCode
+		}
+		tx.Delete(resetCodeKey)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return am.SetPassphrase(casefoldedAccount, passphrase)
+}
+
+// normalizeCertfp converts a user-supplied certificate fingerprint, which may be
+// in the common colon-separated format, into the lowercase hex we store.
+func normalizeCertfp(certfp string) (string, error) {
+	certfp = strings.ToLower(strings.Replace(certfp, ":", "", -1))
+	decoded, err := hex.DecodeString(certfp)
+	if err != nil || len(decoded) == 0 {
+		return "", errInvalidCertfp
+	}
+	return certfp, nil
+}
+
+// AddCertfp authorizes a TLS client certificate fingerprint to log into an account.
+func (am *AccountManager) AddCertfp(account string, certfp string) error {
+	certfp, err := normalizeCertfp(certfp)
+	if err != nil {
+		return err
+	}
+	return am.modifyCredentials(account, func(creds *AccountCredentials) error {
+		if containsString(creds.Certificates, certfp) {
+			return errCertfpAlreadyYours
+		}
+		if maxCertfpsPerAccount <= len(creds.Certificates) {
+			return errAccountTooManyCertfps
+		}
+		creds.Certificates = append(creds.Certificates, certfp)
+		return nil
+	})
+}
+
+// RemoveCertfp deauthorizes a TLS client certificate fingerprint from an account.
+func (am *AccountManager) RemoveCertfp(account string, certfp string) error {
+	certfp, err := normalizeCertfp(certfp)
+	if err != nil {
+		return err
+	}
+	return am.modifyCredentials(account, func(creds *AccountCredentials) error {
+		var certfps []string
+		for _, existing := range creds.Certificates {
+			if existing != certfp {
+				certfps = append(certfps, existing)
+			}
+		}
+		if len(certfps) == len(creds.Certificates) {
+			return errNoSuchCertfp
+		}
+		// don't lock the user out of their account
+		if len(certfps) == 0 && len(creds.PassphraseHash) == 0 {
+			return errAccountCantRemoveLastCredential
+		}
+		creds.Certificates = certfps
+		return nil
+	})
+}
+
+// authenticateExternally checks credentials with the AuthProvider and logs the client in if
+// they're valid, creating the local account if necessary and allowed by the config.
+func (am *AccountManager) authenticateExternally(client *Client, provider AuthProvider, input AuthProviderInput) error {
+	input.IP = client.IPString()
+	accountName, err := provider.Authenticate(input)
+	if err != nil {
+		am.server.logger.Debug("accounts", fmt.Sprintf("external authentication failed for %s: %v", client.Nick(), err))
+		return errAccountInvalidCredentials
+	}
+
+	account, err := am.LoadAccount(accountName)
+	if err == errAccountDoesNotExist && am.server.AccountConfig().AuthScript.Autocreate {
+		// the account has no local credentials, so it can only be used via the provider
+		err = am.Register(client, accountName, "*", "", "", "")
+		if err == nil {
+			// this logs the client in
+			err = am.Verify(client, accountName, "")
+		}
+		if err == nil {
+			am.server.logger.Info("accounts", fmt.Sprintf("created account %s for externally authenticated client %s", accountName, client.Nick()))
+		}
+		return err
+	} else if err != nil {
+		return err
+	} else if !account.Verified {
+		return errAccountUnverified
+	} else if _, suspended := am.CheckSuspension(account.Name); suspended {
+		return errAccountSuspended
+	}
+
+	am.Login(client, account.Name)
+	return nil
+}
+
 func (am *AccountManager) AuthenticateByPassphrase(client *Client, accountName string, passphrase string) error {
+	if provider := am.getAuthProvider(); provider != nil {
+		input := AuthProviderInput{
+			AccountName: accountName,
+			Passphrase:  passphrase,
+			Certfp:      client.certfp,
+		}
+		if am.authenticateExternally(client, provider, input) == nil {
+			return nil
+		}
+		// fall back to our own credentials
+	}
+
 	account, err := am.LoadAccount(accountName)
 	if err != nil {
 		return err
@@ -464,10 +801,52 @@ func (am *AccountManager) AuthenticateByPassphrase(client *Client, accountName s
 		return errAccountInvalidCredentials
 	}
 
+	if account.Credentials.Scram == nil {
+		am.migrateScramCredentials(account, passphrase)
+	}
+
+	if _, suspended := am.CheckSuspension(account.Name); suspended {
+		return errAccountSuspended
+	}
+
 	am.Login(client, account.Name)
 	return nil
 }
 
+// migrateScramCredentials adds SCRAM credentials to accounts registered before
+// they were supported, now that we know the account's passphrase.
+func (am *AccountManager) migrateScramCredentials(account ClientAccount, passphrase string) {
+	scram, err := passwd.NewScramCredentials(passphrase, passwd.DefaultScramIterations)
+	if err == nil {
+		err = am.modifyCredentials(account.Name, func(creds *AccountCredentials) error {
+			// make sure the passphrase didn't change in the meantime
+			if creds.Scram == nil && bytes.Equal(creds.PassphraseHash, account.Credentials.PassphraseHash) {
+				creds.Scram = &scram
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		am.server.logger.Error("internal", fmt.Sprintf("could not migrate SCRAM credentials: %v", err))
+	}
+}
+
+// ScramCredentials returns the SCRAM credentials of a verified account.
+func (am *AccountManager) ScramCredentials(accountName string) (creds passwd.ScramCredentials, err error) {
+	// every failure looks the same, so that the exchange can't be used to find
+	// out which accounts exist
+	account, err := am.LoadAccount(accountName)
+	if err != nil || !account.Verified || account.Credentials.Scram == nil {
+		// accounts without SCRAM credentials need to login with PLAIN once
+		// to populate them
+		err = errAccountInvalidCredentials
+		return
+	}
+	// suspension is checked once the exchange succeeds, as with PLAIN,
+	// so that it isn't revealed to someone who doesn't know the passphrase
+	return *account.Credentials.Scram, nil
+}
+
 func (am *AccountManager) LoadAccount(accountName string) (result ClientAccount, err error) {
 	casefoldedAccount, err := CasefoldName(accountName)
 	if err != nil {
@@ -487,7 +866,8 @@ func (am *AccountManager) LoadAccount(accountName string) (result ClientAccount,
 	result.Name = raw.Name
 	regTimeInt, _ := strconv.ParseInt(raw.RegisteredAt, 10, 64)
 	result.RegisteredAt = time.Unix(regTimeInt, 0)
-	e := json.Unmarshal([]byte(raw.Credentials), &result.Credentials)
+	var e error
+	result.Credentials, e = unmarshalCredentials(raw.Credentials)
 	if e != nil {
 		am.server.logger.Error("internal", fmt.Sprintf("could not unmarshal credentials: %v", e))
 		err = errAccountDoesNotExist
@@ -498,6 +878,29 @@ func (am *AccountManager) LoadAccount(accountName string) (result ClientAccount,
 	return
 }
 
+// AllAccounts returns every registered account, verified or not.
+func (am *AccountManager) AllAccounts() (result []ClientAccount) {
+	prefix := fmt.Sprintf(keyAccountExists, "")
+	var casefoldedAccounts []string
+	am.server.store.View(func(tx *buntdb.Tx) error {
+		return tx.AscendGreaterOrEqual("", prefix, func(key, value string) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			casefoldedAccounts = append(casefoldedAccounts, strings.TrimPrefix(key, prefix))
+			return true
+		})
+	})
+
+	for _, casefoldedAccount := range casefoldedAccounts {
+		account, err := am.LoadAccount(casefoldedAccount)
+		if err == nil {
+			result = append(result, account)
+		}
+	}
+	return
+}
+
 func (am *AccountManager) loadRawAccount(tx *buntdb.Tx, casefoldedAccount string) (result rawClientAccount, err error) {
 	accountKey := fmt.Sprintf(keyAccountExists, casefoldedAccount)
 	accountNameKey := fmt.Sprintf(keyAccountName, casefoldedAccount)
@@ -527,9 +930,20 @@ func (am *AccountManager) loadRawAccount(tx *buntdb.Tx, casefoldedAccount string
 }
 
 func (am *AccountManager) Unregister(account string) error {
+	orphaned, err := am.unregister(account)
+	// always-on clients can't stay on the server without their account. they're
+	// disconnected here, since destroying them needs the locks unregister holds
+	for _, client := range orphaned {
+		client.Quit(client.t("Your account was unregistered"))
+		client.destroy(false)
+	}
+	return err
+}
+
+func (am *AccountManager) unregister(account string) (orphaned []*Client, err error) {
 	casefoldedAccount, err := CasefoldName(account)
 	if err != nil {
-		return errAccountDoesNotExist
+		return nil, errAccountDoesNotExist
 	}
 
 	accountKey := fmt.Sprintf(keyAccountExists, casefoldedAccount)
@@ -540,6 +954,8 @@ func (am *AccountManager) Unregister(account string) error {
 	verificationCodeKey := fmt.Sprintf(keyAccountVerificationCode, casefoldedAccount)
 	verifiedKey := fmt.Sprintf(keyAccountVerified, casefoldedAccount)
 	nicksKey := fmt.Sprintf(keyAccountAdditionalNicks, casefoldedAccount)
+	resetCodeKey := fmt.Sprintf(keyAccountResetCode, casefoldedAccount)
+	resetSentKey := fmt.Sprintf(keyAccountResetSent, casefoldedAccount)
 
 	var clients []*Client
 
@@ -556,20 +972,30 @@ func (am *AccountManager) Unregister(account string) error {
 		tx.Delete(registeredTimeKey)
 		tx.Delete(callbackKey)
 		tx.Delete(verificationCodeKey)
+		tx.Delete(resetCodeKey)
+		tx.Delete(resetSentKey)
 		rawNicks, _ = tx.Get(nicksKey)
 		tx.Delete(nicksKey)
+		tx.Delete(fmt.Sprintf(keyAccountVHost, casefoldedAccount))
+		tx.Delete(fmt.Sprintf(keyAccountSuspended, casefoldedAccount))
+		tx.Delete(fmt.Sprintf(keyAccountIgnoreLists, casefoldedAccount))
+		tx.Delete(fmt.Sprintf(keyAccountAlwaysOn, casefoldedAccount))
+		tx.Delete(fmt.Sprintf(keyAccountAlwaysOnState, casefoldedAccount))
 		credText, err = tx.Get(credentialsKey)
 		tx.Delete(credentialsKey)
+		deleteDirectMessages(tx, casefoldedAccount)
 		return nil
 	})
 
 	if err == nil {
 		var creds AccountCredentials
-		if err = json.Unmarshal([]byte(credText), &creds); err == nil && creds.Certificate != "" {
-			certFPKey := fmt.Sprintf(keyCertToAccount, creds.Certificate)
+		if creds, err = unmarshalCredentials(credText); err == nil && len(creds.Certificates) != 0 {
 			am.server.store.Update(func(tx *buntdb.Tx) error {
-				if account, err := tx.Get(certFPKey); err == nil && account == casefoldedAccount {
-					tx.Delete(certFPKey)
+				for _, certfp := range creds.Certificates {
+					certFPKey := fmt.Sprintf(keyCertToAccount, certfp)
+					if account, err := tx.Get(certFPKey); err == nil && account == casefoldedAccount {
+						tx.Delete(certFPKey)
+					}
 				}
 				return nil
 			})
@@ -588,66 +1014,635 @@ func (am *AccountManager) Unregister(account string) error {
 		delete(am.nickToAccount, nick)
 	}
 	for _, client := range clients {
-		am.logoutOfAccount(client)
+		if am.logoutOfAccount(client) {
+			orphaned = append(orphaned, client)
+		}
 	}
 
 	if err != nil {
-		return errAccountDoesNotExist
+		return orphaned, errAccountDoesNotExist
 	}
-	return nil
+	return orphaned, nil
 }
 
-func (am *AccountManager) AuthenticateByCertFP(client *Client) error {
-	if client.certfp == "" {
-		return errAccountInvalidCredentials
-	}
-
-	var account string
-	var rawAccount rawClientAccount
-	certFPKey := fmt.Sprintf(keyCertToAccount, client.certfp)
-
-	err := am.server.store.Update(func(tx *buntdb.Tx) error {
-		var err error
-		account, _ = tx.Get(certFPKey)
-		if account == "" {
-			return errAccountInvalidCredentials
-		}
-		rawAccount, err = am.loadRawAccount(tx, account)
-		if err != nil || !rawAccount.Verified {
-			return errAccountUnverified
-		}
-		return nil
-	})
-
-	if err != nil {
-		return err
+// directMessageKeys returns the key prefix for the conversation between two
+// accounts, and the key of its message count.
+func directMessageKeys(account1, account2 string) (prefix, countKey string) {
+	if account2 < account1 {
+		account1, account2 = account2, account1
 	}
-
-	// ok, we found an account corresponding to their certificate
-
-	am.Login(client, rawAccount.Name)
-	return nil
+	prefix = fmt.Sprintf(keyAccountDirectMessage, account1, account2, "")
+	countKey = fmt.Sprintf(keyAccountDirectMessageCount, account1, account2)
+	return
 }
 
-func (am *AccountManager) Login(client *Client, account string) {
-	am.Lock()
-	defer am.Unlock()
-
-	am.loginToAccount(client, account)
-	casefoldedAccount := client.Account()
-	am.accountToClients[casefoldedAccount] = append(am.accountToClients[casefoldedAccount], client)
+// directMessageCutoff returns the key below which the messages in a conversation
+// are older than the configured max age, or "" if they don't expire.
+func directMessageCutoff(config *DirectMessageHistoryConfig, prefix string, now time.Time) string {
+	if config.MaxAge == 0 {
+		return ""
+	}
+	return prefix + fmt.Sprintf("%019d", now.Add(-config.MaxAge).UnixNano())
 }
 
-func (am *AccountManager) Logout(client *Client) {
-	am.Lock()
-	defer am.Unlock()
+// AddDirectMessage stores a direct message sent between two (casefolded) accounts,
+// discarding the oldest messages in the conversation beyond the configured length
+// or age.
+func (am *AccountManager) AddDirectMessage(sender, recipient string, item history.Item) {
+	config := am.server.AccountConfig().DirectMessageHistory
+	if !config.Enabled {
+		return
+	}
 
-	casefoldedAccount := client.Account()
-	if casefoldedAccount == "" {
+	if item.Time.IsZero() {
+		item.Time = time.Now().UTC()
+	}
+	itemBytes, err := json.Marshal(item)
+	if err != nil {
+		am.server.logger.Error("internal", fmt.Sprintf("could not marshal direct message: %v", err))
 		return
 	}
 
-	am.logoutOfAccount(client)
+	prefix, countKey := directMessageKeys(sender, recipient)
+	key := prefix + fmt.Sprintf("%019d.%s", item.Time.UnixNano(), item.Msgid)
+	cutoff := directMessageCutoff(&config, prefix, item.Time)
+
+	err = am.server.store.Update(func(tx *buntdb.Tx) error {
+		countStr, _ := tx.Get(countKey)
+		count, _ := strconv.Atoi(countStr)
+		_, _, err := tx.Set(key, string(itemBytes), nil)
+		if err != nil {
+			return err
+		}
+		count++
+
+		// messages are only ever discarded from the old end of the conversation,
+		// so this stops at the first one that's kept
+		var discard []string
+		tx.AscendGreaterOrEqual("", prefix, func(key, value string) bool {
+			if !strings.HasPrefix(key, prefix) || (count-len(discard) <= config.Length && cutoff <= key) {
+				return false
+			}
+			discard = append(discard, key)
+			return true
+		})
+		for _, key := range discard {
+			tx.Delete(key)
+		}
+
+		_, _, err = tx.Set(countKey, strconv.Itoa(count-len(discard)), nil)
+		return err
+	})
+	if err != nil {
+		am.server.logger.Error("internal", fmt.Sprintf("could not store direct message: %v", err))
+	}
+}
+
+// DirectMessages returns the stored direct messages between two (casefolded) accounts
+// that satisfy `predicate`, with the same semantics as history.Buffer.Match.
+func (am *AccountManager) DirectMessages(account1, account2 string, predicate history.Predicate, ascending bool, limit int) (results []history.Item) {
+	config := am.server.AccountConfig().DirectMessageHistory
+	prefix, _ := directMessageKeys(account1, account2)
+	// messages older than this are discarded the next time the conversation is written to
+	cutoff := directMessageCutoff(&config, prefix, time.Now().UTC())
+
+	iterator := func(key, value string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if key < cutoff {
+			// everything older has expired as well
+			return ascending
+		}
+		var item history.Item
+		if err := json.Unmarshal([]byte(value), &item); err != nil {
+			am.server.logger.Error("internal", fmt.Sprintf("could not unmarshal direct message: %v", err))
+			return true
+		}
+		if predicate(item) {
+			results = append(results, item)
+		}
+		return limit <= 0 || len(results) < limit
+	}
+
+	am.server.store.View(func(tx *buntdb.Tx) error {
+		if ascending {
+			return tx.AscendGreaterOrEqual("", prefix, iterator)
+		}
+		// every key in the conversation sorts below this
+		return tx.DescendLessOrEqual("", prefix+"~", iterator)
+	})
+
+	if !ascending {
+		for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+			results[i], results[j] = results[j], results[i]
+		}
+	}
+	return
+}
+
+// deleteDirectMessages removes every stored direct message involving the given account,
+// along with the message counts of its conversations.
+func deleteDirectMessages(tx *buntdb.Tx, casefoldedAccount string) {
+	var keys []string
+	// see keyAccountDirectMessage and keyAccountDirectMessageCount
+	for _, prefix := range []string{"account.directmessage ", "account.directmessagecount "} {
+		tx.AscendGreaterOrEqual("", prefix, func(key, value string) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			pieces := strings.SplitN(strings.TrimPrefix(key, prefix), " ", 3)
+			if pieces[0] == casefoldedAccount || (1 < len(pieces) && pieces[1] == casefoldedAccount) {
+				keys = append(keys, key)
+			}
+			return true
+		})
+	}
+	for _, key := range keys {
+		tx.Delete(key)
+	}
+}
+
+func (am *AccountManager) AuthenticateByCertFP(client *Client) error {
+	if client.certfp == "" {
+		return errAccountInvalidCredentials
+	}
+
+	if provider := am.getAuthProvider(); provider != nil {
+		if am.authenticateExternally(client, provider, AuthProviderInput{Certfp: client.certfp}) == nil {
+			return nil
+		}
+		// fall back to our own credentials
+	}
+
+	var account string
+	var rawAccount rawClientAccount
+	certFPKey := fmt.Sprintf(keyCertToAccount, client.certfp)
+
+	err := am.server.store.Update(func(tx *buntdb.Tx) error {
+		var err error
+		account, _ = tx.Get(certFPKey)
+		if account == "" {
+			return errAccountInvalidCredentials
+		}
+		rawAccount, err = am.loadRawAccount(tx, account)
+		if err != nil || !rawAccount.Verified {
+			return errAccountUnverified
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// ok, we found an account corresponding to their certificate
+
+	if _, suspended := am.CheckSuspension(rawAccount.Name); suspended {
+		return errAccountSuspended
+	}
+
+	am.Login(client, rawAccount.Name)
+	return nil
+}
+
+func (am *AccountManager) Login(client *Client, account string) {
+	am.Lock()
+	am.loginToAccount(client, account)
+	casefoldedAccount := client.Account()
+	am.accountToClients[casefoldedAccount] = append(am.accountToClients[casefoldedAccount], client)
+	am.Unlock()
+
+	// give them any persistent modes they have in channels they're already in
+	for _, channel := range client.Channels() {
+		channel.applyAccountUMode(client)
+	}
+
+	// and their account cloak
+	client.updateCloaks()
+
+	// and their vhost, if they have one
+	if am.server.AccountConfig().VHosts.Enabled {
+		if info, err := am.LoadVHostInfo(casefoldedAccount); err == nil && info.ApprovedVHost != "" {
+			client.setAccountVHost(info.ApprovedVHost)
+		}
+	}
+
+	// and their SILENCE and ACCEPT lists
+	if lists, err := am.LoadIgnoreLists(casefoldedAccount); err == nil {
+		client.applyIgnoreLists(lists)
+	}
+
+	// and whether their client should stay on the server after they disconnect
+	if am.server.AccountConfig().Multiclient.AllowAlwaysOn {
+		client.SetAlwaysOn(am.LoadAlwaysOn(casefoldedAccount))
+	}
+}
+
+// AccountToClients returns the clients that are logged into the given account.
+func (am *AccountManager) AccountToClients(account string) (clients []*Client) {
+	casefoldedAccount, err := CasefoldName(account)
+	if err != nil {
+		return nil
+	}
+
+	am.RLock()
+	defer am.RUnlock()
+	clients = make([]*Client, len(am.accountToClients[casefoldedAccount]))
+	copy(clients, am.accountToClients[casefoldedAccount])
+	return
+}
+
+// LoadIgnoreLists loads the stored SILENCE and ACCEPT lists of the given account.
+func (am *AccountManager) LoadIgnoreLists(account string) (result IgnoreLists, err error) {
+	casefoldedAccount, err := CasefoldName(account)
+	if err != nil {
+		return result, errAccountDoesNotExist
+	}
+
+	var raw string
+	am.server.store.View(func(tx *buntdb.Tx) error {
+		raw, _ = tx.Get(fmt.Sprintf(keyAccountIgnoreLists, casefoldedAccount))
+		return nil
+	})
+	if raw != "" {
+		err = json.Unmarshal([]byte(raw), &result)
+	}
+	return
+}
+
+// StoreIgnoreLists stores the SILENCE and ACCEPT lists of the given account.
+func (am *AccountManager) StoreIgnoreLists(account string, lists IgnoreLists) error {
+	casefoldedAccount, err := CasefoldName(account)
+	if err != nil {
+		return errAccountDoesNotExist
+	}
+
+	b, err := json.Marshal(lists)
+	if err != nil {
+		return err
+	}
+
+	return am.server.store.Update(func(tx *buntdb.Tx) error {
+		if _, err := tx.Get(fmt.Sprintf(keyAccountExists, casefoldedAccount)); err != nil {
+			return errAccountDoesNotExist
+		}
+		_, _, err := tx.Set(fmt.Sprintf(keyAccountIgnoreLists, casefoldedAccount), string(b), nil)
+		return err
+	})
+}
+
+// LoadAlwaysOn returns whether the given account has enabled always-on.
+func (am *AccountManager) LoadAlwaysOn(account string) (alwaysOn bool) {
+	casefoldedAccount, err := CasefoldName(account)
+	if err != nil {
+		return false
+	}
+
+	am.server.store.View(func(tx *buntdb.Tx) error {
+		_, err := tx.Get(fmt.Sprintf(keyAccountAlwaysOn, casefoldedAccount))
+		alwaysOn = err == nil
+		return nil
+	})
+	return
+}
+
+// StoreAlwaysOn enables or disables always-on for the given account. Disabling it
+// also forgets any stored always-on state.
+func (am *AccountManager) StoreAlwaysOn(account string, alwaysOn bool) error {
+	casefoldedAccount, err := CasefoldName(account)
+	if err != nil {
+		return errAccountDoesNotExist
+	}
+
+	return am.server.store.Update(func(tx *buntdb.Tx) error {
+		if _, err := tx.Get(fmt.Sprintf(keyAccountExists, casefoldedAccount)); err != nil {
+			return errAccountDoesNotExist
+		}
+		if alwaysOn {
+			_, _, err := tx.Set(fmt.Sprintf(keyAccountAlwaysOn, casefoldedAccount), "1", nil)
+			return err
+		}
+		tx.Delete(fmt.Sprintf(keyAccountAlwaysOn, casefoldedAccount))
+		tx.Delete(fmt.Sprintf(keyAccountAlwaysOnState, casefoldedAccount))
+		return nil
+	})
+}
+
+// StoreAlwaysOnState stores the state of the given account's always-on client, so
+// that it can be restored when the server restarts.
+func (am *AccountManager) StoreAlwaysOnState(account string, state AlwaysOnState) error {
+	casefoldedAccount, err := CasefoldName(account)
+	if err != nil {
+		return errAccountDoesNotExist
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return am.server.store.Update(func(tx *buntdb.Tx) error {
+		if _, err := tx.Get(fmt.Sprintf(keyAccountAlwaysOn, casefoldedAccount)); err != nil {
+			// always-on was disabled in the meantime
+			return nil
+		}
+		_, _, err := tx.Set(fmt.Sprintf(keyAccountAlwaysOnState, casefoldedAccount), string(b), nil)
+		return err
+	})
+}
+
+// DeleteAlwaysOnState forgets the stored state of the given account's always-on client.
+func (am *AccountManager) DeleteAlwaysOnState(account string) {
+	casefoldedAccount, err := CasefoldName(account)
+	if err != nil {
+		return
+	}
+
+	am.server.store.Update(func(tx *buntdb.Tx) error {
+		tx.Delete(fmt.Sprintf(keyAccountAlwaysOnState, casefoldedAccount))
+		return nil
+	})
+}
+
+// AlwaysOnStates returns the stored state of every always-on client, by account.
+func (am *AccountManager) AlwaysOnStates() (result map[string]AlwaysOnState) {
+	result = make(map[string]AlwaysOnState)
+	statePrefix := fmt.Sprintf(keyAccountAlwaysOnState, "")
+
+	am.server.store.View(func(tx *buntdb.Tx) error {
+		return tx.AscendGreaterOrEqual("", statePrefix, func(key, value string) bool {
+			if !strings.HasPrefix(key, statePrefix) {
+				return false
+			}
+			var state AlwaysOnState
+			if err := json.Unmarshal([]byte(value), &state); err == nil {
+				result[strings.TrimPrefix(key, statePrefix)] = state
+			}
+			return true
+		})
+	})
+	return
+}
+
+// Suspend prevents anyone from logging into the given account, until the suspension
+// expires or is lifted. It returns the clients that were logged into the account,
+// so that the caller can disconnect them.
+func (am *AccountManager) Suspend(account string, info IPBanInfo) (clients []*Client, err error) {
+	casefoldedAccount, err := CasefoldName(account)
+	if err != nil {
+		return nil, errAccountDoesNotExist
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	err = am.server.store.Update(func(tx *buntdb.Tx) error {
+		if _, err := tx.Get(fmt.Sprintf(keyAccountExists, casefoldedAccount)); err != nil {
+			return errAccountDoesNotExist
+		}
+		_, _, err := tx.Set(fmt.Sprintf(keyAccountSuspended, casefoldedAccount), string(b), nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	am.RLock()
+	clients = make([]*Client, len(am.accountToClients[casefoldedAccount]))
+	copy(clients, am.accountToClients[casefoldedAccount])
+	am.RUnlock()
+	return clients, nil
+}
+
+// Unsuspend lifts the suspension of the given account.
+func (am *AccountManager) Unsuspend(account string) error {
+	casefoldedAccount, err := CasefoldName(account)
+	if err != nil {
+		return errAccountDoesNotExist
+	}
+
+	return am.server.store.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(fmt.Sprintf(keyAccountSuspended, casefoldedAccount))
+		if err == buntdb.ErrNotFound {
+			return errNoExistingBan
+		}
+		return err
+	})
+}
+
+// CheckSuspension returns whether the given account is currently suspended,
+// along with the details of the suspension. Expired suspensions are cleaned up.
+func (am *AccountManager) CheckSuspension(account string) (info IPBanInfo, suspended bool) {
+	casefoldedAccount, err := CasefoldName(account)
+	if err != nil {
+		return
+	}
+	suspensionKey := fmt.Sprintf(keyAccountSuspended, casefoldedAccount)
+
+	var raw string
+	am.server.store.View(func(tx *buntdb.Tx) error {
+		raw, _ = tx.Get(suspensionKey)
+		return nil
+	})
+	if raw == "" || json.Unmarshal([]byte(raw), &info) != nil {
+		return info, false
+	}
+
+	if info.Time != nil && info.Time.IsExpired() {
+		am.server.store.Update(func(tx *buntdb.Tx) error {
+			tx.Delete(suspensionKey)
+			return nil
+		})
+		return info, false
+	}
+	return info, true
+}
+
+// AllSuspensions returns all current account suspensions (for use with APIs, etc).
+func (am *AccountManager) AllSuspensions() map[string]IPBanInfo {
+	allb := make(map[string]IPBanInfo)
+	prefix := fmt.Sprintf(keyAccountSuspended, "")
+
+	am.server.store.View(func(tx *buntdb.Tx) error {
+		return tx.AscendGreaterOrEqual("", prefix, func(key, value string) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			var info IPBanInfo
+			if json.Unmarshal([]byte(value), &info) == nil && !(info.Time != nil && info.Time.IsExpired()) {
+				allb[strings.TrimPrefix(key, prefix)] = info
+			}
+			return true
+		})
+	})
+	return allb
+}
+
+// formatSuspension describes an account suspension to the given client, for
+// NS SUSPEND LIST and STATS S.
+func formatSuspension(client *Client, account string, info IPBanInfo) string {
+	return fmt.Sprintf(client.t("Suspension - %[1]s - added by %[2]s - %[3]s"), account, info.OperName, info.BanMessage("%s"))
+}
+
+// LoadVHostInfo returns the vhost information stored for the given account.
+func (am *AccountManager) LoadVHostInfo(account string) (result VHostInfo, err error) {
+	casefoldedAccount, err := CasefoldName(account)
+	if err != nil {
+		return result, errAccountDoesNotExist
+	}
+
+	var raw string
+	am.server.store.View(func(tx *buntdb.Tx) error {
+		if _, e := tx.Get(fmt.Sprintf(keyAccountExists, casefoldedAccount)); e != nil {
+			err = errAccountDoesNotExist
+			return nil
+		}
+		raw, _ = tx.Get(fmt.Sprintf(keyAccountVHost, casefoldedAccount))
+		return nil
+	})
+	if err == nil && raw != "" {
+		err = json.Unmarshal([]byte(raw), &result)
+	}
+	return
+}
+
+// performVHostChange atomically modifies the vhost information of the given account,
+// then updates the hostnames of any clients logged in to it.
+func (am *AccountManager) performVHostChange(account string, modify func(info *VHostInfo) error) (result VHostInfo, err error) {
+	casefoldedAccount, err := CasefoldName(account)
+	if err != nil {
+		return result, errAccountDoesNotExist
+	}
+
+	var oldVHost string
+	err = am.server.store.Update(func(tx *buntdb.Tx) error {
+		if _, err := tx.Get(fmt.Sprintf(keyAccountExists, casefoldedAccount)); err != nil {
+			return errAccountDoesNotExist
+		}
+
+		vhostKey := fmt.Sprintf(keyAccountVHost, casefoldedAccount)
+		if raw, err := tx.Get(vhostKey); err == nil {
+			if err = json.Unmarshal([]byte(raw), &result); err != nil {
+				return err
+			}
+		}
+		oldVHost = result.ApprovedVHost
+
+		if err := modify(&result); err != nil {
+			return err
+		}
+
+		b, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		_, _, err = tx.Set(vhostKey, string(b), nil)
+		return err
+	})
+	if err != nil || oldVHost == result.ApprovedVHost {
+		return
+	}
+
+	am.RLock()
+	clients := make([]*Client, len(am.accountToClients[casefoldedAccount]))
+	copy(clients, am.accountToClients[casefoldedAccount])
+	am.RUnlock()
+	for _, client := range clients {
+		client.setAccountVHost(result.ApprovedVHost)
+	}
+	return
+}
+
+// VHostRequest records a request for a vhost, to be approved by an oper.
+func (am *AccountManager) VHostRequest(account string, vhost string, cooldown time.Duration) (result VHostInfo, err error) {
+	return am.performVHostChange(account, func(info *VHostInfo) error {
+		if time.Since(info.LastRequestTime) < cooldown {
+			return errVHostRequestCooldown
+		}
+		info.RequestedVHost = vhost
+		info.RejectedReason = ""
+		info.LastRequestTime = time.Now().UTC()
+		return nil
+	})
+}
+
+// VHostApprove approves the account's pending vhost request.
+func (am *AccountManager) VHostApprove(account string) (result VHostInfo, err error) {
+	return am.performVHostChange(account, func(info *VHostInfo) error {
+		if info.RequestedVHost == "" {
+			return errNoVHostRequest
+		}
+		info.ApprovedVHost = info.RequestedVHost
+		info.RequestedVHost = ""
+		info.RejectedReason = ""
+		return nil
+	})
+}
+
+// VHostReject rejects the account's pending vhost request.
+func (am *AccountManager) VHostReject(account string, reason string) (result VHostInfo, err error) {
+	return am.performVHostChange(account, func(info *VHostInfo) error {
+		if info.RequestedVHost == "" {
+			return errNoVHostRequest
+		}
+		info.RequestedVHost = ""
+		info.RejectedReason = reason
+		return nil
+	})
+}
+
+// VHostSet sets the account's vhost directly; an empty vhost removes it.
+func (am *AccountManager) VHostSet(account string, vhost string) (result VHostInfo, err error) {
+	return am.performVHostChange(account, func(info *VHostInfo) error {
+		info.ApprovedVHost = vhost
+		return nil
+	})
+}
+
+// VHostListRequests returns the pending vhost requests, oldest first.
+func (am *AccountManager) VHostListRequests() (result []PendingVHostRequest) {
+	prefix := fmt.Sprintf(keyAccountVHost, "")
+	am.server.store.View(func(tx *buntdb.Tx) error {
+		return tx.AscendGreaterOrEqual("", prefix, func(key, value string) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			var info VHostInfo
+			if json.Unmarshal([]byte(value), &info) == nil && info.RequestedVHost != "" {
+				result = append(result, PendingVHostRequest{
+					VHostInfo: info,
+					Account:   strings.TrimPrefix(key, prefix),
+				})
+			}
+			return true
+		})
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastRequestTime.Before(result[j].LastRequestTime)
+	})
+	return
+}
+
+func (am *AccountManager) Logout(client *Client) {
+	if am.logout(client) {
+		client.Quit(client.t("You were logged out of your always-on account"))
+		client.destroy(false)
+	}
+}
+
+func (am *AccountManager) logout(client *Client) (orphaned bool) {
+	am.Lock()
+	defer am.Unlock()
+
+	casefoldedAccount := client.Account()
+	if casefoldedAccount == "" {
+		return
+	}
+
+	orphaned = am.logoutOfAccount(client)
 
 	clients := am.accountToClients[casefoldedAccount]
 	if len(clients) <= 1 {
@@ -670,16 +1665,57 @@ var (
 	// EnabledSaslMechanisms contains the SASL mechanisms that exist and that we support.
 	// This can be moved to some other data structure/place if we need to load/unload mechs later.
 	EnabledSaslMechanisms = map[string]func(*Server, *Client, string, []byte, *ResponseBuffer) bool{
-		"PLAIN":    authPlainHandler,
-		"EXTERNAL": authExternalHandler,
+		"PLAIN":         authPlainHandler,
+		"EXTERNAL":      authExternalHandler,
+		"SCRAM-SHA-256": authScramHandler,
 	}
 )
 
+// VHostInfo stores an account's approved vhost, along with any request for a new one.
+type VHostInfo struct {
+	ApprovedVHost   string
+	RequestedVHost  string
+	RejectedReason  string
+	LastRequestTime time.Time
+}
+
+// PendingVHostRequest is a vhost request that's waiting for an oper to handle it.
+type PendingVHostRequest struct {
+	VHostInfo
+	Account string
+}
+
 // AccountCredentials stores the various methods for verifying accounts.
 type AccountCredentials struct {
 	PassphraseSalt []byte
 	PassphraseHash []byte
-	Certificate    string // fingerprint
+	// Certificate is the single fingerprint stored by older versions;
+	// unmarshalCredentials migrates it into Certificates
+	Certificate  string   `json:",omitempty"`
+	Certificates []string // fingerprints
+	// Scram holds the keys for SCRAM-SHA-256, if the account has a passphrase
+	Scram *passwd.ScramCredentials `json:",omitempty"`
+}
+
+// unmarshalCredentials parses stored account credentials.
+func unmarshalCredentials(credText string) (creds AccountCredentials, err error) {
+	err = json.Unmarshal([]byte(credText), &creds)
+	if err == nil && creds.Certificate != "" {
+		if !containsString(creds.Certificates, creds.Certificate) {
+			creds.Certificates = append([]string{creds.Certificate}, creds.Certificates...)
+		}
+		creds.Certificate = ""
+	}
+	return
+}
+
+func containsString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
 }
 
 // ClientAccount represents a user account.
@@ -711,8 +1747,10 @@ func (am *AccountManager) loginToAccount(client *Client, account string) {
 	}
 }
 
-// logoutOfAccount logs the client out of their current account.
-func (am *AccountManager) logoutOfAccount(client *Client) {
+// logoutOfAccount logs the client out of their current account. It returns true
+// if the client was always-on and has no connections, in which case the caller
+// must disconnect it once the account locks are released.
+func (am *AccountManager) logoutOfAccount(client *Client) (orphaned bool) {
 	if client.Account() == "" {
 		// already logged out
 		return
@@ -721,11 +1759,24 @@ func (am *AccountManager) logoutOfAccount(client *Client) {
 	client.SetAccountName("")
 	go client.nickTimer.Touch()
 
+	// always-on clients can't stay on the server without their account
+	if client.AlwaysOn() {
+		client.SetAlwaysOn(false)
+		if client.Primary() == nil && client.detached() && !client.Destroyed() {
+			// the client is about to quit, so there's no account change to announce
+			return true
+		}
+	}
+
 	// dispatch account-notify
 	// TODO: doing the I/O here is kind of a kludge, let's move this somewhere else
 	go func() {
+		if !client.Destroyed() {
+			client.clearAccountVHost()
+		}
 		for friend := range client.Friends(caps.AccountNotify) {
 			friend.Send(nil, client.NickMaskString(), "ACCOUNT", "*")
 		}
 	}()
+	return false
 }
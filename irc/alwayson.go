@@ -0,0 +1,283 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/caps"
+	"github.com/oragono/oragono/irc/modes"
+	"github.com/oragono/oragono/irc/sno"
+)
+
+// Always-on clients belong to accounts that have opted in with NS SET ALWAYS-ON.
+// When the last connection of an always-on client closes, the client isn't
+// destroyed: it stays in its channels, is marked away, and keeps the lines sent
+// to it. The next connection that logs into the account is attached to it as a
+// session (see sessions.go), and is sent everything it missed. Their nick, modes
+// and channels are stored in the datastore, so they're restored when the server
+// restarts.
+
+const alwaysOnAwayMessage = "Disconnected"
+
+var (
+	// user modes that are kept across server restarts. oper modes aren't, since
+	// the oper would need to authenticate again
+	alwaysOnUserModes = modes.Modes{
+		modes.Bot, modes.CallerID, modes.Invisible, modes.RegisteredOnly, modes.UserRoleplaying, modes.WallOps,
+	}
+
+	// capabilities of clients restored after a restart, so that the lines they're
+	// sent keep as much information as possible for replaying
+	alwaysOnCapabilities = []caps.Capability{
+		caps.AccountNotify, caps.AccountTag, caps.AwayNotify, caps.ChgHost, caps.ExtendedJoin,
+		caps.InviteNotify, caps.MessageTags, caps.MultiPrefix, caps.ServerTime, caps.SetName,
+		caps.UserhostInNames,
+	}
+)
+
+// AlwaysOnState is the part of an always-on client that's restored after a restart.
+type AlwaysOnState struct {
+	Nick     string
+	Username string
+	Realname string
+	Hostname string
+	IP       string
+	Modes    string
+	Channels map[string]string // channel name to membership prefixes
+}
+
+// detached returns true if none of the client's connections are open.
+func (client *Client) detached() bool {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	return client.connectionClosed && len(client.sessions) == 0
+}
+
+// detachAlwaysOn is called when the last connection of an always-on client closes.
+func (client *Client) detachAlwaysOn() {
+	client.server.logger.Debug("quit", fmt.Sprintf("%s has no connections left, but is always-on", client.Nick()))
+	client.setAutoAway(true)
+	client.storeAlwaysOnState()
+}
+
+// setAutoAway marks the client as away because it has no connections, or unmarks
+// it when a connection is attached again. Clients that set themselves away are
+// left alone.
+func (client *Client) setAutoAway(away bool) {
+	client.stateMutex.Lock()
+	changed := away != client.autoAway && (!away || !client.flags[modes.Away])
+	if changed {
+		client.autoAway = away
+		if away {
+			client.flags[modes.Away] = true
+			client.awayMessage = alwaysOnAwayMessage
+		} else {
+			delete(client.flags, modes.Away)
+			client.awayMessage = ""
+		}
+	}
+	client.stateMutex.Unlock()
+
+	if changed {
+		client.notifyAway()
+	}
+}
+
+// notifyAway tells the client's friends with away-notify about its away status.
+func (client *Client) notifyAway() {
+	client.stateMutex.RLock()
+	isAway := client.flags[modes.Away]
+	awayMessage := client.awayMessage
+	client.stateMutex.RUnlock()
+
+	for friend := range client.Friends(caps.AwayNotify) {
+		if isAway {
+			friend.SendFromClient("", client, nil, "AWAY", awayMessage)
+		} else {
+			friend.SendFromClient("", client, nil, "AWAY")
+		}
+	}
+}
+
+// alwaysOnState returns the client's current state, for storing.
+func (client *Client) alwaysOnState() (state AlwaysOnState) {
+	state.IP = client.IPString()
+	state.Channels = make(map[string]string)
+	for _, channel := range client.Channels() {
+		state.Channels[channel.Name()] = channel.ClientPrefixes(client, true)
+	}
+
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	state.Nick = client.nick
+	state.Username = client.username
+	state.Realname = client.realname
+	state.Hostname = client.rawHostname
+	for _, mode := range alwaysOnUserModes {
+		if client.flags[mode] {
+			state.Modes += mode.String()
+		}
+	}
+	return
+}
+
+// storeAlwaysOnState stores the state of the client, if it's always-on.
+func (client *Client) storeAlwaysOnState() {
+	if !client.AlwaysOn() || client.Primary() != nil {
+		return
+	}
+	account := client.Account()
+	err := client.server.accounts.StoreAlwaysOnState(account, client.alwaysOnState())
+	if err != nil {
+		client.server.logger.Error("internal", fmt.Sprintf("couldn't store always-on state for %s: %v", account, err))
+	}
+}
+
+// recordReplay keeps a line sent to an always-on client while it has no
+// connections, so that it can be replayed to the next one.
+func (client *Client) recordReplay(message ircmsg.IrcMessage) {
+	limit := client.server.AccountConfig().Multiclient.ReplayLimit
+
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	if !client.alwaysOn || !client.connectionClosed || len(client.sessions) != 0 || limit == 0 {
+		return
+	}
+
+	// the time the line was sent matters more than the time it's replayed
+	tags := make(map[string]ircmsg.TagValue, len(message.Tags)+1)
+	for name, value := range message.Tags {
+		tags[name] = value
+	}
+	if _, exists := tags["time"]; !exists {
+		tags["time"] = ircmsg.MakeTagValue(time.Now().UTC().Format(IRCv3TimestampFormat))
+	}
+	message.Tags = tags
+
+	client.replay = append(client.replay, message)
+	if limit < len(client.replay) {
+		client.replay = client.replay[len(client.replay)-limit:]
+		client.replayTruncated = true
+	}
+}
+
+// takeReplay returns the lines the client missed while it had no connections.
+func (client *Client) takeReplay() (lines []ircmsg.IrcMessage, truncated bool) {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	lines, truncated = client.replay, client.replayTruncated
+	client.replay = nil
+	client.replayTruncated = false
+	return
+}
+
+// sendReplay sends the lines the client missed while it had no connections to the
+// given session.
+func (client *Client) sendReplay(session *Client) {
+	lines, truncated := client.takeReplay()
+	if truncated {
+		session.sendToConnection(nil, client.server.name, "NOTICE", session.Nick(), session.t("Some messages sent while you were disconnected could not be replayed"))
+	}
+	for _, line := range lines {
+		if adapted, ok := session.adaptMessage(line); ok {
+			session.writeMessage(adapted)
+		}
+	}
+}
+
+// alwaysOnClient returns the always-on client of the given account, if it has one.
+// New connections to the account are attached to it, whatever nick they ask for.
+func (server *Server) alwaysOnClient(account string) *Client {
+	for _, client := range server.accounts.AccountToClients(account) {
+		if client.AlwaysOn() && client.Registered() && !client.Destroyed() && client.Primary() == nil {
+			return client
+		}
+	}
+	return nil
+}
+
+// restoreAlwaysOnClients recreates the always-on clients stored in the datastore.
+func (server *Server) restoreAlwaysOnClients() {
+	if !server.AccountConfig().Multiclient.AllowAlwaysOn {
+		return
+	}
+	for account, state := range server.accounts.AlwaysOnStates() {
+		server.restoreAlwaysOnClient(account, state)
+	}
+}
+
+// restoreAlwaysOnClient recreates a single always-on client, with no connections.
+func (server *Server) restoreAlwaysOnClient(account string, state AlwaysOnState) {
+	now := time.Now()
+	client := &Client{
+		accepted:         make(map[string]bool),
+		atime:            now,
+		authorized:       true,
+		capabilities:     caps.NewSet(alwaysOnCapabilities...),
+		capState:         caps.NoneState,
+		capVersion:       caps.Cap302,
+		channels:         make(ChannelSet),
+		connectionClosed: true,
+		ctime:            now,
+		flags:            make(map[modes.Mode]bool),
+		rawHostname:      state.Hostname,
+		realname:         state.Realname,
+		registered:       true,
+		server:           server,
+		silence:          NewUserMaskSet(),
+		uid:              server.links.newUID(),
+		username:         state.Username,
+		nick:             "*",
+		nickCasefolded:   "*",
+		nickMaskString:   "*",
+	}
+	client.languages = server.languages.Default()
+	client.proxiedIP = net.ParseIP(state.IP)
+	if client.proxiedIP == nil {
+		client.proxiedIP = net.IPv4zero
+	}
+	for _, mode := range state.Modes {
+		client.flags[modes.Mode(mode)] = true
+	}
+	client.recomputeMaxlens()
+
+	server.accounts.Login(client, account)
+	if !client.AlwaysOn() {
+		server.accounts.Logout(client)
+		return
+	}
+	if err := server.clients.SetNick(client, state.Nick); err != nil {
+		server.logger.Error("startup", fmt.Sprintf("couldn't restore always-on client %s for %s: %v", state.Nick, account, err))
+		// the client never made it onto the server, so there's nothing to destroy
+		client.SetAlwaysOn(false)
+		server.accounts.Logout(client)
+		return
+	}
+
+	for name, prefixes := range state.Channels {
+		server.channels.JoinRemote(server, name, func(channel *Channel) {
+			channel.stateMutex.Lock()
+			channel.members.Add(client)
+			for mode, prefix := range modes.ChannelModePrefixes {
+				if prefix != "" && strings.Contains(prefixes, prefix) {
+					channel.members[client][mode] = true
+				}
+			}
+			channel.stateMutex.Unlock()
+			channel.regenerateMembersCache(false)
+			client.addChannel(channel)
+		})
+	}
+
+	client.setAutoAway(true)
+	server.links.Introduce(client)
+	server.logger.Info("startup", fmt.Sprintf("Restored always-on client %s for %s", state.Nick, account))
+	server.snomasks.Send(sno.LocalConnects, fmt.Sprintf(ircfmt.Unescape("Always-on client $c[grey][$r%s$c[grey]] restored for account $c[grey][$r%s$c[grey]]"), state.Nick, account))
+}
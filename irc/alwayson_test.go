@@ -0,0 +1,104 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+
+	"github.com/oragono/oragono/irc/logger"
+	"github.com/oragono/oragono/irc/modes"
+)
+
+func TestAlwaysOn(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	config := testConfig(dir, "irc.test")
+	config.Accounts.Multiclient.Enabled = true
+	config.Accounts.Multiclient.AllowAlwaysOn = true
+	config.Accounts.Multiclient.ReplayLimit = 100
+	server := startTestServer(t, config)
+
+	laptop := openTestClient(server)
+	laptop.send("CAP LS 302")
+	laptop.expect(t, "CAP * LS")
+	if err := server.accounts.Register(laptop.client, "alice", "none", "", "", "0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.accounts.Verify(laptop.client, "alice", ""); err != nil {
+		t.Fatal(err)
+	}
+	laptop.register(t, "alice", "server-time")
+	laptop.send("JOIN #test")
+	laptop.expect(t, " 366 ")
+	laptop.send("PRIVMSG NickServ :SET ALWAYS-ON ON")
+	laptop.expect(t, "NickServ", "now enabled")
+
+	bob := newTestClient(t, server, "bob", "away-notify")
+	bob.send("JOIN #test")
+	bob.expect(t, " 366 ")
+
+	// the client stays when its connection closes, and keeps what it's sent
+	laptop.send("QUIT")
+	laptop.expect(t, "ERROR")
+	bob.expect(t, ":alice!", "AWAY", "Disconnected")
+	bob.send("PRIVMSG #test :are you there?")
+	bob.send("PRIVMSG alice :hello")
+	bob.send("PING sync")
+	bob.expect(t, "PONG", "sync")
+	if server.clients.Get("alice") == nil {
+		t.Fatal("always-on client was destroyed")
+	}
+
+	// new connections are attached whatever nick they use, and sent what they missed
+	phone := openTestClient(server)
+	phone.login(t, server, "alice")
+	phone.register(t, "alice_phone", "server-time")
+	phone.expect(t, ":alice!", "JOIN", "#test")
+	phone.expect(t, "time=", ":bob!", "PRIVMSG #test :are you there?")
+	phone.expect(t, "time=", ":bob!", "PRIVMSG alice :hello")
+	bob.expect(t, ":alice!", "AWAY")
+
+	// the client is restored when the server restarts
+	server.Shutdown()
+	logManager, err := logger.NewManager(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := NewServer(config, logManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Shutdown()
+	alice := restarted.clients.Get("alice")
+	if alice == nil {
+		t.Fatal("always-on client wasn't restored")
+	}
+	if !alice.HasMode(modes.Away) || alice.Account() != "alice" {
+		t.Errorf("restored client should be away and logged in")
+	}
+	channel := restarted.channels.Get("#test")
+	if channel == nil || !channel.ClientIsAtLeast(alice, modes.ChannelOperator) {
+		t.Fatal("restored client should still be opped in #test")
+	}
+	if !restarted.links.introduced(alice) {
+		t.Error("restored client should be known to linked servers")
+	}
+
+	laptop = openTestClient(restarted)
+	laptop.login(t, restarted, "alice")
+	laptop.register(t, "alice", "server-time")
+	laptop.expect(t, ":alice!", "JOIN", "#test")
+	if alice.HasMode(modes.Away) {
+		t.Error("client should no longer be away")
+	}
+
+	// disabling always-on lets the client quit again
+	laptop.send("PRIVMSG NickServ :SET ALWAYS-ON OFF")
+	laptop.expect(t, "NickServ", "now disabled")
+	laptop.send("QUIT")
+	laptop.expect(t, "ERROR")
+	waitFor(t, "alice to quit", func() bool {
+		return restarted.clients.Get("alice") == nil
+	})
+}
@@ -0,0 +1,431 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/oragono/oragono/irc/custime"
+	"github.com/oragono/oragono/irc/modes"
+	"github.com/oragono/oragono/irc/sno"
+)
+
+// the administration API is a small JSON-over-HTTP interface to the server's managers,
+// intended for bots and dashboards. every request must carry one of the configured
+// tokens in an `Authorization: Bearer <token>` header.
+
+type apiClient struct {
+	Nick     string    `json:"nick"`
+	Username string    `json:"username"`
+	Hostname string    `json:"hostname"`
+	Realname string    `json:"realname"`
+	IP       string    `json:"ip"`
+	Account  string    `json:"account,omitempty"`
+	Operator bool      `json:"operator"`
+	Channels []string  `json:"channels"`
+	Signon   time.Time `json:"signon"`
+	Idle     int64     `json:"idle"`
+}
+
+type apiChannel struct {
+	Name       string   `json:"name"`
+	Topic      string   `json:"topic"`
+	Members    []string `json:"members"`
+	Registered bool     `json:"registered"`
+	Founder    string   `json:"founder,omitempty"`
+}
+
+type apiAccount struct {
+	Name            string    `json:"name"`
+	RegisteredAt    time.Time `json:"registeredAt"`
+	Verified        bool      `json:"verified"`
+	AdditionalNicks []string  `json:"additionalNicks"`
+}
+
+type apiBan struct {
+	Target     string     `json:"target"`
+	Reason     string     `json:"reason"`
+	OperReason string     `json:"operReason"`
+	OperName   string     `json:"operName"`
+	Expires    *time.Time `json:"expires,omitempty"`
+}
+
+// apiBanRequest is the body of a request to add a D-Line or K-Line.
+type apiBanRequest struct {
+	Target     string `json:"target"`
+	Duration   string `json:"duration"`
+	Reason     string `json:"reason"`
+	OperReason string `json:"operReason"`
+	OperName   string `json:"operName"`
+}
+
+type apiKillRequest struct {
+	Nick   string `json:"nick"`
+	Reason string `json:"reason"`
+}
+
+type apiStats struct {
+	Server    string    `json:"server"`
+	Network   string    `json:"network"`
+	Version   string    `json:"version"`
+	StartedAt time.Time `json:"startedAt"`
+	Uptime    int64     `json:"uptime"`
+	Clients   int       `json:"clients"`
+	Invisible int       `json:"invisible"`
+	Operators int       `json:"operators"`
+	Channels  int       `json:"channels"`
+	DLines    int       `json:"dlines"`
+	KLines    int       `json:"klines"`
+	Suspended int       `json:"suspendedAccounts"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiHandler returns the router serving the administration API.
+func (server *Server) apiHandler() http.Handler {
+	router := http.NewServeMux()
+	router.Handle("/v1/stats", apiMethods{"GET": server.apiStatsHandler})
+	router.Handle("/v1/clients", apiMethods{"GET": server.apiClientsHandler})
+	router.Handle("/v1/channels", apiMethods{"GET": server.apiChannelsHandler})
+	router.Handle("/v1/accounts", apiMethods{"GET": server.apiAccountsHandler})
+	router.Handle("/v1/dlines", apiMethods{"GET": server.apiDlinesHandler, "POST": server.apiAddDlineHandler})
+	router.Handle("/v1/dlines/", apiMethods{"DELETE": server.apiRemoveDlineHandler})
+	router.Handle("/v1/klines", apiMethods{"GET": server.apiKlinesHandler, "POST": server.apiAddKlineHandler})
+	router.Handle("/v1/klines/", apiMethods{"DELETE": server.apiRemoveKlineHandler})
+	router.Handle("/v1/suspensions", apiMethods{"GET": server.apiSuspensionsHandler})
+	router.Handle("/v1/kill", apiMethods{"POST": server.apiKillHandler})
+	router.Handle("/v1/rehash", apiMethods{"POST": server.apiRehashHandler})
+	return server.apiAuthMiddleware(router)
+}
+
+// apiMethods dispatches a request to the handler for its HTTP method.
+type apiMethods map[string]http.HandlerFunc
+
+func (methods apiMethods) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler, exists := methods[r.Method]
+	if !exists {
+		apiWriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	handler(w, r)
+}
+
+// apiTarget returns the path component following the given prefix, such as the
+// mask in `/v1/klines/<mask>`. masks and CIDRs may themselves contain slashes.
+func apiTarget(r *http.Request, prefix string) string {
+	return strings.TrimPrefix(r.URL.Path, prefix)
+}
+
+// apiAuthMiddleware rejects requests that don't present a valid bearer token.
+// tokens are read on every request, so they can be changed with a rehash.
+func (server *Server) apiAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if strings.HasPrefix(authorization, "Bearer ") {
+			presented := []byte(strings.TrimPrefix(authorization, "Bearer "))
+			for _, token := range server.APITokens() {
+				if subtle.ConstantTimeCompare(presented, []byte(token)) == 1 {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		apiWriteError(w, http.StatusUnauthorized, "Invalid or missing API token")
+	})
+}
+
+func apiWriteJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func apiWriteError(w http.ResponseWriter, status int, message string) {
+	apiWriteJSON(w, status, apiError{Error: message})
+}
+
+func (server *Server) apiStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := apiStats{
+		Server:    server.name,
+		Network:   server.NetworkName(),
+		Version:   Ver,
+		StartedAt: server.ctime,
+		Uptime:    int64(time.Since(server.ctime).Seconds()),
+		Channels:  server.channels.Len(),
+		DLines:    len(server.dlines.AllBans()),
+		KLines:    len(server.klines.AllBans()),
+		Suspended: len(server.accounts.AllSuspensions()),
+	}
+	for _, client := range server.clients.AllClients() {
+		stats.Clients++
+		if client.HasMode(modes.Invisible) {
+			stats.Invisible++
+		}
+		if client.HasMode(modes.Operator) {
+			stats.Operators++
+		}
+	}
+	apiWriteJSON(w, http.StatusOK, stats)
+}
+
+func (server *Server) apiClientsHandler(w http.ResponseWriter, r *http.Request) {
+	result := []apiClient{}
+	for _, client := range server.clients.AllClients() {
+		channels := []string{}
+		for _, channel := range client.Channels() {
+			channels = append(channels, channel.Name())
+		}
+		sort.Strings(channels)
+		account := client.AccountName()
+		if account == "*" {
+			account = ""
+		}
+		result = append(result, apiClient{
+			Nick:     client.Nick(),
+			Username: client.Username(),
+			Hostname: client.Hostname(),
+			Realname: client.Realname(),
+			IP:       client.IP().String(),
+			Account:  account,
+			Operator: client.HasMode(modes.Operator),
+			Channels: channels,
+			Signon:   time.Unix(client.SignonTime(), 0),
+			Idle:     int64(client.IdleTime().Seconds()),
+		})
+	}
+	apiWriteJSON(w, http.StatusOK, result)
+}
+
+func (server *Server) apiChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	result := []apiChannel{}
+	for _, channel := range server.channels.Channels() {
+		members := []string{}
+		for _, member := range channel.Members() {
+			members = append(members, member.Nick())
+		}
+		sort.Strings(members)
+		result = append(result, apiChannel{
+			Name:       channel.Name(),
+			Topic:      channel.Topic(),
+			Members:    members,
+			Registered: channel.IsRegistered(),
+			Founder:    channel.Founder(),
+		})
+	}
+	apiWriteJSON(w, http.StatusOK, result)
+}
+
+func (server *Server) apiAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	result := []apiAccount{}
+	for _, account := range server.accounts.AllAccounts() {
+		nicks := account.AdditionalNicks
+		if nicks == nil {
+			nicks = []string{}
+		}
+		result = append(result, apiAccount{
+			Name:            account.Name,
+			RegisteredAt:    account.RegisteredAt,
+			Verified:        account.Verified,
+			AdditionalNicks: nicks,
+		})
+	}
+	apiWriteJSON(w, http.StatusOK, result)
+}
+
+func apiBanList(bans map[string]IPBanInfo) []apiBan {
+	result := []apiBan{}
+	for target, info := range bans {
+		ban := apiBan{
+			Target:     target,
+			Reason:     info.Reason,
+			OperReason: info.OperReason,
+			OperName:   info.OperName,
+		}
+		if info.Time != nil {
+			expires := info.Time.Expires
+			ban.Expires = &expires
+		}
+		result = append(result, ban)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Target < result[j].Target })
+	return result
+}
+
+// parseBanRequest reads an apiBanRequest from the request body, filling in defaults
+// the same way DLINE and KLINE do.
+func (server *Server) parseBanRequest(r *http.Request) (target string, info IPBanInfo, err error) {
+	var req apiBanRequest
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return
+	}
+	if req.Target == "" {
+		err = errInvalidParams
+		return
+	}
+	target = req.Target
+
+	if req.Duration != "" {
+		var duration time.Duration
+		duration, err = custime.ParseDuration(req.Duration)
+		if err != nil {
+			return
+		}
+		info.Time = &IPRestrictTime{
+			Duration: duration,
+			Expires:  time.Now().Add(duration),
+		}
+	}
+
+	info.Reason = req.Reason
+	if info.Reason == "" {
+		info.Reason = "No reason given"
+	}
+	info.OperReason = req.OperReason
+	if info.OperReason == "" {
+		info.OperReason = info.Reason
+	}
+	info.OperName = req.OperName
+	if info.OperName == "" {
+		info.OperName = server.name
+	}
+	return
+}
+
+func (server *Server) apiDlinesHandler(w http.ResponseWriter, r *http.Request) {
+	apiWriteJSON(w, http.StatusOK, apiBanList(server.dlines.AllBans()))
+}
+
+func (server *Server) apiAddDlineHandler(w http.ResponseWriter, r *http.Request) {
+	target, info, err := server.parseBanRequest(r)
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, fmt.Sprintf("Invalid D-Line: %s", err.Error()))
+		return
+	}
+
+	hostString, err := server.addDline(target, info)
+	if err == errInvalidDlineHost {
+		apiWriteError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		apiWriteError(w, http.StatusInternalServerError, fmt.Sprintf("Could not successfully save new D-LINE: %s", err.Error()))
+		return
+	}
+
+	server.links.AddBan("D", hostString, info)
+	server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("API [%s]$r added D-Line for %s"), info.OperName, hostString))
+	apiWriteJSON(w, http.StatusCreated, apiBanList(map[string]IPBanInfo{hostString: info})[0])
+}
+
+func (server *Server) apiRemoveDlineHandler(w http.ResponseWriter, r *http.Request) {
+	hostString, err := server.removeDline(apiTarget(r, "/v1/dlines/"))
+	if err == errInvalidDlineHost {
+		apiWriteError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err == errNoExistingBan {
+		apiWriteError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		apiWriteError(w, http.StatusInternalServerError, fmt.Sprintf("Could not remove ban [%s]", err.Error()))
+		return
+	}
+
+	server.links.RemoveBan("D", hostString)
+	server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("API$r removed D-Line for %s"), hostString))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) apiKlinesHandler(w http.ResponseWriter, r *http.Request) {
+	apiWriteJSON(w, http.StatusOK, apiBanList(server.klines.AllBans()))
+}
+
+func (server *Server) apiAddKlineHandler(w http.ResponseWriter, r *http.Request) {
+	target, info, err := server.parseBanRequest(r)
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, fmt.Sprintf("Invalid K-Line: %s", err.Error()))
+		return
+	}
+
+	mask := canonicalizeKlineMask(target)
+	err = server.addKline(mask, info)
+	if err != nil {
+		apiWriteError(w, http.StatusInternalServerError, fmt.Sprintf("Could not successfully save new K-LINE: %s", err.Error()))
+		return
+	}
+
+	server.links.AddBan("K", mask, info)
+	server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("API [%s]$r added K-Line for %s"), info.OperName, mask))
+	apiWriteJSON(w, http.StatusCreated, apiBanList(map[string]IPBanInfo{mask: info})[0])
+}
+
+func (server *Server) apiRemoveKlineHandler(w http.ResponseWriter, r *http.Request) {
+	mask := canonicalizeKlineMask(apiTarget(r, "/v1/klines/"))
+	err := server.removeKline(mask)
+	if err == errNoExistingBan {
+		apiWriteError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		apiWriteError(w, http.StatusInternalServerError, fmt.Sprintf("Could not remove ban [%s]", err.Error()))
+		return
+	}
+
+	server.links.RemoveBan("K", mask)
+	server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("API$r removed K-Line for %s"), mask))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) apiSuspensionsHandler(w http.ResponseWriter, r *http.Request) {
+	apiWriteJSON(w, http.StatusOK, apiBanList(server.accounts.AllSuspensions()))
+}
+
+func (server *Server) apiKillHandler(w http.ResponseWriter, r *http.Request) {
+	var req apiKillRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiWriteError(w, http.StatusBadRequest, fmt.Sprintf("Invalid kill request: %s", err.Error()))
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "<no reason supplied>"
+	}
+
+	casefoldedNickname, err := CasefoldName(req.Nick)
+	target := server.clients.Get(casefoldedNickname)
+	if err != nil || target == nil {
+		apiWriteError(w, http.StatusNotFound, "No such nick")
+		return
+	}
+
+	server.snomasks.Send(sno.LocalKills, fmt.Sprintf(ircfmt.Unescape("%s$r was killed by API $c[grey][$r%s$c[grey]]"), target.Nick(), req.Reason))
+	quitMsg := fmt.Sprintf("Killed (%s (%s))", server.name, req.Reason)
+	if target.IsRemote() {
+		server.links.Kill(nil, target, quitMsg)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	target.exitedSnomaskSent = true
+
+	target.Quit(quitMsg)
+	target.destroy(false)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) apiRehashHandler(w http.ResponseWriter, r *http.Request) {
+	server.logger.Info("rehash", "Rehashing due to API request")
+	err := server.rehash()
+	if err != nil {
+		server.logger.Error("rehash", fmt.Sprintln("Failed to rehash:", err.Error()))
+		apiWriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
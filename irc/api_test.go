@@ -0,0 +1,52 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIAuthentication(t *testing.T) {
+	server, shutdown := newTestServer(t, func(config *Config) {
+		config.Debug.APITokens = []string{"secret"}
+	})
+	defer shutdown()
+	newTestClient(t, server, "alice")
+
+	handler := server.apiHandler()
+	request := func(method, path, authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, authorization := range []string{"", "Bearer ", "Bearer wrong", "Basic secret", "secret"} {
+		if w := request("GET", "/v1/stats", authorization); w.Code != http.StatusUnauthorized {
+			t.Errorf("authorization %q: expected 401, got %d", authorization, w.Code)
+		}
+	}
+
+	w := request("GET", "/v1/stats", "Bearer secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var stats apiStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Server != "irc.test" || stats.Clients != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	if w := request("POST", "/v1/stats", "Bearer secret"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", w.Code)
+	}
+}
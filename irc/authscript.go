@@ -0,0 +1,96 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// AuthProvider checks credentials against a source of accounts outside our own database.
+type AuthProvider interface {
+	// Authenticate returns the name of the account that the credentials belong to,
+	// or an error if they aren't valid.
+	Authenticate(input AuthProviderInput) (accountName string, err error)
+}
+
+// AuthProviderInput holds the credentials presented by a client.
+// For certificate authentication, AccountName and Passphrase are empty.
+type AuthProviderInput struct {
+	AccountName string `json:"accountName,omitempty"`
+	Passphrase  string `json:"passphrase,omitempty"`
+	Certfp      string `json:"certfp,omitempty"`
+	IP          string `json:"ip,omitempty"`
+}
+
+// authScriptOutput is the response an auth script writes to its stdout.
+type authScriptOutput struct {
+	AccountName string `json:"accountName"`
+	Success     bool   `json:"success"`
+	Error       string `json:"error"`
+}
+
+// scriptAuthProvider is an AuthProvider that runs a local executable, passing it
+// an AuthProviderInput as JSON on stdin and reading an authScriptOutput from stdout.
+type scriptAuthProvider struct {
+	command string
+	args    []string
+	timeout time.Duration
+}
+
+// newScriptAuthProvider returns the AuthProvider described by the config, or nil if it's disabled.
+func newScriptAuthProvider(config *AuthScriptConfig) AuthProvider {
+	if !config.Enabled {
+		return nil
+	}
+	return &scriptAuthProvider{
+		command: config.Command,
+		args:    config.Args,
+		timeout: config.Timeout,
+	}
+}
+
+// Authenticate implements AuthProvider.
+func (sap *scriptAuthProvider) Authenticate(input AuthProviderInput) (accountName string, err error) {
+	inputBytes, err := json.Marshal(input)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sap.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, sap.command, sap.args...)
+	cmd.Stdin = bytes.NewReader(append(inputBytes, '\n'))
+	outputBytes, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("auth script failed: %v", err)
+	}
+
+	var output authScriptOutput
+	err = json.Unmarshal(outputBytes, &output)
+	if err != nil {
+		return "", fmt.Errorf("auth script returned invalid output: %v", err)
+	}
+	if !output.Success {
+		if output.Error != "" {
+			return "", errors.New(output.Error)
+		}
+		return "", errAccountInvalidCredentials
+	}
+
+	accountName = output.AccountName
+	if accountName == "" {
+		accountName = input.AccountName
+	}
+	if accountName == "" {
+		return "", errAccountInvalidCredentials
+	}
+	return accountName, nil
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// testAuthScript accepts the passphrase "scriptpass" for any account, and
+// renames the "Remote" account to "remote_user".
+const testAuthScript = `#!/bin/sh
+read input
+case "$input" in
+*'"accountName":"Remote"'*) echo '{"success": true, "accountName": "remote_user"}' ;;
+*'"passphrase":"scriptpass"'*) echo '{"success": true}' ;;
+*) echo '{"success": false, "error": "unknown user"}' ;;
+esac
+`
+
+// saslPlain authenticates the connection with SASL PLAIN, returning the numeric
+// the server finished with. CAP negotiation is left open.
+func (tc *testClient) saslPlain(t *testing.T, account, passphrase string) string {
+	tc.send("CAP LS 302")
+	tc.send("CAP REQ :sasl")
+	tc.expect(t, "CAP", "ACK")
+	tc.send("AUTHENTICATE PLAIN")
+	tc.expect(t, "AUTHENTICATE +")
+	tc.send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\x00"+account+"\x00"+passphrase)))
+	for {
+		line := tc.expect(t, " 90")
+		if numeric := line[len(":irc.test "):][:3]; numeric != RPL_LOGGEDIN {
+			return numeric
+		}
+	}
+}
+
+func newAuthScriptTestServer(t *testing.T, autocreate bool) (*Server, func()) {
+	dir, removeDir := newTestDir(t)
+	script := filepath.Join(dir, "auth.sh")
+	if err := ioutil.WriteFile(script, []byte(testAuthScript), 0700); err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig(dir, "irc.test")
+	config.Accounts.AuthenticationEnabled = true
+	config.Accounts.AuthScript.Enabled = true
+	config.Accounts.AuthScript.Command = script
+	config.Accounts.AuthScript.Autocreate = autocreate
+	config.Accounts.AuthScript.Timeout = testTimeout
+	server := startTestServer(t, config)
+	return server, func() {
+		server.Shutdown()
+		removeDir()
+	}
+}
+
+func TestAuthScriptAutocreate(t *testing.T) {
+	server, shutdown := newAuthScriptTestServer(t, true)
+	defer shutdown()
+
+	alice := openTestClient(server)
+	if numeric := alice.saslPlain(t, "alice", "scriptpass"); numeric != RPL_SASLSUCCESS {
+		t.Fatalf("expected SASL success, got %s", numeric)
+	}
+	alice.register(t, "alice")
+	if alice.client.Account() != "alice" {
+		t.Errorf("expected to be logged into alice, got %s", alice.client.Account())
+	}
+	account, err := server.accounts.LoadAccount("alice")
+	if err != nil || !account.Verified {
+		t.Fatalf("account wasn't created: %v", err)
+	}
+	// it can only be used through the script
+	if len(account.Credentials.PassphraseHash) != 0 {
+		t.Errorf("created account shouldn't have a passphrase")
+	}
+
+	// the script can choose the account name
+	remote := openTestClient(server)
+	if numeric := remote.saslPlain(t, "Remote", "anything"); numeric != RPL_SASLSUCCESS {
+		t.Fatalf("expected SASL success, got %s", numeric)
+	}
+	if remote.client.Account() != "remote_user" {
+		t.Errorf("expected to be logged into remote_user, got %s", remote.client.Account())
+	}
+
+	// our own credentials are checked if the script rejects the login
+	bob := openTestClient(server)
+	bob.registerAccount(t, server, "bob", "bobpass")
+	server.accounts.Logout(bob.client)
+	if numeric := openTestClient(server).saslPlain(t, "bob", "bobpass"); numeric != RPL_SASLSUCCESS {
+		t.Errorf("local credentials should still work, got %s", numeric)
+	}
+	if numeric := openTestClient(server).saslPlain(t, "bob", "wrongpass"); numeric != ERR_SASLFAIL {
+		t.Errorf("expected SASL failure, got %s", numeric)
+	}
+}
+
+func TestAuthScriptWithoutAutocreate(t *testing.T) {
+	server, shutdown := newAuthScriptTestServer(t, false)
+	defer shutdown()
+
+	if numeric := openTestClient(server).saslPlain(t, "alice", "scriptpass"); numeric != ERR_SASLFAIL {
+		t.Errorf("expected SASL failure, got %s", numeric)
+	}
+	if _, err := server.accounts.LoadAccount("alice"); err != errAccountDoesNotExist {
+		t.Errorf("account shouldn't have been created: %v", err)
+	}
+
+	// existing accounts can be logged into
+	bob := openTestClient(server)
+	bob.registerAccount(t, server, "bob", "bobpass")
+	server.accounts.Logout(bob.client)
+	if numeric := bob.saslPlain(t, "bob", "scriptpass"); numeric != RPL_SASLSUCCESS {
+		t.Errorf("expected SASL success, got %s", numeric)
+	}
+}
@@ -5,6 +5,7 @@ package irc
 
 import (
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/goshuirc/irc-go/ircmsg"
@@ -16,14 +17,15 @@ const (
 	//
 	// Batch IDs are made up of the current unix timestamp plus a rolling int ID that's
 	// incremented for every new batch. It's an alright solution and will work unless we get
-	// more than maxId batches per nanosecond. Later on when we have S2S linking, the batch
-	// ID will also contain the server ID to ensure they stay unique.
+	// more than maxId batches per nanosecond. Batch IDs are never sent over server links, so
+	// they only need to be unique on this server.
 	maxBatchID uint64 = 60000
 )
 
 // BatchManager helps generate new batches and new batch IDs.
 type BatchManager struct {
-	idCounter uint64
+	sync.Mutex // tier 3
+	idCounter  uint64
 }
 
 // NewBatchManager returns a new Manager.
@@ -33,12 +35,15 @@ func NewBatchManager() *BatchManager {
 
 // NewID returns a new batch ID that should be unique.
 func (bm *BatchManager) NewID() string {
+	bm.Lock()
 	bm.idCounter++
 	if maxBatchID < bm.idCounter {
 		bm.idCounter = 0
 	}
+	idCounter := bm.idCounter
+	bm.Unlock()
 
-	return strconv.FormatInt(time.Now().UnixNano(), 36) + strconv.FormatUint(bm.idCounter, 36)
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + strconv.FormatUint(idCounter, 36)
 }
 
 // Batch represents an IRCv3 batch.
@@ -0,0 +1,106 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/caps"
+	"github.com/oragono/oragono/irc/modes"
+)
+
+// checkBroadcastCooldown returns true if the client is allowed to send a
+// network-wide broadcast (WALLOPS, GLOBOPS or a $mask message) right now,
+// and if so, starts their cooldown.
+func (client *Client) checkBroadcastCooldown() bool {
+	cooldown := client.server.Limits().BroadcastCooldown
+	now := time.Now()
+
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	if cooldown != 0 && now.Sub(client.lastBroadcast) < cooldown {
+		return false
+	}
+	client.lastBroadcast = now
+	return true
+}
+
+// matchesServerMask returns true if the given $mask target (e.g., `$*` or
+// `$*.example.com`) matches this server.
+func (server *Server) matchesServerMask(mask string) bool {
+	mask = strings.TrimPrefix(mask, "$")
+	if mask == "" {
+		return false
+	}
+	re, err := regexp.Compile("(?i)^" + globToRegexp(mask) + "$")
+	if err != nil {
+		return false
+	}
+	return re.MatchString(server.name)
+}
+
+// sendWallops sends a WALLOPS message from the given client to every client with +w.
+func (server *Server) sendWallops(from *Client, message string) {
+	for _, client := range server.clients.AllClients() {
+		if client.HasMode(modes.WallOps) {
+			client.SendFromClient("", from, nil, "WALLOPS", message)
+		}
+	}
+	server.logger.Info("opers", fmt.Sprintf("%s sent WALLOPS: %s", from.Nick(), message))
+}
+
+// sendGlobops sends a GLOBOPS notice from the given client to every operator.
+func (server *Server) sendGlobops(from *Client, message string) {
+	line := fmt.Sprintf("*** Global -- from %s: %s", from.Nick(), message)
+	for _, client := range server.clients.AllClients() {
+		if client.HasMode(modes.Operator) {
+			client.Send(nil, server.name, "NOTICE", client.Nick(), line)
+		}
+	}
+	server.logger.Info("opers", fmt.Sprintf("%s sent GLOBOPS: %s", from.Nick(), message))
+}
+
+// massMessage handles a PRIVMSG or NOTICE sent to a $mask target, delivering
+// it to every client on the server. Errors are only reported for PRIVMSG.
+func (server *Server) massMessage(client *Client, command string, mask string, clientOnlyTags *map[string]ircmsg.TagValue, splitMsg SplitMessage, rb *ResponseBuffer) {
+	isPrivmsg := command == "PRIVMSG"
+
+	if !client.HasMode(modes.Operator) || !client.HasRoleCapabs("oper:massmessage") {
+		if isPrivmsg {
+			rb.Add(nil, server.name, ERR_NOPRIVILEGES, client.Nick(), client.t("Permission Denied"))
+		}
+		return
+	}
+	if !server.matchesServerMask(mask) {
+		if isPrivmsg {
+			rb.Add(nil, server.name, ERR_BADMASK, client.Nick(), mask, client.t("Bad server/host mask"))
+		}
+		return
+	}
+	if !client.checkBroadcastCooldown() {
+		rb.Notice(client.t("You're sending broadcasts too quickly; wait a while and try again"))
+		return
+	}
+
+	msgid := server.generateMessageID()
+	for _, user := range server.clients.AllClients() {
+		if user == client {
+			continue
+		}
+		tags := clientOnlyTags
+		if !user.capabilities.Has(caps.MessageTags) {
+			tags = nil
+		}
+		user.SendSplitMsgFromClient(msgid, client, tags, command, mask, splitMsg)
+	}
+	if rb.target.capabilities.Has(caps.EchoMessage) {
+		rb.AddSplitMessageFromClient(msgid, client, clientOnlyTags, command, mask, splitMsg)
+	}
+	client.echoToSessions(rb.target, msgid, clientOnlyTags, command, mask, &splitMsg)
+	server.logger.Info("opers", fmt.Sprintf("%s sent %s to %s: %s", client.Nick(), command, mask, splitMsg.ForMaxLine))
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// drain returns the lines received before the server answers a PING, so tests
+// can check that something wasn't sent.
+func (tc *testClient) drain(t *testing.T) (lines []string) {
+	tc.send("PING :drain")
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case line, ok := <-tc.lines:
+			if !ok {
+				t.Fatal("connection closed while draining")
+			}
+			if strings.Contains(line, "PONG") && strings.HasSuffix(line, "drain") {
+				return
+			}
+			lines = append(lines, line)
+		case <-timeout:
+			t.Fatal("timed out draining")
+		}
+	}
+}
+
+// expectNone fails the test if any line received before a PING is answered
+// contains the given string.
+func (tc *testClient) expectNone(t *testing.T, substring string) {
+	for _, line := range tc.drain(t) {
+		if strings.Contains(line, substring) {
+			t.Errorf("unexpected line %s", line)
+		}
+	}
+}
+
+func newBroadcastTestServer(t *testing.T) (*Server, func()) {
+	return newTestServer(t, func(config *Config) {
+		config.Limits.BroadcastCooldown = time.Hour
+		addTestOper(t, config, "wallopser", "oper:wallops")
+		addTestOper(t, config, "globopser", "oper:wallops", "oper:globops")
+		addTestOper(t, config, "announcer", "oper:massmessage")
+	})
+}
+
+func TestWallops(t *testing.T) {
+	server, shutdown := newBroadcastTestServer(t)
+	defer shutdown()
+
+	bob := newTestClient(t, server, "bob")
+	bob.send("MODE bob +w")
+	bob.expect(t, "MODE bob +w")
+	carol := newTestClient(t, server, "carol")
+
+	carol.send("WALLOPS :hello")
+	carol.expect(t, " 481 carol ")
+
+	oper := newOperTestClient(t, server, "wallopser")
+	oper.send("WALLOPS :hello everyone")
+	bob.expect(t, ":wallopser!", "WALLOPS :hello everyone")
+	carol.expectNone(t, "WALLOPS")
+
+	// a second broadcast is refused until the cooldown runs out
+	oper.send("WALLOPS :hello again")
+	oper.expect(t, "sending broadcasts too quickly")
+	bob.expectNone(t, "hello again")
+}
+
+func TestGlobops(t *testing.T) {
+	server, shutdown := newBroadcastTestServer(t)
+	defer shutdown()
+
+	bob := newTestClient(t, server, "bob")
+	wallopser := newOperTestClient(t, server, "wallopser")
+	wallopser.send("GLOBOPS :hello")
+	wallopser.expect(t, " 481 wallopser :Permission Denied")
+
+	globopser := newOperTestClient(t, server, "globopser")
+	globopser.send("GLOBOPS :hello opers")
+	wallopser.expect(t, "NOTICE wallopser :*** Global -- from globopser: hello opers")
+	globopser.expect(t, "NOTICE globopser :*** Global -- from globopser: hello opers")
+	bob.expectNone(t, "hello opers")
+
+	globopser.send("GLOBOPS :hello again")
+	globopser.expect(t, "sending broadcasts too quickly")
+}
+
+func TestMassMessage(t *testing.T) {
+	server, shutdown := newBroadcastTestServer(t)
+	defer shutdown()
+
+	bob := newTestClient(t, server, "bob")
+	bob.send("PRIVMSG $* :hello")
+	bob.expect(t, " 481 bob ")
+
+	// opers need the capability too
+	wallopser := newOperTestClient(t, server, "wallopser")
+	wallopser.send("PRIVMSG $* :hello")
+	wallopser.expect(t, " 481 wallopser ")
+
+	announcer := newOperTestClient(t, server, "announcer")
+	announcer.send("PRIVMSG $*.example :hello")
+	announcer.expect(t, " 415 announcer $*.example ")
+	announcer.send("PRIVMSG $irc.* :hello everyone")
+	bob.expect(t, ":announcer!", "PRIVMSG $irc.* :hello everyone")
+	wallopser.expect(t, ":announcer!", "PRIVMSG $irc.* :hello everyone")
+
+	announcer.send("NOTICE $* :hello again")
+	announcer.expect(t, "sending broadcasts too quickly")
+	bob.expectNone(t, "hello again")
+}
@@ -46,6 +46,8 @@ const (
 	SASL Capability = "sasl"
 	// ServerTime is this IRCv3 capability: http://ircv3.net/specs/extensions/server-time-3.2.html
 	ServerTime Capability = "server-time"
+	// SetName is this draft IRCv3 capability: https://github.com/ircv3/ircv3-specifications/pull/361
+	SetName Capability = "draft/setname"
 	// STS is this IRCv3 capability: http://ircv3.net/specs/extensions/sts.html
 	STS Capability = "sts"
 	// UserhostInNames is this IRCv3 capability: http://ircv3.net/specs/extensions/userhost-in-names-3.2.html
@@ -0,0 +1,175 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oragono/oragono/irc/modes"
+)
+
+// the +f channel mode protects a channel from floods by many different clients
+// (fakelag only protects against floods from a single client). its argument is a
+// comma-separated list of limits, like `10m:5,3j:10` for "10 messages per 5 seconds,
+// 3 joins per 10 seconds". when a limit is exceeded, the channel is set +m (for
+// messages) or +i (for joins) for a while, and the channel operators are told.
+
+// floodLimit is a limit of Count events per Window.
+type floodLimit struct {
+	Count  int
+	Window time.Duration
+}
+
+// ChannelFloodLimits holds the limits set with the +f channel mode.
+type ChannelFloodLimits struct {
+	Messages floodLimit
+	Joins    floodLimit
+}
+
+// ParseChannelFloodLimits parses the argument of the +f channel mode.
+func ParseChannelFloodLimits(arg string) (limits ChannelFloodLimits, err error) {
+	for _, item := range strings.Split(arg, ",") {
+		colon := strings.IndexByte(item, ':')
+		if colon < 2 {
+			return limits, errInvalidFloodLimits
+		}
+		count, err := strconv.Atoi(item[:colon-1])
+		if err != nil || count < 1 {
+			return limits, errInvalidFloodLimits
+		}
+		seconds, err := strconv.Atoi(item[colon+1:])
+		if err != nil || seconds < 1 {
+			return limits, errInvalidFloodLimits
+		}
+		limit := floodLimit{
+			Count:  count,
+			Window: time.Duration(seconds) * time.Second,
+		}
+
+		switch item[colon-1] {
+		case 'm':
+			limits.Messages = limit
+		case 'j':
+			limits.Joins = limit
+		default:
+			return limits, errInvalidFloodLimits
+		}
+	}
+	return
+}
+
+// String returns the limits in the format used by the +f channel mode.
+func (limits ChannelFloodLimits) String() string {
+	var items []string
+	if limits.Messages.Count != 0 {
+		items = append(items, fmt.Sprintf("%dm:%d", limits.Messages.Count, int(limits.Messages.Window.Seconds())))
+	}
+	if limits.Joins.Count != 0 {
+		items = append(items, fmt.Sprintf("%dj:%d", limits.Joins.Count, int(limits.Joins.Window.Seconds())))
+	}
+	return strings.Join(items, ",")
+}
+
+// floodCounter counts events over a fixed window.
+type floodCounter struct {
+	windowStart time.Time
+	count       int
+}
+
+// Touch records an event, returning whether the limit has been exceeded.
+func (fc *floodCounter) Touch(limit floodLimit, now time.Time) (exceeded bool) {
+	if now.Sub(fc.windowStart) >= limit.Window {
+		fc.windowStart = now
+		fc.count = 0
+	}
+	fc.count++
+	return limit.Count < fc.count
+}
+
+// setFloodLimits changes the channel's flood limits, resetting the counters.
+func (channel *Channel) setFloodLimits(limits ChannelFloodLimits) {
+	channel.stateMutex.Lock()
+	defer channel.stateMutex.Unlock()
+	channel.floodLimits = limits
+	channel.messageFlood = floodCounter{}
+	channel.joinFlood = floodCounter{}
+}
+
+// checkMessageFlood records a message from the given client, returning true if
+// the message exceeded the channel's limit and should be refused.
+func (channel *Channel) checkMessageFlood(client *Client) (flooded bool) {
+	// voiced users and above aren't affected by the lockout, so don't count them
+	if channel.ClientIsAtLeast(client, modes.Voice) {
+		return false
+	}
+	return channel.checkFlood(modes.Moderated, "messages")
+}
+
+// checkJoinFlood records a join, returning true if the join exceeded the channel's
+// limit and should be refused.
+func (channel *Channel) checkJoinFlood() (flooded bool) {
+	return channel.checkFlood(modes.InviteOnly, "joins")
+}
+
+func (channel *Channel) checkFlood(lockoutMode modes.Mode, event string) (flooded bool) {
+	var lockout bool
+
+	channel.stateMutex.Lock()
+	limit, counter := channel.floodLimits.Messages, &channel.messageFlood
+	if lockoutMode == modes.InviteOnly {
+		limit, counter = channel.floodLimits.Joins, &channel.joinFlood
+	}
+	if limit.Count != 0 {
+		flooded = counter.Touch(limit, time.Now())
+		if flooded && !channel.flags[lockoutMode] {
+			lockout = true
+			channel.flags[lockoutMode] = true
+			channel.floodLockouts[lockoutMode] = true
+		}
+	}
+	channel.stateMutex.Unlock()
+
+	if lockout {
+		duration := channel.server.ChannelFloodLockout()
+		channel.sendServerModeChange(modes.ModeChange{Op: modes.Add, Mode: lockoutMode})
+		channel.server.links.ChannelModes(channel, nil, modes.ModeChanges{{Op: modes.Add, Mode: lockoutMode}})
+		for _, member := range channel.Members() {
+			if channel.ClientIsAtLeast(member, modes.ChannelOperator) {
+				member.Send(nil, channel.server.name, "NOTICE", member.Nick(), fmt.Sprintf(member.t("Flood protection triggered in %[1]s by too many %[2]s, setting +%[3]s for %[4]s"), channel.Name(), event, lockoutMode.String(), duration.String()))
+			}
+		}
+		time.AfterFunc(duration, func() {
+			channel.endFloodLockout(lockoutMode)
+		})
+	}
+	return
+}
+
+// endFloodLockout lifts a mode that was set by flood protection, unless someone
+// has changed the mode since.
+func (channel *Channel) endFloodLockout(lockoutMode modes.Mode) {
+	channel.stateMutex.Lock()
+	lifted := channel.floodLockouts[lockoutMode]
+	if lifted {
+		delete(channel.floodLockouts, lockoutMode)
+		delete(channel.flags, lockoutMode)
+	}
+	channel.stateMutex.Unlock()
+
+	if lifted {
+		channel.sendServerModeChange(modes.ModeChange{Op: modes.Remove, Mode: lockoutMode})
+		channel.server.links.ChannelModes(channel, nil, modes.ModeChanges{{Op: modes.Remove, Mode: lockoutMode}})
+	}
+}
+
+// sendServerModeChange tells the channel members about a mode change made by the server.
+func (channel *Channel) sendServerModeChange(change modes.ModeChange) {
+	args := append([]string{channel.Name()}, strings.Split(modes.ModeChanges{change}.String(), " ")...)
+	for _, member := range channel.Members() {
+		member.Send(nil, channel.server.name, "MODE", args...)
+	}
+}
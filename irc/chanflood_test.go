@@ -0,0 +1,45 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseChannelFloodLimits(t *testing.T) {
+	limits, err := ParseChannelFloodLimits("3j:10,10m:5")
+	if err != nil {
+		t.Fatalf("could not parse limits: %v", err)
+	}
+	if limits.Messages != (floodLimit{10, 5 * time.Second}) || limits.Joins != (floodLimit{3, 10 * time.Second}) {
+		t.Errorf("parsed limits incorrectly: %#v", limits)
+	}
+	if limits.String() != "10m:5,3j:10" {
+		t.Errorf("limits should be canonicalized, got %s", limits.String())
+	}
+
+	invalid := []string{"", "10m", "m:5", "10x:5", "0m:5", "10m:0", "10m:5,", "-1j:3"}
+	for _, arg := range invalid {
+		if _, err := ParseChannelFloodLimits(arg); err == nil {
+			t.Errorf("%s should be invalid", arg)
+		}
+	}
+}
+
+func TestFloodCounter(t *testing.T) {
+	limit := floodLimit{Count: 2, Window: time.Second}
+	var counter floodCounter
+	now := time.Now()
+
+	if counter.Touch(limit, now) || counter.Touch(limit, now) {
+		t.Error("should be within the limit")
+	}
+	if !counter.Touch(limit, now.Add(500*time.Millisecond)) {
+		t.Error("should have exceeded the limit")
+	}
+	if counter.Touch(limit, now.Add(time.Second)) {
+		t.Error("should have started a new window")
+	}
+}
@@ -15,7 +15,9 @@ import (
 
 	"github.com/goshuirc/irc-go/ircmsg"
 	"github.com/oragono/oragono/irc/caps"
+	"github.com/oragono/oragono/irc/history"
 	"github.com/oragono/oragono/irc/modes"
+	"github.com/oragono/oragono/irc/utils"
 )
 
 // Channel represents a channel that clients can join.
@@ -38,6 +40,13 @@ type Channel struct {
 	topicSetTime      time.Time
 	userLimit         uint64
 	accountToUMode    map[string]modes.Mode
+	history           *history.Buffer
+	floodLimits       ChannelFloodLimits
+	messageFlood      floodCounter
+	joinFlood         floodCounter
+	floodLockouts     modes.ModeSet // modes that were set by flood protection
+	knocks            map[string]time.Time
+	lastKnock         time.Time
 }
 
 // NewChannel creates a new channel from a `Server` and a `name`
@@ -56,12 +65,20 @@ func NewChannel(s *Server, name string, regInfo *RegisteredChannel) *Channel {
 			modes.BanMask:    NewUserMaskSet(),
 			modes.ExceptMask: NewUserMaskSet(),
 			modes.InviteMask: NewUserMaskSet(),
+			modes.QuietMask:  NewUserMaskSet(),
 		},
 		members:        make(MemberSet),
 		name:           name,
 		nameCasefolded: casefoldedName,
 		server:         s,
 		accountToUMode: make(map[string]modes.Mode),
+		floodLockouts:  make(modes.ModeSet),
+	}
+
+	if historyConfig := s.ChannelHistoryConfig(); historyConfig != nil {
+		channel.history = history.NewHistoryBuffer(historyConfig.ChannelLength, historyConfig.MaxAge)
+	} else {
+		channel.history = history.NewHistoryBuffer(0, 0)
 	}
 
 	if regInfo != nil {
@@ -85,6 +102,7 @@ func (channel *Channel) applyRegInfo(chanReg *RegisteredChannel) {
 	channel.name = chanReg.Name
 	channel.createdTime = chanReg.RegisteredAt
 	channel.key = chanReg.Key
+	channel.floodLimits, _ = ParseChannelFloodLimits(chanReg.FloodLimits)
 
 	for _, mode := range chanReg.Modes {
 		channel.flags[mode] = true
@@ -98,6 +116,9 @@ func (channel *Channel) applyRegInfo(chanReg *RegisteredChannel) {
 	for _, mask := range chanReg.Invitelist {
 		channel.lists[modes.InviteMask].Add(mask)
 	}
+	for _, mask := range chanReg.Quietlist {
+		channel.lists[modes.QuietMask].Add(mask)
+	}
 	for account, mode := range chanReg.AccountToUMode {
 		channel.accountToUMode[account] = mode
 	}
@@ -120,8 +141,12 @@ func (channel *Channel) ExportRegistration(includeFlags uint) (info RegisteredCh
 
 	if includeFlags&IncludeModes != 0 {
 		info.Key = channel.key
+		info.FloodLimits = channel.floodLimits.String()
 		for mode := range channel.flags {
-			info.Modes = append(info.Modes, mode)
+			// flood protection lockouts are temporary
+			if !channel.floodLockouts[mode] {
+				info.Modes = append(info.Modes, mode)
+			}
 		}
 	}
 
@@ -135,6 +160,9 @@ func (channel *Channel) ExportRegistration(includeFlags uint) (info RegisteredCh
 		for mask := range channel.lists[modes.InviteMask].masks {
 			info.Invitelist = append(info.Invitelist, mask)
 		}
+		for mask := range channel.lists[modes.QuietMask].masks {
+			info.Quietlist = append(info.Quietlist, mask)
+		}
 		info.AccountToUMode = make(map[string]modes.Mode)
 		for account, mode := range channel.accountToUMode {
 			info.AccountToUMode[account] = mode
@@ -153,11 +181,132 @@ func (channel *Channel) SetRegistered(founder string) error {
 		return errChannelAlreadyRegistered
 	}
 	channel.registeredFounder = founder
-	channel.registeredTime = time.Now()
+	// truncated so that it compares equal to the time read back from the store
+	channel.registeredTime = time.Now().Truncate(time.Second)
 	channel.accountToUMode[founder] = modes.ChannelFounder
 	return nil
 }
 
+// AccountToUMode returns a copy of the persistent channel modes of registered accounts.
+func (channel *Channel) AccountToUMode() (result map[string]modes.Mode) {
+	channel.stateMutex.RLock()
+	defer channel.stateMutex.RUnlock()
+	result = make(map[string]modes.Mode, len(channel.accountToUMode))
+	for account, mode := range channel.accountToUMode {
+		result[account] = mode
+	}
+	return
+}
+
+// umodeRank returns the relative strength of a channel membership mode,
+// with 0 meaning no privileges at all.
+func umodeRank(mode modes.Mode) int {
+	switch mode {
+	case modes.ChannelFounder:
+		return 5
+	case modes.ChannelAdmin:
+		return 4
+	case modes.ChannelOperator:
+		return 3
+	case modes.Halfop:
+		return 2
+	case modes.Voice:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// ProcessAccountToUmodeChange applies a change to the persistent mode of the (casefolded)
+// account in change.Arg, as requested by `client`. Clients can only modify the entries of
+// accounts ranked below them, and can only grant modes below their own. It returns the
+// changes made, starting with the removal of any mode the new one replaces.
+func (channel *Channel) ProcessAccountToUmodeChange(client *Client, change modes.ModeChange) (applied modes.ModeChanges, err error) {
+	if umodeRank(change.Mode) == 0 {
+		return nil, errInvalidParams
+	}
+
+	account := client.Account()
+
+	channel.stateMutex.Lock()
+	defer channel.stateMutex.Unlock()
+
+	clientRank := umodeRank(channel.accountToUMode[account])
+	targetMode, targetExists := channel.accountToUMode[change.Arg]
+	if clientRank <= umodeRank(targetMode) || clientRank <= umodeRank(change.Mode) {
+		return nil, errInsufficientPrivs
+	}
+
+	switch change.Op {
+	case modes.Add:
+		if targetExists && targetMode == change.Mode {
+			return nil, nil
+		}
+		channel.accountToUMode[change.Arg] = change.Mode
+		// an account only has one persistent mode, so this replaces any previous one
+		if targetExists {
+			applied = append(applied, modes.ModeChange{Op: modes.Remove, Mode: targetMode, Arg: change.Arg})
+		}
+	case modes.Remove:
+		if !targetExists || targetMode != change.Mode {
+			return nil, nil
+		}
+		delete(channel.accountToUMode, change.Arg)
+	default:
+		return nil, errInvalidParams
+	}
+	return append(applied, change), nil
+}
+
+// applyAccountUMode gives a member of the channel the persistent mode of the account
+// they're logged into, if they don't already have it.
+func (channel *Channel) applyAccountUMode(client *Client) {
+	account := client.Account()
+	if account == "" {
+		return
+	}
+
+	channel.stateMutex.Lock()
+	mode, persistentModeExists := channel.accountToUMode[account]
+	modeset, isMember := channel.members[client]
+	changed := persistentModeExists && isMember && !modeset[mode]
+	if changed {
+		modeset[mode] = true
+	}
+	channel.stateMutex.Unlock()
+
+	if changed {
+		for _, member := range channel.Members() {
+			member.Send(nil, client.server.name, "MODE", channel.Name(), fmt.Sprintf("+%v", mode), client.Nick())
+		}
+	}
+}
+
+// SetUnregistered deletes the channel's registration information.
+func (channel *Channel) SetUnregistered() {
+	channel.stateMutex.Lock()
+	defer channel.stateMutex.Unlock()
+
+	channel.registeredFounder = ""
+	channel.registeredTime = time.Time{}
+	channel.accountToUMode = make(map[string]modes.Mode)
+}
+
+// Transfer makes `newFounder` the founder of the channel, as long as the channel is
+// still registered to `oldFounder`. The old founder loses their persistent founder mode.
+func (channel *Channel) Transfer(oldFounder, newFounder string) error {
+	channel.stateMutex.Lock()
+	defer channel.stateMutex.Unlock()
+
+	if channel.registeredFounder == "" || channel.registeredFounder != oldFounder {
+		return errChannelNotOwnedByAccount
+	}
+	delete(channel.accountToUMode, oldFounder)
+	channel.registeredFounder = newFounder
+	channel.accountToUMode[newFounder] = modes.ChannelFounder
+	return nil
+}
+
 // IsRegistered returns whether the channel is registered.
 func (channel *Channel) IsRegistered() bool {
 	channel.stateMutex.RLock()
@@ -320,6 +469,7 @@ func (channel *Channel) modeStrings(client *Client) (result []string) {
 	isMember := client.HasMode(modes.Operator) || channel.hasClient(client)
 	showKey := isMember && (channel.key != "")
 	showUserLimit := channel.userLimit > 0
+	floodLimits := channel.FloodLimits().String()
 
 	mods := "+"
 
@@ -330,6 +480,9 @@ func (channel *Channel) modeStrings(client *Client) (result []string) {
 	if showUserLimit {
 		mods += modes.UserLimit.String()
 	}
+	if floodLimits != "" {
+		mods += modes.FloodLimit.String()
+	}
 
 	channel.stateMutex.RLock()
 	defer channel.stateMutex.RUnlock()
@@ -349,6 +502,9 @@ func (channel *Channel) modeStrings(client *Client) (result []string) {
 	if showUserLimit {
 		result = append(result, strconv.FormatUint(channel.userLimit, 10))
 	}
+	if floodLimits != "" {
+		result = append(result, floodLimits)
+	}
 
 	return
 }
@@ -377,33 +533,14 @@ func (channel *Channel) IsEmpty() bool {
 }
 
 // Join joins the given client to this channel (if they can be joined).
-//TODO(dan): /SAJOIN and maybe a ForceJoin function?
-func (channel *Channel) Join(client *Client, key string, rb *ResponseBuffer) {
+// If isSajoin is set, the channel's restrictions (limit, key, bans, etc.) are ignored.
+func (channel *Channel) Join(client *Client, key string, isSajoin bool, rb *ResponseBuffer) {
 	if channel.hasClient(client) {
 		// already joined, no message needs to be sent
 		return
 	}
 
-	if channel.IsFull() {
-		rb.Add(nil, client.server.name, ERR_CHANNELISFULL, channel.name, fmt.Sprintf(client.t("Cannot join channel (+%s)"), "l"))
-		return
-	}
-
-	if !channel.CheckKey(key) {
-		rb.Add(nil, client.server.name, ERR_BADCHANNELKEY, channel.name, fmt.Sprintf(client.t("Cannot join channel (+%s)"), "k"))
-		return
-	}
-
-	isInvited := channel.lists[modes.InviteMask].Match(client.nickMaskCasefolded)
-	if channel.flags[modes.InviteOnly] && !isInvited {
-		rb.Add(nil, client.server.name, ERR_INVITEONLYCHAN, channel.name, fmt.Sprintf(client.t("Cannot join channel (+%s)"), "i"))
-		return
-	}
-
-	if channel.lists[modes.BanMask].Match(client.nickMaskCasefolded) &&
-		!isInvited &&
-		!channel.lists[modes.ExceptMask].Match(client.nickMaskCasefolded) {
-		rb.Add(nil, client.server.name, ERR_BANNEDFROMCHAN, channel.name, fmt.Sprintf(client.t("Cannot join channel (+%s)"), "b"))
+	if !isSajoin && !channel.checkJoinRestrictions(client, key, rb) {
 		return
 	}
 
@@ -412,13 +549,13 @@ func (channel *Channel) Join(client *Client, key string, rb *ResponseBuffer) {
 	for _, member := range channel.Members() {
 		if member == client {
 			if member.capabilities.Has(caps.ExtendedJoin) {
-				rb.Add(nil, client.nickMaskString, "JOIN", channel.name, client.AccountName(), client.realname)
+				rb.Add(nil, client.nickMaskString, "JOIN", channel.name, client.AccountName(), client.Realname())
 			} else {
 				rb.Add(nil, client.nickMaskString, "JOIN", channel.name)
 			}
 		} else {
 			if member.capabilities.Has(caps.ExtendedJoin) {
-				member.Send(nil, client.nickMaskString, "JOIN", channel.name, client.AccountName(), client.realname)
+				member.Send(nil, client.nickMaskString, "JOIN", channel.name, client.AccountName(), client.Realname())
 			} else {
 				member.Send(nil, client.nickMaskString, "JOIN", channel.name)
 			}
@@ -451,7 +588,7 @@ func (channel *Channel) Join(client *Client, key string, rb *ResponseBuffer) {
 	channel.stateMutex.Unlock()
 
 	if client.capabilities.Has(caps.ExtendedJoin) {
-		rb.Add(nil, client.nickMaskString, "JOIN", channel.name, client.AccountName(), client.realname)
+		rb.Add(nil, client.nickMaskString, "JOIN", channel.name, client.AccountName(), client.Realname())
 	} else {
 		rb.Add(nil, client.nickMaskString, "JOIN", channel.name)
 	}
@@ -469,6 +606,50 @@ func (channel *Channel) Join(client *Client, key string, rb *ResponseBuffer) {
 			}
 		}
 	}
+
+	channel.history.Add(history.Item{
+		Type:        history.Join,
+		Nick:        client.NickMaskString(),
+		AccountName: client.AccountName(),
+		Msgid:       client.server.generateMessageID(),
+		Message:     client.Realname(),
+	})
+
+	client.server.links.Join(channel, client, firstJoin)
+}
+
+// checkJoinRestrictions returns true if the client is allowed to join the channel,
+// replying with the relevant error if they aren't.
+func (channel *Channel) checkJoinRestrictions(client *Client, key string, rb *ResponseBuffer) bool {
+	if channel.IsFull() {
+		rb.Add(nil, client.server.name, ERR_CHANNELISFULL, channel.name, fmt.Sprintf(client.t("Cannot join channel (+%s)"), "l"))
+		return false
+	}
+
+	if !channel.CheckKey(key) {
+		rb.Add(nil, client.server.name, ERR_BADCHANNELKEY, channel.name, fmt.Sprintf(client.t("Cannot join channel (+%s)"), "k"))
+		return false
+	}
+
+	isInvited := channel.lists[modes.InviteMask].MatchClient(client)
+	if channel.flags[modes.InviteOnly] && !isInvited {
+		rb.Add(nil, client.server.name, ERR_INVITEONLYCHAN, channel.name, fmt.Sprintf(client.t("Cannot join channel (+%s)"), "i"))
+		return false
+	}
+
+	if channel.lists[modes.BanMask].MatchClient(client) &&
+		!isInvited &&
+		!channel.lists[modes.ExceptMask].MatchClient(client) {
+		rb.Add(nil, client.server.name, ERR_BANNEDFROMCHAN, channel.name, fmt.Sprintf(client.t("Cannot join channel (+%s)"), "b"))
+		return false
+	}
+
+	if !isInvited && channel.checkJoinFlood() {
+		rb.Add(nil, client.server.name, ERR_INVITEONLYCHAN, channel.name, fmt.Sprintf(client.t("Cannot join channel (+%s)"), "i"))
+		return false
+	}
+
+	return true
 }
 
 // Part parts the given client from this channel, with the given message.
@@ -486,6 +667,17 @@ func (channel *Channel) Part(client *Client, message string, rb *ResponseBuffer)
 		}
 	}
 	channel.Quit(client)
+	if !client.IsRemote() {
+		client.server.links.Part(channel, client, message)
+	}
+
+	channel.history.Add(history.Item{
+		Type:        history.Part,
+		Nick:        client.NickMaskString(),
+		AccountName: client.AccountName(),
+		Msgid:       client.server.generateMessageID(),
+		Message:     message,
+	})
 
 	client.server.logger.Debug("part", fmt.Sprintf("%s left channel %s", client.nick, channel.name))
 }
@@ -529,6 +721,12 @@ func (channel *Channel) SetTopic(client *Client, topic string, rb *ResponseBuffe
 		topic = topic[:client.server.limits.TopicLen]
 	}
 
+	channel.setTopic(client, topic, rb)
+	channel.server.links.Topic(channel, client, topic)
+}
+
+// setTopic sets the topic of this channel, without any checks.
+func (channel *Channel) setTopic(client *Client, topic string, rb *ResponseBuffer) {
 	channel.stateMutex.Lock()
 	channel.topic = topic
 	channel.topicSetBy = client.nickMaskString
@@ -543,11 +741,34 @@ func (channel *Channel) SetTopic(client *Client, topic string, rb *ResponseBuffe
 		}
 	}
 
+	channel.history.Add(history.Item{
+		Type:        history.Topic,
+		Nick:        client.NickMaskString(),
+		AccountName: client.AccountName(),
+		Msgid:       client.server.generateMessageID(),
+		Message:     topic,
+	})
+
 	go channel.server.channelRegistry.StoreChannel(channel, IncludeTopic)
 }
 
 // CanSpeak returns true if the client can speak on this channel.
 func (channel *Channel) CanSpeak(client *Client) bool {
+	if !channel.canSpeakWithModes(client) {
+		return false
+	}
+	// quieted clients can still speak if they're voiced (or higher). the mask lists
+	// are checked without holding stateMutex, since extbans can look at other channels
+	if channel.lists[modes.QuietMask].MatchClient(client) &&
+		!channel.lists[modes.ExceptMask].MatchClient(client) &&
+		!channel.ClientIsAtLeast(client, modes.Voice) {
+		return false
+	}
+	return true
+}
+
+// canSpeakWithModes checks the channel flags that stop clients from speaking.
+func (channel *Channel) canSpeakWithModes(client *Client) bool {
 	channel.stateMutex.RLock()
 	defer channel.stateMutex.RUnlock()
 
@@ -571,7 +792,7 @@ func (channel *Channel) TagMsg(msgid string, minPrefix *modes.Mode, clientOnlyTa
 
 // sendMessage sends a given message to everyone on this channel.
 func (channel *Channel) sendMessage(msgid, cmd string, requiredCaps []caps.Capability, minPrefix *modes.Mode, clientOnlyTags *map[string]ircmsg.TagValue, client *Client, message *string, rb *ResponseBuffer) {
-	if !channel.CanSpeak(client) {
+	if !channel.CanSpeak(client) || channel.checkMessageFlood(client) {
 		rb.Add(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.name, client.t("Cannot send to channel"))
 		return
 	}
@@ -582,9 +803,9 @@ func (channel *Channel) sendMessage(msgid, cmd string, requiredCaps []caps.Capab
 		minPrefixMode = *minPrefix
 	}
 	// send echo-message
-	if client.capabilities.Has(caps.EchoMessage) {
+	if rb.target.capabilities.Has(caps.EchoMessage) {
 		var messageTagsToUse *map[string]ircmsg.TagValue
-		if client.capabilities.Has(caps.MessageTags) {
+		if rb.target.capabilities.Has(caps.MessageTags) {
 			messageTagsToUse = clientOnlyTags
 		}
 
@@ -594,6 +815,11 @@ func (channel *Channel) sendMessage(msgid, cmd string, requiredCaps []caps.Capab
 			rb.AddFromClient(msgid, client, messageTagsToUse, cmd, channel.name, *message)
 		}
 	}
+	if message == nil {
+		client.echoToSessions(rb.target, msgid, clientOnlyTags, cmd, channel.name, nil)
+	} else {
+		client.echoToSessions(rb.target, msgid, clientOnlyTags, cmd, channel.name, &SplitMessage{For512: []string{*message}, ForMaxLine: *message})
+	}
 	for _, member := range channel.Members() {
 		if minPrefix != nil && !channel.ClientIsAtLeast(member, minPrefixMode) {
 			// STATUSMSG
@@ -625,6 +851,17 @@ func (channel *Channel) sendMessage(msgid, cmd string, requiredCaps []caps.Capab
 			member.SendFromClient(msgid, client, messageTagsToUse, cmd, channel.name, *message)
 		}
 	}
+
+	// STATUSMSG messages aren't visible to everyone, so they aren't stored
+	if minPrefix == nil && cmd == "TAGMSG" {
+		channel.history.Add(history.Item{
+			Type:        history.Tagmsg,
+			Nick:        client.NickMaskString(),
+			AccountName: client.AccountName(),
+			Msgid:       msgid,
+			Tags:        historyTags(clientOnlyTags),
+		})
+	}
 }
 
 // SplitPrivMsg sends a private message to everyone in this channel.
@@ -638,20 +875,15 @@ func (channel *Channel) SplitNotice(msgid string, minPrefix *modes.Mode, clientO
 }
 
 func (channel *Channel) sendSplitMessage(msgid, cmd string, minPrefix *modes.Mode, clientOnlyTags *map[string]ircmsg.TagValue, client *Client, message *SplitMessage, rb *ResponseBuffer) {
-	if !channel.CanSpeak(client) {
+	if !channel.CanSpeak(client) || channel.checkMessageFlood(client) {
 		rb.Add(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.name, client.t("Cannot send to channel"))
 		return
 	}
 
-	// for STATUSMSG
-	var minPrefixMode modes.Mode
-	if minPrefix != nil {
-		minPrefixMode = *minPrefix
-	}
 	// send echo-message
-	if client.capabilities.Has(caps.EchoMessage) {
+	if rb.target.capabilities.Has(caps.EchoMessage) {
 		var tagsToUse *map[string]ircmsg.TagValue
-		if client.capabilities.Has(caps.MessageTags) {
+		if rb.target.capabilities.Has(caps.MessageTags) {
 			tagsToUse = clientOnlyTags
 		}
 		if message == nil {
@@ -660,6 +892,27 @@ func (channel *Channel) sendSplitMessage(msgid, cmd string, minPrefix *modes.Mod
 			rb.AddSplitMessageFromClient(msgid, client, tagsToUse, cmd, channel.name, *message)
 		}
 	}
+	client.echoToSessions(rb.target, msgid, clientOnlyTags, cmd, channel.name, message)
+
+	channel.distributeMessage(msgid, cmd, minPrefix, clientOnlyTags, client, message)
+
+	if message != nil {
+		target := channel.Name()
+		if minPrefix != nil {
+			target = modes.ChannelModePrefixes[*minPrefix] + target
+		}
+		channel.server.links.ChannelMessage(msgid, client, cmd, target, clientOnlyTags, message.ForMaxLine)
+	}
+}
+
+// distributeMessage sends a message to the channel's members (besides the sender)
+// and stores it in the channel's history.
+func (channel *Channel) distributeMessage(msgid, cmd string, minPrefix *modes.Mode, clientOnlyTags *map[string]ircmsg.TagValue, client *Client, message *SplitMessage) {
+	// for STATUSMSG
+	var minPrefixMode modes.Mode
+	if minPrefix != nil {
+		minPrefixMode = *minPrefix
+	}
 	for _, member := range channel.Members() {
 		if minPrefix != nil && !channel.ClientIsAtLeast(member, minPrefixMode) {
 			// STATUSMSG
@@ -680,6 +933,118 @@ func (channel *Channel) sendSplitMessage(msgid, cmd string, minPrefix *modes.Mod
 			member.SendSplitMsgFromClient(msgid, client, tagsToUse, cmd, channel.name, *message)
 		}
 	}
+
+	// STATUSMSG messages aren't visible to everyone, so they aren't stored
+	if minPrefix == nil && message != nil {
+		var itemType history.ItemType
+		if cmd == "PRIVMSG" {
+			itemType = history.Privmsg
+		} else {
+			itemType = history.Notice
+		}
+		channel.history.Add(history.Item{
+			Type:        itemType,
+			Nick:        client.NickMaskString(),
+			AccountName: client.AccountName(),
+			Msgid:       msgid,
+			Message:     message.ForMaxLine,
+			Tags:        historyTags(clientOnlyTags),
+		})
+	}
+}
+
+// replayHistoryItems sends the given history items to the client that owns `rb`,
+// inside a chathistory batch if the client supports batches.
+func (channel *Channel) replayHistoryItems(rb *ResponseBuffer, items []history.Item) {
+	client := rb.target
+	server := client.server
+	chname := channel.Name()
+	extendedJoin := client.capabilities.Has(caps.ExtendedJoin)
+	useMaxLine := client.capabilities.Has(caps.MaxLine)
+	messageTags := client.capabilities.Has(caps.MessageTags)
+
+	var batchID string
+	if client.capabilities.Has(caps.Batch) {
+		batch := server.batches.New("chathistory", chname)
+		batchID = batch.ID
+		rb.Add(nil, server.name, "BATCH", "+"+batch.ID, batch.Type, chname)
+	}
+
+	for _, item := range items {
+		var tags *map[string]ircmsg.TagValue
+		if messageTags {
+			tags = copyTags(&item.Tags)
+		}
+		if batchID != "" {
+			if tags == nil {
+				tags = ircmsg.MakeTags("batch", batchID)
+			} else {
+				(*tags)["batch"] = ircmsg.MakeTagValue(batchID)
+			}
+		}
+		// the account tag is only attached if the sender was logged in
+		account := item.AccountName
+		if account == "*" {
+			account = ""
+		}
+
+		switch item.Type {
+		case history.Privmsg, history.Notice:
+			command := "PRIVMSG"
+			if item.Type == history.Notice {
+				command = "NOTICE"
+			}
+			if useMaxLine {
+				rb.AddFromNickmask(item.Time, item.Msgid, item.Nick, account, tags, command, chname, item.Message)
+			} else {
+				for _, line := range server.splitMessage(item.Message, false).For512 {
+					rb.AddFromNickmask(item.Time, item.Msgid, item.Nick, account, copyTags(tags), command, chname, line)
+				}
+			}
+		case history.Tagmsg:
+			if messageTags {
+				rb.AddFromNickmask(item.Time, item.Msgid, item.Nick, account, tags, "TAGMSG", chname)
+			}
+		case history.Join:
+			if extendedJoin {
+				rb.AddFromNickmask(item.Time, "", item.Nick, account, tags, "JOIN", chname, item.AccountName, item.Message)
+			} else {
+				rb.AddFromNickmask(item.Time, "", item.Nick, account, tags, "JOIN", chname)
+			}
+		case history.Part:
+			rb.AddFromNickmask(item.Time, "", item.Nick, account, tags, "PART", chname, item.Message)
+		case history.Kick:
+			rb.AddFromNickmask(item.Time, "", item.Nick, account, tags, "KICK", chname, item.Target, item.Message)
+		case history.Topic:
+			rb.AddFromNickmask(item.Time, "", item.Nick, account, tags, "TOPIC", chname, item.Message)
+		}
+	}
+
+	if batchID != "" {
+		rb.Add(nil, server.name, "BATCH", "-"+batchID)
+	}
+}
+
+// historyTags extracts the client-only tags that should be stored with a history item.
+func historyTags(tags *map[string]ircmsg.TagValue) (result map[string]ircmsg.TagValue) {
+	if tags != nil {
+		if clientOnlyTags := utils.GetClientOnlyTags(*tags); clientOnlyTags != nil {
+			result = *clientOnlyTags
+		}
+	}
+	return
+}
+
+// copyTags returns a copy of the given tag map, so that it can be modified safely.
+func copyTags(tags *map[string]ircmsg.TagValue) *map[string]ircmsg.TagValue {
+	if tags == nil || len(*tags) == 0 {
+		return nil
+	}
+	result := make(map[string]ircmsg.TagValue, len(*tags))
+	for name, value := range *tags {
+		result[name] = value
+	}
+	return &result
 }
 
 func (channel *Channel) applyModeMemberNoMutex(client *Client, mode modes.Mode, op modes.ModeOp, nick string, rb *ResponseBuffer) *modes.ModeChange {
@@ -733,17 +1098,29 @@ func (channel *Channel) ShowMaskList(client *Client, mode modes.Mode, rb *Respon
 	} else if mode == modes.InviteMask {
 		rpllist = RPL_INVITELIST
 		rplendoflist = RPL_ENDOFINVITELIST
+	} else if mode == modes.QuietMask {
+		rpllist = RPL_QUIETLIST
+		rplendoflist = RPL_ENDOFQUIETLIST
 	}
 
 	nick := client.Nick()
 	channel.stateMutex.RLock()
 	// XXX don't acquire any new locks in this section, besides Socket.Write
 	for mask := range channel.lists[mode].masks {
-		rb.Add(nil, client.server.name, rpllist, nick, channel.name, mask)
+		if mode == modes.QuietMask {
+			// like other servers' quiet lists, these replies include the mode letter
+			rb.Add(nil, client.server.name, rpllist, nick, channel.name, mode.String(), mask)
+		} else {
+			rb.Add(nil, client.server.name, rpllist, nick, channel.name, mask)
+		}
 	}
 	channel.stateMutex.RUnlock()
 
-	rb.Add(nil, client.server.name, rplendoflist, nick, channel.name, client.t("End of list"))
+	if mode == modes.QuietMask {
+		rb.Add(nil, client.server.name, rplendoflist, nick, channel.name, mode.String(), client.t("End of list"))
+	} else {
+		rb.Add(nil, client.server.name, rplendoflist, nick, channel.name, client.t("End of list"))
+	}
 }
 
 func (channel *Channel) applyModeMask(client *Client, mode modes.Mode, op modes.ModeOp, mask string, rb *ResponseBuffer) bool {
@@ -812,6 +1189,12 @@ func (channel *Channel) Kick(client *Client, target *Client, comment string, rb
 		comment = comment[:kicklimit]
 	}
 
+	channel.kick(client, target, comment)
+	channel.server.links.Kick(channel, client, target, comment)
+}
+
+// kick removes the target from the channel, without any checks.
+func (channel *Channel) kick(client *Client, target *Client, comment string) {
 	clientMask := client.NickMaskString()
 	targetNick := target.Nick()
 	for _, member := range channel.Members() {
@@ -819,11 +1202,27 @@ func (channel *Channel) Kick(client *Client, target *Client, comment string, rb
 	}
 
 	channel.Quit(target)
+
+	channel.history.Add(history.Item{
+		Type:        history.Kick,
+		Nick:        clientMask,
+		AccountName: client.AccountName(),
+		Msgid:       client.server.generateMessageID(),
+		Message:     comment,
+		Target:      targetNick,
+	})
 }
 
 // Invite invites the given client to the channel, if the inviter can do so.
+// Halfops can answer a pending KNOCK by inviting the client that knocked.
 func (channel *Channel) Invite(invitee *Client, inviter *Client, rb *ResponseBuffer) {
-	if channel.flags[modes.InviteOnly] && !channel.ClientIsAtLeast(inviter, modes.ChannelOperator) {
+	requiredMode := modes.ChannelOperator
+	knocked := channel.hasPendingKnock(invitee)
+	if knocked {
+		requiredMode = modes.Halfop
+	}
+
+	if channel.flags[modes.InviteOnly] && !channel.ClientIsAtLeast(inviter, requiredMode) {
 		rb.Add(nil, inviter.server.name, ERR_CHANOPRIVSNEEDED, channel.name, inviter.t("You're not a channel operator"))
 		return
 	}
@@ -837,7 +1236,7 @@ func (channel *Channel) Invite(invitee *Client, inviter *Client, rb *ResponseBuf
 	if channel.flags[modes.InviteOnly] {
 		nmc := invitee.NickCasefolded()
 		channel.stateMutex.Lock()
-		channel.lists[modes.InviteMask].Add(nmc)
+		channel.lists[modes.InviteMask].Add(ExpandUserHost(nmc))
 		channel.stateMutex.Unlock()
 	}
 
@@ -847,6 +1246,10 @@ func (channel *Channel) Invite(invitee *Client, inviter *Client, rb *ResponseBuf
 		}
 	}
 
+	if knocked {
+		channel.clearKnock(invitee)
+	}
+
 	//TODO(dan): should inviter.server.name here be inviter.nickMaskString ?
 	rb.Add(nil, inviter.server.name, RPL_INVITING, invitee.nick, channel.name)
 	invitee.Send(nil, inviter.nickMaskString, "INVITE", invitee.nick, channel.name)
@@ -45,13 +45,42 @@ func (cm *ChannelManager) Get(name string) *Channel {
 }
 
 // Join causes `client` to join the channel named `name`, creating it if necessary.
-func (cm *ChannelManager) Join(client *Client, name string, key string, rb *ResponseBuffer) error {
+func (cm *ChannelManager) Join(client *Client, name string, key string, isSajoin bool, rb *ResponseBuffer) error {
 	server := client.server
 	casefoldedName, err := CasefoldChannel(name)
 	if err != nil || len(casefoldedName) > server.Limits().ChannelLen {
 		return errNoSuchChannel
 	}
 
+	entry := cm.acquire(server, casefoldedName, name)
+
+	entry.channel.Join(client, key, isSajoin, rb)
+
+	cm.maybeCleanup(entry.channel, true)
+
+	return nil
+}
+
+// JoinRemote joins clients from another server to the channel named `name`,
+// creating it if necessary; `join` does the actual joining.
+func (cm *ChannelManager) JoinRemote(server *Server, name string, join func(*Channel)) error {
+	casefoldedName, err := CasefoldChannel(name)
+	if err != nil {
+		return errNoSuchChannel
+	}
+
+	entry := cm.acquire(server, casefoldedName, name)
+
+	join(entry.channel)
+
+	cm.maybeCleanup(entry.channel, true)
+
+	return nil
+}
+
+// acquire returns the entry for the given channel, creating it if necessary, and
+// counts a pending join against it. maybeCleanup must be called afterwards.
+func (cm *ChannelManager) acquire(server *Server, casefoldedName, name string) *channelManagerEntry {
 	cm.Lock()
 	entry := cm.chans[casefoldedName]
 	if entry == nil {
@@ -60,7 +89,7 @@ func (cm *ChannelManager) Join(client *Client, name string, key string, rb *Resp
 		// outside the lock initially on every join, so this is best thought of as an
 		// optimization to avoid that.
 		cm.Unlock()
-		info := client.server.channelRegistry.LoadChannel(casefoldedName)
+		info := server.channelRegistry.LoadChannel(casefoldedName)
 		cm.Lock()
 		entry = cm.chans[casefoldedName]
 		if entry == nil {
@@ -74,11 +103,7 @@ func (cm *ChannelManager) Join(client *Client, name string, key string, rb *Resp
 	entry.pendingJoins += 1
 	cm.Unlock()
 
-	entry.channel.Join(client, key, rb)
-
-	cm.maybeCleanup(entry.channel, true)
-
-	return nil
+	return entry
 }
 
 func (cm *ChannelManager) maybeCleanup(channel *Channel, afterJoin bool) {
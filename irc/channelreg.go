@@ -30,8 +30,10 @@ const (
 	keyChannelBanlist        = "channel.banlist %s"
 	keyChannelExceptlist     = "channel.exceptlist %s"
 	keyChannelInvitelist     = "channel.invitelist %s"
+	keyChannelQuietlist      = "channel.quietlist %s"
 	keyChannelPassword       = "channel.key %s"
 	keyChannelModes          = "channel.modes %s"
+	keyChannelFloodLimits    = "channel.floodlimits %s"
 	keyChannelAccountToUMode = "channel.accounttoumode %s"
 )
 
@@ -47,8 +49,10 @@ var (
 		keyChannelBanlist,
 		keyChannelExceptlist,
 		keyChannelInvitelist,
+		keyChannelQuietlist,
 		keyChannelPassword,
 		keyChannelModes,
+		keyChannelFloodLimits,
 		keyChannelAccountToUMode,
 	}
 )
@@ -85,6 +89,8 @@ type RegisteredChannel struct {
 	Modes []modes.Mode
 	// Key represents the channel key / password
 	Key string
+	// FloodLimits represents the channel's flood protection limits (+f)
+	FloodLimits string
 	// AccountToUMode maps user accounts to their persistent channel modes (e.g., +q, +h)
 	AccountToUMode map[string]modes.Mode
 	// Banlist represents the bans set on the channel.
@@ -93,6 +99,8 @@ type RegisteredChannel struct {
 	Exceptlist []string
 	// Invitelist represents the invite exceptions set on the channel.
 	Invitelist []string
+	// Quietlist represents the quiets set on the channel.
+	Quietlist []string
 }
 
 // ChannelRegistry manages registered channels.
@@ -162,9 +170,11 @@ func (reg *ChannelRegistry) LoadChannel(nameCasefolded string) (info *Registered
 		topicSetTimeInt, _ := strconv.ParseInt(topicSetTime, 10, 64)
 		password, _ := tx.Get(fmt.Sprintf(keyChannelPassword, channelKey))
 		modeString, _ := tx.Get(fmt.Sprintf(keyChannelModes, channelKey))
+		floodLimits, _ := tx.Get(fmt.Sprintf(keyChannelFloodLimits, channelKey))
 		banlistString, _ := tx.Get(fmt.Sprintf(keyChannelBanlist, channelKey))
 		exceptlistString, _ := tx.Get(fmt.Sprintf(keyChannelExceptlist, channelKey))
 		invitelistString, _ := tx.Get(fmt.Sprintf(keyChannelInvitelist, channelKey))
+		quietlistString, _ := tx.Get(fmt.Sprintf(keyChannelQuietlist, channelKey))
 		accountToUModeString, _ := tx.Get(fmt.Sprintf(keyChannelAccountToUMode, channelKey))
 
 		modeSlice := make([]modes.Mode, len(modeString))
@@ -178,6 +188,8 @@ func (reg *ChannelRegistry) LoadChannel(nameCasefolded string) (info *Registered
 		_ = json.Unmarshal([]byte(exceptlistString), &exceptlist)
 		var invitelist []string
 		_ = json.Unmarshal([]byte(invitelistString), &invitelist)
+		var quietlist []string
+		_ = json.Unmarshal([]byte(quietlistString), &quietlist)
 		accountToUMode := make(map[string]modes.Mode)
 		_ = json.Unmarshal([]byte(accountToUModeString), &accountToUMode)
 
@@ -189,10 +201,12 @@ func (reg *ChannelRegistry) LoadChannel(nameCasefolded string) (info *Registered
 			TopicSetBy:     topicSetBy,
 			TopicSetTime:   time.Unix(topicSetTimeInt, 0),
 			Key:            password,
+			FloodLimits:    floodLimits,
 			Modes:          modeSlice,
 			Banlist:        banlist,
 			Exceptlist:     exceptlist,
 			Invitelist:     invitelist,
+			Quietlist:      quietlist,
 			AccountToUMode: accountToUMode,
 		}
 		return nil
@@ -226,6 +240,21 @@ func (reg *ChannelRegistry) Rename(channel *Channel, casefoldedOldName string) {
 	})
 }
 
+// Delete removes a channel registration from the store.
+func (reg *ChannelRegistry) Delete(casefoldedName string, info RegisteredChannel) {
+	if !reg.server.ChannelRegistrationEnabled() {
+		return
+	}
+
+	reg.Lock()
+	defer reg.Unlock()
+
+	reg.server.store.Update(func(tx *buntdb.Tx) error {
+		reg.deleteChannel(tx, casefoldedName, info)
+		return nil
+	})
+}
+
 // delete a channel, unless it was overwritten by another registration of the same channel
 func (reg *ChannelRegistry) deleteChannel(tx *buntdb.Tx, key string, info RegisteredChannel) {
 	_, err := tx.Get(fmt.Sprintf(keyChannelExists, key))
@@ -266,6 +295,7 @@ func (reg *ChannelRegistry) saveChannel(tx *buntdb.Tx, channelKey string, channe
 			modeStrings[i] = string(mode)
 		}
 		tx.Set(fmt.Sprintf(keyChannelModes, channelKey), strings.Join(modeStrings, ""), nil)
+		tx.Set(fmt.Sprintf(keyChannelFloodLimits, channelKey), channelInfo.FloodLimits, nil)
 	}
 
 	if includeFlags&IncludeLists != 0 {
@@ -275,6 +305,8 @@ func (reg *ChannelRegistry) saveChannel(tx *buntdb.Tx, channelKey string, channe
 		tx.Set(fmt.Sprintf(keyChannelExceptlist, channelKey), string(exceptlistString), nil)
 		invitelistString, _ := json.Marshal(channelInfo.Invitelist)
 		tx.Set(fmt.Sprintf(keyChannelInvitelist, channelKey), string(invitelistString), nil)
+		quietlistString, _ := json.Marshal(channelInfo.Quietlist)
+		tx.Set(fmt.Sprintf(keyChannelQuietlist, channelKey), string(quietlistString), nil)
 		accountToUModeString, _ := json.Marshal(channelInfo.AccountToUMode)
 		tx.Set(fmt.Sprintf(keyChannelAccountToUMode, channelKey), string(accountToUModeString), nil)
 	}
@@ -4,8 +4,11 @@
 package irc
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/goshuirc/irc-go/ircfmt"
@@ -32,12 +35,42 @@ type csCommand struct {
 
 var (
 	chanservCommands = map[string]*csCommand{
+		"amode": {
+			handler: csAmodeHandler,
+			help: `Syntax: $bAMODE #channel [mode change] [account]$b
+
+AMODE lists or modifies persistent mode settings that affect channel members.
+For example, $bAMODE #channel +o dan$b grants the holder of the "dan"
+account the +o operator mode every time they join #channel, and
+$bAMODE #channel -o dan$b removes it. To list current accounts and modes,
+use $bAMODE #channel$b. Any account with a persistent mode can modify the
+list, but only for accounts and modes below its own: for example, channel
+operators can grant +h and +v, and only the founder can grant +a.`,
+			helpShort: `$bAMODE$b modifies persistent mode settings for channel members.`,
+		},
+		"drop": {
+			handler: csDropHandler,
+			help: `Syntax: $bDROP #channel$b
+
+DROP deletes the registration of the given channel. You can only use this
+command if you're the founder of the channel, or an IRC operator with the
+correct permissions.`,
+			helpShort: `$bDROP$b deletes a channel registration.`,
+		},
 		"help": {
 			help: `Syntax: $bHELP [command]$b
 
 HELP returns information on the given command.`,
 			helpShort: `$bHELP$b shows in-depth information about commands.`,
 		},
+		"info": {
+			handler: csInfoHandler,
+			help: `Syntax: $bINFO #channel$b
+
+INFO displays information about a registered channel, including its founder,
+when it was registered, and its persisted topic and modes.`,
+			helpShort: `$bINFO$b displays information about a registered channel.`,
+		},
 		"op": {
 			handler: csOpHandler,
 			help: `Syntax: $bOP #channel [nickname]$b
@@ -55,6 +88,25 @@ given admin privs on it. Modes set on the channel and the topic will also be
 remembered.`,
 			helpShort: `$bREGISTER$b lets you own a given channel.`,
 		},
+		"transfer": {
+			handler: csTransferHandler,
+			help: `Syntax: $bTRANSFER #channel <account> [code]$b
+
+TRANSFER makes the given account the founder of the channel. You can only use
+this command if you're the founder of the channel, or an IRC operator with the
+correct permissions. Since transfers can't be undone without the cooperation
+of the new founder, you'll be asked to confirm the transfer with a code.`,
+			helpShort: `$bTRANSFER$b makes another account the founder of a channel.`,
+		},
+		"unregister": {
+			handler: csDropHandler,
+			help: `Syntax: $bUNREGISTER #channel$b
+
+UNREGISTER deletes the registration of the given channel. You can only use this
+command if you're the founder of the channel, or an IRC operator with the
+correct permissions.`,
+			helpShort: `$bUNREGISTER$b deletes a channel registration.`,
+		},
 	}
 )
 
@@ -148,6 +200,115 @@ func csHelpHandler(server *Server, client *Client, command, params string, rb *R
 	csNotice(rb, ircfmt.Unescape(client.t("*** $bEnd of ChanServ HELP$b ***")))
 }
 
+func csAmodeHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
+	channelName, params := utils.ExtractParam(params)
+	modeChange, params := utils.ExtractParam(params)
+	accountName, _ := utils.ExtractParam(params)
+
+	if channelName == "" {
+		csNotice(rb, ircfmt.Unescape(client.t("Syntax: $bAMODE #channel [mode change] [account]$b")))
+		return
+	}
+
+	channel := server.channels.Get(channelName)
+	if channel == nil {
+		csNotice(rb, client.t("Channel does not exist"))
+		return
+	} else if channel.Founder() == "" {
+		csNotice(rb, client.t("Channel is not registered"))
+		return
+	}
+
+	clientAccount := client.Account()
+	if clientAccount == "" {
+		csNotice(rb, client.t("You must be logged in to use AMODE"))
+		return
+	}
+
+	accountToUMode := channel.AccountToUMode()
+	if modeChange == "" {
+		// only accounts with some level of access can see the list
+		if _, hasAccess := accountToUMode[clientAccount]; !hasAccess {
+			csNotice(rb, client.t("Insufficient privileges"))
+			return
+		}
+		var accounts sort.StringSlice
+		for account := range accountToUMode {
+			accounts = append(accounts, account)
+		}
+		sort.Sort(accounts)
+		csNotice(rb, fmt.Sprintf(client.t("Channel %s has %d persistent modes set"), channel.Name(), len(accounts)))
+		for _, account := range accounts {
+			csNotice(rb, fmt.Sprintf(client.t("Account %[1]s receives mode +%[2]s"), account, string(accountToUMode[account])))
+		}
+		return
+	}
+
+	if accountName == "" || len(modeChange) != 2 || (modeChange[0] != '+' && modeChange[0] != '-') {
+		csNotice(rb, ircfmt.Unescape(client.t("Syntax: $bAMODE #channel [mode change] [account]$b")))
+		return
+	}
+
+	change := modes.ModeChange{
+		Op:   modes.ModeOp(modeChange[0]),
+		Mode: modes.Mode(modeChange[1]),
+	}
+	if umodeRank(change.Mode) == 0 {
+		csNotice(rb, fmt.Sprintf(client.t("Invalid mode: %s"), string(change.Mode)))
+		return
+	}
+
+	var err error
+
+	// entries for accounts that no longer exist can still be removed
+	change.Arg, err = CasefoldName(accountName)
+	if err == nil && change.Op == modes.Add {
+		_, err = server.accounts.LoadAccount(accountName)
+	}
+	if err != nil {
+		csNotice(rb, client.t("Account does not exist"))
+		return
+	}
+
+	applied, err := channel.ProcessAccountToUmodeChange(client, change)
+	if err == errInsufficientPrivs {
+		csNotice(rb, client.t("Insufficient privileges"))
+		return
+	} else if err != nil {
+		csNotice(rb, client.t("Internal error"))
+		return
+	} else if applied == nil {
+		csNotice(rb, client.t("No changes were made"))
+		return
+	}
+
+	go server.channelRegistry.StoreChannel(channel, IncludeLists)
+
+	csNotice(rb, fmt.Sprintf(client.t("Successfully set mode %[1]s for account %[2]s in channel %[3]s"), modeChange, accountName, channel.Name()))
+	server.logger.Info("chanserv", fmt.Sprintf("Client %s set amode %s for account %s in channel %s", client.Nick(), modeChange, accountName, channel.Name()))
+	server.snomasks.Send(sno.LocalChannels, fmt.Sprintf(ircfmt.Unescape("Client $c[grey][$r%s$c[grey]] CS AMODE'd $c[grey][$r%s %s$c[grey]] in channel $c[grey][$r%s$c[grey]]"), client.NickMaskString(), modeChange, accountName, channel.Name()))
+
+	// apply the changes to members who are currently logged into the account
+	for _, member := range channel.Members() {
+		if member.Account() != change.Arg {
+			continue
+		}
+		var memberChanges modes.ModeChanges
+		for _, appliedChange := range applied {
+			memberChange := channel.applyModeMemberNoMutex(client, appliedChange.Mode, appliedChange.Op, member.NickCasefolded(), rb)
+			if memberChange != nil {
+				memberChanges = append(memberChanges, *memberChange)
+			}
+		}
+		if len(memberChanges) != 0 {
+			args := append([]string{channel.Name()}, strings.Split(memberChanges.String(), " ")...)
+			for _, target := range channel.Members() {
+				target.Send(nil, fmt.Sprintf("ChanServ!services@%s", client.server.name), "MODE", args...)
+			}
+		}
+	}
+}
+
 func csOpHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
 	channelName, clientToOp := utils.ExtractParam(params)
 
@@ -270,3 +431,158 @@ func csRegisterHandler(server *Server, client *Client, command, params string, r
 		}
 	}
 }
+
+// csGetRegisteredChannel returns the channel named `channelName` if it's registered and
+// `client` is allowed to administer its registration, sending an error notice otherwise.
+func csGetRegisteredChannel(server *Server, client *Client, channelName string, rb *ResponseBuffer) (channel *Channel, info RegisteredChannel) {
+	channel = server.channels.Get(channelName)
+	if channel == nil {
+		csNotice(rb, client.t("Channel does not exist"))
+		return nil, info
+	}
+
+	info = channel.ExportRegistration(0)
+	if info.Founder == "" {
+		csNotice(rb, client.t("Channel is not registered"))
+		return nil, info
+	}
+
+	if client.Account() != info.Founder && !client.HasRoleCapabs("chanreg") {
+		csNotice(rb, client.t("Insufficient privileges"))
+		return nil, info
+	}
+	return
+}
+
+func csDropHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
+	channelName, _ := utils.ExtractParam(params)
+	if channelName == "" {
+		csNotice(rb, ircfmt.Unescape(fmt.Sprintf(client.t("Syntax: $b%s #channel$b"), strings.ToUpper(command))))
+		return
+	}
+
+	channel, info := csGetRegisteredChannel(server, client, channelName, rb)
+	if channel == nil {
+		return
+	}
+
+	channel.SetUnregistered()
+	server.channelRegistry.Delete(channel.NameCasefolded(), info)
+	// empty channels are only kept around while they're registered
+	server.channels.Cleanup(channel)
+
+	csNotice(rb, fmt.Sprintf(client.t("Channel %s is now unregistered"), info.Name))
+
+	server.logger.Info("chanserv", fmt.Sprintf("Client %s unregistered channel %s", client.Nick(), info.Name))
+	server.snomasks.Send(sno.LocalChannels, fmt.Sprintf(ircfmt.Unescape("Channel unregistered $c[grey][$r%s$c[grey]] by $c[grey][$r%s$c[grey]]"), info.Name, client.NickMaskString()))
+}
+
+// transferConfirmationCode returns the code needed to confirm the transfer of a channel
+// registration; it changes whenever the channel is reregistered or transferred again.
+func transferConfirmationCode(info RegisteredChannel, newFounder string) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{info.Name, info.Founder, newFounder, strconv.FormatInt(info.RegisteredAt.Unix(), 10)}, "\x00")))
+	return hex.EncodeToString(hash[:])[:8]
+}
+
+func csTransferHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
+	channelName, params := utils.ExtractParam(params)
+	accountName, params := utils.ExtractParam(params)
+	code, _ := utils.ExtractParam(params)
+
+	if channelName == "" || accountName == "" {
+		csNotice(rb, ircfmt.Unescape(client.t("Syntax: $bTRANSFER #channel <account> [code]$b")))
+		return
+	}
+
+	channel, info := csGetRegisteredChannel(server, client, channelName, rb)
+	if channel == nil {
+		return
+	}
+
+	account, err := server.accounts.LoadAccount(accountName)
+	if err != nil || !account.Verified {
+		csNotice(rb, client.t("Account does not exist"))
+		return
+	}
+	newFounder, _ := CasefoldName(account.Name)
+	if newFounder == info.Founder {
+		csNotice(rb, client.t("That account is already the founder of the channel"))
+		return
+	}
+
+	expectedCode := transferConfirmationCode(info, newFounder)
+	if code != expectedCode {
+		if code != "" {
+			csNotice(rb, client.t("Invalid confirmation code"))
+		}
+		csNotice(rb, fmt.Sprintf(client.t("To confirm the transfer of channel %[1]s to account %[2]s, type: /CS TRANSFER %[1]s %[2]s %[3]s"), info.Name, account.Name, expectedCode))
+		return
+	}
+
+	err = channel.Transfer(info.Founder, newFounder)
+	if err != nil {
+		csNotice(rb, client.t(err.Error()))
+		return
+	}
+	go server.channelRegistry.StoreChannel(channel, IncludeInitial|IncludeLists)
+
+	// move the founder privileges over to the new founder right away
+	for _, member := range channel.Members() {
+		switch member.Account() {
+		case info.Founder:
+			change := channel.applyModeMemberNoMutex(client, modes.ChannelFounder, modes.Remove, member.NickCasefolded(), rb)
+			if change != nil {
+				args := append([]string{channel.Name()}, strings.Split(change.String(), " ")...)
+				for _, target := range channel.Members() {
+					target.Send(nil, server.name, "MODE", args...)
+				}
+			}
+		case newFounder:
+			channel.applyAccountUMode(member)
+		}
+	}
+
+	csNotice(rb, fmt.Sprintf(client.t("Channel %[1]s was transferred to account %[2]s"), info.Name, account.Name))
+
+	server.logger.Info("chanserv", fmt.Sprintf("Client %s transferred channel %s from %s to %s", client.Nick(), info.Name, info.Founder, newFounder))
+	server.snomasks.Send(sno.LocalChannels, fmt.Sprintf(ircfmt.Unescape("Channel $c[grey][$r%s$c[grey]] transferred to $c[grey][$r%s$c[grey]] by $c[grey][$r%s$c[grey]]"), info.Name, account.Name, client.NickMaskString()))
+}
+
+func csInfoHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
+	channelName, _ := utils.ExtractParam(params)
+	if channelName == "" {
+		csNotice(rb, ircfmt.Unescape(client.t("Syntax: $bINFO #channel$b")))
+		return
+	}
+
+	channelKey, err := CasefoldChannel(channelName)
+	if err != nil {
+		csNotice(rb, client.t("Channel name is not valid"))
+		return
+	}
+
+	info := server.channelRegistry.LoadChannel(channelKey)
+	if info == nil {
+		csNotice(rb, fmt.Sprintf(client.t("Channel %s is not registered"), channelName))
+		return
+	}
+
+	csNotice(rb, fmt.Sprintf(client.t("Channel: %s"), info.Name))
+	csNotice(rb, fmt.Sprintf(client.t("Founder: %s"), info.Founder))
+	csNotice(rb, fmt.Sprintf(client.t("Registered at: %s"), info.RegisteredAt.Format("Jan 02, 2006 15:04:05Z")))
+	if info.Topic != "" {
+		csNotice(rb, fmt.Sprintf(client.t("Topic: %s"), info.Topic))
+		csNotice(rb, fmt.Sprintf(client.t("Topic set by %[1]s at %[2]s"), info.TopicSetBy, info.TopicSetTime.Format("Jan 02, 2006 15:04:05Z")))
+	}
+	if 0 < len(info.Modes) || info.Key != "" {
+		modeString := "+"
+		for _, mode := range info.Modes {
+			modeString += string(mode)
+		}
+		// don't leak the key itself
+		if info.Key != "" {
+			modeString += modes.Key.String()
+		}
+		csNotice(rb, fmt.Sprintf(client.t("Modes: %s"), modeString))
+	}
+}
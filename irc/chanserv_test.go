@@ -0,0 +1,136 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/oragono/oragono/irc/modes"
+)
+
+// newChanServTestServer starts a server with channel registration enabled, and
+// returns a client logged into the "alice" account who has registered #test.
+func newChanServTestServer(t *testing.T) (*Server, func(), *testClient) {
+	server, shutdown := newTestServer(t, func(config *Config) {
+		config.Channels.Registration.Enabled = true
+	})
+	alice := openTestClient(server)
+	alice.registerAccount(t, server, "alice", "alicepass")
+	alice.register(t, "alice")
+	alice.send("JOIN #test")
+	alice.expect(t, " 366 ")
+	alice.send("PRIVMSG ChanServ :REGISTER #test")
+	alice.expect(t, "ChanServ", "registered")
+	return server, shutdown, alice
+}
+
+func newAccountTestClient(t *testing.T, server *Server, nick string) *testClient {
+	tc := openTestClient(server)
+	tc.registerAccount(t, server, nick, nick+"pass")
+	tc.register(t, nick)
+	return tc
+}
+
+func TestChanServAmode(t *testing.T) {
+	server, shutdown, alice := newChanServTestServer(t)
+	defer shutdown()
+
+	bob := newAccountTestClient(t, server, "bob")
+	bob.send("JOIN #test")
+	bob.expect(t, " 366 ")
+	newAccountTestClient(t, server, "carol")
+
+	alice.send("PRIVMSG ChanServ :AMODE #test +v bob")
+	alice.expect(t, "ChanServ", "Successfully set mode +v")
+	bob.expect(t, "MODE #test +v bob")
+
+	// replacing the mode takes the old one away from members
+	alice.send("PRIVMSG ChanServ :AMODE #test +o bob")
+	alice.expect(t, "ChanServ", "Successfully set mode +o")
+	bob.expect(t, "MODE #test -v+o bob bob")
+	channel := server.channels.Get("#test")
+	if amodes := channel.AccountToUMode(); amodes["bob"] != modes.ChannelOperator {
+		t.Errorf("expected bob to have +o, got %v", amodes)
+	}
+	if !channel.members.HasMode(bob.client, modes.ChannelOperator) || channel.members.HasMode(bob.client, modes.Voice) {
+		t.Errorf("bob should be an operator without voice")
+	}
+
+	// operators can only grant and change modes below their own
+	for _, command := range []string{"AMODE #test +o carol", "AMODE #test +a carol", "AMODE #test -q alice"} {
+		bob.send("PRIVMSG ChanServ :" + command)
+		bob.expect(t, "ChanServ", "Insufficient privileges")
+	}
+	bob.send("PRIVMSG ChanServ :AMODE #test +h carol")
+	bob.expect(t, "ChanServ", "Successfully set mode +h")
+	bob.send("PRIVMSG ChanServ :AMODE #test -h carol")
+	bob.expect(t, "ChanServ", "Successfully set mode -h")
+	if _, exists := channel.AccountToUMode()["carol"]; exists {
+		t.Errorf("carol's mode should have been removed")
+	}
+
+	// accounts without a persistent mode can't see or change the list
+	dave := newAccountTestClient(t, server, "dave")
+	dave.send("PRIVMSG ChanServ :AMODE #test")
+	dave.expect(t, "ChanServ", "Insufficient privileges")
+	dave.send("PRIVMSG ChanServ :AMODE #test +v dave")
+	dave.expect(t, "ChanServ", "Insufficient privileges")
+}
+
+func TestChanServTransferAndDrop(t *testing.T) {
+	server, shutdown, alice := newChanServTestServer(t)
+	defer shutdown()
+
+	founderIs := func(founder string) func() bool {
+		return func() bool {
+			info := server.channelRegistry.LoadChannel("#test")
+			return info != nil && info.Founder == founder
+		}
+	}
+	waitFor(t, "the channel to be stored", founderIs("alice"))
+
+	bob := newAccountTestClient(t, server, "bob")
+	bob.send("JOIN #test")
+	bob.expect(t, " 366 ")
+	bob.send("PRIVMSG ChanServ :INFO #test")
+	bob.expect(t, "ChanServ", "Channel: #test")
+	bob.expect(t, "ChanServ", "Founder: alice")
+
+	// only the founder can transfer or drop the channel
+	bob.send("PRIVMSG ChanServ :TRANSFER #test bob")
+	bob.expect(t, "ChanServ", "Insufficient privileges")
+	bob.send("PRIVMSG ChanServ :DROP #test")
+	bob.expect(t, "ChanServ", "Insufficient privileges")
+
+	// transfers have to be confirmed with a code
+	alice.send("PRIVMSG ChanServ :TRANSFER #test bob")
+	line := alice.expect(t, "ChanServ", "To confirm")
+	code := line[strings.LastIndex(line, " ")+1:]
+	alice.send("PRIVMSG ChanServ :TRANSFER #test bob 00000000")
+	alice.expect(t, "ChanServ", "Invalid confirmation code")
+	alice.send("PRIVMSG ChanServ :TRANSFER #test bob " + code)
+
+	// the founder mode moves with the channel
+	alice.expect(t, "MODE #test +q bob")
+	alice.expect(t, "ChanServ", "was transferred to account bob")
+	bob.expect(t, "MODE #test -q alice")
+	channel := server.channels.Get("#test")
+	if channel.members.HasMode(alice.client, modes.ChannelFounder) || !channel.members.HasMode(bob.client, modes.ChannelFounder) {
+		t.Errorf("founder mode wasn't moved to bob")
+	}
+	waitFor(t, "the transfer to be stored", founderIs("bob"))
+	alice.send("PRIVMSG ChanServ :INFO #test")
+	alice.expect(t, "ChanServ", "Founder: bob")
+
+	alice.send("PRIVMSG ChanServ :DROP #test")
+	alice.expect(t, "ChanServ", "Insufficient privileges")
+	bob.send("PRIVMSG ChanServ :DROP #test")
+	bob.expect(t, "ChanServ", "is now unregistered")
+	if channel.IsRegistered() || server.channelRegistry.LoadChannel("#test") != nil {
+		t.Errorf("channel is still registered")
+	}
+	bob.send("PRIVMSG ChanServ :INFO #test")
+	bob.expect(t, "ChanServ", "is not registered")
+}
@@ -20,7 +20,10 @@ import (
 	"github.com/goshuirc/irc-go/ircmsg"
 	ident "github.com/oragono/go-ident"
 	"github.com/oragono/oragono/irc/caps"
+	"github.com/oragono/oragono/irc/dnsbl"
+	"github.com/oragono/oragono/irc/history"
 	"github.com/oragono/oragono/irc/modes"
+	"github.com/oragono/oragono/irc/passwd"
 	"github.com/oragono/oragono/irc/sno"
 	"github.com/oragono/oragono/irc/utils"
 )
@@ -37,9 +40,13 @@ var (
 // Client is an IRC client.
 type Client struct {
 	account            string
+	accepted           map[string]bool
+	accountCloak       string // cloak of the account the client is logged into
 	accountName        string
+	alwaysOn           bool // the client stays on the server without connections, see alwayson.go
 	atime              time.Time
 	authorized         bool
+	autoAway           bool // the client was marked away because it has no connections
 	awayMessage        string
 	capabilities       *caps.Set
 	capState           caps.State
@@ -47,7 +54,10 @@ type Client struct {
 	certfp             string
 	channels           ChannelSet
 	class              *OperClass
+	cloakedHostname    string // cloak of the hostname or IP the client connected from
+	connectionClosed   bool   // the client's own connection has closed, see sessions.go
 	ctime              time.Time
+	dnsblListing       dnsbl.Result // the DNSBL listing of the client's IP, if any
 	exitedSnomaskSent  bool
 	fakelag            *Fakelag
 	flags              map[modes.Mode]bool
@@ -58,40 +68,56 @@ type Client struct {
 	isDestroyed        bool
 	isQuitting         bool
 	languages          []string
+	lastBroadcast      time.Time
+	lastCallerIDNotify time.Time
+	lastKnock          time.Time
+	link               *ServerLink // for remote clients, the link they're reached through
 	maxlenTags         uint32
 	maxlenRest         uint32
 	nick               string
 	nickCasefolded     string
 	nickMaskCasefolded string
-	nickMaskString     string // cache for nickmask string since it's used with lots of replies
+	nickMaskString     string    // cache for nickmask string since it's used with lots of replies
+	nickTime           time.Time // when the nick was set, for resolving collisions
 	nickTimer          *NickTimer
 	operName           string
 	preregNick         string
-	proxiedIP          net.IP // actual remote IP if using the PROXY protocol
+	primary            *Client // for sessions, the client they're attached to
+	proxiedIP          net.IP  // actual remote IP if using the PROXY protocol
 	quitMessage        string
 	rawHostname        string
 	realname           string
 	registered         bool
+	remoteServer       string              // for remote clients, the server they're connected to
+	replay             []ircmsg.IrcMessage // lines sent to an always-on client while it had no connections
+	replayTruncated    bool
 	resumeDetails      *ResumeDetails
 	saslInProgress     bool
 	saslMechanism      string
+	saslScram          *passwd.ScramConversation // state of a multi-step SCRAM exchange
 	saslValue          string
 	server             *Server
+	sessions           []*Client // other connections attached to this client
+	silence            *UserMaskSet
 	socket             *Socket
 	stateMutex         sync.RWMutex // tier 1
+	uid                string       // network-unique ID, used over server links
 	username           string
 	vhost              string
+	vhostFromAccount   bool // whether vhost is the one approved for the client's account
 	whoisLine          string
 }
 
 // NewClient returns a client with all the appropriate info setup.
-func NewClient(server *Server, conn net.Conn, isTLS bool) *Client {
+func NewClient(server *Server, conn net.Conn, isTLS bool, listing dnsbl.Result) *Client {
 	now := time.Now()
 	limits := server.Limits()
 	fullLineLenLimit := limits.LineLen.Tags + limits.LineLen.Rest
 	socket := NewSocket(conn, fullLineLenLimit*2, server.MaxSendQBytes())
 	go socket.RunSocketWriter()
+	server.metrics.ConnectionOpened()
 	client := &Client{
+		accepted:       make(map[string]bool),
 		atime:          now,
 		authorized:     server.Password() == nil,
 		capabilities:   caps.NewSet(),
@@ -99,9 +125,12 @@ func NewClient(server *Server, conn net.Conn, isTLS bool) *Client {
 		capVersion:     caps.Cap301,
 		channels:       make(ChannelSet),
 		ctime:          now,
+		dnsblListing:   listing,
 		flags:          make(map[modes.Mode]bool),
 		server:         server,
+		silence:        NewUserMaskSet(),
 		socket:         &socket,
+		uid:            server.links.newUID(),
 		nick:           "*", // * is used until actual nick is given
 		nickCasefolded: "*",
 		nickMaskString: "*", // * is used until actual nick is given
@@ -115,7 +144,9 @@ func NewClient(server *Server, conn net.Conn, isTLS bool) *Client {
 		// error is not useful to us here anyways so we can ignore it
 		client.certfp, _ = client.socket.CertFP()
 	}
-	if server.checkIdent && !utils.AddrIsUnix(conn.RemoteAddr()) {
+	// ident doesn't make sense for websockets, which may come through a proxy
+	_, isWebSocket := conn.(*wsConn)
+	if server.checkIdent && !isWebSocket && !utils.AddrIsUnix(conn.RemoteAddr()) {
 		_, serverPortString, err := net.SplitHostPort(conn.LocalAddr().String())
 		serverPort, _ := strconv.Atoi(serverPortString)
 		if err != nil {
@@ -236,7 +267,7 @@ func (client *Client) run() {
 			}
 		}
 		// ensure client connection gets closed
-		client.destroy(false)
+		client.closeConnection()
 	}()
 
 	client.idletimer = NewIdleTimer(client)
@@ -249,6 +280,7 @@ func (client *Client) run() {
 	// Set the hostname for this client
 	// (may be overridden by a later PROXY command from stunnel)
 	client.rawHostname = utils.AddrLookupHostname(client.socket.conn.RemoteAddr())
+	client.updateCloaks()
 
 	for {
 		maxlenTags, maxlenRest := client.recomputeMaxlens()
@@ -276,9 +308,9 @@ func (client *Client) run() {
 		cmd, exists := Commands[msg.Command]
 		if !exists {
 			if len(msg.Command) > 0 {
-				client.Send(nil, client.server.name, ERR_UNKNOWNCOMMAND, client.nick, msg.Command, client.t("Unknown command"))
+				client.sendToConnection(nil, client.server.name, ERR_UNKNOWNCOMMAND, client.nick, msg.Command, client.t("Unknown command"))
 			} else {
-				client.Send(nil, client.server.name, ERR_UNKNOWNCOMMAND, client.nick, "lastcmd", client.t("No command given"))
+				client.sendToConnection(nil, client.server.name, ERR_UNKNOWNCOMMAND, client.nick, "lastcmd", client.t("No command given"))
 			}
 			continue
 		}
@@ -309,7 +341,7 @@ func (client *Client) Touch() {
 
 // Ping sends the client a PING message.
 func (client *Client) Ping() {
-	client.Send(nil, "", "PING", client.nick)
+	client.sendToConnection(nil, "", "PING", client.nick)
 
 }
 
@@ -354,7 +386,7 @@ func (client *Client) TryResume() {
 	timestamp := client.resumeDetails.Timestamp
 	var timestampString string
 	if timestamp != nil {
-		timestampString = timestamp.UTC().Format("2006-01-02T15:04:05.999Z")
+		timestampString = timestamp.UTC().Format(IRCv3TimestampFormat)
 	}
 
 	// can't use server.clients.Get since we hold server.clients' tier 1 mutex
@@ -365,7 +397,7 @@ func (client *Client) TryResume() {
 	}
 
 	oldClient := server.clients.byNick[casefoldedName]
-	if oldClient == nil {
+	if oldClient == nil || oldClient.IsRemote() {
 		client.Send(nil, server.name, ERR_CANNOT_RESUME, oldnick, client.t("Cannot resume connection, old client not found"))
 		return
 	}
@@ -408,6 +440,8 @@ func (client *Client) TryResume() {
 
 	// apply old client's details to new client
 	client.nick = oldClient.nick
+	// take over the old client's place on the rest of the network
+	client.uid = oldClient.uid
 	client.updateNickMaskNoMutex()
 
 	for channel := range oldClient.channels {
@@ -438,7 +472,7 @@ func (client *Client) TryResume() {
 			}
 
 			if member.capabilities.Has(caps.ExtendedJoin) {
-				member.Send(nil, client.nickMaskString, "JOIN", channel.name, client.AccountName(), client.realname)
+				member.Send(nil, client.nickMaskString, "JOIN", channel.name, client.AccountName(), client.Realname())
 			} else {
 				member.Send(nil, client.nickMaskString, "JOIN", channel.name)
 			}
@@ -503,6 +537,18 @@ func (client *Client) HasRoleCapabs(capabs ...string) bool {
 	return true
 }
 
+// canSeeRealHost returns true if the client can see the real hostnames and IPs of
+// other clients. If cloaking is enabled, opers need the oper:realhost capability.
+func (client *Client) canSeeRealHost() bool {
+	if !client.flags[modes.Operator] {
+		return false
+	}
+	if config := client.server.CloakConfig(); config != nil && config.Enabled {
+		return client.HasRoleCapabs("oper:realhost")
+	}
+	return true
+}
+
 // ModeString returns the mode string for this client.
 func (client *Client) ModeString() (str string) {
 	str = "+"
@@ -558,9 +604,140 @@ func (client *Client) updateNick(nick string) {
 	client.stateMutex.Lock()
 	client.nick = nick
 	client.nickCasefolded = casefoldedName
+	client.nickTime = time.Now()
 	client.stateMutex.Unlock()
 }
 
+// setVHost changes the client's vhost (or clears it, if vhost is empty),
+// notifying friends with the chghost capability.
+func (client *Client) setVHost(vhost string) {
+	client.stateMutex.Lock()
+	client.vhostFromAccount = false
+	accountCloak, cloakedHostname := client.accountCloak, client.cloakedHostname
+	client.stateMutex.Unlock()
+	client.setHostnames(vhost, accountCloak, cloakedHostname)
+}
+
+// setAccountVHost changes the client's vhost to the one approved for its account.
+// if vhost is empty, the client's vhost is only cleared if it came from the account,
+// so that vhosts set by opers are left alone.
+func (client *Client) setAccountVHost(vhost string) {
+	client.stateMutex.Lock()
+	if vhost == "" && !client.vhostFromAccount {
+		client.stateMutex.Unlock()
+		return
+	}
+	client.vhostFromAccount = vhost != ""
+	accountCloak, cloakedHostname := client.accountCloak, client.cloakedHostname
+	client.stateMutex.Unlock()
+	client.setHostnames(vhost, accountCloak, cloakedHostname)
+}
+
+// clearAccountVHost removes the client's vhost if it came from the account the
+// client is logging out of, and recomputes its cloaks in the same step.
+func (client *Client) clearAccountVHost() {
+	client.stateMutex.Lock()
+	if client.vhostFromAccount {
+		client.vhost = ""
+		client.vhostFromAccount = false
+	}
+	client.stateMutex.Unlock()
+	client.updateCloaks()
+}
+
+// updateCloaks recomputes the client's cloaks, after its hostname or account changes.
+func (client *Client) updateCloaks() {
+	client.stateMutex.RLock()
+	vhost := client.vhost
+	rawHostname := client.rawHostname
+	accountName := client.accountName
+	client.stateMutex.RUnlock()
+
+	var accountCloak, cloakedHostname string
+	if config := client.server.CloakConfig(); config != nil && config.Enabled {
+		cloakedHostname = config.ComputeCloak(client.IP(), rawHostname)
+		if accountName != "" {
+			accountCloak = config.ComputeAccountCloak(accountName)
+		}
+	}
+	client.setHostnames(vhost, accountCloak, cloakedHostname)
+}
+
+// setHostnames changes the client's vhost and cloaks, notifying friends with the
+// chghost capability if the hostname they see changes.
+func (client *Client) setHostnames(vhost, accountCloak, cloakedHostname string) {
+	client.stateMutex.RLock()
+	username := client.username
+	oldHostname := client.hostname
+	newHostname := visibleHostname(vhost, accountCloak, cloakedHostname, client.rawHostname)
+	client.stateMutex.RUnlock()
+
+	// CHGHOST requires prefix nickmask to have original hostname, so do that before updating nickmask
+	if oldHostname != newHostname {
+		for fClient := range client.Friends(caps.ChgHost) {
+			fClient.SendFromClient("", client, nil, "CHGHOST", username, newHostname)
+		}
+	}
+
+	client.stateMutex.Lock()
+	client.vhost = vhost
+	client.accountCloak = accountCloak
+	client.cloakedHostname = cloakedHostname
+	client.updateNickMaskNoMutex()
+	client.stateMutex.Unlock()
+}
+
+// visibleHostname returns the hostname that's shown to other clients: the vhost,
+// then the account cloak, then the hostname cloak, then the real hostname.
+func visibleHostname(vhost, accountCloak, cloakedHostname, rawHostname string) string {
+	for _, hostname := range []string{vhost, accountCloak, cloakedHostname} {
+		if hostname != "" {
+			return hostname
+		}
+	}
+	return rawHostname
+}
+
+// setUsername changes the client's username, notifying friends with the
+// chghost capability.
+func (client *Client) setUsername(username string) {
+	client.stateMutex.RLock()
+	oldUsername := client.username
+	hostname := client.hostname
+	client.stateMutex.RUnlock()
+
+	if oldUsername == username {
+		return
+	}
+
+	// CHGHOST requires prefix nickmask to have original username, so do that before updating nickmask
+	for fClient := range client.Friends(caps.ChgHost) {
+		fClient.SendFromClient("", client, nil, "CHGHOST", username, hostname)
+	}
+
+	client.stateMutex.Lock()
+	client.username = username
+	client.updateNickMaskNoMutex()
+	client.stateMutex.Unlock()
+}
+
+// setRealname changes the client's realname, notifying friends with the
+// setname capability. If rb is given, the client's own notification is
+// added to it.
+func (client *Client) setRealname(realname string, rb *ResponseBuffer) {
+	client.stateMutex.Lock()
+	client.realname = realname
+	client.stateMutex.Unlock()
+
+	for fClient := range client.Friends(caps.SetName) {
+		if fClient == client && rb != nil {
+			rb.AddFromClient("", client, nil, "SETNAME", realname)
+		} else {
+			fClient.SendFromClient("", client, nil, "SETNAME", realname)
+		}
+	}
+}
+
 // updateNickMask updates the casefolded nickname and nickmask.
 func (client *Client) updateNickMask(nick string) {
 	// on "", just regenerate the nickmask etc.
@@ -576,11 +753,7 @@ func (client *Client) updateNickMask(nick string) {
 
 // updateNickMask updates the casefolded nickname and nickmask, not holding any mutexes.
 func (client *Client) updateNickMaskNoMutex() {
-	if len(client.vhost) > 0 {
-		client.hostname = client.vhost
-	} else {
-		client.hostname = client.rawHostname
-	}
+	client.hostname = visibleHostname(client.vhost, client.accountCloak, client.cloakedHostname, client.rawHostname)
 
 	nickMaskString := fmt.Sprintf("%s!%s@%s", client.nick, client.username, client.hostname)
 	nickMaskCasefolded, err := Casefold(nickMaskString)
@@ -606,6 +779,16 @@ func (client *Client) AllNickmasks() []string {
 		}
 	}
 
+	// K-Lines on either cloak still apply to a client with the other one
+	for _, cloak := range []string{client.accountCloak, client.cloakedHostname} {
+		if len(cloak) > 0 {
+			mask, err = Casefold(fmt.Sprintf("%s!%s@%s", client.nick, client.username, cloak))
+			if err == nil {
+				masks = append(masks, mask)
+			}
+		}
+	}
+
 	mask, err = Casefold(fmt.Sprintf("%s!%s@%s", client.nick, client.username, client.rawHostname))
 	if err == nil {
 		masks = append(masks, mask)
@@ -654,11 +837,19 @@ func (client *Client) Quit(message string) {
 	errorMsg := ircmsg.MakeMessage(nil, "", "ERROR", message)
 	errorLine, _ := errorMsg.Line()
 
-	client.socket.SetFinalData(quitLine + errorLine)
+	if client.socket != nil {
+		client.socket.SetFinalData(quitLine + errorLine)
+	}
 }
 
 // destroy gets rid of a client, removes them from server lists etc.
 func (client *Client) destroy(beingResumed bool) {
+	// sessions only have their own connection to clean up
+	if client.Primary() != nil {
+		client.closeConnection()
+		return
+	}
+
 	// allow destroy() to execute at most once
 	if !beingResumed {
 		client.stateMutex.Lock()
@@ -680,6 +871,10 @@ func (client *Client) destroy(beingResumed bool) {
 
 	// send quit/error message to client if they haven't been sent already
 	client.Quit("Connection closed")
+	for _, session := range client.detachSessions() {
+		session.Quit(client.quitMessage)
+		session.releaseConnection()
+	}
 
 	friends := client.Friends()
 	friends.Remove(client)
@@ -687,13 +882,6 @@ func (client *Client) destroy(beingResumed bool) {
 		client.server.whoWas.Append(client)
 	}
 
-	// remove from connection limits
-	ipaddr := client.IP()
-	// this check shouldn't be required but eh
-	if ipaddr != nil {
-		client.server.connectionLimiter.RemoveClient(ipaddr)
-	}
-
 	// alert monitors
 	client.server.monitorManager.AlertAbout(client, false)
 	// clean up monitor state
@@ -713,14 +901,23 @@ func (client *Client) destroy(beingResumed bool) {
 	if !beingResumed {
 		client.server.clients.Remove(client)
 	}
+	// clients on other servers are announced by their own server, and a
+	// resumed client keeps its place on the network
+	if !client.IsRemote() && !beingResumed {
+		client.server.links.Quit(client, client.quitMessage)
+	}
 
 	// clean up self
-	client.idletimer.Stop()
+	if !client.IsRemote() {
+		client.releaseConnection()
+	}
 	client.nickTimer.Stop()
 
-	client.server.accounts.Logout(client)
+	if client.AlwaysOn() && !beingResumed {
+		client.server.accounts.DeleteAlwaysOnState(client.Account())
+	}
 
-	client.socket.Close()
+	client.server.accounts.Logout(client)
 
 	// send quit messages to friends
 	if !beingResumed {
@@ -775,6 +972,93 @@ func (client *Client) SendFromClient(msgid string, from *Client, tags *map[strin
 	return client.Send(tags, from.nickMaskString, command, params...)
 }
 
+// replayDirectMessages sends the given items from the client's direct message
+// history with `target` to the client, inside a chathistory batch if the client
+// supports batches.
+func (client *Client) replayDirectMessages(rb *ResponseBuffer, target string, items []history.Item) {
+	server := client.server
+	nick := client.Nick()
+	accountName := client.AccountName()
+	useMaxLine := client.capabilities.Has(caps.MaxLine)
+	messageTags := client.capabilities.Has(caps.MessageTags)
+
+	var batchID string
+	if client.capabilities.Has(caps.Batch) {
+		batch := server.batches.New("chathistory", target)
+		batchID = batch.ID
+		rb.Add(nil, server.name, "BATCH", "+"+batch.ID, batch.Type, target)
+	}
+
+	for _, item := range items {
+		var tags *map[string]ircmsg.TagValue
+		if messageTags {
+			tags = copyTags(&item.Tags)
+		}
+		if batchID != "" {
+			if tags == nil {
+				tags = ircmsg.MakeTags("batch", batchID)
+			} else {
+				(*tags)["batch"] = ircmsg.MakeTagValue(batchID)
+			}
+		}
+		// messages the client sent are addressed to the other party, and the
+		// ones it received are addressed to the client itself
+		msgTarget := nick
+		if item.AccountName == accountName {
+			msgTarget = item.Target
+		}
+
+		switch item.Type {
+		case history.Privmsg, history.Notice:
+			command := "PRIVMSG"
+			if item.Type == history.Notice {
+				command = "NOTICE"
+			}
+			if useMaxLine {
+				rb.AddFromNickmask(item.Time, item.Msgid, item.Nick, item.AccountName, tags, command, msgTarget, item.Message)
+			} else {
+				for _, line := range server.splitMessage(item.Message, false).For512 {
+					rb.AddFromNickmask(item.Time, item.Msgid, item.Nick, item.AccountName, copyTags(tags), command, msgTarget, line)
+				}
+			}
+		case history.Tagmsg:
+			if messageTags {
+				rb.AddFromNickmask(item.Time, item.Msgid, item.Nick, item.AccountName, tags, "TAGMSG", msgTarget)
+			}
+		}
+	}
+
+	if batchID != "" {
+		rb.Add(nil, server.name, "BATCH", "-"+batchID)
+	}
+}
+
+// resetSasl discards the state of any SASL exchange in progress.
+func (client *Client) resetSasl() {
+	client.saslInProgress = false
+	client.saslMechanism = ""
+	client.saslScram = nil
+	client.saslValue = ""
+}
+
+// recordDirectMessage stores a message sent by this client to `target` in the
+// persistent direct message history, if both of them are logged into accounts.
+func (client *Client) recordDirectMessage(target *Client, itemType history.ItemType, msgid, message string, tags *map[string]ircmsg.TagValue) {
+	account, targetAccount := client.Account(), target.Account()
+	if account == "" || targetAccount == "" {
+		return
+	}
+	client.server.accounts.AddDirectMessage(account, targetAccount, history.Item{
+		Type:        itemType,
+		Nick:        client.NickMaskString(),
+		AccountName: client.AccountName(),
+		Msgid:       msgid,
+		Message:     message,
+		Target:      target.Nick(),
+		Tags:        historyTags(tags),
+	})
+}
+
 var (
 	// these are all the output commands that MUST have their last param be a trailing.
 	// this is needed because dumb clients like to treat trailing params separately from the
@@ -788,8 +1072,29 @@ var (
 	}
 )
 
-// SendRawMessage sends a raw message to the client.
+// SendRawMessage sends a raw message to the client, and to each of their sessions.
 func (client *Client) SendRawMessage(message ircmsg.IrcMessage) error {
+	// clients on other servers get messages through their own server
+	if client.IsRemote() {
+		return nil
+	}
+
+	client.recordReplay(message)
+	for _, session := range client.Sessions() {
+		if adapted, ok := session.adaptMessage(message); ok {
+			session.writeMessage(adapted)
+		}
+	}
+	return client.writeMessage(message)
+}
+
+// writeMessage writes a message to the client's own connection.
+func (client *Client) writeMessage(message ircmsg.IrcMessage) error {
+	// always-on clients restored after a restart have never had a connection
+	if client.IsRemote() || client.socket == nil {
+		return nil
+	}
+
 	// use dumb hack to force the last param to be a trailing param if required
 	var usedTrailingHack bool
 	if commandsThatMustUseTrailing[strings.ToUpper(message.Command)] && len(message.Params) > 0 {
@@ -831,7 +1136,7 @@ func (client *Client) SendRawMessage(message ircmsg.IrcMessage) error {
 func (client *Client) Send(tags *map[string]ircmsg.TagValue, prefix string, command string, params ...string) error {
 	// attach server-time
 	if client.capabilities.Has(caps.ServerTime) {
-		t := time.Now().UTC().Format("2006-01-02T15:04:05.999Z")
+		t := time.Now().UTC().Format(IRCv3TimestampFormat)
 		if tags == nil {
 			tags = ircmsg.MakeTags("time", t)
 		} else {
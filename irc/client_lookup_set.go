@@ -122,6 +122,27 @@ func (clients *ClientManager) SetNick(client *Client, newNick string) error {
 	return nil
 }
 
+// SetRemoteNick sets the nickname of a client on another server. Nick reservation
+// is up to their own server, and any collision must already have been resolved.
+func (clients *ClientManager) SetRemoteNick(client *Client, newNick string) error {
+	newcfnick, err := CasefoldName(newNick)
+	if err != nil {
+		return err
+	}
+
+	clients.Lock()
+	defer clients.Unlock()
+
+	currentNewEntry := clients.byNick[newcfnick]
+	if currentNewEntry != nil && currentNewEntry != client {
+		return errNicknameInUse
+	}
+	clients.removeInternal(client)
+	clients.byNick[newcfnick] = client
+	client.updateNickMask(newNick)
+	return nil
+}
+
 func (clients *ClientManager) AllClients() (result []*Client) {
 	clients.RLock()
 	defer clients.RUnlock()
@@ -207,8 +228,9 @@ func (clients *ClientManager) Find(userhost string) *Client {
 // UserMaskSet holds a set of client masks and lets you match  hostnames to them.
 type UserMaskSet struct {
 	sync.RWMutex
-	masks  map[string]bool
-	regexp *regexp.Regexp
+	masks   map[string]bool
+	regexp  *regexp.Regexp
+	extbans []extban
 }
 
 // NewUserMaskSet returns a new UserMaskSet.
@@ -220,7 +242,7 @@ func NewUserMaskSet() *UserMaskSet {
 
 // Add adds the given mask to this set.
 func (set *UserMaskSet) Add(mask string) (added bool) {
-	casefoldedMask, err := Casefold(mask)
+	casefoldedMask, err := casefoldMask(mask)
 	if err != nil {
 		log.Println(fmt.Sprintf("ERROR: Could not add mask to usermaskset: [%s]", mask))
 		return false
@@ -242,14 +264,14 @@ func (set *UserMaskSet) Add(mask string) (added bool) {
 // AddAll adds the given masks to this set.
 func (set *UserMaskSet) AddAll(masks []string) (added bool) {
 	set.Lock()
-	defer set.Unlock()
-
 	for _, mask := range masks {
 		if !added && !set.masks[mask] {
 			added = true
 		}
 		set.masks[mask] = true
 	}
+	set.Unlock()
+
 	if added {
 		set.setRegexp()
 	}
@@ -283,6 +305,24 @@ func (set *UserMaskSet) Match(userhost string) bool {
 	return regexp.MatchString(userhost)
 }
 
+// MatchClient matches the given client against both the nickmasks and the extbans in this set.
+func (set *UserMaskSet) MatchClient(client *Client) bool {
+	set.RLock()
+	regexp := set.regexp
+	extbans := set.extbans
+	set.RUnlock()
+
+	if regexp != nil && regexp.MatchString(client.NickMaskCasefolded()) {
+		return true
+	}
+	for i := range extbans {
+		if extbans[i].match(client) {
+			return true
+		}
+	}
+	return false
+}
+
 // String returns the masks in this set.
 func (set *UserMaskSet) String() string {
 	set.RLock()
@@ -302,40 +342,51 @@ func (set *UserMaskSet) Length() int {
 	return len(set.masks)
 }
 
+// globToRegexp converts a mask to a regular expression (without anchors).
+// Masks are split at the two types of wildcards, `*` and `?`. All the
+// pieces are meta-escaped. `*` is replaced with `.*`, the regexp
+// equivalent. Likewise, `?` is replaced with `.`.
+func globToRegexp(mask string) string {
+	manyParts := strings.Split(mask, "*")
+	manyExprs := make([]string, len(manyParts))
+	for mindex, manyPart := range manyParts {
+		oneParts := strings.Split(manyPart, "?")
+		oneExprs := make([]string, len(oneParts))
+		for oindex, onePart := range oneParts {
+			oneExprs[oindex] = regexp.QuoteMeta(onePart)
+		}
+		manyExprs[mindex] = strings.Join(oneExprs, ".")
+	}
+	return strings.Join(manyExprs, ".*")
+}
+
 // setRegexp generates a regular expression from the set of user mask
-// strings. Masks are split at the two types of wildcards, `*` and
-// `?`. All the pieces are meta-escaped. `*` is replaced with `.*`,
-// the regexp equivalent. Likewise, `?` is replaced with `.`. The
-// parts are re-joined and finally all masks are joined into a big
-// or-expression.
+// strings, joining all the masks into a big or-expression. Extbans are
+// parsed separately, since they don't match against the nickmask.
 func (set *UserMaskSet) setRegexp() {
 	var re *regexp.Regexp
+	var extbans []extban
 
 	set.RLock()
-	maskExprs := make([]string, len(set.masks))
-	index := 0
+	maskExprs := make([]string, 0, len(set.masks))
 	for mask := range set.masks {
-		manyParts := strings.Split(mask, "*")
-		manyExprs := make([]string, len(manyParts))
-		for mindex, manyPart := range manyParts {
-			oneParts := strings.Split(manyPart, "?")
-			oneExprs := make([]string, len(oneParts))
-			for oindex, onePart := range oneParts {
-				oneExprs[oindex] = regexp.QuoteMeta(onePart)
+		if isExtban(mask) {
+			if eb, err := parseExtban(mask); err == nil {
+				extbans = append(extbans, eb)
 			}
-			manyExprs[mindex] = strings.Join(oneExprs, ".")
+			continue
 		}
-		maskExprs[index] = strings.Join(manyExprs, ".*")
-		index++
+		maskExprs = append(maskExprs, globToRegexp(mask))
 	}
 	set.RUnlock()
 
-	if index > 0 {
+	if len(maskExprs) > 0 {
 		expr := "^" + strings.Join(maskExprs, "|") + "$"
 		re, _ = regexp.Compile(expr)
 	}
 
 	set.Lock()
 	set.regexp = re
+	set.extbans = extbans
 	set.Unlock()
 }
@@ -0,0 +1,45 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCloaking(t *testing.T) {
+	server, cleanup := newTestServer(t, func(config *Config) {
+		config.Server.Cloaks.Enabled = true
+		config.Server.Cloaks.Netname = "oragono"
+		config.Server.Cloaks.Secret = "4afbb3ba7a4d6b2e7e1ab4d1cf7f4b2c"
+		config.Server.Cloaks.AccountSuffix = "users.irc.test"
+	})
+	defer cleanup()
+
+	alice := openTestClient(server)
+	alice.login(t, server, "alice")
+	alice.register(t, "alice", "chghost")
+	bob := newTestClient(t, server, "bob")
+
+	// other clients only see the cloak
+	bob.send("WHOIS alice")
+	bob.expect(t, " 311 ", "alice.users.irc.test")
+	bob.send("WHOIS bob")
+	whois := bob.expect(t, " 311 ", ".IP ")
+	ipCloak := strings.Fields(whois)[5]
+
+	// and bans on either cloak still match
+	masks := strings.Join(alice.client.AllNickmasks(), " ")
+	if !strings.Contains(masks, "@alice.users.irc.test") || !strings.Contains(masks, "@"+strings.ToLower(ipCloak)) {
+		t.Errorf("nickmasks %s should contain both cloaks", masks)
+	}
+	server.klines.AddMask(canonicalizeKlineMask(strings.ToLower("*@"+ipCloak)), nil, "cloaked", "", "test")
+	if banned, _ := server.klines.CheckMasks(bob.client.AllNickmasks()...); !banned {
+		t.Error("K-Line on the IP cloak should match")
+	}
+
+	// logging out falls back to the IP cloak
+	server.accounts.Logout(alice.client)
+	alice.expect(t, ":alice!~u@alice.users.irc.test", "CHGHOST", ipCloak)
+}
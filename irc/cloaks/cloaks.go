@@ -0,0 +1,81 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package cloaks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"github.com/oragono/oragono/irc/utils"
+)
+
+// CloakConfig controls the cloaking of client hostnames.
+type CloakConfig struct {
+	Enabled       bool
+	Netname       string
+	Secret        string
+	AccountSuffix string `yaml:"account-suffix"`
+}
+
+var (
+	// the subnets that each part of an IP cloak covers, from the most specific to the
+	// least, so that a ban on the last few parts of a cloak bans the whole subnet
+	ipv4CloakMasks = []net.IPMask{net.CIDRMask(32, 32), net.CIDRMask(24, 32), net.CIDRMask(16, 32)}
+	ipv6CloakMasks = []net.IPMask{net.CIDRMask(128, 128), net.CIDRMask(64, 128), net.CIDRMask(48, 128)}
+)
+
+// hash returns a short keyed hash of the given string.
+func (config *CloakConfig) hash(input string) string {
+	mac := hmac.New(sha256.New, []byte(config.Secret))
+	mac.Write([]byte(input))
+	return strings.ToUpper(hex.EncodeToString(mac.Sum(nil)[:4]))
+}
+
+// ComputeCloak returns the cloaked hostname of a client connecting from the given
+// IP, whose hostname resolved to the given one (or is just the IP).
+//
+// IPs are cloaked as the hashes of the IP and of its enclosing subnets, like
+// A1B2C3D4.E5F6A7B8.C9D0E1F2.IP for IPv4 (the /32, /24 and /16) and
+// A1B2C3D4:E5F6A7B8:C9D0E1F2:IP for IPv6 (the /128, /64 and /48). Hostnames keep
+// their domain, and have their first label replaced, like netname-A1B2C3D4.example.com.
+func (config *CloakConfig) ComputeCloak(ip net.IP, hostname string) string {
+	if hostname != "" && net.ParseIP(hostname) == nil && utils.IsHostname(hostname) {
+		cloak := config.Netname + "-" + config.hash(strings.ToLower(hostname))
+		if dot := strings.IndexByte(hostname, '.'); dot != -1 {
+			cloak += hostname[dot:]
+		}
+		return cloak
+	}
+
+	masks, separator := ipv4CloakMasks, "."
+	if ip.To4() == nil {
+		masks, separator = ipv6CloakMasks, ":"
+	} else {
+		ip = ip.To4()
+	}
+	parts := make([]string, len(masks)+1)
+	for i, mask := range masks {
+		network := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		parts[i] = config.hash(network.String())
+	}
+	parts[len(masks)] = "IP"
+	return strings.Join(parts, separator)
+}
+
+// ComputeAccountCloak returns the cloaked hostname of a client logged into the
+// given account, or "" if account cloaks are disabled or the account name can't
+// be used in a hostname.
+func (config *CloakConfig) ComputeAccountCloak(account string) string {
+	if config.AccountSuffix == "" {
+		return ""
+	}
+	cloak := strings.ToLower(account) + "." + config.AccountSuffix
+	if !utils.IsHostname(cloak) {
+		return ""
+	}
+	return cloak
+}
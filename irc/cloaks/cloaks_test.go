@@ -0,0 +1,84 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package cloaks
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func testConfig() *CloakConfig {
+	return &CloakConfig{
+		Enabled:       true,
+		Netname:       "oragono",
+		Secret:        "4afbb3ba7a4d6b2e7e1ab4d1cf7f4b2c",
+		AccountSuffix: "users.oragono.test",
+	}
+}
+
+func TestIPCloaks(t *testing.T) {
+	config := testConfig()
+
+	cloak := config.ComputeCloak(net.ParseIP("203.0.113.7"), "203.0.113.7")
+	if !strings.HasSuffix(cloak, ".IP") || strings.Contains(cloak, "203") {
+		t.Errorf("bad IPv4 cloak %s", cloak)
+	}
+	if cloak != config.ComputeCloak(net.ParseIP("203.0.113.7"), "203.0.113.7") {
+		t.Error("cloaks should be stable")
+	}
+
+	// clients in the same subnets share the ends of their cloaks
+	sameSlash24 := config.ComputeCloak(net.ParseIP("203.0.113.8"), "203.0.113.8")
+	sameSlash16 := config.ComputeCloak(net.ParseIP("203.0.5.7"), "203.0.5.7")
+	parts := strings.Split(cloak, ".")
+	if sameSlash24 == cloak || !strings.HasSuffix(sameSlash24, strings.Join(parts[1:], ".")) {
+		t.Errorf("cloaks %s and %s should share the /24", cloak, sameSlash24)
+	}
+	if strings.HasSuffix(sameSlash16, strings.Join(parts[1:], ".")) || !strings.HasSuffix(sameSlash16, strings.Join(parts[2:], ".")) {
+		t.Errorf("cloaks %s and %s should only share the /16", cloak, sameSlash16)
+	}
+
+	v6cloak := config.ComputeCloak(net.ParseIP("2001:db8:1:2::7"), "2001:db8:1:2::7")
+	v6same64 := config.ComputeCloak(net.ParseIP("2001:db8:1:2::8"), "2001:db8:1:2::8")
+	v6parts := strings.Split(v6cloak, ":")
+	if len(v6parts) != 4 || !strings.HasSuffix(v6same64, strings.Join(v6parts[1:], ":")) {
+		t.Errorf("cloaks %s and %s should share the /64", v6cloak, v6same64)
+	}
+
+	// the secret matters
+	other := testConfig()
+	other.Secret = "something else"
+	if other.ComputeCloak(net.ParseIP("203.0.113.7"), "203.0.113.7") == cloak {
+		t.Error("cloaks with different secrets should differ")
+	}
+}
+
+func TestHostnameCloaks(t *testing.T) {
+	config := testConfig()
+
+	cloak := config.ComputeCloak(net.ParseIP("203.0.113.7"), "host-7.dsl.example.com")
+	if !strings.HasPrefix(cloak, "oragono-") || !strings.HasSuffix(cloak, ".dsl.example.com") || strings.Contains(cloak, "host-7") {
+		t.Errorf("bad hostname cloak %s", cloak)
+	}
+	// hostnames that aren't valid are treated like missing ones
+	if cloak := config.ComputeCloak(net.ParseIP("203.0.113.7"), "localhost"); !strings.HasSuffix(cloak, ".IP") {
+		t.Errorf("bad cloak for localhost %s", cloak)
+	}
+}
+
+func TestAccountCloaks(t *testing.T) {
+	config := testConfig()
+
+	if cloak := config.ComputeAccountCloak("Dan"); cloak != "dan.users.oragono.test" {
+		t.Errorf("bad account cloak %s", cloak)
+	}
+	if cloak := config.ComputeAccountCloak("d_a_n"); cloak != "" {
+		t.Errorf("account names that aren't valid hostnames shouldn't be used, got %s", cloak)
+	}
+	config.AccountSuffix = ""
+	if cloak := config.ComputeAccountCloak("dan"); cloak != "" {
+		t.Errorf("account cloaks should be disabled, got %s", cloak)
+	}
+}
@@ -6,6 +6,8 @@
 package irc
 
 import (
+	"time"
+
 	"github.com/goshuirc/irc-go/ircmsg"
 	"github.com/oragono/oragono/irc/modes"
 )
@@ -17,37 +19,47 @@ type Command struct {
 	usablePreReg      bool
 	leaveClientActive bool // if true, leaves the client active time alone. reversed because we can't default a struct element to True
 	leaveClientIdle   bool
+	perSession        bool // if true, runs on a session itself rather than the client it's attached to
 	minParams         int
 	capabs            []string
 }
 
 // Run runs this command with the given client/message.
 func (cmd *Command) Run(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+	// commands from a session are run as the client it's attached to, with the
+	// replies going back to the session
+	session := client
+	if primary := client.Primary(); primary != nil && !cmd.perSession {
+		client = primary
+	}
+
 	if !client.registered && !cmd.usablePreReg {
-		client.Send(nil, server.name, ERR_NOTREGISTERED, client.nick, client.t("You need to register before you can use that command"))
+		session.sendToConnection(nil, server.name, ERR_NOTREGISTERED, client.nick, client.t("You need to register before you can use that command"))
 		return false
 	}
 	if cmd.oper && !client.HasMode(modes.Operator) {
-		client.Send(nil, server.name, ERR_NOPRIVILEGES, client.nick, client.t("Permission Denied - You're not an IRC operator"))
+		session.sendToConnection(nil, server.name, ERR_NOPRIVILEGES, client.nick, client.t("Permission Denied - You're not an IRC operator"))
 		return false
 	}
 	if len(cmd.capabs) > 0 && !client.HasRoleCapabs(cmd.capabs...) {
-		client.Send(nil, server.name, ERR_NOPRIVILEGES, client.nick, client.t("Permission Denied"))
+		session.sendToConnection(nil, server.name, ERR_NOPRIVILEGES, client.nick, client.t("Permission Denied"))
 		return false
 	}
 	if len(msg.Params) < cmd.minParams {
-		client.Send(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, msg.Command, client.t("Not enough parameters"))
+		session.sendToConnection(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, msg.Command, client.t("Not enough parameters"))
 		return false
 	}
 
-	if client.registered {
-		client.fakelag.Touch()
+	if client.registered && session.fakelag.Touch() {
+		server.metrics.FakelagActivated()
 	}
 
-	rb := NewResponseBuffer(client)
+	start := time.Now()
+	rb := NewResponseBuffer(session)
 	rb.Label = GetLabel(msg)
 	exiting := cmd.handler(server, client, msg, rb)
 	rb.Send()
+	server.metrics.CommandCompleted(msg.Command, time.Since(start))
 
 	// after each command, see if we can send registration to the client
 	if !client.registered {
@@ -55,7 +67,7 @@ func (cmd *Command) Run(server *Server, client *Client, msg ircmsg.IrcMessage) b
 	}
 
 	if !cmd.leaveClientIdle {
-		client.Touch()
+		session.Touch()
 	}
 
 	if !cmd.leaveClientActive {
@@ -74,6 +86,10 @@ func init() {
 			handler:   accHandler,
 			minParams: 3,
 		},
+		"ACCEPT": {
+			handler:   acceptHandler,
+			minParams: 1,
+		},
 		"AMBIANCE": {
 			handler:   sceneHandler,
 			minParams: 2,
@@ -90,8 +106,13 @@ func init() {
 		"CAP": {
 			handler:      capHandler,
 			usablePreReg: true,
+			perSession:   true,
 			minParams:    1,
 		},
+		"CHATHISTORY": {
+			handler:   chathistoryHandler,
+			minParams: 3,
+		},
 		"CHANSERV": {
 			handler:   csHandler,
 			minParams: 1,
@@ -100,6 +121,30 @@ func init() {
 			handler:   csHandler,
 			minParams: 1,
 		},
+		"CHGHOST": {
+			handler:   chghostHandler,
+			minParams: 2,
+			oper:      true,
+			capabs:    []string{"chghost"},
+		},
+		"CHGIDENT": {
+			handler:   chgidentHandler,
+			minParams: 2,
+			oper:      true,
+			capabs:    []string{"chgident"},
+		},
+		"CHGNAME": {
+			handler:   chgnameHandler,
+			minParams: 2,
+			oper:      true,
+			capabs:    []string{"chgname"},
+		},
+		"CONNECT": {
+			handler:   connectHandler,
+			minParams: 1,
+			oper:      true,
+			capabs:    []string{"linking"},
+		},
 		"DEBUG": {
 			handler:   debugHandler,
 			minParams: 1,
@@ -110,6 +155,12 @@ func init() {
 			minParams: 1,
 			oper:      true,
 		},
+		"GLOBOPS": {
+			handler:   globopsHandler,
+			minParams: 1,
+			oper:      true,
+			capabs:    []string{"oper:globops"},
+		},
 		"HELP": {
 			handler:   helpHandler,
 			minParams: 0,
@@ -118,6 +169,14 @@ func init() {
 			handler:   helpHandler,
 			minParams: 0,
 		},
+		"HOSTSERV": {
+			handler:   hsHandler,
+			minParams: 1,
+		},
+		"HS": {
+			handler:   hsHandler,
+			minParams: 1,
+		},
 		"INFO": {
 			handler: infoHandler,
 		},
@@ -148,11 +207,19 @@ func init() {
 			minParams: 1,
 			oper:      true,
 		},
+		"KNOCK": {
+			handler:   knockHandler,
+			minParams: 1,
+		},
 		"LANGUAGE": {
 			handler:      languageHandler,
 			usablePreReg: true,
 			minParams:    1,
 		},
+		"LINKS": {
+			handler:   linksHandler,
+			minParams: 0,
+		},
 		"LIST": {
 			handler:   listHandler,
 			minParams: 0,
@@ -218,12 +285,14 @@ func init() {
 		"PING": {
 			handler:           pingHandler,
 			usablePreReg:      true,
+			perSession:        true,
 			minParams:         1,
 			leaveClientActive: true,
 		},
 		"PONG": {
 			handler:           pongHandler,
 			usablePreReg:      true,
+			perSession:        true,
 			minParams:         1,
 			leaveClientActive: true,
 		},
@@ -245,6 +314,12 @@ func init() {
 			usablePreReg: true,
 			minParams:    1,
 		},
+		"SAJOIN": {
+			handler:   sajoinHandler,
+			minParams: 2,
+			oper:      true,
+			capabs:    []string{"sajoin"},
+		},
 		"SANICK": {
 			handler:   sanickHandler,
 			minParams: 2,
@@ -255,10 +330,40 @@ func init() {
 			minParams: 1,
 			capabs:    []string{"samode"},
 		},
+		"SAPART": {
+			handler:   sapartHandler,
+			minParams: 2,
+			oper:      true,
+			capabs:    []string{"sapart"},
+		},
+		"SAQUIT": {
+			handler:   saquitHandler,
+			minParams: 2,
+			oper:      true,
+			capabs:    []string{"saquit"},
+		},
 		"SCENE": {
 			handler:   sceneHandler,
 			minParams: 2,
 		},
+		"SETNAME": {
+			handler:   setnameHandler,
+			minParams: 1,
+		},
+		"SILENCE": {
+			handler:   silenceHandler,
+			minParams: 0,
+		},
+		"SQUIT": {
+			handler:   squitHandler,
+			minParams: 1,
+			oper:      true,
+			capabs:    []string{"linking"},
+		},
+		"STATS": {
+			handler:   statsHandler,
+			minParams: 1,
+		},
 		"TAGMSG": {
 			handler:   tagmsgHandler,
 			minParams: 1,
@@ -266,6 +371,7 @@ func init() {
 		"QUIT": {
 			handler:      quitHandler,
 			usablePreReg: true,
+			perSession:   true,
 			minParams:    0,
 		},
 		"REHASH": {
@@ -305,6 +411,12 @@ func init() {
 			handler:   versionHandler,
 			minParams: 0,
 		},
+		"WALLOPS": {
+			handler:   wallopsHandler,
+			minParams: 1,
+			oper:      true,
+			capabs:    []string{"oper:wallops"},
+		},
 		"WEBIRC": {
 			handler:      webircHandler,
 			usablePreReg: true,
@@ -17,8 +17,10 @@ import (
 	"time"
 
 	"code.cloudfoundry.org/bytefmt"
+	"github.com/oragono/oragono/irc/cloaks"
 	"github.com/oragono/oragono/irc/connection_limits"
 	"github.com/oragono/oragono/irc/custime"
+	"github.com/oragono/oragono/irc/dnsbl"
 	"github.com/oragono/oragono/irc/languages"
 	"github.com/oragono/oragono/irc/logger"
 	"github.com/oragono/oragono/irc/passwd"
@@ -37,6 +39,29 @@ type TLSListenConfig struct {
 	Key  string
 }
 
+// WebSocketsConfig controls the websocket listeners, see websocket.go.
+type WebSocketsConfig struct {
+	Listen         []string
+	TLSListeners   map[string]*TLSListenConfig `yaml:"tls-listeners"`
+	AllowedOrigins []string                    `yaml:"allowed-origins"`
+}
+
+// LinkConfig is a link block, describing another server we can link to.
+type LinkConfig struct {
+	Address     string
+	Password    string
+	Certfp      string
+	AutoConnect bool `yaml:"auto-connect"`
+}
+
+// LinkingConfig controls server-to-server linking, see linking.go.
+type LinkingConfig struct {
+	Enabled bool
+	Listen  string
+	TLS     TLSListenConfig
+	Links   map[string]*LinkConfig
+}
+
 // Config returns the TLS contiguration assicated with this TLSListenConfig.
 func (conf *TLSListenConfig) Config() (*tls.Config, error) {
 	cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
@@ -60,9 +85,61 @@ func (conf *PassConfig) PasswordBytes() []byte {
 
 type AccountConfig struct {
 	Registration          AccountRegistrationConfig
-	AuthenticationEnabled bool                  `yaml:"authentication-enabled"`
-	SkipServerPassword    bool                  `yaml:"skip-server-password"`
-	NickReservation       NickReservationConfig `yaml:"nick-reservation"`
+	AuthenticationEnabled bool                       `yaml:"authentication-enabled"`
+	SkipServerPassword    bool                       `yaml:"skip-server-password"`
+	NickReservation       NickReservationConfig      `yaml:"nick-reservation"`
+	DirectMessageHistory  DirectMessageHistoryConfig `yaml:"dm-history"`
+	AuthScript            AuthScriptConfig           `yaml:"auth-script"`
+	VHosts                VHostConfig
+	Multiclient           MulticlientConfig
+}
+
+// MulticlientConfig controls whether several connections can share one client,
+// see sessions.go, and whether accounts can keep their client around while none
+// of them are connected, see alwayson.go.
+type MulticlientConfig struct {
+	Enabled       bool
+	AllowAlwaysOn bool `yaml:"allow-always-on"`
+	ReplayLimit   int  `yaml:"replay-limit"`
+}
+
+// VHostConfig controls the vhosts that HostServ can assign to accounts.
+type VHostConfig struct {
+	Enabled      bool
+	MaxLength    int `yaml:"max-length"`
+	UserRequests struct {
+		Enabled  bool
+		Cooldown time.Duration
+	} `yaml:"user-requests"`
+}
+
+// AuthScriptConfig controls the external authentication script, see authscript.go.
+type AuthScriptConfig struct {
+	Enabled bool
+	Command string
+	Args    []string
+	// Autocreate creates local accounts for users who authenticate successfully
+	Autocreate bool
+	Timeout    time.Duration
+}
+
+// DirectMessageHistoryConfig controls the persistent history of direct messages
+// between logged-in accounts.
+type DirectMessageHistoryConfig struct {
+	Enabled bool
+	// Length is the maximum number of messages stored for each conversation
+	Length int
+	MaxAge time.Duration `yaml:"max-age"`
+}
+
+// directMessageHistoryLimit returns the maximum number of direct messages that
+// CHATHISTORY replays at once.
+func (config *Config) directMessageHistoryLimit() int {
+	limit := config.Accounts.DirectMessageHistory.Length
+	if max := config.Channels.History.ChathistoryMaxMessages; max < limit {
+		limit = max
+	}
+	return limit
 }
 
 // AccountRegistrationConfig controls account registration.
@@ -129,6 +206,20 @@ type ChannelRegistrationConfig struct {
 	Enabled bool
 }
 
+// ChannelHistoryConfig controls the in-memory history buffer kept for each channel.
+type ChannelHistoryConfig struct {
+	Enabled                bool
+	ChannelLength          int           `yaml:"channel-length"`
+	MaxAge                 time.Duration `yaml:"max-age"`
+	ChathistoryMaxMessages int           `yaml:"chathistory-maxmessages"`
+}
+
+// ChannelFloodProtectionConfig controls the +f channel mode.
+type ChannelFloodProtectionConfig struct {
+	// Lockout is how long a channel stays +m or +i after a flood
+	Lockout time.Duration
+}
+
 // OperClassConfig defines a specific operator class.
 type OperClassConfig struct {
 	Title        string
@@ -219,6 +310,9 @@ type Config struct {
 		MaxSendQBytes       int
 		ConnectionLimiter   connection_limits.LimiterConfig   `yaml:"connection-limits"`
 		ConnectionThrottler connection_limits.ThrottlerConfig `yaml:"connection-throttling"`
+		WebSockets          WebSocketsConfig                  `yaml:"websockets"`
+		Cloaks              cloaks.CloakConfig
+		DNSBL               dnsbl.Config
 	}
 
 	Languages struct {
@@ -235,10 +329,14 @@ type Config struct {
 	Accounts AccountConfig
 
 	Channels struct {
-		DefaultModes *string `yaml:"default-modes"`
-		Registration ChannelRegistrationConfig
+		DefaultModes    *string `yaml:"default-modes"`
+		Registration    ChannelRegistrationConfig
+		History         ChannelHistoryConfig
+		FloodProtection ChannelFloodProtectionConfig `yaml:"flood-protection"`
 	}
 
+	Linking LinkingConfig
+
 	OperClasses map[string]*OperClassConfig `yaml:"oper-classes"`
 
 	Opers map[string]*OperConfig
@@ -246,21 +344,28 @@ type Config struct {
 	Logging []logger.LoggingConfig
 
 	Debug struct {
-		RecoverFromErrors *bool   `yaml:"recover-from-errors"`
-		PprofListener     *string `yaml:"pprof-listener"`
+		RecoverFromErrors *bool    `yaml:"recover-from-errors"`
+		PprofListener     *string  `yaml:"pprof-listener"`
+		APIListener       *string  `yaml:"api-listener"`
+		APITokens         []string `yaml:"api-tokens"`
+		MetricsListener   *string  `yaml:"metrics-listener"`
 		StackImpact       StackImpactConfig
 	}
 
 	Limits struct {
-		AwayLen        uint          `yaml:"awaylen"`
-		ChanListModes  uint          `yaml:"chan-list-modes"`
-		ChannelLen     uint          `yaml:"channellen"`
-		KickLen        uint          `yaml:"kicklen"`
-		MonitorEntries uint          `yaml:"monitor-entries"`
-		NickLen        uint          `yaml:"nicklen"`
-		TopicLen       uint          `yaml:"topiclen"`
-		WhowasEntries  uint          `yaml:"whowas-entries"`
-		LineLen        LineLenConfig `yaml:"linelen"`
+		AwayLen           uint          `yaml:"awaylen"`
+		BroadcastCooldown time.Duration `yaml:"broadcast-cooldown"`
+		ChanListModes     uint          `yaml:"chan-list-modes"`
+		ChannelLen        uint          `yaml:"channellen"`
+		KickLen           uint          `yaml:"kicklen"`
+		MonitorEntries    uint          `yaml:"monitor-entries"`
+		NickLen           uint          `yaml:"nicklen"`
+		RealnameLen       uint          `yaml:"realnamelen"`
+		SilenceEntries    uint          `yaml:"silence-entries"`
+		AcceptEntries     uint          `yaml:"accept-entries"`
+		TopicLen          uint          `yaml:"topiclen"`
+		WhowasEntries     uint          `yaml:"whowas-entries"`
+		LineLen           LineLenConfig `yaml:"linelen"`
 	}
 
 	Fakelag FakelagConfig
@@ -388,8 +493,17 @@ func (conf *Config) Operators(oc *map[string]OperClass) (map[string]Oper, error)
 
 // TLSListeners returns a list of TLS listeners and their configs.
 func (conf *Config) TLSListeners() map[string]*tls.Config {
+	return loadTLSListeners(conf.Server.TLSListeners)
+}
+
+// WebSocketTLSListeners returns a list of TLS websocket listeners and their configs.
+func (conf *Config) WebSocketTLSListeners() map[string]*tls.Config {
+	return loadTLSListeners(conf.Server.WebSockets.TLSListeners)
+}
+
+func loadTLSListeners(listenersConf map[string]*TLSListenConfig) map[string]*tls.Config {
 	tlsListeners := make(map[string]*tls.Config)
-	for s, tlsListenersConf := range conf.Server.TLSListeners {
+	for s, tlsListenersConf := range listenersConf {
 		config, err := tlsListenersConf.Config()
 		if err != nil {
 			log.Fatal(err)
@@ -434,6 +548,15 @@ func LoadConfig(filename string) (config *Config, err error) {
 	if len(config.Server.Listen) == 0 {
 		return nil, ErrNoListenersDefined
 	}
+	if config.Limits.RealnameLen == 0 {
+		config.Limits.RealnameLen = 128
+	}
+	if config.Limits.SilenceEntries == 0 {
+		config.Limits.SilenceEntries = 32
+	}
+	if config.Limits.AcceptEntries == 0 {
+		config.Limits.AcceptEntries = 32
+	}
 	if config.Limits.NickLen < 1 || config.Limits.ChannelLen < 2 || config.Limits.AwayLen < 1 || config.Limits.KickLen < 1 || config.Limits.TopicLen < 1 {
 		return nil, ErrLimitsAreInsane
 	}
@@ -471,6 +594,83 @@ func LoadConfig(filename string) (config *Config, err error) {
 		newWebIRC = append(newWebIRC, webirc)
 	}
 	config.Server.WebIRC = newWebIRC
+	if !config.Channels.History.Enabled || config.Channels.History.ChannelLength < 0 {
+		config.Channels.History.ChannelLength = 0
+	}
+	if config.Channels.History.MaxAge < 0 {
+		config.Channels.History.MaxAge = 0
+	}
+	if config.Channels.FloodProtection.Lockout <= 0 {
+		config.Channels.FloodProtection.Lockout = time.Minute
+	}
+	if config.Channels.History.ChathistoryMaxMessages < 1 {
+		config.Channels.History.ChathistoryMaxMessages = 100
+	}
+	// channel replays can't be longer than the channel history itself
+	if config.Channels.History.Enabled && config.Channels.History.ChannelLength < config.Channels.History.ChathistoryMaxMessages {
+		config.Channels.History.ChathistoryMaxMessages = config.Channels.History.ChannelLength
+	}
+	if !config.Accounts.DirectMessageHistory.Enabled || config.Accounts.DirectMessageHistory.Length < 1 {
+		config.Accounts.DirectMessageHistory.Enabled = false
+		config.Accounts.DirectMessageHistory.Length = 0
+	}
+	if config.Accounts.VHosts.MaxLength <= 0 {
+		config.Accounts.VHosts.MaxLength = 64
+	}
+	if !config.Accounts.Multiclient.Enabled {
+		config.Accounts.Multiclient.AllowAlwaysOn = false
+	}
+	if config.Accounts.Multiclient.ReplayLimit < 0 {
+		config.Accounts.Multiclient.ReplayLimit = 0
+	}
+	if config.Accounts.AuthScript.Enabled {
+		if config.Accounts.AuthScript.Command == "" {
+			return nil, ErrAuthScriptCommandMissing
+		}
+		if config.Accounts.AuthScript.Timeout <= 0 {
+			config.Accounts.AuthScript.Timeout = 9 * time.Second
+		}
+	}
+	if config.Server.Cloaks.Enabled {
+		if config.Server.Cloaks.Secret == "" {
+			return nil, ErrCloakSecretMissing
+		}
+		if config.Server.Cloaks.Netname == "" {
+			config.Server.Cloaks.Netname = "oragono"
+		}
+	}
+	if config.Debug.APIListener != nil && *config.Debug.APIListener != "" && len(config.Debug.APITokens) == 0 {
+		return nil, ErrAPITokensMissing
+	}
+	for _, token := range config.Debug.APITokens {
+		// an empty token would authorize any request with an empty bearer token
+		if strings.TrimSpace(token) == "" {
+			return nil, ErrAPITokenEmpty
+		}
+	}
+	if config.Linking.Enabled && config.Linking.Listen != "" && (config.Linking.TLS.Cert == "" || config.Linking.TLS.Key == "") {
+		return nil, ErrLinkingTLSMissing
+	}
+	linkBlocks := make(map[string]*LinkConfig)
+	for name, link := range config.Linking.Links {
+		casefoldedName, err := Casefold(name)
+		if err != nil || !utils.IsHostname(name) {
+			return nil, fmt.Errorf("Link name isn't valid [%s]", name)
+		}
+		if link.Password == "" {
+			return nil, fmt.Errorf("Link to %s has no password", name)
+		}
+		// we'd otherwise send our password to whoever answers at that address
+		if link.Address != "" && link.Certfp == "" {
+			return nil, fmt.Errorf("Link to %s connects out, but has no certfp to verify it", name)
+		}
+		link.Certfp = strings.ToLower(strings.Replace(link.Certfp, ":", "", -1))
+		linkBlocks[casefoldedName] = link
+	}
+	config.Linking.Links = linkBlocks
+	if config.Accounts.DirectMessageHistory.MaxAge < 0 {
+		config.Accounts.DirectMessageHistory.MaxAge = 0
+	}
 	// process limits
 	if config.Limits.LineLen.Tags < 512 || config.Limits.LineLen.Rest < 512 {
 		return nil, ErrLineLengthsTooSmall
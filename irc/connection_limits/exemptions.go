@@ -0,0 +1,51 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package connection_limits
+
+import (
+	"fmt"
+	"net"
+)
+
+// Exemptions holds the IPs and networks that are exempted from some check.
+type Exemptions struct {
+	// ips holds IPs that are exempt
+	ips map[string]bool
+	// nets holds networks that are exempt
+	nets []net.IPNet
+}
+
+// ParseExemptions parses a list of exempted IPs and networks, like the
+// `exempted` lists in the config.
+func ParseExemptions(list []string) (exemptions Exemptions, err error) {
+	exemptions.ips = make(map[string]bool)
+	for _, cidr := range list {
+		ipaddr := net.ParseIP(cidr)
+		_, netaddr, err := net.ParseCIDR(cidr)
+
+		if ipaddr == nil && err != nil {
+			return exemptions, fmt.Errorf("Could not parse exempted IP/network [%s]", cidr)
+		}
+
+		if ipaddr != nil {
+			exemptions.ips[ipaddr.String()] = true
+		} else {
+			exemptions.nets = append(exemptions.nets, *netaddr)
+		}
+	}
+	return exemptions, nil
+}
+
+// Contains returns true if the given IP is exempted.
+func (exemptions Exemptions) Contains(addr net.IP) bool {
+	if exemptions.ips[addr.String()] {
+		return true
+	}
+	for _, ex := range exemptions.nets {
+		if ex.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
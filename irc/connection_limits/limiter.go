@@ -5,7 +5,6 @@ package connection_limits
 
 import (
 	"errors"
-	"fmt"
 	"net"
 	"sync"
 )
@@ -36,10 +35,8 @@ type Limiter struct {
 	// population holds IP -> count of clients connected from there
 	population map[string]int
 
-	// exemptedIPs holds IPs that are exempt from limits
-	exemptedIPs map[string]bool
-	// exemptedNets holds networks that are exempt from limits
-	exemptedNets []net.IPNet
+	// exempted holds IPs and networks that are exempt from limits
+	exempted Exemptions
 }
 
 // maskAddr masks the given IPv4/6 address with our cidr limit masks.
@@ -67,14 +64,9 @@ func (cl *Limiter) AddClient(addr net.IP, force bool) error {
 
 	// check exempted lists
 	// we don't track populations for exempted addresses or nets - this is by design
-	if cl.exemptedIPs[addr.String()] {
+	if cl.exempted.Contains(addr) {
 		return nil
 	}
-	for _, ex := range cl.exemptedNets {
-		if ex.Contains(addr) {
-			return nil
-		}
-	}
 
 	// check population
 	cl.maskAddr(addr)
@@ -107,6 +99,20 @@ func (cl *Limiter) RemoveClient(addr net.IP) {
 	}
 }
 
+// Population returns the number of clients connected from each subnet.
+func (cl *Limiter) Population() map[string]int {
+	cl.Lock()
+	defer cl.Unlock()
+
+	population := make(map[string]int)
+	for addr, count := range cl.population {
+		if count > 0 {
+			population[addr] = count
+		}
+	}
+	return population
+}
+
 // NewLimiter returns a new connection limit handler.
 // The handler is functional, but disabled; it can be enabled via `ApplyConfig`.
 func NewLimiter() *Limiter {
@@ -121,21 +127,9 @@ func NewLimiter() *Limiter {
 // ApplyConfig atomically applies a config update to a connection limit handler
 func (cl *Limiter) ApplyConfig(config LimiterConfig) error {
 	// assemble exempted nets
-	exemptedIPs := make(map[string]bool)
-	var exemptedNets []net.IPNet
-	for _, cidr := range config.Exempted {
-		ipaddr := net.ParseIP(cidr)
-		_, netaddr, err := net.ParseCIDR(cidr)
-
-		if ipaddr == nil && err != nil {
-			return fmt.Errorf("Could not parse exempted IP/network [%s]", cidr)
-		}
-
-		if ipaddr != nil {
-			exemptedIPs[ipaddr.String()] = true
-		} else {
-			exemptedNets = append(exemptedNets, *netaddr)
-		}
+	exempted, err := ParseExemptions(config.Exempted)
+	if err != nil {
+		return err
 	}
 
 	cl.Lock()
@@ -151,8 +145,7 @@ func (cl *Limiter) ApplyConfig(config LimiterConfig) error {
 	if cl.subnetLimit == 0 && config.IPsPerSubnet != 0 {
 		cl.subnetLimit = config.IPsPerSubnet
 	}
-	cl.exemptedIPs = exemptedIPs
-	cl.exemptedNets = exemptedNets
+	cl.exempted = exempted
 
 	return nil
 }
@@ -4,7 +4,6 @@
 package connection_limits
 
 import (
-	"fmt"
 	"net"
 	"sync"
 	"time"
@@ -45,10 +44,8 @@ type Throttler struct {
 	banDuration time.Duration
 	banMessage  string
 
-	// exemptedIPs holds IPs that are exempt from limits
-	exemptedIPs map[string]bool
-	// exemptedNets holds networks that are exempt from limits
-	exemptedNets []net.IPNet
+	// exempted holds IPs and networks that are exempt from limits
+	exempted Exemptions
 }
 
 // maskAddr masks the given IPv4/6 address with our cidr limit masks.
@@ -89,14 +86,9 @@ func (ct *Throttler) AddClient(addr net.IP) error {
 	}
 
 	// check exempted lists
-	if ct.exemptedIPs[addr.String()] {
+	if ct.exempted.Contains(addr) {
 		return nil
 	}
-	for _, ex := range ct.exemptedNets {
-		if ex.Contains(addr) {
-			return nil
-		}
-	}
 
 	// check throttle
 	ct.maskAddr(addr)
@@ -133,6 +125,20 @@ func (ct *Throttler) BanMessage() string {
 	return ct.banMessage
 }
 
+// Population returns the throttling details of each subnet that's connected recently.
+func (ct *Throttler) Population() map[string]ThrottleDetails {
+	ct.RLock()
+	defer ct.RUnlock()
+
+	population := make(map[string]ThrottleDetails)
+	for addr, details := range ct.population {
+		if time.Since(details.Start) < ct.duration {
+			population[addr] = details
+		}
+	}
+	return population
+}
+
 // NewThrottler returns a new client connection throttler.
 // The throttler is functional, but disabled; it can be enabled via `ApplyConfig`.
 func NewThrottler() *Throttler {
@@ -147,21 +153,9 @@ func NewThrottler() *Throttler {
 // ApplyConfig atomically applies a config update to a throttler
 func (ct *Throttler) ApplyConfig(config ThrottlerConfig) error {
 	// assemble exempted nets
-	exemptedIPs := make(map[string]bool)
-	var exemptedNets []net.IPNet
-	for _, cidr := range config.Exempted {
-		ipaddr := net.ParseIP(cidr)
-		_, netaddr, err := net.ParseCIDR(cidr)
-
-		if ipaddr == nil && err != nil {
-			return fmt.Errorf("Could not parse exempted IP/network [%s]", cidr)
-		}
-
-		if ipaddr != nil {
-			exemptedIPs[ipaddr.String()] = true
-		} else {
-			exemptedNets = append(exemptedNets, *netaddr)
-		}
+	exempted, err := ParseExemptions(config.Exempted)
+	if err != nil {
+		return err
 	}
 
 	ct.Lock()
@@ -174,8 +168,7 @@ func (ct *Throttler) ApplyConfig(config ThrottlerConfig) error {
 	ct.duration = config.Duration
 	ct.banDuration = config.BanDuration
 	ct.banMessage = config.BanMessage
-	ct.exemptedIPs = exemptedIPs
-	ct.exemptedNets = exemptedNets
+	ct.exempted = exempted
 
 	return nil
 }
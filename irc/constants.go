@@ -10,6 +10,9 @@ import "fmt"
 const (
 	// SemVer is the semantic version of Oragono.
 	SemVer = "0.12.0-unreleased"
+
+	// IRCv3TimestampFormat is the format used for server-time and other IRCv3 timestamps.
+	IRCv3TimestampFormat = "2006-01-02T15:04:05.999Z"
 )
 
 var (
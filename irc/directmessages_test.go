@@ -0,0 +1,105 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oragono/oragono/irc/history"
+	"github.com/tidwall/buntdb"
+)
+
+func newDirectMessageTestServer(t *testing.T) (*Server, func()) {
+	return newTestServer(t, func(config *Config) {
+		config.Channels.History.ChathistoryMaxMessages = 100
+		config.Accounts.DirectMessageHistory.Enabled = true
+		config.Accounts.DirectMessageHistory.Length = 3
+		config.Accounts.DirectMessageHistory.MaxAge = time.Hour
+	})
+}
+
+func directMessageCount(server *Server, account1, account2 string) (count string) {
+	_, countKey := directMessageKeys(account1, account2)
+	server.store.View(func(tx *buntdb.Tx) error {
+		count, _ = tx.Get(countKey)
+		return nil
+	})
+	return
+}
+
+func TestDirectMessageHistory(t *testing.T) {
+	server, shutdown := newDirectMessageTestServer(t)
+	defer shutdown()
+
+	alice := openTestClient(server)
+	alice.registerAccount(t, server, "alice", "alicepass")
+	alice.register(t, "alice", "batch")
+	bob := openTestClient(server)
+	bob.registerAccount(t, server, "bob", "bobpass")
+	bob.register(t, "bob", "batch")
+
+	for i := 1; i <= 5; i++ {
+		alice.send(fmt.Sprintf("PRIVMSG bob :message %d", i))
+		bob.expect(t, "PRIVMSG bob", fmt.Sprintf("message %d", i))
+	}
+
+	// only the newest messages are kept, and the count follows the trimming
+	all := func(item history.Item) bool { return true }
+	items := server.accounts.DirectMessages("bob", "alice", all, true, 0)
+	if len(items) != 3 || items[0].Message != "message 3" || items[2].Message != "message 5" {
+		t.Fatalf("unexpected stored messages: %v", items)
+	}
+	if count := directMessageCount(server, "alice", "bob"); count != "3" {
+		t.Errorf("expected a count of 3, got %s", count)
+	}
+
+	// each participant sees its own side of the conversation
+	bob.send("CHATHISTORY LATEST alice * 10")
+	bob.expect(t, "BATCH +", "chathistory alice")
+	bob.expect(t, ":alice!", "PRIVMSG bob :message 3")
+	bob.expect(t, ":alice!", "PRIVMSG bob :message 5")
+	bob.expect(t, "BATCH -")
+	alice.send("CHATHISTORY BEFORE bob msgid=" + items[2].Msgid + " 10")
+	alice.expect(t, "BATCH +", "chathistory bob")
+	alice.expect(t, ":alice!", "PRIVMSG bob :message 3")
+	alice.expect(t, ":alice!", "PRIVMSG bob :message 4")
+	alice.expect(t, "BATCH -")
+
+	// anyone else gets their own (empty) conversation
+	carol := openTestClient(server)
+	carol.registerAccount(t, server, "carol", "carolpass")
+	carol.register(t, "carol", "batch")
+	carol.send("CHATHISTORY LATEST alice * 10")
+	carol.expect(t, "BATCH +")
+	if line := carol.expect(t); !strings.Contains(line, "BATCH -") {
+		t.Errorf("carol was sent another conversation: %s", line)
+	}
+	dave := newTestClient(t, server, "dave")
+	dave.send("CHATHISTORY LATEST alice * 10")
+	dave.expect(t, " 400 ", "logged into an account")
+}
+
+func TestDirectMessageHistoryMaxAge(t *testing.T) {
+	server, shutdown := newDirectMessageTestServer(t)
+	defer shutdown()
+
+	all := func(item history.Item) bool { return true }
+	old := history.Item{Type: history.Privmsg, Message: "old", Time: time.Now().UTC().Add(-2 * time.Hour)}
+	server.accounts.AddDirectMessage("alice", "bob", old)
+	if items := server.accounts.DirectMessages("alice", "bob", all, true, 0); len(items) != 0 {
+		t.Errorf("expired messages shouldn't be returned: %v", items)
+	}
+
+	// the next write discards it
+	server.accounts.AddDirectMessage("bob", "alice", history.Item{Type: history.Privmsg, Message: "new"})
+	if count := directMessageCount(server, "alice", "bob"); count != "1" {
+		t.Errorf("expected a count of 1, got %s", count)
+	}
+	if items := server.accounts.DirectMessages("alice", "bob", all, false, 0); len(items) != 1 || items[0].Message != "new" {
+		t.Errorf("unexpected stored messages: %v", items)
+	}
+}
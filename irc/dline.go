@@ -243,3 +243,79 @@ func (s *Server) loadDLines() {
 		return nil
 	})
 }
+
+// parseDlineHost parses an IP address or CIDR network, returning its canonical
+// string form along with whichever of the two it turned out to be.
+func parseDlineHost(host string) (hostString string, hostAddr net.IP, hostNet *net.IPNet, err error) {
+	_, hostNet, err = net.ParseCIDR(host)
+	if err == nil {
+		return hostNet.String(), nil, hostNet, nil
+	}
+	hostAddr = net.ParseIP(host)
+	if hostAddr == nil {
+		return "", nil, nil, errInvalidDlineHost
+	}
+	return hostAddr.String(), hostAddr, nil, nil
+}
+
+// addDline saves a D-Line for the given IP address or network to the datastore and applies it.
+func (server *Server) addDline(host string, info IPBanInfo) (hostString string, err error) {
+	hostString, hostAddr, hostNet, err := parseDlineHost(host)
+	if err != nil {
+		return
+	}
+
+	err = server.store.Update(func(tx *buntdb.Tx) error {
+		// assemble json from ban info
+		b, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+
+		tx.Set(fmt.Sprintf(keyDlineEntry, hostString), string(b), nil)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	if hostNet == nil {
+		server.dlines.AddIP(hostAddr, info.Time, info.Reason, info.OperReason, info.OperName)
+	} else {
+		server.dlines.AddNetwork(*hostNet, info.Time, info.Reason, info.OperReason, info.OperName)
+	}
+	return
+}
+
+// removeDline deletes the D-Line for the given IP address or network from the datastore and lifts it.
+func (server *Server) removeDline(host string) (hostString string, err error) {
+	hostString, hostAddr, hostNet, err := parseDlineHost(host)
+	if err != nil {
+		return
+	}
+
+	err = server.store.Update(func(tx *buntdb.Tx) error {
+		dlineKey := fmt.Sprintf(keyDlineEntry, hostString)
+
+		// check if it exists or not
+		val, err := tx.Get(dlineKey)
+		if val == "" {
+			return errNoExistingBan
+		} else if err != nil {
+			return err
+		}
+
+		tx.Delete(dlineKey)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	if hostNet == nil {
+		server.dlines.RemoveIP(hostAddr)
+	} else {
+		server.dlines.RemoveNetwork(*hostNet)
+	}
+	return
+}
@@ -0,0 +1,292 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+// Package dnsbl checks connecting clients against DNS blocklists.
+package dnsbl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oragono/oragono/irc/connection_limits"
+)
+
+// Action is what's done with clients listed in a DNSBL.
+type Action int
+
+const (
+	// ActionNone lets the client connect as usual.
+	ActionNone Action = iota
+	// ActionNotify lets the client connect, but marks it and tells opers about it.
+	ActionNotify
+	// ActionRequireSASL only lets the client connect if it logs in with SASL.
+	ActionRequireSASL
+	// ActionReject refuses the connection.
+	ActionReject
+)
+
+var (
+	actionNames = map[string]Action{
+		"notify":       ActionNotify,
+		"require-sasl": ActionRequireSASL,
+		"reject":       ActionReject,
+	}
+
+	// defaultTimeout is how long lookups can take if the config doesn't say
+	defaultTimeout = 5 * time.Second
+)
+
+// String returns the config name of the action.
+func (action Action) String() string {
+	for name, value := range actionNames {
+		if value == action {
+			return name
+		}
+	}
+	return "none"
+}
+
+// ListConfig controls how a single DNSBL is used.
+type ListConfig struct {
+	Host string
+	// Replies maps the addresses the list replies with to actions, "*" matches
+	// any reply that isn't listed
+	Replies map[string]string
+	Reason  string
+}
+
+// Config controls DNSBL checking.
+type Config struct {
+	Enabled bool
+	// Resolver is the address of the DNS server to use, instead of the system's
+	Resolver      string
+	Timeout       time.Duration
+	CacheDuration time.Duration `yaml:"cache-duration"`
+	Exempted      []string
+	Lists         []ListConfig
+}
+
+// Result is the outcome of checking an IP against the DNSBLs.
+type Result struct {
+	Action Action
+	// List and Reply are the DNSBL and reply that decided the action
+	List   string
+	Reply  string
+	Reason string
+}
+
+// list is a DNSBL, ready for use.
+type list struct {
+	host    string
+	replies map[string]Action
+	reason  string
+}
+
+// cacheEntry is a result that was looked up recently.
+type cacheEntry struct {
+	result  Result
+	expires time.Time
+}
+
+// Checker checks IPs against the configured DNSBLs, caching the results.
+type Checker struct {
+	sync.Mutex
+
+	enabled       bool
+	resolver      *net.Resolver
+	timeout       time.Duration
+	cacheDuration time.Duration
+	lists         []list
+	exempted      connection_limits.Exemptions
+	// cache holds IP -> the result of its last lookup
+	cache map[string]cacheEntry
+}
+
+// NewChecker returns a new DNSBL checker.
+// The checker is functional, but disabled; it can be enabled via `ApplyConfig`.
+func NewChecker() *Checker {
+	return &Checker{
+		cache: make(map[string]cacheEntry),
+	}
+}
+
+// ApplyConfig atomically applies a config update to the checker.
+func (checker *Checker) ApplyConfig(config Config) error {
+	exempted, err := connection_limits.ParseExemptions(config.Exempted)
+	if err != nil {
+		return err
+	}
+
+	var lists []list
+	for _, listConfig := range config.Lists {
+		host := strings.Trim(listConfig.Host, ".")
+		if host == "" {
+			return fmt.Errorf("DNSBL lists must have a host")
+		}
+		replies := make(map[string]Action)
+		for reply, name := range listConfig.Replies {
+			action, exists := actionNames[strings.ToLower(name)]
+			if !exists {
+				return fmt.Errorf("Unknown action [%s] for DNSBL [%s]", name, host)
+			}
+			if reply != "*" && net.ParseIP(reply) == nil {
+				return fmt.Errorf("Could not parse reply [%s] for DNSBL [%s]", reply, host)
+			}
+			replies[reply] = action
+		}
+		lists = append(lists, list{
+			host:    host,
+			replies: replies,
+			reason:  listConfig.Reason,
+		})
+	}
+
+	resolver := net.DefaultResolver
+	if config.Resolver != "" {
+		address := config.Resolver
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, "53")
+		}
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, address)
+			},
+		}
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	checker.Lock()
+	defer checker.Unlock()
+
+	checker.enabled = config.Enabled
+	checker.resolver = resolver
+	checker.timeout = timeout
+	checker.cacheDuration = config.CacheDuration
+	checker.lists = lists
+	checker.exempted = exempted
+	// the lists or their actions may have changed
+	checker.cache = make(map[string]cacheEntry)
+
+	return nil
+}
+
+// Check looks the given IP up in the DNSBLs, returning the most severe action
+// any of them calls for. Errors from the lists are returned alongside the result
+// of the lists that could be checked.
+func (checker *Checker) Check(addr net.IP) (result Result, err error) {
+	checker.Lock()
+	if !checker.enabled || len(checker.lists) == 0 || checker.exempted.Contains(addr) {
+		checker.Unlock()
+		return
+	}
+	key := addr.String()
+	if entry, exists := checker.cache[key]; exists {
+		if time.Now().Before(entry.expires) {
+			checker.Unlock()
+			return entry.result, nil
+		}
+		delete(checker.cache, key)
+	}
+	resolver, timeout, cacheDuration, lists := checker.resolver, checker.timeout, checker.cacheDuration, checker.lists
+	checker.Unlock()
+
+	// look the IP up in all the lists at once
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	results := make([]Result, len(lists))
+	errs := make([]error, len(lists))
+	var wg sync.WaitGroup
+	for i := range lists {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = lists[i].lookup(ctx, resolver, addr)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range lists {
+		if errs[i] != nil && err == nil {
+			err = errs[i]
+		}
+		if result.Action < results[i].Action {
+			result = results[i]
+		}
+	}
+
+	// failed lookups aren't cached, so the IP is checked again next time
+	if err == nil && 0 < cacheDuration {
+		checker.Lock()
+		now := time.Now()
+		for ip, entry := range checker.cache {
+			if now.After(entry.expires) {
+				delete(checker.cache, ip)
+			}
+		}
+		checker.cache[key] = cacheEntry{
+			result:  result,
+			expires: now.Add(cacheDuration),
+		}
+		checker.Unlock()
+	}
+
+	return
+}
+
+// lookup checks the given IP against this list.
+func (l *list) lookup(ctx context.Context, resolver *net.Resolver, addr net.IP) (result Result, err error) {
+	addrs, err := resolver.LookupIPAddr(ctx, queryName(addr, l.host))
+	if err != nil {
+		// the IP isn't listed
+		if dnsErr, ok := err.(*net.DNSError); ok && !dnsErr.Temporary() {
+			return result, nil
+		}
+		return result, fmt.Errorf("DNSBL [%s] lookup failed: %v", l.host, err)
+	}
+
+	for _, replyAddr := range addrs {
+		reply := replyAddr.IP.String()
+		action, exists := l.replies[reply]
+		if !exists {
+			action = l.replies["*"]
+		}
+		if result.Action < action {
+			result = Result{
+				Action: action,
+				List:   l.host,
+				Reply:  reply,
+				Reason: l.reason,
+			}
+		}
+	}
+	return result, nil
+}
+
+// queryName returns the name to look up to check the given IP against the
+// given list: the reversed octets of IPv4 addresses, or the reversed nibbles of
+// IPv6 addresses, followed by the list's host.
+func queryName(addr net.IP, host string) string {
+	var labels []string
+	if ip4 := addr.To4(); ip4 != nil {
+		for i := len(ip4) - 1; 0 <= i; i-- {
+			labels = append(labels, fmt.Sprintf("%d", ip4[i]))
+		}
+	} else {
+		ip6 := addr.To16()
+		for i := len(ip6) - 1; 0 <= i; i-- {
+			labels = append(labels, fmt.Sprintf("%x", ip6[i]&0xf), fmt.Sprintf("%x", ip6[i]>>4))
+		}
+	}
+	// the trailing dot stops the resolver from trying search domains
+	return strings.Join(labels, ".") + "." + host + "."
+}
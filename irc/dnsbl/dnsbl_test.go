@@ -0,0 +1,211 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package dnsbl
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDNS is a tiny DNS server that answers A queries from a fixed set of records,
+// standing in for real DNSBLs.
+type fakeDNS struct {
+	sync.Mutex
+	conn    net.PacketConn
+	records map[string]net.IP // lowercased name without the trailing dot -> reply
+	queries int
+}
+
+func newFakeDNS(t *testing.T, records map[string]net.IP) *fakeDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeDNS{conn: conn, records: records}
+	go server.serve()
+	return server
+}
+
+func (server *fakeDNS) Address() string {
+	return server.conn.LocalAddr().String()
+}
+
+func (server *fakeDNS) Queries() int {
+	server.Lock()
+	defer server.Unlock()
+	return server.queries
+}
+
+func (server *fakeDNS) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := server.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if response := server.respond(buf[:n]); response != nil {
+			server.conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (server *fakeDNS) respond(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	// read the question's name, type and class
+	var labels []string
+	pos := 12
+	for pos < len(query) && query[pos] != 0 {
+		length := int(query[pos])
+		if len(query) < pos+1+length {
+			return nil
+		}
+		labels = append(labels, string(query[pos+1:pos+1+length]))
+		pos += 1 + length
+	}
+	pos += 5
+	if len(query) < pos {
+		return nil
+	}
+	name := strings.ToLower(strings.Join(labels, "."))
+	qtype := binary.BigEndian.Uint16(query[pos-4 : pos-2])
+
+	server.Lock()
+	reply, listed := server.records[name]
+	if qtype == 1 {
+		server.queries++
+	}
+	server.Unlock()
+
+	response := make([]byte, pos, pos+16)
+	copy(response, query[:pos])
+	flags := uint16(0x8180) // response, recursion desired and available
+	if !listed {
+		flags |= 3 // NXDOMAIN
+	}
+	binary.BigEndian.PutUint16(response[2:], flags)
+	binary.BigEndian.PutUint16(response[4:], 1)
+	binary.BigEndian.PutUint16(response[8:], 0)
+	binary.BigEndian.PutUint16(response[10:], 0)
+	if listed && qtype == 1 {
+		binary.BigEndian.PutUint16(response[6:], 1)
+		response = append(response, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		response = append(response, reply.To4()...)
+	} else {
+		binary.BigEndian.PutUint16(response[6:], 0)
+	}
+	return response
+}
+
+func newTestChecker(t *testing.T, dns *fakeDNS) *Checker {
+	checker := NewChecker()
+	err := checker.ApplyConfig(Config{
+		Enabled:       true,
+		Resolver:      dns.Address(),
+		Timeout:       2 * time.Second,
+		CacheDuration: time.Hour,
+		Exempted:      []string{"192.0.2.0/24"},
+		Lists: []ListConfig{
+			{
+				Host:    "rbl.test",
+				Replies: map[string]string{"127.0.0.2": "reject", "*": "notify"},
+				Reason:  "listed in rbl.test",
+			},
+			{
+				Host:    "proxies.test",
+				Replies: map[string]string{"127.0.0.3": "require-sasl"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return checker
+}
+
+func TestQueryName(t *testing.T) {
+	if name := queryName(net.ParseIP("203.0.113.7"), "rbl.test"); name != "7.113.0.203.rbl.test." {
+		t.Errorf("bad IPv4 query name %s", name)
+	}
+	name := queryName(net.ParseIP("2001:db8::1"), "rbl.test")
+	if name != "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.rbl.test." {
+		t.Errorf("bad IPv6 query name %s", name)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dns := newFakeDNS(t, map[string]net.IP{
+		"1.113.0.203.rbl.test":     net.ParseIP("127.0.0.2"),
+		"2.113.0.203.rbl.test":     net.ParseIP("127.0.0.4"),
+		"3.113.0.203.proxies.test": net.ParseIP("127.0.0.3"),
+		"4.113.0.203.proxies.test": net.ParseIP("127.0.0.4"),
+		"3.113.0.203.rbl.test":     net.ParseIP("127.0.0.4"),
+		"7.2.0.192.rbl.test":       net.ParseIP("127.0.0.2"),
+	})
+	defer dns.conn.Close()
+	checker := newTestChecker(t, dns)
+
+	cases := []struct {
+		ip     string
+		action Action
+		list   string
+	}{
+		{"203.0.113.1", ActionReject, "rbl.test"},
+		// replies that aren't mapped fall back to "*"
+		{"203.0.113.2", ActionNotify, "rbl.test"},
+		// the most severe action wins
+		{"203.0.113.3", ActionRequireSASL, "proxies.test"},
+		// and replies that aren't mapped at all are ignored
+		{"203.0.113.4", ActionNone, ""},
+		{"203.0.113.5", ActionNone, ""},
+		// exempted IPs aren't looked up
+		{"192.0.2.7", ActionNone, ""},
+	}
+	for _, c := range cases {
+		result, err := checker.Check(net.ParseIP(c.ip))
+		if err != nil {
+			t.Errorf("%s: %v", c.ip, err)
+		}
+		if result.Action != c.action || result.List != c.list {
+			t.Errorf("%s: expected %v from %s, got %v from %s", c.ip, c.action, c.list, result.Action, result.List)
+		}
+	}
+	if result, _ := checker.Check(net.ParseIP("203.0.113.1")); result.Reason != "listed in rbl.test" || result.Reply != "127.0.0.2" {
+		t.Errorf("bad result %#v", result)
+	}
+
+	// results are cached
+	queries := dns.Queries()
+	for _, c := range cases {
+		checker.Check(net.ParseIP(c.ip))
+	}
+	if dns.Queries() != queries {
+		t.Errorf("cached results should be used, made %d more queries", dns.Queries()-queries)
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	checker := NewChecker()
+	bad := []Config{
+		{Lists: []ListConfig{{Host: ""}}},
+		{Lists: []ListConfig{{Host: "rbl.test", Replies: map[string]string{"127.0.0.2": "explode"}}}},
+		{Lists: []ListConfig{{Host: "rbl.test", Replies: map[string]string{"two": "reject"}}}},
+		{Exempted: []string{"not an ip"}},
+	}
+	for _, config := range bad {
+		if checker.ApplyConfig(config) == nil {
+			t.Errorf("config %#v should be rejected", config)
+		}
+	}
+
+	// disabled checkers don't look anything up
+	if result, err := checker.Check(net.ParseIP("203.0.113.1")); result.Action != ActionNone || err != nil {
+		t.Errorf("disabled checker returned %#v, %v", result, err)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+
+	"github.com/oragono/oragono/irc/dnsbl"
+)
+
+func TestDNSBLRequireSASL(t *testing.T) {
+	server, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	listing := dnsbl.Result{
+		Action: dnsbl.ActionRequireSASL,
+		List:   "proxies.test",
+		Reply:  "127.0.0.3",
+		Reason: "open proxy",
+	}
+
+	// listed clients can't connect without logging in
+	mallory := openListedTestClient(server, listing)
+	mallory.send("NICK mallory")
+	mallory.send("USER u 0 * :Test User")
+	mallory.expect(t, "ERROR", "SASL", "open proxy")
+	if server.clients.Get("mallory") != nil {
+		t.Error("listed client shouldn't have registered")
+	}
+
+	// but can once they have
+	alice := openListedTestClient(server, listing)
+	alice.login(t, server, "alice")
+	alice.register(t, "alice")
+}
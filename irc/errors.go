@@ -9,31 +9,58 @@ import "errors"
 
 // Runtime Errors
 var (
-	errAccountAlreadyRegistered       = errors.New("Account already exists")
-	errAccountCreation                = errors.New("Account could not be created")
-	errAccountDoesNotExist            = errors.New("Account does not exist")
-	errAccountNotLoggedIn             = errors.New("You're not logged into an account")
-	errAccountVerificationFailed      = errors.New("Account verification failed")
-	errAccountVerificationInvalidCode = errors.New("Invalid account verification code")
-	errAccountUnverified              = errors.New("Account is not yet verified")
-	errAccountAlreadyVerified         = errors.New("Account is already verified")
-	errAccountInvalidCredentials      = errors.New("Invalid account credentials")
-	errAccountTooManyNicks            = errors.New("Account has too many reserved nicks")
-	errAccountNickReservationFailed   = errors.New("Could not (un)reserve nick")
-	errAccountCantDropPrimaryNick     = errors.New("Can't unreserve primary nickname")
-	errCallbackFailed                 = errors.New("Account verification could not be sent")
-	errCertfpAlreadyExists            = errors.New("An account already exists with your certificate")
-	errChannelAlreadyRegistered       = errors.New("Channel is already registered")
-	errChannelNameInUse               = errors.New("Channel name in use")
-	errInvalidChannelName             = errors.New("Invalid channel name")
-	errMonitorLimitExceeded           = errors.New("Monitor limit exceeded")
-	errNickMissing                    = errors.New("nick missing")
-	errNicknameInUse                  = errors.New("nickname in use")
-	errNicknameReserved               = errors.New("nickname is reserved")
-	errNoExistingBan                  = errors.New("Ban does not exist")
-	errNoSuchChannel                  = errors.New("No such channel")
-	errRenamePrivsNeeded              = errors.New("Only chanops can rename channels")
-	errSaslFail                       = errors.New("SASL failed")
+	errAcceptExists                    = errors.New("Nickname is already on the accept list")
+	errAcceptListFull                  = errors.New("Accept list is full")
+	errAcceptNotFound                  = errors.New("Nickname is not on the accept list")
+	errAccountAlreadyRegistered        = errors.New("Account already exists")
+	errAccountCreation                 = errors.New("Account could not be created")
+	errAccountDoesNotExist             = errors.New("Account does not exist")
+	errAccountNotLoggedIn              = errors.New("You're not logged into an account")
+	errAccountVerificationFailed       = errors.New("Account verification failed")
+	errAccountVerificationInvalidCode  = errors.New("Invalid account verification code")
+	errAccountUnverified               = errors.New("Account is not yet verified")
+	errAccountAlreadyVerified          = errors.New("Account is already verified")
+	errAccountInvalidCredentials       = errors.New("Invalid account credentials")
+	errAccountTooManyNicks             = errors.New("Account has too many reserved nicks")
+	errAccountNickReservationFailed    = errors.New("Could not (un)reserve nick")
+	errAccountCantDropPrimaryNick      = errors.New("Can't unreserve primary nickname")
+	errAccountCantRemoveLastCredential = errors.New("Can't remove the account's only credential")
+	errAccountNoResetCallback          = errors.New("Account has no e-mail address to send a reset code to")
+	errAccountResetThrottled           = errors.New("A reset code was sent to this account recently, please wait before requesting another")
+	errAccountSuspended                = errors.New("Account has been suspended")
+	errAccountTooManyCertfps           = errors.New("Account has too many certificate fingerprints")
+	errCallbackFailed                  = errors.New("Account verification could not be sent")
+	errCertfpAlreadyExists             = errors.New("An account already exists with your certificate")
+	errCertfpAlreadyYours              = errors.New("That certificate fingerprint is already authorized for your account")
+	errChannelAlreadyRegistered        = errors.New("Channel is already registered")
+	errChannelNameInUse                = errors.New("Channel name in use")
+	errChannelNotOwnedByAccount        = errors.New("Channel not owned by the specified account")
+	errInsufficientPrivs               = errors.New("Insufficient privileges")
+	errInvalidCertfp                   = errors.New("Invalid certificate fingerprint")
+	errInvalidChannelName              = errors.New("Invalid channel name")
+	errInvalidDlineHost                = errors.New("Could not parse IP address or CIDR network")
+	errInvalidExtban                   = errors.New("Invalid extban")
+	errInvalidFloodLimits              = errors.New("Invalid flood limits")
+	errInvalidParams                   = errors.New("Invalid parameters")
+	errInvalidVHost                    = errors.New("Invalid vhost")
+	errLinkAlreadyExists               = errors.New("Server is already linked")
+	errLinkBadCertfp                   = errors.New("Certificate fingerprint doesn't match")
+	errLinkBadPassword                 = errors.New("Bad link password")
+	errLinkNetworkMismatch             = errors.New("Server is on a different network")
+	errLinkNoSuchServer                = errors.New("No link block for server")
+	errLinkProtocol                    = errors.New("Protocol error")
+	errLinkSIDCollision                = errors.New("Server ID is already in use")
+	errMonitorLimitExceeded            = errors.New("Monitor limit exceeded")
+	errNickMissing                     = errors.New("nick missing")
+	errNicknameInUse                   = errors.New("nickname in use")
+	errNicknameReserved                = errors.New("nickname is reserved")
+	errNoExistingBan                   = errors.New("Ban does not exist")
+	errNoSuchCertfp                    = errors.New("Certificate fingerprint is not associated with the account")
+	errNoSuchChannel                   = errors.New("No such channel")
+	errNoVHostRequest                  = errors.New("No pending vhost request")
+	errRenamePrivsNeeded               = errors.New("Only chanops can rename channels")
+	errSaslFail                        = errors.New("SASL failed")
+	errVHostRequestCooldown            = errors.New("Too soon to request another vhost")
 )
 
 // Socket Errors
@@ -52,17 +79,22 @@ var (
 
 // Config Errors
 var (
-	ErrDatastorePathMissing    = errors.New("Datastore path missing")
-	ErrInvalidCertKeyPair      = errors.New("tls cert+key: invalid pair")
-	ErrLimitsAreInsane         = errors.New("Limits aren't setup properly, check them and make them sane")
-	ErrLineLengthsTooSmall     = errors.New("Line lengths must be 512 or greater (check the linelen section under server->limits)")
-	ErrLoggerExcludeEmpty      = errors.New("Encountered logging type '-' with no type to exclude")
-	ErrLoggerFilenameMissing   = errors.New("Logging configuration specifies 'file' method but 'filename' is empty")
-	ErrLoggerHasNoTypes        = errors.New("Logger has no types to log")
-	ErrNetworkNameMissing      = errors.New("Network name missing")
-	ErrNoFingerprintOrPassword = errors.New("Fingerprint or password needs to be specified")
-	ErrNoListenersDefined      = errors.New("Server listening addresses missing")
-	ErrOperClassDependencies   = errors.New("OperClasses contains a looping dependency, or a class extends from a class that doesn't exist")
-	ErrServerNameMissing       = errors.New("Server name missing")
-	ErrServerNameNotHostname   = errors.New("Server name must match the format of a hostname")
+	ErrAPITokenEmpty            = errors.New("API tokens can't be empty")
+	ErrAPITokensMissing         = errors.New("API listener is enabled but no API tokens are configured")
+	ErrAuthScriptCommandMissing = errors.New("Authentication script is enabled but its command is missing")
+	ErrCloakSecretMissing       = errors.New("Cloaking is enabled but no cloak secret is configured")
+	ErrDatastorePathMissing     = errors.New("Datastore path missing")
+	ErrInvalidCertKeyPair       = errors.New("tls cert+key: invalid pair")
+	ErrLimitsAreInsane          = errors.New("Limits aren't setup properly, check them and make them sane")
+	ErrLineLengthsTooSmall      = errors.New("Line lengths must be 512 or greater (check the linelen section under server->limits)")
+	ErrLinkingTLSMissing        = errors.New("Linking listener is enabled but no TLS certificate is configured")
+	ErrLoggerExcludeEmpty       = errors.New("Encountered logging type '-' with no type to exclude")
+	ErrLoggerFilenameMissing    = errors.New("Logging configuration specifies 'file' method but 'filename' is empty")
+	ErrLoggerHasNoTypes         = errors.New("Logger has no types to log")
+	ErrNetworkNameMissing       = errors.New("Network name missing")
+	ErrNoFingerprintOrPassword  = errors.New("Fingerprint or password needs to be specified")
+	ErrNoListenersDefined       = errors.New("Server listening addresses missing")
+	ErrOperClassDependencies    = errors.New("OperClasses contains a looping dependency, or a class extends from a class that doesn't exist")
+	ErrServerNameMissing        = errors.New("Server name missing")
+	ErrServerNameNotHostname    = errors.New("Server name must match the format of a hostname")
 )
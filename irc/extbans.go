@@ -0,0 +1,111 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"regexp"
+	"strings"
+)
+
+// extbans let the channel mask lists (bans, excepts, invexes and quiets) match clients
+// on something other than their nickmask. they look like `$<type>[:<arg>]`, and the
+// type can be prefixed with `~` to negate it, so `$~a` matches unregistered clients.
+const (
+	extbanPrefix = "$"
+
+	extbanAccount  = 'a' // $a matches logged-in clients, $a:<mask> matches account names
+	extbanChannel  = 'c' // $c:<channel> matches members of the channel
+	extbanRealname = 'r' // $r:<mask> matches realnames
+)
+
+// extbanTypes is advertised in the EXTBAN isupport token.
+var extbanTypes = string([]byte{extbanAccount, extbanChannel, extbanRealname})
+
+// extban is a parsed extban mask.
+type extban struct {
+	negate  bool
+	banType byte
+	arg     string
+	// matcher is set for the types that take a glob argument
+	matcher *regexp.Regexp
+}
+
+// isExtban returns whether the (casefolded) mask is an extban rather than a nickmask.
+func isExtban(mask string) bool {
+	return strings.HasPrefix(mask, extbanPrefix)
+}
+
+// casefoldMask casefolds a mask for a mask list. extbans are folded with foldText,
+// since their arguments (like realnames) can contain characters that Casefold rejects,
+// and are matched against text that's folded the same way.
+func casefoldMask(mask string) (string, error) {
+	if isExtban(mask) {
+		return foldText(mask), nil
+	}
+	return Casefold(mask)
+}
+
+// parseExtban parses a casefolded extban mask.
+func parseExtban(mask string) (result extban, err error) {
+	mask = strings.TrimPrefix(mask, extbanPrefix)
+	if strings.HasPrefix(mask, "~") {
+		result.negate = true
+		mask = mask[1:]
+	}
+	if mask == "" {
+		return result, errInvalidExtban
+	}
+	result.banType = mask[0]
+	if len(mask) > 1 {
+		if mask[1] != ':' || len(mask) == 2 {
+			return result, errInvalidExtban
+		}
+		result.arg = mask[2:]
+	}
+
+	switch result.banType {
+	case extbanAccount:
+		if result.arg != "" {
+			result.matcher, err = regexp.Compile("^" + globToRegexp(result.arg) + "$")
+		}
+	case extbanRealname:
+		if result.arg == "" {
+			return result, errInvalidExtban
+		}
+		result.matcher, err = regexp.Compile("^" + globToRegexp(result.arg) + "$")
+	case extbanChannel:
+		result.arg, err = CasefoldChannel(result.arg)
+	default:
+		err = errInvalidExtban
+	}
+	if err != nil {
+		err = errInvalidExtban
+	}
+	return
+}
+
+// match returns whether the extban matches the given client.
+func (eb *extban) match(client *Client) (matched bool) {
+	switch eb.banType {
+	case extbanAccount:
+		account := client.Account()
+		if eb.matcher == nil {
+			matched = account != ""
+		} else {
+			matched = account != "" && eb.matcher.MatchString(account)
+		}
+	case extbanRealname:
+		matched = eb.matcher.MatchString(foldText(client.Realname()))
+	case extbanChannel:
+		// don't take the channel's lock here, we may be checking a mask list of that channel
+		target := client.server.channels.Get(eb.arg)
+		for _, channel := range client.Channels() {
+			if channel == target {
+				matched = true
+				break
+			}
+		}
+	}
+	return matched != eb.negate
+}
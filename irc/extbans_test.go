@@ -0,0 +1,78 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+)
+
+func TestParseExtban(t *testing.T) {
+	valid := []string{"$a", "$~a", "$a:dan*", "$r:*bot*", "$c:#chan"}
+	for _, mask := range valid {
+		if _, err := parseExtban(mask); err != nil {
+			t.Errorf("%s should be a valid extban, got %v", mask, err)
+		}
+	}
+
+	invalid := []string{"$", "$~", "$x", "$a:", "$r", "$c:chan", "$ab"}
+	for _, mask := range invalid {
+		if _, err := parseExtban(mask); err == nil {
+			t.Errorf("%s should be an invalid extban", mask)
+		}
+	}
+}
+
+func TestExtbanMatch(t *testing.T) {
+	loggedIn := &Client{account: "dan", realname: "Dan Oaks"}
+	loggedOut := &Client{realname: "some bot"}
+	accented := &Client{realname: "ÉLODIE Ｍartin"}
+
+	cases := []struct {
+		mask    string
+		client  *Client
+		matched bool
+	}{
+		{"$a", loggedIn, true},
+		{"$a", loggedOut, false},
+		{"$~a", loggedIn, false},
+		{"$~a", loggedOut, true},
+		{"$a:d?n", loggedIn, true},
+		{"$a:shivaram", loggedIn, false},
+		{"$r:*oaks", loggedIn, true},
+		{"$r:*bot*", loggedIn, false},
+		{"$r:*bot*", loggedOut, true},
+		{"$r:Élodie*", accented, true},
+		{"$r:*martin", accented, true},
+		{"$r:élodie", accented, false},
+	}
+	for _, c := range cases {
+		mask, err := casefoldMask(c.mask)
+		if err != nil {
+			t.Fatalf("could not casefold %s: %v", c.mask, err)
+		}
+		eb, err := parseExtban(mask)
+		if err != nil {
+			t.Fatalf("could not parse %s: %v", c.mask, err)
+		}
+		if eb.match(c.client) != c.matched {
+			t.Errorf("%s matching %#v should be %t", c.mask, c.client.realname, c.matched)
+		}
+	}
+}
+
+func TestUserMaskSetExtbans(t *testing.T) {
+	set := NewUserMaskSet()
+	set.Add("$a:dan")
+	set.Add("*!*@example.com")
+
+	if !set.MatchClient(&Client{account: "dan", nickMaskCasefolded: "dan!d@localhost"}) {
+		t.Error("extban in the set should match")
+	}
+	if !set.MatchClient(&Client{nickMaskCasefolded: "bob!b@example.com"}) {
+		t.Error("nickmask in the set should match")
+	}
+	if set.MatchClient(&Client{account: "bob", nickMaskCasefolded: "bob!b@localhost"}) {
+		t.Error("client shouldn't match")
+	}
+}
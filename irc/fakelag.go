@@ -48,8 +48,9 @@ func NewFakelag(window time.Duration, burstLimit uint, throttleMessagesPerWindow
 	}
 }
 
-// register a new command, sleep if necessary to delay it
-func (fl *Fakelag) Touch() {
+// register a new command, sleep if necessary to delay it.
+// returns whether this command moved the client from bursting to being throttled
+func (fl *Fakelag) Touch() (activated bool) {
 	if fl == nil {
 		return
 	}
@@ -71,6 +72,7 @@ func (fl *Fakelag) Touch() {
 			fl.burstCount = 0
 			// transition to throttling
 			fl.state = FakelagThrottled
+			activated = true
 			// continue to throttling logic
 		} else {
 			return
@@ -81,7 +83,7 @@ func (fl *Fakelag) Touch() {
 		if elapsed > fl.cooldown {
 			// let them burst again
 			fl.state = FakelagBursting
-			return
+			return false
 		}
 		// space them out by at least window/messagesperwindow
 		sleepDuration := time.Duration((int64(fl.window) / int64(fl.throttleMessagesPerWindow)) - int64(elapsed))
@@ -91,4 +93,5 @@ func (fl *Fakelag) Touch() {
 			fl.lastTouch = fl.nowFunc()
 		}
 	}
+	return
 }
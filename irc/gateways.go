@@ -68,7 +68,7 @@ func (client *Client) ApplyProxiedIP(proxiedIP string, tls bool) (exiting bool)
 		return true
 	}
 
-	isBanned, banMsg := client.server.checkBans(parsedProxiedIP)
+	isBanned, banMsg, listing := client.server.checkBans(parsedProxiedIP)
 	if isBanned {
 		client.Quit(banMsg)
 		return true
@@ -76,8 +76,9 @@ func (client *Client) ApplyProxiedIP(proxiedIP string, tls bool) (exiting bool)
 
 	// given IP is sane! override the client's current IP
 	client.proxiedIP = parsedProxiedIP
+	client.dnsblListing = listing
 	client.rawHostname = utils.LookupHostname(proxiedIP)
-	client.hostname = client.rawHostname
+	client.updateCloaks()
 
 	// set tls info
 	client.certfp = ""
@@ -4,9 +4,11 @@
 package irc
 
 import (
+	"github.com/oragono/oragono/irc/cloaks"
 	"github.com/oragono/oragono/irc/isupport"
 	"github.com/oragono/oragono/irc/modes"
 	"sync/atomic"
+	"time"
 )
 
 func (server *Server) MaxSendQBytes() int {
@@ -35,6 +37,12 @@ func (server *Server) Password() []byte {
 	return server.password
 }
 
+func (server *Server) NetworkName() string {
+	server.configurableStateMutex.RLock()
+	defer server.configurableStateMutex.RUnlock()
+	return server.networkName
+}
+
 func (server *Server) RecoverFromErrors() bool {
 	server.configurableStateMutex.RLock()
 	defer server.configurableStateMutex.RUnlock()
@@ -83,6 +91,66 @@ func (server *Server) FakelagConfig() *FakelagConfig {
 	return &server.config.Fakelag
 }
 
+func (server *Server) directMessageHistoryLimit() int {
+	server.configurableStateMutex.RLock()
+	defer server.configurableStateMutex.RUnlock()
+	return server.config.directMessageHistoryLimit()
+}
+
+func (server *Server) ChannelHistoryConfig() *ChannelHistoryConfig {
+	server.configurableStateMutex.RLock()
+	defer server.configurableStateMutex.RUnlock()
+	if server.config == nil {
+		return nil
+	}
+	return &server.config.Channels.History
+}
+
+func (server *Server) ChannelFloodLockout() time.Duration {
+	server.configurableStateMutex.RLock()
+	defer server.configurableStateMutex.RUnlock()
+	if server.config == nil {
+		return 0
+	}
+	return server.config.Channels.FloodProtection.Lockout
+}
+
+func (server *Server) CloakConfig() *cloaks.CloakConfig {
+	server.configurableStateMutex.RLock()
+	defer server.configurableStateMutex.RUnlock()
+	if server.config == nil {
+		return nil
+	}
+	return &server.config.Server.Cloaks
+}
+
+func (server *Server) OperConfigs() map[string]*OperConfig {
+	server.configurableStateMutex.RLock()
+	defer server.configurableStateMutex.RUnlock()
+	if server.config == nil {
+		return nil
+	}
+	return server.config.Opers
+}
+
+func (server *Server) WebSocketAllowedOrigins() []string {
+	server.configurableStateMutex.RLock()
+	defer server.configurableStateMutex.RUnlock()
+	if server.config == nil {
+		return nil
+	}
+	return server.config.Server.WebSockets.AllowedOrigins
+}
+
+func (server *Server) APITokens() []string {
+	server.configurableStateMutex.RLock()
+	defer server.configurableStateMutex.RUnlock()
+	if server.config == nil {
+		return nil
+	}
+	return server.config.Debug.APITokens
+}
+
 func (client *Client) Nick() string {
 	client.stateMutex.RLock()
 	defer client.stateMutex.RUnlock()
@@ -95,6 +163,12 @@ func (client *Client) NickMaskString() string {
 	return client.nickMaskString
 }
 
+func (client *Client) NickMaskCasefolded() string {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	return client.nickMaskCasefolded
+}
+
 func (client *Client) NickCasefolded() string {
 	client.stateMutex.RLock()
 	defer client.stateMutex.RUnlock()
@@ -131,6 +205,55 @@ func (client *Client) Destroyed() bool {
 	return client.isDestroyed
 }
 
+func (client *Client) Primary() *Client {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	return client.primary
+}
+
+func (client *Client) Sessions() []*Client {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	sessions := make([]*Client, len(client.sessions))
+	copy(sessions, client.sessions)
+	return sessions
+}
+
+func (client *Client) QuitMessage() string {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	return client.quitMessage
+}
+
+func (client *Client) AlwaysOn() bool {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	return client.alwaysOn
+}
+
+func (client *Client) SetAlwaysOn(alwaysOn bool) {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	client.alwaysOn = alwaysOn
+}
+
+func (client *Client) IsRemote() bool {
+	return client.link != nil
+}
+
+func (client *Client) ServerName() string {
+	if client.link != nil {
+		return client.remoteServer
+	}
+	return client.server.name
+}
+
+func (client *Client) NickTime() time.Time {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	return client.nickTime
+}
+
 func (client *Client) Account() string {
 	client.stateMutex.RLock()
 	defer client.stateMutex.RUnlock()
@@ -236,6 +359,12 @@ func (channel *Channel) Members() (result []*Client) {
 	return channel.membersCache
 }
 
+func (channel *Channel) CreatedTime() time.Time {
+	channel.stateMutex.RLock()
+	defer channel.stateMutex.RUnlock()
+	return channel.createdTime
+}
+
 func (channel *Channel) UserLimit() uint64 {
 	channel.stateMutex.RLock()
 	defer channel.stateMutex.RUnlock()
@@ -260,6 +389,12 @@ func (channel *Channel) setKey(key string) {
 	channel.key = key
 }
 
+func (channel *Channel) FloodLimits() ChannelFloodLimits {
+	channel.stateMutex.RLock()
+	defer channel.stateMutex.RUnlock()
+	return channel.floodLimits
+}
+
 func (channel *Channel) HasMode(mode modes.Mode) bool {
 	channel.stateMutex.RLock()
 	defer channel.stateMutex.RUnlock()
@@ -272,10 +407,18 @@ func (channel *Channel) Founder() string {
 	return channel.registeredFounder
 }
 
+func (channel *Channel) Topic() string {
+	channel.stateMutex.RLock()
+	defer channel.stateMutex.RUnlock()
+	return channel.topic
+}
+
 // set a channel mode, return whether it was already set
 func (channel *Channel) setMode(mode modes.Mode, enable bool) (already bool) {
 	channel.stateMutex.Lock()
 	already = (channel.flags[mode] == enable)
+	// an explicit change overrides any flood protection lockout
+	delete(channel.floodLockouts, mode)
 	if !already {
 		if enable {
 			channel.flags[mode] = true
@@ -9,9 +9,7 @@ package irc
 import (
 	"bytes"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
-	"net"
 	"os"
 	"runtime"
 	"runtime/debug"
@@ -20,17 +18,18 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/goshuirc/irc-go/ircfmt"
 	"github.com/goshuirc/irc-go/ircmatch"
 	"github.com/goshuirc/irc-go/ircmsg"
 	"github.com/oragono/oragono/irc/caps"
 	"github.com/oragono/oragono/irc/custime"
+	"github.com/oragono/oragono/irc/history"
 	"github.com/oragono/oragono/irc/modes"
 	"github.com/oragono/oragono/irc/passwd"
 	"github.com/oragono/oragono/irc/sno"
 	"github.com/oragono/oragono/irc/utils"
-	"github.com/tidwall/buntdb"
 )
 
 // ACC [REGISTER|VERIFY] ...
@@ -239,14 +238,59 @@ func accVerifyHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb
 	return false
 }
 
+// ACCEPT <nick>{,<nick>}
+// ACCEPT *
+func acceptHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	nick := client.Nick()
+	if msg.Params[0] == "*" {
+		for _, accepted := range client.AcceptedNicks() {
+			rb.Add(nil, server.name, RPL_ACCEPTLIST, nick, accepted)
+		}
+		rb.Add(nil, server.name, RPL_ENDOFACCEPT, nick, client.t("End of /ACCEPT list"))
+		return false
+	}
+
+	changed := false
+	for _, target := range strings.Split(msg.Params[0], ",") {
+		remove := strings.HasPrefix(target, "-")
+		target = strings.TrimPrefix(strings.TrimPrefix(target, "-"), "+")
+		casefoldedTarget, err := CasefoldName(target)
+		if err != nil {
+			rb.Add(nil, server.name, ERR_NOSUCHNICK, nick, target, client.t("No such nick"))
+			continue
+		}
+
+		if remove {
+			err = client.removeAccepted(casefoldedTarget)
+			if err == errAcceptNotFound {
+				rb.Add(nil, server.name, ERR_ACCEPTNOT, nick, target, client.t("is not on your accept list"))
+				continue
+			}
+		} else {
+			err = client.addAccepted(casefoldedTarget, server.Limits().AcceptEntries)
+			if err == errAcceptExists {
+				rb.Add(nil, server.name, ERR_ACCEPTEXIST, nick, target, client.t("is already on your accept list"))
+				continue
+			} else if err == errAcceptListFull {
+				rb.Add(nil, server.name, ERR_ACCEPTFULL, nick, client.t("Accept list is full"))
+				break
+			}
+		}
+		changed = true
+	}
+
+	if changed {
+		client.storeIgnoreLists()
+	}
+	return false
+}
+
 // AUTHENTICATE [<mechanism>|<data>|*]
 func authenticateHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	// sasl abort
 	if !server.AccountConfig().AuthenticationEnabled || len(msg.Params) == 1 && msg.Params[0] == "*" {
 		rb.Add(nil, server.name, ERR_SASLABORTED, client.nick, client.t("SASL authentication aborted"))
-		client.saslInProgress = false
-		client.saslMechanism = ""
-		client.saslValue = ""
+		client.resetSasl()
 		return false
 	}
 
@@ -271,18 +315,14 @@ func authenticateHandler(server *Server, client *Client, msg ircmsg.IrcMessage,
 
 	if len(rawData) > 400 {
 		rb.Add(nil, server.name, ERR_SASLTOOLONG, client.nick, client.t("SASL message too long"))
-		client.saslInProgress = false
-		client.saslMechanism = ""
-		client.saslValue = ""
+		client.resetSasl()
 		return false
 	} else if len(rawData) == 400 {
 		client.saslValue += rawData
 		// allow 4 'continuation' lines before rejecting for length
 		if len(client.saslValue) > 400*4 {
 			rb.Add(nil, server.name, ERR_SASLFAIL, client.nick, client.t("SASL authentication failed: Passphrase too long"))
-			client.saslInProgress = false
-			client.saslMechanism = ""
-			client.saslValue = ""
+			client.resetSasl()
 			return false
 		}
 		return false
@@ -297,9 +337,7 @@ func authenticateHandler(server *Server, client *Client, msg ircmsg.IrcMessage,
 		data, err = base64.StdEncoding.DecodeString(client.saslValue)
 		if err != nil {
 			rb.Add(nil, server.name, ERR_SASLFAIL, client.nick, client.t("SASL authentication failed: Invalid b64 encoding"))
-			client.saslInProgress = false
-			client.saslMechanism = ""
-			client.saslValue = ""
+			client.resetSasl()
 			return false
 		}
 	}
@@ -310,9 +348,7 @@ func authenticateHandler(server *Server, client *Client, msg ircmsg.IrcMessage,
 	// like 100% not required, but it's good to be safe I guess
 	if !handlerExists {
 		rb.Add(nil, server.name, ERR_SASLFAIL, client.nick, client.t("SASL authentication failed"))
-		client.saslInProgress = false
-		client.saslMechanism = ""
-		client.saslValue = ""
+		client.resetSasl()
 		return false
 	}
 
@@ -323,10 +359,12 @@ func authenticateHandler(server *Server, client *Client, msg ircmsg.IrcMessage,
 		client.SetAuthorized(true)
 	}
 
-	// wait 'til SASL is done before emptying the sasl vars
-	client.saslInProgress = false
-	client.saslMechanism = ""
+	// wait 'til SASL is done before emptying the sasl vars,
+	// unless a multi-step mechanism is still in progress
 	client.saslValue = ""
+	if client.saslScram == nil {
+		client.resetSasl()
+	}
 
 	return exiting
 }
@@ -365,7 +403,7 @@ func authPlainHandler(server *Server, client *Client, mechanism string, value []
 }
 
 func authErrorToMessage(server *Server, err error) (msg string) {
-	if err == errAccountDoesNotExist || err == errAccountUnverified || err == errAccountInvalidCredentials {
+	if err == errAccountDoesNotExist || err == errAccountUnverified || err == errAccountInvalidCredentials || err == errAccountSuspended {
 		msg = err.Error()
 	} else {
 		server.logger.Error("internal", fmt.Sprintf("sasl authentication failure: %v", err))
@@ -392,6 +430,51 @@ func authExternalHandler(server *Server, client *Client, mechanism string, value
 	return false
 }
 
+// AUTHENTICATE SCRAM-SHA-256
+func authScramHandler(server *Server, client *Client, mechanism string, value []byte, rb *ResponseBuffer) bool {
+	if client.saslScram == nil {
+		client.saslScram = passwd.NewScramConversation(server.accounts.ScramCredentials)
+	}
+
+	response, done, err := client.saslScram.Step(value)
+	if err != nil {
+		client.saslScram = nil
+		var msg string
+		if err == passwd.ErrScramInvalidMessage || err == passwd.ErrScramChannelBinding {
+			msg = client.t("SASL authentication failed: Invalid auth blob")
+		} else {
+			if err == passwd.ErrScramInvalidProof {
+				err = errAccountInvalidCredentials
+			}
+			msg = fmt.Sprintf("%s: %s", client.t("SASL authentication failed"), client.t(authErrorToMessage(server, err)))
+		}
+		rb.Add(nil, server.name, ERR_SASLFAIL, client.nick, msg)
+		return false
+	}
+
+	if !done {
+		rb.Add(nil, server.name, "AUTHENTICATE", base64.StdEncoding.EncodeToString(response))
+		return false
+	}
+
+	username := client.saslScram.Username()
+	client.saslScram = nil
+	account, err := server.accounts.LoadAccount(username)
+	if err == nil {
+		if _, suspended := server.accounts.CheckSuspension(account.Name); suspended {
+			err = errAccountSuspended
+		}
+	}
+	if err != nil {
+		msg := authErrorToMessage(server, err)
+		rb.Add(nil, server.name, ERR_SASLFAIL, client.nick, fmt.Sprintf("%s: %s", client.t("SASL authentication failed"), client.t(msg)))
+		return false
+	}
+	server.accounts.Login(client, account.Name)
+	sendSuccessfulSaslAuth(client, rb, false)
+	return false
+}
+
 // AWAY [<message>]
 func awayHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	var isAway bool
@@ -405,12 +488,15 @@ func awayHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 		}
 	}
 
+	client.stateMutex.Lock()
 	if isAway {
 		client.flags[modes.Away] = true
 	} else {
 		delete(client.flags, modes.Away)
 	}
 	client.awayMessage = text
+	client.autoAway = false
+	client.stateMutex.Unlock()
 
 	var op modes.ModeOp
 	if client.flags[modes.Away] {
@@ -428,13 +514,7 @@ func awayHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 	rb.Add(nil, server.name, "MODE", client.nick, modech.String())
 
 	// dispatch away-notify
-	for friend := range client.Friends(caps.AwayNotify) {
-		if client.flags[modes.Away] {
-			friend.SendFromClient("", client, nil, "AWAY", client.awayMessage)
-		} else {
-			friend.SendFromClient("", client, nil, "AWAY")
-		}
-	}
+	client.notifyAway()
 
 	return false
 }
@@ -498,12 +578,243 @@ func capHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Respo
 	return false
 }
 
+// CHATHISTORY <subcommand> <target> <reference> [<limit>]
+// e.g., CHATHISTORY LATEST #ircv3 * 100
+// e.g., CHATHISTORY BEFORE #ircv3 msgid=ytNBbt565yt 50
+// e.g., CHATHISTORY AFTER dan timestamp=2018-06-01T12:00:00.000Z 50
+func chathistoryHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	config := server.ChannelHistoryConfig()
+	subcommand := strings.ToUpper(msg.Params[0])
+	target := msg.Params[1]
+
+	errorResponse := func(message string) {
+		rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.Nick(), "CHATHISTORY", subcommand, message)
+	}
+
+	// match selects items from the history of the target, see history.Buffer.Match
+	var match func(predicate history.Predicate, ascending bool, limit int) []history.Item
+	// replay sends the selected items to the client
+	var replay func(items []history.Item)
+	limit := config.ChathistoryMaxMessages
+
+	if _, err := CasefoldChannel(target); err == nil {
+		channel := server.channels.Get(target)
+		if channel == nil {
+			rb.Add(nil, server.name, ERR_NOSUCHCHANNEL, client.Nick(), target, client.t("No such channel"))
+			return false
+		}
+		if !channel.hasClient(client) {
+			rb.Add(nil, server.name, ERR_NOTONCHANNEL, client.Nick(), channel.Name(), client.t("You're not on that channel"))
+			return false
+		}
+		if !channel.history.Enabled() {
+			errorResponse(client.t("Message history is not enabled"))
+			return false
+		}
+		match = channel.history.Match
+		replay = func(items []history.Item) {
+			channel.replayHistoryItems(rb, items)
+		}
+	} else {
+		// direct message history is stored per pair of accounts, so it can
+		// only be retrieved by the two participants in the conversation
+		account := client.Account()
+		if account == "" {
+			errorResponse(client.t("You must be logged into an account to retrieve direct message history"))
+			return false
+		}
+		if !server.AccountConfig().DirectMessageHistory.Enabled {
+			errorResponse(client.t("Message history is not enabled"))
+			return false
+		}
+		var otherAccount string
+		if user := server.clients.Get(target); user != nil {
+			otherAccount = user.Account()
+		}
+		if otherAccount == "" {
+			otherAccount, err = CasefoldName(target)
+			if err != nil {
+				rb.Add(nil, server.name, ERR_NOSUCHNICK, client.Nick(), target, client.t("No such nick"))
+				return false
+			}
+		}
+		match = func(predicate history.Predicate, ascending bool, limit int) []history.Item {
+			return server.accounts.DirectMessages(account, otherAccount, predicate, ascending, limit)
+		}
+		replay = func(items []history.Item) {
+			client.replayDirectMessages(rb, target, items)
+		}
+		limit = server.directMessageHistoryLimit()
+	}
+
+	if 3 < len(msg.Params) {
+		requested, err := strconv.Atoi(msg.Params[3])
+		if err != nil || requested < 1 {
+			errorResponse(client.t("Invalid message limit"))
+			return false
+		}
+		if requested < limit {
+			limit = requested
+		}
+	}
+
+	// the reference is either msgid=<msgid>, timestamp=<timestamp>,
+	// or * to indicate no bound (only for LATEST)
+	var timestamp time.Time
+	reference := msg.Params[2]
+	if !(subcommand == "LATEST" && reference == "*") {
+		pieces := strings.SplitN(reference, "=", 2)
+		if len(pieces) != 2 {
+			errorResponse(client.t("Invalid message reference"))
+			return false
+		}
+		switch strings.ToLower(pieces[0]) {
+		case "msgid":
+			msgid := pieces[1]
+			items := match(func(item history.Item) bool { return item.Msgid == msgid }, false, 1)
+			if len(items) == 0 {
+				errorResponse(client.t("Could not find the referenced message"))
+				return false
+			}
+			timestamp = items[0].Time
+		case "timestamp":
+			var err error
+			timestamp, err = time.Parse(IRCv3TimestampFormat, pieces[1])
+			if err != nil {
+				errorResponse(client.t("Invalid message reference"))
+				return false
+			}
+		default:
+			errorResponse(client.t("Invalid message reference"))
+			return false
+		}
+	}
+
+	all := func(item history.Item) bool { return true }
+	before := func(item history.Item) bool { return item.Time.Before(timestamp) }
+	after := func(item history.Item) bool { return item.Time.After(timestamp) }
+
+	var items []history.Item
+	switch subcommand {
+	case "LATEST":
+		if timestamp.IsZero() {
+			items = match(all, false, limit)
+		} else {
+			items = match(after, false, limit)
+		}
+	case "BEFORE":
+		items = match(before, false, limit)
+	case "AFTER":
+		items = match(after, true, limit)
+	case "AROUND":
+		// split the limit between messages before and after the reference,
+		// with the reference itself counted as being after it
+		if 1 < limit {
+			items = match(before, false, limit/2)
+		}
+		notBefore := func(item history.Item) bool { return !item.Time.Before(timestamp) }
+		items = append(items, match(notBefore, true, limit-len(items))...)
+	default:
+		errorResponse(client.t("Unknown subcommand"))
+		return false
+	}
+
+	replay(items)
+	return false
+}
+
+// localOperTarget returns the client an oper command is aimed at, telling the
+// oper why not if there's no such client or they're connected to another server.
+func localOperTarget(server *Server, client *Client, nick string, rb *ResponseBuffer) *Client {
+	target := server.clients.Get(nick)
+	if target == nil {
+		rb.Add(nil, server.name, ERR_NOSUCHNICK, client.Nick(), nick, client.t("No such nick"))
+		return nil
+	}
+	if target.IsRemote() {
+		rb.Notice(client.t("That user is connected to another server"))
+		return nil
+	}
+	return target
+}
+
+// CHGHOST <nickname> <vhost>
+func chghostHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	target := localOperTarget(server, client, msg.Params[0], rb)
+	if target == nil {
+		return false
+	}
+	vhost := msg.Params[1]
+	if validateVHost(server, vhost) != nil {
+		rb.Notice(client.t("Invalid vhost"))
+		return false
+	}
+
+	target.setVHost(vhost)
+	server.snomasks.Send(sno.LocalOpers, fmt.Sprintf(ircfmt.Unescape("Operator $c[grey][$r%s$c[grey]] changed the hostname of $c[grey][$r%s$c[grey]] to $c[grey][$r%s$c[grey]]"), client.Nick(), target.Nick(), vhost))
+	server.logger.Info("opers", fmt.Sprintf("Operator %s changed the hostname of %s to %s", client.Nick(), target.Nick(), vhost))
+	return false
+}
+
+// CHGIDENT <nickname> <username>
+func chgidentHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	target := localOperTarget(server, client, msg.Params[0], rb)
+	if target == nil {
+		return false
+	}
+	username := msg.Params[1]
+	if _, err := CasefoldName(username); err != nil || strings.HasPrefix(username, ":") {
+		rb.Notice(client.t("Invalid username"))
+		return false
+	}
+
+	target.setUsername(username)
+	server.snomasks.Send(sno.LocalOpers, fmt.Sprintf(ircfmt.Unescape("Operator $c[grey][$r%s$c[grey]] changed the username of $c[grey][$r%s$c[grey]] to $c[grey][$r%s$c[grey]]"), client.Nick(), target.Nick(), username))
+	server.logger.Info("opers", fmt.Sprintf("Operator %s changed the username of %s to %s", client.Nick(), target.Nick(), username))
+	return false
+}
+
+// CHGNAME <nickname> <realname>
+func chgnameHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	target := localOperTarget(server, client, msg.Params[0], rb)
+	if target == nil {
+		return false
+	}
+	realname := msg.Params[1]
+	if realname == "" || len(realname) > server.Limits().RealnameLen {
+		rb.Notice(client.t("Invalid realname"))
+		return false
+	}
+
+	target.setRealname(realname, nil)
+	server.snomasks.Send(sno.LocalOpers, fmt.Sprintf(ircfmt.Unescape("Operator $c[grey][$r%s$c[grey]] changed the realname of $c[grey][$r%s$c[grey]] to $c[grey][$r%s$c[grey]]"), client.Nick(), target.Nick(), realname))
+	server.logger.Info("opers", fmt.Sprintf("Operator %s changed the realname of %s to %s", client.Nick(), target.Nick(), realname))
+	return false
+}
+
 // CHANSERV [...]
 func csHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	server.chanservPrivmsgHandler(client, strings.Join(msg.Params, " "), rb)
 	return false
 }
 
+// CONNECT <server>
+func connectHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	name := msg.Params[0]
+	err := server.links.Connect(name)
+	if err == errLinkNoSuchServer {
+		rb.Add(nil, server.name, ERR_NOSUCHSERVER, client.Nick(), name, client.t("No link block for that server"))
+		return false
+	} else if err != nil {
+		rb.Notice(fmt.Sprintf(client.t("Could not connect to %[1]s: %[2]s"), name, err.Error()))
+		return false
+	}
+
+	rb.Notice(fmt.Sprintf(client.t("Connecting to %s"), name))
+	server.snomasks.Send(sno.Links, fmt.Sprintf(ircfmt.Unescape("Operator $c[grey][$r%s$c[grey]] is connecting to $c[grey][$r%s$c[grey]]"), client.Nick(), name))
+	return false
+}
+
 // DEBUG <subcmd>
 func debugHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	param := strings.ToUpper(msg.Params[0])
@@ -615,31 +926,21 @@ func dlineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 		rb.Add(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, msg.Command, client.t("Not enough parameters"))
 		return false
 	}
-	hostString := msg.Params[currentArg]
+	hostString, hostAddr, hostNet, err := parseDlineHost(msg.Params[currentArg])
 	currentArg++
 
 	// check host
-	var hostAddr net.IP
-	var hostNet *net.IPNet
-
-	_, hostNet, err = net.ParseCIDR(hostString)
 	if err != nil {
-		hostAddr = net.ParseIP(hostString)
-	}
-
-	if hostAddr == nil && hostNet == nil {
 		rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, client.t("Could not parse IP address or CIDR network"))
 		return false
 	}
 
 	if hostNet == nil {
-		hostString = hostAddr.String()
 		if !dlineMyself && hostAddr.Equal(client.IP()) {
 			rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, client.t("This ban matches you. To DLINE yourself, you must use the command:  /DLINE MYSELF <arguments>"))
 			return false
 		}
 	} else {
-		hostString = hostNet.String()
 		if !dlineMyself && hostNet.Contains(client.IP()) {
 			rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, client.t("This ban matches you. To DLINE yourself, you must use the command:  /DLINE MYSELF <arguments>"))
 			return false
@@ -691,30 +992,12 @@ func dlineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 	}
 
 	// save in datastore
-	err = server.store.Update(func(tx *buntdb.Tx) error {
-		dlineKey := fmt.Sprintf(keyDlineEntry, hostString)
-
-		// assemble json from ban info
-		b, err := json.Marshal(info)
-		if err != nil {
-			return err
-		}
-
-		tx.Set(dlineKey, string(b), nil)
-
-		return nil
-	})
-
+	_, err = server.addDline(hostString, info)
 	if err != nil {
 		rb.Notice(fmt.Sprintf(client.t("Could not successfully save new D-LINE: %s"), err.Error()))
 		return false
 	}
-
-	if hostNet == nil {
-		server.dlines.AddIP(hostAddr, banTime, reason, operReason, operName)
-	} else {
-		server.dlines.AddNetwork(*hostNet, banTime, reason, operReason, operName)
-	}
+	server.links.AddBan("D", hostString, info)
 
 	var snoDescription string
 	if durationIsUsed {
@@ -746,6 +1029,10 @@ func dlineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 		}
 
 		for _, mcl := range clientsToKill {
+			if mcl.IsRemote() {
+				server.links.Kill(client, mcl, fmt.Sprintf("You have been banned from this server (%s)", reason))
+				continue
+			}
 			mcl.exitedSnomaskSent = true
 			mcl.Quit(fmt.Sprintf(mcl.t("You have been banned from this server (%s)"), reason))
 			if mcl == client {
@@ -764,6 +1051,16 @@ func dlineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 	return killClient
 }
 
+// GLOBOPS <message>
+func globopsHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	if !client.checkBroadcastCooldown() {
+		rb.Notice(client.t("You're sending broadcasts too quickly; wait a while and try again"))
+		return false
+	}
+	server.sendGlobops(client, msg.Params[0])
+	return false
+}
+
 // HELP [<query>]
 func helpHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	argument := strings.ToLower(strings.TrimSpace(strings.Join(msg.Params, " ")))
@@ -802,6 +1099,12 @@ Get an explanation of <argument>, or "index" for a list of help topics.`), rb)
 	return false
 }
 
+// HOSTSERV [params...]
+func hsHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	server.hostservPrivmsgHandler(client, strings.Join(msg.Params, " "), rb)
+	return false
+}
+
 // INFO
 func infoHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	// we do the below so that the human-readable lines in info can be translated.
@@ -852,6 +1155,10 @@ func inviteHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 		return false
 	}
 
+	if !target.checkIgnores(client, rb) {
+		return false
+	}
+
 	channel.Invite(target, client, rb)
 	return false
 }
@@ -897,7 +1204,7 @@ func joinHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 		if len(keys) > i {
 			key = keys[i]
 		}
-		err := server.channels.Join(client, name, key, rb)
+		err := server.channels.Join(client, name, key, false, rb)
 		if err == errNoSuchChannel {
 			rb.Add(nil, server.name, ERR_NOSUCHCHANNEL, client.Nick(), name, client.t("No such channel"))
 		}
@@ -970,6 +1277,10 @@ func killHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 	quitMsg := fmt.Sprintf("Killed (%s (%s))", client.nick, comment)
 
 	server.snomasks.Send(sno.LocalKills, fmt.Sprintf(ircfmt.Unescape("%s$r was killed by %s $c[grey][$r%s$c[grey]]"), target.nick, client.nick, comment))
+	if target.IsRemote() {
+		server.links.Kill(client, target, quitMsg)
+		return false
+	}
 	target.exitedSnomaskSent = true
 
 	target.Quit(quitMsg)
@@ -1030,16 +1341,9 @@ func klineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 		rb.Add(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, msg.Command, client.t("Not enough parameters"))
 		return false
 	}
-	mask := strings.ToLower(msg.Params[currentArg])
+	mask := canonicalizeKlineMask(msg.Params[currentArg])
 	currentArg++
 
-	// check mask
-	if !strings.Contains(mask, "!") && !strings.Contains(mask, "@") {
-		mask = mask + "!*@*"
-	} else if !strings.Contains(mask, "@") {
-		mask = mask + "@*"
-	}
-
 	matcher := ircmatch.MakeMatch(mask)
 
 	for _, clientMask := range client.AllNickmasks() {
@@ -1096,26 +1400,12 @@ func klineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 	}
 
 	// save in datastore
-	err = server.store.Update(func(tx *buntdb.Tx) error {
-		klineKey := fmt.Sprintf(keyKlineEntry, mask)
-
-		// assemble json from ban info
-		b, err := json.Marshal(info)
-		if err != nil {
-			return err
-		}
-
-		tx.Set(klineKey, string(b), nil)
-
-		return nil
-	})
-
+	err = server.addKline(mask, info)
 	if err != nil {
 		rb.Notice(fmt.Sprintf(client.t("Could not successfully save new K-LINE: %s"), err.Error()))
 		return false
 	}
-
-	server.klines.AddMask(mask, banTime, reason, operReason, operName)
+	server.links.AddBan("K", mask, info)
 
 	var snoDescription string
 	if durationIsUsed {
@@ -1142,6 +1432,10 @@ func klineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 		}
 
 		for _, mcl := range clientsToKill {
+			if mcl.IsRemote() {
+				server.links.Kill(client, mcl, fmt.Sprintf("You have been banned from this server (%s)", reason))
+				continue
+			}
 			mcl.exitedSnomaskSent = true
 			mcl.Quit(fmt.Sprintf(mcl.t("You have been banned from this server (%s)"), reason))
 			if mcl == client {
@@ -1160,6 +1454,22 @@ func klineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 	return killClient
 }
 
+// KNOCK <channel> [<reason>]
+func knockHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	channel := server.channels.Get(msg.Params[0])
+	if channel == nil {
+		rb.Add(nil, server.name, ERR_NOSUCHCHANNEL, client.Nick(), msg.Params[0], client.t("No such channel"))
+		return false
+	}
+	var reason string
+	if len(msg.Params) > 1 {
+		reason = msg.Params[1]
+	}
+
+	channel.Knock(client, reason, rb)
+	return false
+}
+
 // LANGUAGE <code>{ <code>}
 func languageHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	alreadyDoneLanguages := make(map[string]bool)
@@ -1216,6 +1526,18 @@ func languageHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *
 	return false
 }
 
+// LINKS
+func linksHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	nick := client.Nick()
+	networkName := server.NetworkName()
+	rb.Add(nil, server.name, RPL_LINKS, nick, server.name, server.name, "0 "+networkName)
+	for _, remote := range server.links.Servers() {
+		rb.Add(nil, server.name, RPL_LINKS, nick, remote.name, remote.uplinkName(server.name), fmt.Sprintf("%d %s", remote.hops, networkName))
+	}
+	rb.Add(nil, server.name, RPL_ENDOFLINKS, nick, "*", client.t("End of LINKS list"))
+	return false
+}
+
 // LIST [<channel>{,<channel>}] [<elistcond>{,<elistcond>}]
 func listHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	// get channels
@@ -1293,10 +1615,13 @@ func listHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 // LUSERS [<mask> [<server>]]
 func lusersHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	//TODO(vegax87) Fix network statistics and additional parameters
-	var totalcount, invisiblecount, opercount int
+	var totalcount, localcount, invisiblecount, opercount int
 
 	for _, onlineusers := range server.clients.AllClients() {
 		totalcount++
+		if !onlineusers.IsRemote() {
+			localcount++
+		}
 		if onlineusers.flags[modes.Invisible] {
 			invisiblecount++
 		}
@@ -1304,10 +1629,10 @@ func lusersHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 			opercount++
 		}
 	}
-	rb.Add(nil, server.name, RPL_LUSERCLIENT, client.nick, fmt.Sprintf(client.t("There are %[1]d users and %[2]d invisible on %[3]d server(s)"), totalcount, invisiblecount, 1))
+	rb.Add(nil, server.name, RPL_LUSERCLIENT, client.nick, fmt.Sprintf(client.t("There are %[1]d users and %[2]d invisible on %[3]d server(s)"), totalcount, invisiblecount, 1+len(server.links.Servers())))
 	rb.Add(nil, server.name, RPL_LUSEROP, client.nick, fmt.Sprintf(client.t("%d IRC Operators online"), opercount))
 	rb.Add(nil, server.name, RPL_LUSERCHANNELS, client.nick, fmt.Sprintf(client.t("%d channels formed"), server.channels.Len()))
-	rb.Add(nil, server.name, RPL_LUSERME, client.nick, fmt.Sprintf(client.t("I have %[1]d clients and %[2]d servers"), totalcount, 1))
+	rb.Add(nil, server.name, RPL_LUSERME, client.nick, fmt.Sprintf(client.t("I have %[1]d clients and %[2]d servers"), localcount, server.links.LinkCount()))
 	return false
 }
 
@@ -1355,7 +1680,7 @@ func cmodeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 	var includeFlags uint
 	for _, change := range applied {
 		includeFlags |= IncludeModes
-		if change.Mode == modes.BanMask || change.Mode == modes.ExceptMask || change.Mode == modes.InviteMask {
+		if change.Mode == modes.BanMask || change.Mode == modes.ExceptMask || change.Mode == modes.InviteMask || change.Mode == modes.QuietMask {
 			includeFlags |= IncludeLists
 		}
 	}
@@ -1366,6 +1691,7 @@ func cmodeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 
 	// send out changes
 	if len(applied) > 0 {
+		server.links.ChannelModes(channel, client, applied)
 		//TODO(dan): we should change the name of String and make it return a slice here
 		args := append([]string{channel.name}, strings.Split(applied.String(), " ")...)
 		for _, member := range channel.Members() {
@@ -1631,7 +1957,7 @@ func noticeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 	message := msg.Params[1]
 
 	// split privmsg
-	splitMsg := server.splitMessage(message, !client.capabilities.Has(caps.MaxLine))
+	splitMsg := server.splitMessage(message, !rb.target.capabilities.Has(caps.MaxLine))
 
 	for i, targetString := range targets {
 		// max of four targets per privmsg
@@ -1641,6 +1967,11 @@ func noticeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 		prefixes, targetString := modes.SplitChannelMembershipPrefixes(targetString)
 		lowestPrefix := modes.GetLowestChannelModePrefix(prefixes)
 
+		if strings.HasPrefix(targetString, "$") {
+			server.massMessage(client, "NOTICE", targetString, clientOnlyTags, splitMsg, rb)
+			continue
+		}
+
 		target, cerr := CasefoldChannel(targetString)
 		if cerr == nil {
 			channel := server.channels.Get(target)
@@ -1665,25 +1996,33 @@ func noticeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 			} else if target == "nickserv" {
 				server.nickservNoticeHandler(client, message, rb)
 				continue
+			} else if target == "hostserv" {
+				server.hostservNoticeHandler(client, message, rb)
+				continue
 			}
 
 			user := server.clients.Get(target)
-			if user == nil {
+			if user == nil || !user.checkIgnores(client, nil) {
 				// errors silently ignored with NOTICE as per RFC
 				continue
 			}
+			msgid := server.generateMessageID()
+			if user.IsRemote() {
+				server.links.DirectMessage(msgid, client, "NOTICE", user, clientOnlyTags, message)
+			}
 			if !user.capabilities.Has(caps.MessageTags) {
 				clientOnlyTags = nil
 			}
-			msgid := server.generateMessageID()
 			// restrict messages appropriately when +R is set
 			// intentionally make the sending user think the message went through fine
 			if !user.flags[modes.RegisteredOnly] || client.registered {
 				user.SendSplitMsgFromClient(msgid, client, clientOnlyTags, "NOTICE", user.nick, splitMsg)
+				client.recordDirectMessage(user, history.Notice, msgid, message, clientOnlyTags)
 			}
-			if client.capabilities.Has(caps.EchoMessage) {
+			if rb.target.capabilities.Has(caps.EchoMessage) {
 				rb.AddSplitMessageFromClient(msgid, client, clientOnlyTags, "NOTICE", user.nick, splitMsg)
 			}
+			client.echoToSessions(rb.target, msgid, clientOnlyTags, "NOTICE", user.nick, &splitMsg)
 		}
 	}
 	return false
@@ -1760,12 +2099,7 @@ func operHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 
 	// push new vhost if one is set
 	if len(oper.Vhost) > 0 {
-		for fClient := range client.Friends(caps.ChgHost) {
-			fClient.SendFromClient("", client, nil, "CHGHOST", client.username, oper.Vhost)
-		}
-		// CHGHOST requires prefix nickmask to have original hostname, so do that before updating nickmask
-		client.vhost = oper.Vhost
-		client.updateNickMask("")
+		client.setVHost(oper.Vhost)
 	}
 
 	// set new modes
@@ -1860,7 +2194,7 @@ func privmsgHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *R
 	message := msg.Params[1]
 
 	// split privmsg
-	splitMsg := server.splitMessage(message, !client.capabilities.Has(caps.MaxLine))
+	splitMsg := server.splitMessage(message, !rb.target.capabilities.Has(caps.MaxLine))
 
 	for i, targetString := range targets {
 		// max of four targets per privmsg
@@ -1875,6 +2209,11 @@ func privmsgHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *R
 			continue
 		}
 
+		if strings.HasPrefix(targetString, "$") {
+			server.massMessage(client, "PRIVMSG", targetString, clientOnlyTags, splitMsg, rb)
+			continue
+		}
+
 		target, err := CasefoldChannel(targetString)
 		if err == nil {
 			channel := server.channels.Get(target)
@@ -1896,6 +2235,9 @@ func privmsgHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *R
 			} else if target == "nickserv" {
 				server.nickservPrivmsgHandler(client, message, rb)
 				continue
+			} else if target == "hostserv" {
+				server.hostservPrivmsgHandler(client, message, rb)
+				continue
 			}
 			user := server.clients.Get(target)
 			if err != nil || user == nil {
@@ -1904,18 +2246,26 @@ func privmsgHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *R
 				}
 				continue
 			}
+			if !user.checkIgnores(client, rb) {
+				continue
+			}
+			msgid := server.generateMessageID()
+			if user.IsRemote() {
+				server.links.DirectMessage(msgid, client, "PRIVMSG", user, clientOnlyTags, message)
+			}
 			if !user.capabilities.Has(caps.MessageTags) {
 				clientOnlyTags = nil
 			}
-			msgid := server.generateMessageID()
 			// restrict messages appropriately when +R is set
 			// intentionally make the sending user think the message went through fine
 			if !user.flags[modes.RegisteredOnly] || client.registered {
 				user.SendSplitMsgFromClient(msgid, client, clientOnlyTags, "PRIVMSG", user.nick, splitMsg)
+				client.recordDirectMessage(user, history.Privmsg, msgid, message, clientOnlyTags)
 			}
-			if client.capabilities.Has(caps.EchoMessage) {
+			if rb.target.capabilities.Has(caps.EchoMessage) {
 				rb.AddSplitMessageFromClient(msgid, client, clientOnlyTags, "PRIVMSG", user.nick, splitMsg)
 			}
+			client.echoToSessions(rb.target, msgid, clientOnlyTags, "PRIVMSG", user.nick, &splitMsg)
 			if user.flags[modes.Away] {
 				//TODO(dan): possibly implement cooldown of away notifications to users
 				rb.Add(nil, server.name, RPL_AWAY, user.nick, user.awayMessage)
@@ -2043,7 +2393,7 @@ func renameHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 		} else {
 			mcl.Send(nil, mcl.nickMaskString, "PART", oldName, fmt.Sprintf(mcl.t("Channel renamed: %s"), reason))
 			if mcl.capabilities.Has(caps.ExtendedJoin) {
-				mcl.Send(nil, mcl.nickMaskString, "JOIN", newName, mcl.AccountName(), mcl.realname)
+				mcl.Send(nil, mcl.nickMaskString, "JOIN", newName, mcl.AccountName(), mcl.Realname())
 			} else {
 				mcl.Send(nil, mcl.nickMaskString, "JOIN", newName)
 			}
@@ -2069,7 +2419,7 @@ func resumeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 
 	var timestamp *time.Time
 	if 1 < len(msg.Params) {
-		ts, err := time.Parse("2006-01-02T15:04:05.999Z", msg.Params[1])
+		ts, err := time.Parse(IRCv3TimestampFormat, msg.Params[1])
 		if err == nil {
 			timestamp = &ts
 		} else {
@@ -2085,6 +2435,30 @@ func resumeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 	return false
 }
 
+// SAJOIN <nickname> <channel>{,<channel>}
+func sajoinHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	target := localOperTarget(server, client, msg.Params[0], rb)
+	if target == nil {
+		return false
+	}
+
+	targetRb := NewResponseBuffer(target)
+	for _, name := range strings.Split(msg.Params[1], ",") {
+		err := server.channels.Join(target, name, "", true, targetRb)
+		if err == errNoSuchChannel {
+			rb.Add(nil, server.name, ERR_NOSUCHCHANNEL, client.Nick(), name, client.t("No such channel"))
+			continue
+		} else if err != nil {
+			rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.Nick(), "SAJOIN", name, client.t(err.Error()))
+			continue
+		}
+		server.snomasks.Send(sno.LocalOpers, fmt.Sprintf(ircfmt.Unescape("Operator $c[grey][$r%s$c[grey]] forced $c[grey][$r%s$c[grey]] to join $c[grey][$r%s$c[grey]]"), client.Nick(), target.Nick(), name))
+		server.logger.Info("opers", fmt.Sprintf("Operator %s forced %s to join %s", client.Nick(), target.Nick(), name))
+	}
+	targetRb.Send()
+	return false
+}
+
 // SANICK <oldnick> <nickname>
 func sanickHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	targetNick := strings.TrimSpace(msg.Params[0])
@@ -2097,6 +2471,57 @@ func sanickHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 	return false
 }
 
+// SAPART <nickname> <channel>{,<channel>} [<reason>]
+func sapartHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	target := localOperTarget(server, client, msg.Params[0], rb)
+	if target == nil {
+		return false
+	}
+	var reason string
+	if len(msg.Params) > 2 {
+		reason = msg.Params[2]
+	}
+
+	targetRb := NewResponseBuffer(target)
+	for _, name := range strings.Split(msg.Params[1], ",") {
+		channel := server.channels.Get(name)
+		if channel == nil {
+			rb.Add(nil, server.name, ERR_NOSUCHCHANNEL, client.Nick(), name, client.t("No such channel"))
+			continue
+		}
+		if !channel.hasClient(target) {
+			rb.Add(nil, server.name, ERR_USERNOTINCHANNEL, client.Nick(), target.Nick(), channel.Name(), client.t("They aren't on that channel"))
+			continue
+		}
+		server.channels.Part(target, name, reason, targetRb)
+		server.snomasks.Send(sno.LocalOpers, fmt.Sprintf(ircfmt.Unescape("Operator $c[grey][$r%s$c[grey]] forced $c[grey][$r%s$c[grey]] to part $c[grey][$r%s$c[grey]]"), client.Nick(), target.Nick(), channel.Name()))
+		server.logger.Info("opers", fmt.Sprintf("Operator %s forced %s to part %s", client.Nick(), target.Nick(), channel.Name()))
+	}
+	targetRb.Send()
+	return false
+}
+
+// SAQUIT <nickname> <reason>
+func saquitHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	target := server.clients.Get(msg.Params[0])
+	if target == nil {
+		rb.Add(nil, server.name, ERR_NOSUCHNICK, client.Nick(), msg.Params[0], client.t("No such nick"))
+		return false
+	}
+	reason := msg.Params[1]
+
+	server.snomasks.Send(sno.LocalOpers, fmt.Sprintf(ircfmt.Unescape("Operator $c[grey][$r%s$c[grey]] forced $c[grey][$r%s$c[grey]] to quit $c[grey][$r%s$c[grey]]"), client.Nick(), target.Nick(), reason))
+	server.logger.Info("opers", fmt.Sprintf("Operator %s forced %s to quit (%s)", client.Nick(), target.Nick(), reason))
+
+	if target.IsRemote() {
+		server.links.Kill(client, target, reason)
+		return false
+	}
+	target.Quit(reason)
+	target.destroy(false)
+	return false
+}
+
 // SCENE <target> <message>
 func sceneHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	target := msg.Params[0]
@@ -2108,6 +2533,186 @@ func sceneHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 	return false
 }
 
+// SETNAME <realname>
+func setnameHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	realname := msg.Params[0]
+	if realname == "" || len(realname) > server.Limits().RealnameLen {
+		rb.Add(nil, server.name, "FAIL", "SETNAME", "INVALID_REALNAME", client.t("Realname is not valid"))
+		return false
+	}
+
+	client.setRealname(realname, rb)
+	return false
+}
+
+// SILENCE [<+|-><mask>{,<+|-><mask>}]
+func silenceHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	nick := client.Nick()
+	if len(msg.Params) == 0 || msg.Params[0] == "" {
+		for _, mask := range client.SilenceMasks() {
+			rb.Add(nil, server.name, RPL_SILELIST, nick, mask)
+		}
+		rb.Add(nil, server.name, RPL_ENDOFSILELIST, nick, client.t("End of /SILENCE list"))
+		return false
+	}
+
+	changed := false
+	for _, mask := range strings.Split(msg.Params[0], ",") {
+		remove := strings.HasPrefix(mask, "-")
+		mask = strings.TrimPrefix(strings.TrimPrefix(mask, "-"), "+")
+		if mask == "" {
+			continue
+		}
+		if !isExtban(mask) {
+			mask = ExpandUserHost(mask)
+		}
+		mask, err := casefoldMask(mask)
+		if err != nil {
+			continue
+		}
+
+		if remove {
+			if client.silence.Remove(mask) {
+				changed = true
+			}
+		} else {
+			if server.Limits().SilenceEntries <= client.silence.Length() {
+				rb.Add(nil, server.name, ERR_SILELISTFULL, nick, mask, client.t("Your SILENCE list is full"))
+				break
+			}
+			if client.silence.Add(mask) {
+				changed = true
+			}
+		}
+	}
+
+	if changed {
+		client.storeIgnoreLists()
+	}
+	return false
+}
+
+// SQUIT <server> [reason]
+func squitHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	name := msg.Params[0]
+	reason := fmt.Sprintf("SQUIT by %s", client.Nick())
+	if 1 < len(msg.Params) && msg.Params[1] != "" {
+		reason = msg.Params[1]
+	}
+
+	if err := server.links.Disconnect(name, reason); err != nil {
+		rb.Add(nil, server.name, ERR_NOSUCHSERVER, client.Nick(), name, client.t("Not linked to that server"))
+		return false
+	}
+	server.snomasks.Send(sno.Links, fmt.Sprintf(ircfmt.Unescape("Operator $c[grey][$r%s$c[grey]] closed the link to $c[grey][$r%s$c[grey]] [%s]"), client.Nick(), name, reason))
+	return false
+}
+
+// STATS <letter>
+func statsHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	nick := client.Nick()
+	if msg.Params[0] == "" {
+		rb.Add(nil, server.name, ERR_NEEDMOREPARAMS, nick, msg.Command, client.t("Not enough parameters"))
+		return false
+	}
+	// take the first character rather than the first byte, so we don't echo back invalid UTF-8
+	firstRune, _ := utf8.DecodeRuneInString(msg.Params[0])
+	letter := string(firstRune)
+
+	server.snomasks.Send(sno.Stats, fmt.Sprintf(ircfmt.Unescape("Client $c[grey][$r%s$c[grey]] requested STATS $c[grey][$r%s$c[grey]]"), client.NickMaskString(), letter))
+
+	// everything except uptime and command usage is only shown to opers
+	if letter != "u" && letter != "m" && !client.HasMode(modes.Operator) {
+		rb.Add(nil, server.name, ERR_NOPRIVILEGES, nick, client.t("Permission Denied - You're not an IRC operator"))
+		rb.Add(nil, server.name, RPL_ENDOFSTATS, nick, letter, client.t("End of /STATS report"))
+		return false
+	}
+
+	switch letter {
+	case "u":
+		uptime := time.Since(server.ctime)
+		days := int(uptime.Hours()) / 24
+		uptime -= time.Duration(days) * 24 * time.Hour
+		rb.Add(nil, server.name, RPL_STATSUPTIME, nick, fmt.Sprintf(client.t("Server Up %[1]d days %[2]d:%02[3]d:%02[4]d"), days, int(uptime.Hours()), int(uptime.Minutes())%60, int(uptime.Seconds())%60))
+
+	case "m":
+		counts := server.metrics.CommandCounts()
+		commands := make([]string, 0, len(counts))
+		for command := range counts {
+			commands = append(commands, command)
+		}
+		sort.Strings(commands)
+		for _, command := range commands {
+			rb.Add(nil, server.name, RPL_STATSCOMMANDS, nick, command, strconv.FormatUint(counts[command], 10), "0", "0")
+		}
+
+	case "P":
+		// hold the rehash lock so the listeners can't change underneath us
+		server.rehashMutex.Lock()
+		var listeners []string
+		for addr, listener := range server.listeners {
+			if listener.tlsConfig != nil {
+				listeners = append(listeners, fmt.Sprintf("%s (tls)", addr))
+			} else {
+				listeners = append(listeners, fmt.Sprintf("%s (plaintext)", addr))
+			}
+		}
+		for addr, listener := range server.wsListeners {
+			if listener.isTLS {
+				listeners = append(listeners, fmt.Sprintf("%s (websocket, tls)", addr))
+			} else {
+				listeners = append(listeners, fmt.Sprintf("%s (websocket)", addr))
+			}
+		}
+		server.rehashMutex.Unlock()
+		sort.Strings(listeners)
+		for _, listener := range listeners {
+			rb.Add(nil, server.name, RPL_STATSDEBUG, nick, "P", listener)
+		}
+		rb.Add(nil, server.name, RPL_STATSDEBUG, nick, "P", fmt.Sprintf(client.t("%d clients connected"), server.clients.Count()))
+
+	case "k", "K":
+		for mask, info := range server.klines.AllBans() {
+			rb.Add(nil, server.name, RPL_STATSKLINE, nick, "K", mask, info.OperName, info.BanMessage("%s"))
+		}
+
+	case "d", "D":
+		for host, info := range server.dlines.AllBans() {
+			rb.Add(nil, server.name, RPL_STATSDLINE, nick, "D", host, info.OperName, info.BanMessage("%s"))
+		}
+
+	case "s", "S":
+		for account, info := range server.accounts.AllSuspensions() {
+			rb.Add(nil, server.name, RPL_STATSDEBUG, nick, "S", formatSuspension(client, account, info))
+		}
+
+	case "o", "O":
+		for name, oper := range server.OperConfigs() {
+			rb.Add(nil, server.name, RPL_STATSOLINE, nick, "O", "*", "*", name, oper.Class)
+		}
+
+	case "p":
+		for _, mcl := range server.clients.AllClients() {
+			if mcl.HasMode(modes.Operator) {
+				rb.Add(nil, server.name, RPL_STATSDEBUG, nick, "p", fmt.Sprintf("%s (%s) idle %s", mcl.Nick(), mcl.operName, mcl.IdleTime().Truncate(time.Second)))
+			}
+		}
+
+	case "L":
+		for subnet, count := range server.connectionLimiter.Population() {
+			rb.Add(nil, server.name, RPL_STATSDEBUG, nick, "L", fmt.Sprintf(client.t("%[1]s has %[2]d clients"), subnet, count))
+		}
+
+	case "T":
+		for subnet, details := range server.connectionThrottler.Population() {
+			rb.Add(nil, server.name, RPL_STATSDEBUG, nick, "T", fmt.Sprintf(client.t("%[1]s has made %[2]d connections since %[3]s"), subnet, details.ClientCount, details.Start.Format(time.RFC1123)))
+		}
+	}
+
+	rb.Add(nil, server.name, RPL_ENDOFSTATS, nick, letter, client.t("End of /STATS report"))
+	return false
+}
+
 // TAGMSG <target>{,<target>}
 func tagmsgHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	clientOnlyTags := utils.GetClientOnlyTags(msg.Tags)
@@ -2157,13 +2762,15 @@ func tagmsgHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 			msgid := server.generateMessageID()
 
 			// end user can't receive tagmsgs
-			if !user.capabilities.Has(caps.MessageTags) {
+			if !user.capabilities.Has(caps.MessageTags) || !user.checkIgnores(client, nil) {
 				continue
 			}
 			user.SendFromClient(msgid, client, clientOnlyTags, "TAGMSG", user.nick)
-			if client.capabilities.Has(caps.EchoMessage) {
+			client.recordDirectMessage(user, history.Tagmsg, msgid, "", clientOnlyTags)
+			if rb.target.capabilities.Has(caps.EchoMessage) {
 				rb.AddFromClient(msgid, client, clientOnlyTags, "TAGMSG", user.nick)
 			}
+			client.echoToSessions(rb.target, msgid, clientOnlyTags, "TAGMSG", user.nick, nil)
 			if user.flags[modes.Away] {
 				//TODO(dan): possibly implement cooldown of away notifications to users
 				rb.Add(nil, server.name, RPL_AWAY, user.nick, user.awayMessage)
@@ -2206,56 +2813,17 @@ func unDLineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *R
 		return false
 	}
 
-	// get host
-	hostString := msg.Params[0]
-
-	// check host
-	var hostAddr net.IP
-	var hostNet *net.IPNet
-
-	_, hostNet, err := net.ParseCIDR(hostString)
-	if err != nil {
-		hostAddr = net.ParseIP(hostString)
-	}
-
-	if hostAddr == nil && hostNet == nil {
+	// save in datastore
+	hostString, err := server.removeDline(msg.Params[0])
+	if err == errInvalidDlineHost {
 		rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, client.t("Could not parse IP address or CIDR network"))
 		return false
-	}
-
-	if hostNet == nil {
-		hostString = hostAddr.String()
-	} else {
-		hostString = hostNet.String()
-	}
-
-	// save in datastore
-	err = server.store.Update(func(tx *buntdb.Tx) error {
-		dlineKey := fmt.Sprintf(keyDlineEntry, hostString)
-
-		// check if it exists or not
-		val, err := tx.Get(dlineKey)
-		if val == "" {
-			return errNoExistingBan
-		} else if err != nil {
-			return err
-		}
-
-		tx.Delete(dlineKey)
-		return nil
-	})
-
-	if err != nil {
+	} else if err != nil {
 		rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, fmt.Sprintf(client.t("Could not remove ban [%s]"), err.Error()))
 		return false
 	}
 
-	if hostNet == nil {
-		server.dlines.RemoveIP(hostAddr)
-	} else {
-		server.dlines.RemoveNetwork(*hostNet)
-	}
-
+	server.links.RemoveBan("D", hostString)
 	rb.Notice(fmt.Sprintf(client.t("Removed D-Line for %s"), hostString))
 	server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("%s$r removed D-Line for %s"), client.nick, hostString))
 	return false
@@ -2270,37 +2838,16 @@ func unKLineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *R
 	}
 
 	// get host
-	mask := msg.Params[0]
-
-	if !strings.Contains(mask, "!") && !strings.Contains(mask, "@") {
-		mask = mask + "!*@*"
-	} else if !strings.Contains(mask, "@") {
-		mask = mask + "@*"
-	}
+	mask := canonicalizeKlineMask(msg.Params[0])
 
 	// save in datastore
-	err := server.store.Update(func(tx *buntdb.Tx) error {
-		klineKey := fmt.Sprintf(keyKlineEntry, mask)
-
-		// check if it exists or not
-		val, err := tx.Get(klineKey)
-		if val == "" {
-			return errNoExistingBan
-		} else if err != nil {
-			return err
-		}
-
-		tx.Delete(klineKey)
-		return nil
-	})
-
+	err := server.removeKline(mask)
 	if err != nil {
 		rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, fmt.Sprintf(client.t("Could not remove ban [%s]"), err.Error()))
 		return false
 	}
 
-	server.klines.RemoveMask(mask)
-
+	server.links.RemoveBan("K", mask)
 	rb.Notice(fmt.Sprintf(client.t("Removed K-Line for %s"), mask))
 	server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("%s$r removed K-Line for %s"), client.nick, mask))
 	return false
@@ -2313,7 +2860,7 @@ func userHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 		return false
 	}
 
-	if client.username != "" && client.realname != "" {
+	if client.username != "" && client.Realname() != "" {
 		return false
 	}
 
@@ -2329,8 +2876,11 @@ func userHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 		client.username = "~" + msg.Params[0]
 		// don't bother updating nickmask here, it's not valid anyway
 	}
-	if client.realname == "" {
-		client.realname = msg.Params[3]
+	if client.Realname() == "" {
+		realname := truncateUTF8(msg.Params[3], server.Limits().RealnameLen)
+		client.stateMutex.Lock()
+		client.realname = realname
+		client.stateMutex.Unlock()
 	}
 
 	return false
@@ -2381,6 +2931,16 @@ func versionHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *R
 	return false
 }
 
+// WALLOPS <message>
+func wallopsHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	if !client.checkBroadcastCooldown() {
+		rb.Notice(client.t("You're sending broadcasts too quickly; wait a while and try again"))
+		return false
+	}
+	server.sendWallops(client, msg.Params[0])
+	return false
+}
+
 // WEBIRC <password> <gateway> <hostname> <ip> [:flag1 flag2=x flag3]
 func webircHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	// only allow unregistered clients to use this command
@@ -40,13 +40,19 @@ Oragono supports the following channel modes:
 
   +b  |  Client masks that are banned from the channel (e.g. *!*@127.0.0.1)
   +e  |  Client masks that are exempted from bans.
+  +f  |  Flood protection, e.g. 10m:5,3j:10 for at most 10 messages per 5 seconds
+      |  and 3 joins per 10 seconds. If a limit is exceeded, the channel is set
+      |  +m or +i for a while.
   +I  |  Client masks that are exempted from the invite-only flag.
   +i  |  Invite-only mode, only invited clients can join the channel.
   +k  |  Key required when joining the channel.
   +l  |  Client join limit for the channel.
+  +K  |  No-knock mode, clients can't use /KNOCK to ask for an invite.
   +m  |  Moderated mode, only privileged clients can talk on the channel.
   +n  |  No-outside-messages mode, only users that are on the channel can send
       |  messages to it.
+  +Q  |  Client masks that are quieted (can join, but not speak, unless they are
+      |  voiced or matched by +e).
   +R  |  Only registered users can talk in the channel.
   +s  |  Secret mode, channel won't show up in /LIST or whois replies.
   +t  |  Only channel opers can modify the topic.
@@ -57,16 +63,28 @@ Oragono supports the following channel modes:
   +a (&)  |  Admin channel mode.
   +o (@)  |  Operator channel mode.
   +h (%)  |  Halfop channel mode.
-  +v (+)  |  Voice channel mode.`
+  +v (+)  |  Voice channel mode.
+
+= Extbans =
+
+The +b, +e, +I and +Q lists also accept these masks. Put a ~ after the $ to
+negate any of them (e.g. $~a matches clients that aren't logged in):
+
+  $a            |  Clients logged into an account.
+  $a:<mask>     |  Clients logged into an account matching the mask.
+  $c:<channel>  |  Clients who are in the given channel.
+  $r:<mask>     |  Clients whose realname matches the mask.`
 	umodeHelpText = `== User Modes ==
 
 Oragono supports the following user modes:
 
   +a  |  User is marked as being away. This mode is set with the /AWAY command.
+  +g  |  Caller-ID: only users on your /ACCEPT list (and opers) can message you.
   +i  |  User is marked as invisible (their channels are hidden from whois replies).
   +o  |  User is an IRC operator.
   +R  |  User only accepts messages from other registered users. 
   +s  |  Server Notice Masks (see help with /HELPOP snomasks).
+  +w  |  User receives WALLOPS messages.
   +Z  |  User is connected via TLS.`
 	snomaskHelpText = `== Server Notice Masks ==
 
@@ -74,8 +92,10 @@ Oragono supports the following server notice masks for operators:
 
   a  |  Local announcements.
   c  |  Local client connections.
+  d  |  Local DNSBL hits.
   j  |  Local channel actions.
   k  |  Local kills.
+  l  |  Server links and netsplits.
   n  |  Local nick changes.
   o  |  Local oper actions.
   q  |  Local quits.
@@ -101,6 +121,15 @@ ACC VERIFY <accountname> <auth_code>
 
 Used in account registration. See the relevant specs for more info:
 https://oragono.io/specs.html`,
+	},
+	"accept": {
+		text: `ACCEPT <nick>{,<nick>}
+ACCEPT *
+
+When you have the +g (caller-ID) user mode set, only users on your accept list
+can message or invite you. ACCEPT adds the given nicknames to your accept list,
+or removes them if they're prefixed with a dash (-). "ACCEPT *" lists the
+nicknames on it. If you're logged into an account, the list is saved.`,
 	},
 	"ambiance": {
 		text: `AMBIANCE <target> <text to be sent>
@@ -125,6 +154,22 @@ longer away.`,
 Used in capability negotiation. See the IRCv3 specs for more info:
 http://ircv3.net/specs/core/capability-negotiation-3.1.html
 http://ircv3.net/specs/core/capability-negotiation-3.2.html`,
+	},
+	"chathistory": {
+		text: `CHATHISTORY <subcommand> <target> <reference> [limit]
+
+Replays messages and events from the history of <target>. If <target> is a
+channel, its history is replayed. If <target> is a nickname or account name,
+the direct messages between your account and theirs are replayed instead.
+<subcommand> is one of:
+
+* LATEST: The most recent messages, after <reference> if it's not '*'.
+* BEFORE: Messages sent before <reference>.
+* AFTER: Messages sent after <reference>.
+* AROUND: Messages sent around <reference>.
+
+<reference> is either msgid=<msgid> or timestamp=<timestamp>, where the
+timestamp is in the same format as the server-time tag.`,
 	},
 	"chanserv": {
 		text: `CHANSERV <subcommand> [params]
@@ -135,6 +180,30 @@ ChanServ controls channel registrations.`,
 		text: `CS <subcommand> [params]
 
 ChanServ controls channel registrations.`,
+	},
+	"chghost": {
+		oper: true,
+		text: `CHGHOST <nickname> <vhost>
+
+Changes the hostname (vhost) of the given user.`,
+	},
+	"chgident": {
+		oper: true,
+		text: `CHGIDENT <nickname> <username>
+
+Changes the username (ident) of the given user.`,
+	},
+	"chgname": {
+		oper: true,
+		text: `CHGNAME <nickname> <realname>
+
+Changes the realname of the given user.`,
+	},
+	"connect": {
+		oper: true,
+		text: `CONNECT <server>
+
+Links to the given server, which must have a link block in the config.`,
 	},
 	"debug": {
 		oper: true,
@@ -177,6 +246,12 @@ ON <server> specifies that the ban is to be set on that specific server.
 [reason] and [oper reason], if they exist, are separated by a vertical bar (|).
 
 If "DLINE LIST" is sent, the server sends back a list of our current DLINEs.`,
+	},
+	"globops": {
+		oper: true,
+		text: `GLOBOPS <message>
+
+Sends the given message as a notice to every IRC operator on the server.`,
 	},
 	"help": {
 		text: `HELP <argument>
@@ -187,6 +262,18 @@ Get an explanation of <argument>, or "index" for a list of help topics.`,
 		text: `HELPOP <argument>
 
 Get an explanation of <argument>, or "index" for a list of help topics.`,
+	},
+	"hostserv": {
+		text: `HOSTSERV <command> [params]
+
+HostServ lets you manage your vhost (a string displayed in place of your
+real hostname).`,
+	},
+	"hs": {
+		text: `HS <command> [params]
+
+HostServ lets you manage your vhost (a string displayed in place of your
+real hostname).`,
 	},
 	"info": {
 		text: `INFO
@@ -250,11 +337,24 @@ ON <server> specifies that the ban is to be set on that specific server.
 [reason] and [oper reason], if they exist, are separated by a vertical bar (|).
 
 If "KLINE LIST" is sent, the server sends back a list of our current KLINEs.`,
+	},
+	"knock": {
+		text: `KNOCK <channel> [reason]
+
+Asks the operators of a channel you can't join (because it's invite-only, has a
+key, or is full) to invite you, with an optional reason. Halfops can answer a
+KNOCK with INVITE, even if only channel operators can usually invite. Channels
+with the +K mode set can't be knocked on.`,
 	},
 	"language": {
 		text: `LANGUAGE <code>{ <code>}
 
 Sets your preferred languages to the given ones.`,
+	},
+	"links": {
+		text: `LINKS
+
+Lists the servers on the network.`,
 	},
 	"list": {
 		text: `LIST [<channel>{,<channel>}] [<elistcond>{,<elistcond>}]
@@ -388,6 +488,13 @@ Renames the given channel with the given reason, if possible.
 
 For example:
 	RENAME #ircv2 #ircv3 :Protocol upgrades!`,
+	},
+	"sajoin": {
+		oper: true,
+		text: `SAJOIN <nickname> <channel>{,<channel>}
+
+Forces the given user to join the given channels, ignoring any keys, bans,
+limits or other restrictions on them.`,
 	},
 	"sanick": {
 		oper: true,
@@ -402,11 +509,62 @@ Gives the given user a new nickname.`,
 Forcibly sets and removes modes from the given target -- only available to
 opers. For more specific information on mode characters, see the help for
 "cmode" and "umode".`,
+	},
+	"sapart": {
+		oper: true,
+		text: `SAPART <nickname> <channel>{,<channel>} [reason]
+
+Forces the given user to leave the given channels.`,
+	},
+	"saquit": {
+		oper: true,
+		text: `SAQUIT <nickname> <reason>
+
+Disconnects the given user from the server, using the given reason as their
+quit message.`,
 	},
 	"scene": {
 		text: `SCENE <target> <text to be sent>
 
 The SCENE command is used to send a scene notification to the given target.`,
+	},
+	"setname": {
+		text: `SETNAME <realname>
+
+Changes your realname to the given value. Clients that support the
+draft/setname capability are notified of the change.`,
+	},
+	"silence": {
+		text: `SILENCE [<+|-><mask>{,<+|-><mask>}]
+
+Ignores private messages, notices and invites from users matching the given
+masks (nicknames, n!u@h masks or extbans). Masks are removed if they're
+prefixed with a dash (-). With no parameters, lists your current silence masks.
+If you're logged into an account, the list is saved.`,
+	},
+	"squit": {
+		oper: true,
+		text: `SQUIT <server> [reason]
+
+Closes the link to the given server, splitting it (and everything linked
+through it) from the network.`,
+	},
+	"stats": {
+		text: `STATS <letter>
+
+Shows server statistics. The letters are:
+
+  u  |  How long the server has been running.
+  m  |  How many times each command has been used.
+  P  |  The listeners clients can connect to (opers only).
+  k  |  Current K-Lines (opers only).
+  d  |  Current D-Lines (opers only).
+  s  |  Current account suspensions (opers only).
+  o  |  Configured operators (opers only).
+  p  |  Operators who are currently online (opers only).
+  L  |  Clients per subnet, as tracked by the connection limiter (opers only).
+  T  |  Recent connections per subnet, as tracked by the connection throttler
+     |  (opers only).`,
 	},
 	"tagmsg": {
 		text: `@+client-only-tags TAGMSG <target>{,<target>}
@@ -477,6 +635,12 @@ Shows information about the given users. Takes up to 10 nicknames.`,
 		text: `VERSION [server]
 
 Views the version of software and the RPL_ISUPPORT tokens for the given server.`,
+	},
+	"wallops": {
+		oper: true,
+		text: `WALLOPS <message>
+
+Sends the given message to every user with the +w user mode set.`,
 	},
 	"webirc": {
 		oper: true, // not really, but it's restricted anyways
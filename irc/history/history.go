@@ -0,0 +1,283 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package history
+
+import (
+	"sync"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// ItemType represents the kind of event stored in a history buffer.
+type ItemType uint
+
+const (
+	uninitializedItem ItemType = iota
+	Privmsg
+	Notice
+	Tagmsg
+	Join
+	Part
+	Kick
+	Topic
+)
+
+// Item represents an event (e.g., a PRIVMSG or a JOIN) and its associated data.
+type Item struct {
+	Type ItemType
+	Time time.Time
+
+	// Nick is the full nickmask of the source of the event
+	Nick        string
+	AccountName string
+	Msgid       string
+	// Message is the text of the event (message body, part/kick reason, topic)
+	Message string
+	// Target is the secondary target of the event, e.g., the nick that was kicked
+	Target string
+	Tags   map[string]ircmsg.TagValue
+}
+
+// Predicate is a function that selects history items.
+type Predicate func(item Item) (matches bool)
+
+// Buffer is a ring buffer holding a bounded number of history items,
+// optionally discarding items that are older than a given age.
+type Buffer struct {
+	sync.RWMutex
+
+	// ring buffer: start is the oldest item and end is one past the newest,
+	// start == end means the buffer is full and start == -1 means it's empty
+	buffer []Item
+	start  int
+	end    int
+
+	maxAge time.Duration
+}
+
+// NewHistoryBuffer returns a new Buffer holding up to `size` items.
+func NewHistoryBuffer(size int, maxAge time.Duration) (result *Buffer) {
+	result = new(Buffer)
+	result.Resize(size, maxAge)
+	return
+}
+
+// Enabled returns whether this buffer stores anything.
+func (list *Buffer) Enabled() bool {
+	list.RLock()
+	defer list.RUnlock()
+	return len(list.buffer) != 0
+}
+
+// Add adds a history item to the buffer, evicting the oldest item if the buffer is full.
+func (list *Buffer) Add(item Item) {
+	list.Lock()
+	defer list.Unlock()
+
+	if len(list.buffer) == 0 {
+		return
+	}
+
+	if item.Time.IsZero() {
+		item.Time = time.Now().UTC()
+	}
+
+	list.maybeExpire(item.Time)
+
+	var pos int
+	if list.start == -1 { // empty
+		pos = 0
+		list.start = 0
+		list.end = 1 % len(list.buffer)
+	} else if list.start != list.end { // partially full
+		pos = list.end
+		list.end = (list.end + 1) % len(list.buffer)
+	} else if list.start == list.end { // full
+		pos = list.end
+		list.end = (list.end + 1) % len(list.buffer)
+		list.start = list.end // advance start as well, overwriting first entry
+	}
+
+	list.buffer[pos] = item
+}
+
+// maybeExpire discards items that have fallen outside the time window.
+func (list *Buffer) maybeExpire(now time.Time) {
+	if list.maxAge == 0 || list.start == -1 {
+		return
+	}
+
+	cutoff := now.Add(-list.maxAge)
+	for {
+		if !list.buffer[list.start].Time.Before(cutoff) {
+			return
+		}
+		list.buffer[list.start] = Item{}
+		list.start = (list.start + 1) % len(list.buffer)
+		if list.start == list.end {
+			// every item expired
+			list.start = -1
+			list.end = -1
+			return
+		}
+	}
+}
+
+// Between returns all history items with a time `after` <= time <= `before`,
+// with an indication of whether the results are complete or are missing items
+// because some of that period was discarded. A zero value of `before` is considered
+// higher than all other times.
+func (list *Buffer) Between(after, before time.Time, ascending bool, limit int) (results []Item, complete bool) {
+	satisfies := func(item Item) bool {
+		return (after.IsZero() || !item.Time.Before(after)) && (before.IsZero() || !item.Time.After(before))
+	}
+
+	list.RLock()
+	defer list.RUnlock()
+
+	if len(list.buffer) == 0 {
+		return
+	}
+
+	complete = list.isComplete(after)
+	results = list.matchInternal(satisfies, ascending, limit)
+	return
+}
+
+// Match returns all history items such that `predicate` returns true for them.
+// Items are considered in reverse insertion order if `ascending` is false, or
+// in insertion order if `ascending` is true, up to a total of `limit` matches
+// if `limit` > 0 (unlimited otherwise).
+// Results are always returned in insertion order.
+func (list *Buffer) Match(predicate Predicate, ascending bool, limit int) (results []Item) {
+	list.RLock()
+	defer list.RUnlock()
+	return list.matchInternal(predicate, ascending, limit)
+}
+
+// Latest returns the items most recently added, up to `limit`. If `limit` is 0,
+// it returns all items.
+func (list *Buffer) Latest(limit int) (results []Item) {
+	return list.Match(func(item Item) bool { return true }, false, limit)
+}
+
+// Find returns the item with the given msgid, if it is still in the buffer.
+func (list *Buffer) Find(msgid string) (result Item, found bool) {
+	if msgid == "" {
+		return
+	}
+	results := list.Match(func(item Item) bool { return item.Msgid == msgid }, false, 1)
+	if len(results) == 1 {
+		return results[0], true
+	}
+	return
+}
+
+// Resize shrinks or expands the buffer, preserving the most recent items.
+func (list *Buffer) Resize(size int, maxAge time.Duration) {
+	list.Lock()
+	defer list.Unlock()
+
+	list.maxAge = maxAge
+
+	if size == len(list.buffer) {
+		return
+	}
+
+	// the oldest items are discarded if we're shrinking
+	var items []Item
+	if list.start != -1 && len(list.buffer) != 0 {
+		items = list.matchInternal(func(item Item) bool { return true }, false, size)
+	}
+
+	list.buffer = make([]Item, size)
+	list.start = -1
+	list.end = -1
+	if size == 0 {
+		return
+	}
+
+	copy(list.buffer, items)
+	if 0 < len(items) {
+		list.start = 0
+		list.end = len(items) % size
+	}
+}
+
+// isComplete returns whether every item since `after` is still in the buffer;
+// caller must hold the read lock.
+func (list *Buffer) isComplete(after time.Time) bool {
+	if list.start == -1 || list.start != list.end {
+		// the buffer was never filled up, so nothing was evicted for space reasons
+		return list.maxAge == 0 || (!after.IsZero() && !after.Before(time.Now().Add(-list.maxAge)))
+	}
+	// the buffer is full, so the oldest item may have evicted earlier ones
+	return !after.IsZero() && list.buffer[list.start].Time.Before(after)
+}
+
+// matchInternal does the work of Match; caller must hold the read lock.
+func (list *Buffer) matchInternal(predicate Predicate, ascending bool, limit int) (results []Item) {
+	if list.start == -1 || len(list.buffer) == 0 {
+		return
+	}
+
+	var cutoff time.Time
+	if list.maxAge != 0 {
+		cutoff = time.Now().Add(-list.maxAge)
+	}
+
+	var pos, stop int
+	if ascending {
+		pos = list.start
+		stop = list.prev(list.end)
+	} else {
+		pos = list.prev(list.end)
+		stop = list.start
+	}
+
+	for {
+		item := list.buffer[pos]
+		if (cutoff.IsZero() || !item.Time.Before(cutoff)) && predicate(item) {
+			results = append(results, item)
+		}
+		if pos == stop || (0 < limit && limit <= len(results)) {
+			break
+		}
+		if ascending {
+			pos = list.next(pos)
+		} else {
+			pos = list.prev(pos)
+		}
+	}
+
+	if !ascending {
+		reverse(results)
+	}
+	return
+}
+
+func (list *Buffer) prev(index int) int {
+	switch index {
+	case 0:
+		return len(list.buffer) - 1
+	default:
+		return index - 1
+	}
+}
+
+func (list *Buffer) next(index int) int {
+	switch index {
+	case len(list.buffer) - 1:
+		return 0
+	default:
+		return index + 1
+	}
+}
+
+func reverse(results []Item) {
+	for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+		results[i], results[j] = results[j], results[i]
+	}
+}
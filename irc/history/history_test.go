@@ -0,0 +1,91 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package history
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func toMsgids(items []Item) (result []string) {
+	for _, item := range items {
+		result = append(result, item.Msgid)
+	}
+	return
+}
+
+func assertEqual(supplied, expected interface{}, t *testing.T) {
+	if !reflect.DeepEqual(supplied, expected) {
+		t.Errorf("expected %v but got %v", expected, supplied)
+	}
+}
+
+func TestEmptyBuffer(t *testing.T) {
+	buf := NewHistoryBuffer(0, 0)
+	buf.Add(Item{Msgid: "testmsgid"})
+	assertEqual(buf.Enabled(), false, t)
+	assertEqual(len(buf.Latest(0)), 0, t)
+
+	buf.Resize(1, 0)
+	assertEqual(buf.Enabled(), true, t)
+	assertEqual(len(buf.Latest(0)), 0, t)
+	buf.Add(Item{Msgid: "testmsgid"})
+	assertEqual(toMsgids(buf.Latest(0)), []string{"testmsgid"}, t)
+	buf.Add(Item{Msgid: "testmsgid2"})
+	assertEqual(toMsgids(buf.Latest(0)), []string{"testmsgid2"}, t)
+
+	_, found := buf.Find("testmsgid")
+	assertEqual(found, false, t)
+	item, found := buf.Find("testmsgid2")
+	assertEqual(found, true, t)
+	assertEqual(item.Msgid, "testmsgid2", t)
+}
+
+func TestBufferOrdering(t *testing.T) {
+	start := time.Now().UTC().Add(-time.Hour)
+	buf := NewHistoryBuffer(3, 0)
+	for i, msgid := range []string{"a", "b", "c", "d"} {
+		buf.Add(Item{Msgid: msgid, Time: start.Add(time.Duration(i) * time.Minute)})
+	}
+
+	assertEqual(toMsgids(buf.Latest(0)), []string{"b", "c", "d"}, t)
+	assertEqual(toMsgids(buf.Latest(2)), []string{"c", "d"}, t)
+
+	results, complete := buf.Between(start.Add(2*time.Minute), time.Time{}, true, 0)
+	assertEqual(toMsgids(results), []string{"c", "d"}, t)
+	assertEqual(complete, true, t)
+
+	results, complete = buf.Between(start, start.Add(2*time.Minute), false, 0)
+	assertEqual(toMsgids(results), []string{"b", "c"}, t)
+	assertEqual(complete, false, t) // "a" was evicted
+
+	results, _ = buf.Between(start, time.Time{}, true, 1)
+	assertEqual(toMsgids(results), []string{"b"}, t)
+}
+
+func TestResize(t *testing.T) {
+	buf := NewHistoryBuffer(4, 0)
+	for _, msgid := range []string{"a", "b", "c", "d"} {
+		buf.Add(Item{Msgid: msgid})
+	}
+
+	buf.Resize(2, 0)
+	assertEqual(toMsgids(buf.Latest(0)), []string{"c", "d"}, t)
+
+	buf.Resize(3, 0)
+	buf.Add(Item{Msgid: "e"})
+	assertEqual(toMsgids(buf.Latest(0)), []string{"c", "d", "e"}, t)
+	buf.Add(Item{Msgid: "f"})
+	assertEqual(toMsgids(buf.Latest(0)), []string{"d", "e", "f"}, t)
+}
+
+func TestMaxAge(t *testing.T) {
+	now := time.Now().UTC()
+	buf := NewHistoryBuffer(8, time.Hour)
+	buf.Add(Item{Msgid: "old", Time: now.Add(-2 * time.Hour)})
+	buf.Add(Item{Msgid: "new", Time: now})
+
+	assertEqual(toMsgids(buf.Latest(0)), []string{"new"}, t)
+}
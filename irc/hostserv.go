@@ -0,0 +1,401 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/oragono/oragono/irc/modes"
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/oragono/oragono/irc/utils"
+)
+
+const hostservHelp = `HostServ lets you manage your vhost (i.e., the string displayed
+in place of your client's hostname/IP).
+
+To see in-depth help for a specific HostServ command, try:
+    $b/HS HELP <command>$b
+
+Here are the commands you can use:
+%s`
+
+type hsCommand struct {
+	capabs       []string // oper capabs the given user has to have to access this command
+	handler      func(server *Server, client *Client, command, params string, rb *ResponseBuffer)
+	help         string
+	helpShort    string
+	oper         bool // true if the user has to be an oper to use this command
+	userRequests bool // user requests must be enabled to use this command
+}
+
+var (
+	hostservCommands = map[string]*hsCommand{
+		"approve": {
+			handler: hsApproveHandler,
+			help: `Syntax: $bAPPROVE <user>$b
+
+APPROVE approves a user's vhost request.`,
+			helpShort: `$bAPPROVE$b approves a user's vhost request.`,
+			capabs:    []string{"vhosts"},
+		},
+		"del": {
+			handler: hsSetHandler,
+			help: `Syntax: $bDEL <user>$b
+
+DEL deletes a user's vhost.`,
+			helpShort: `$bDEL$b deletes a user's vhost.`,
+			capabs:    []string{"vhosts"},
+		},
+		"help": {
+			help: `Syntax: $bHELP [command]$b
+
+HELP returns information on the given command.`,
+			helpShort: `$bHELP$b shows in-depth information about commands.`,
+		},
+		"reject": {
+			handler: hsRejectHandler,
+			help: `Syntax: $bREJECT <user> [reason]$b
+
+REJECT rejects a user's vhost request, optionally giving them a reason
+for the rejection.`,
+			helpShort: `$bREJECT$b rejects a user's vhost request.`,
+			capabs:    []string{"vhosts"},
+		},
+		"request": {
+			handler: hsRequestHandler,
+			help: `Syntax: $bREQUEST <vhost>$b
+
+REQUEST requests that a new vhost be assigned to your account. The request must
+then be approved by a server operator.`,
+			helpShort:    `$bREQUEST$b requests a new vhost, pending operator approval.`,
+			userRequests: true,
+		},
+		"set": {
+			handler: hsSetHandler,
+			help: `Syntax: $bSET <user> <vhost>$b
+
+SET sets a user's vhost, bypassing the request system.`,
+			helpShort: `$bSET$b sets a user's vhost.`,
+			capabs:    []string{"vhosts"},
+		},
+		"status": {
+			handler: hsStatusHandler,
+			help: `Syntax: $bSTATUS [user]$b
+
+STATUS displays your current vhost, if any, and the status of your most recent
+request for a new one. A server operator can view someone else's status.`,
+			helpShort: `$bSTATUS$b shows your vhost and request status.`,
+		},
+		"waiting": {
+			handler: hsWaitingHandler,
+			help: `Syntax: $bWAITING$b
+
+WAITING shows a list of pending vhost requests, which can then be approved
+or rejected.`,
+			helpShort: `$bWAITING$b shows a list of pending vhost requests.`,
+			capabs:    []string{"vhosts"},
+		},
+	}
+
+	// vhosts are displayed in place of hostnames, so keep them to characters
+	// that are valid (or at least harmless) there
+	validVHostRegex = regexp.MustCompile(`^[0-9A-Za-z.\-_/]+$`)
+)
+
+// hsNotice sends the client a notice from HostServ.
+func hsNotice(rb *ResponseBuffer, text string) {
+	rb.Add(nil, "HostServ", "NOTICE", rb.target.Nick(), text)
+}
+
+// hsNotifyAccount notifies the clients logged into the given account of a change
+// to their vhost request. the message is built separately for each client, so
+// that it's translated into that client's language.
+func hsNotifyAccount(server *Server, account string, message func(client *Client) string) {
+	casefoldedAccount, err := CasefoldName(account)
+	if err != nil {
+		return
+	}
+	server.accounts.RLock()
+	clients := make([]*Client, len(server.accounts.accountToClients[casefoldedAccount]))
+	copy(clients, server.accounts.accountToClients[casefoldedAccount])
+	server.accounts.RUnlock()
+
+	for _, client := range clients {
+		client.Send(nil, "HostServ", "NOTICE", client.Nick(), message(client))
+	}
+}
+
+// hostservNoticeHandler handles NOTICEs that HostServ receives.
+func (server *Server) hostservNoticeHandler(client *Client, message string, rb *ResponseBuffer) {
+	// do nothing
+}
+
+// hostservPrivmsgHandler handles PRIVMSGs that HostServ receives.
+func (server *Server) hostservPrivmsgHandler(client *Client, message string, rb *ResponseBuffer) {
+	if !server.AccountConfig().VHosts.Enabled {
+		hsNotice(rb, client.t("HostServ is disabled on this server"))
+		return
+	}
+
+	commandName, params := utils.ExtractParam(message)
+	commandName = strings.ToLower(commandName)
+
+	commandInfo := hostservCommands[commandName]
+	if commandInfo == nil {
+		hsNotice(rb, client.t("Unknown command. To see available commands, run /HS HELP"))
+		return
+	}
+
+	if commandInfo.oper && !client.HasMode(modes.Operator) {
+		hsNotice(rb, client.t("Command restricted"))
+		return
+	}
+
+	if 0 < len(commandInfo.capabs) && !client.HasRoleCapabs(commandInfo.capabs...) {
+		hsNotice(rb, client.t("Command restricted"))
+		return
+	}
+
+	if commandInfo.userRequests && !server.AccountConfig().VHosts.UserRequests.Enabled {
+		hsNotice(rb, client.t("Vhost requests are disabled"))
+		return
+	}
+
+	// custom help handling here to prevent recursive init loop
+	if commandName == "help" {
+		hsHelpHandler(server, client, commandName, params, rb)
+		return
+	}
+
+	if commandInfo.handler == nil {
+		hsNotice(rb, client.t("Command error. Please report this to the developers"))
+		return
+	}
+
+	server.logger.Debug("hostserv", fmt.Sprintf("Client %s ran command %s", client.Nick(), commandName))
+
+	commandInfo.handler(server, client, commandName, params, rb)
+}
+
+func hsHelpHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
+	hsNotice(rb, ircfmt.Unescape(client.t("*** $bHostServ HELP$b ***")))
+
+	if params == "" {
+		// show general help
+		var shownHelpLines sort.StringSlice
+		for _, commandInfo := range hostservCommands {
+			// skip commands user can't access
+			if commandInfo.oper && !client.HasMode(modes.Operator) {
+				continue
+			}
+			if 0 < len(commandInfo.capabs) && !client.HasRoleCapabs(commandInfo.capabs...) {
+				continue
+			}
+			if commandInfo.userRequests && !server.AccountConfig().VHosts.UserRequests.Enabled {
+				continue
+			}
+
+			shownHelpLines = append(shownHelpLines, "    "+client.t(commandInfo.helpShort))
+		}
+
+		// sort help lines
+		sort.Sort(shownHelpLines)
+
+		// assemble help text
+		assembledHelpLines := strings.Join(shownHelpLines, "\n")
+		fullHelp := ircfmt.Unescape(fmt.Sprintf(client.t(hostservHelp), assembledHelpLines))
+
+		// push out help text
+		for _, line := range strings.Split(fullHelp, "\n") {
+			hsNotice(rb, line)
+		}
+	} else {
+		commandInfo := hostservCommands[strings.ToLower(strings.TrimSpace(params))]
+		if commandInfo == nil {
+			hsNotice(rb, client.t("Unknown command. To see available commands, run /HS HELP"))
+		} else {
+			for _, line := range strings.Split(ircfmt.Unescape(client.t(commandInfo.help)), "\n") {
+				hsNotice(rb, line)
+			}
+		}
+	}
+
+	hsNotice(rb, ircfmt.Unescape(client.t("*** $bEnd of HostServ HELP$b ***")))
+}
+
+// validateVHost checks that a vhost is acceptable to display in place of a hostname.
+func validateVHost(server *Server, vhost string) error {
+	if len(vhost) > server.AccountConfig().VHosts.MaxLength {
+		return errInvalidVHost
+	}
+	if strings.HasPrefix(vhost, ":") || strings.HasPrefix(vhost, "-") || !validVHostRegex.MatchString(vhost) {
+		return errInvalidVHost
+	}
+	return nil
+}
+
+func hsRequestHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
+	vhost, _ := utils.ExtractParam(params)
+	if vhost == "" {
+		hsNotice(rb, client.t("Invalid parameters"))
+		return
+	}
+	if !client.LoggedIntoAccount() {
+		hsNotice(rb, client.t("You're not logged into an account"))
+		return
+	}
+	if validateVHost(server, vhost) != nil {
+		hsNotice(rb, client.t("Invalid vhost"))
+		return
+	}
+
+	accountName := client.AccountName()
+	_, err := server.accounts.VHostRequest(accountName, vhost, server.AccountConfig().VHosts.UserRequests.Cooldown)
+	if err == errVHostRequestCooldown {
+		hsNotice(rb, client.t("You must wait longer before making another vhost request"))
+		return
+	} else if err != nil {
+		hsNotice(rb, client.t("An error occurred"))
+		return
+	}
+
+	hsNotice(rb, client.t("Your vhost request will be reviewed by an administrator"))
+	server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Account $c[grey][$r%s$c[grey]] requested vhost $c[grey][$r%s$c[grey]]"), accountName, vhost))
+}
+
+func hsStatusHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
+	accountName, _ := utils.ExtractParam(params)
+	if accountName == "" {
+		if !client.LoggedIntoAccount() {
+			hsNotice(rb, client.t("You're not logged into an account"))
+			return
+		}
+		accountName = client.AccountName()
+	} else if !client.HasRoleCapabs("vhosts") {
+		hsNotice(rb, client.t("Command restricted"))
+		return
+	}
+
+	info, err := server.accounts.LoadVHostInfo(accountName)
+	if err == errAccountDoesNotExist {
+		hsNotice(rb, client.t("Account does not exist"))
+		return
+	} else if err != nil {
+		hsNotice(rb, client.t("An error occurred"))
+		return
+	}
+
+	if info.ApprovedVHost != "" {
+		hsNotice(rb, fmt.Sprintf(client.t("Account %[1]s has vhost: %[2]s"), accountName, info.ApprovedVHost))
+	} else {
+		hsNotice(rb, fmt.Sprintf(client.t("Account %s has no vhost"), accountName))
+	}
+	if info.RequestedVHost != "" {
+		hsNotice(rb, fmt.Sprintf(client.t("A request is pending for vhost: %s"), info.RequestedVHost))
+	}
+	if info.RejectedReason != "" {
+		hsNotice(rb, fmt.Sprintf(client.t("A request was previously rejected for reason: %s"), info.RejectedReason))
+	}
+}
+
+func hsSetHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
+	accountName, params := utils.ExtractParam(params)
+	var vhost string
+	if command == "set" {
+		vhost, _ = utils.ExtractParam(params)
+		if vhost == "" || validateVHost(server, vhost) != nil {
+			hsNotice(rb, client.t("Invalid vhost"))
+			return
+		}
+	}
+	if accountName == "" {
+		hsNotice(rb, client.t("Invalid parameters"))
+		return
+	}
+
+	_, err := server.accounts.VHostSet(accountName, vhost)
+	if err == errAccountDoesNotExist {
+		hsNotice(rb, client.t("Account does not exist"))
+		return
+	} else if err != nil {
+		hsNotice(rb, client.t("An error occurred"))
+		return
+	}
+
+	if vhost != "" {
+		hsNotice(rb, client.t("Successfully set vhost"))
+		server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Operator $c[grey][$r%s$c[grey]] set the vhost of account $c[grey][$r%s$c[grey]] to $c[grey][$r%s$c[grey]]"), client.Nick(), accountName, vhost))
+	} else {
+		hsNotice(rb, client.t("Successfully cleared vhost"))
+		server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Operator $c[grey][$r%s$c[grey]] cleared the vhost of account $c[grey][$r%s$c[grey]]"), client.Nick(), accountName))
+	}
+}
+
+func hsApproveHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
+	accountName, _ := utils.ExtractParam(params)
+	if accountName == "" {
+		hsNotice(rb, client.t("Invalid parameters"))
+		return
+	}
+
+	info, err := server.accounts.VHostApprove(accountName)
+	if err == errAccountDoesNotExist {
+		hsNotice(rb, client.t("Account does not exist"))
+		return
+	} else if err == errNoVHostRequest {
+		hsNotice(rb, client.t("That account has no pending vhost request"))
+		return
+	} else if err != nil {
+		hsNotice(rb, client.t("An error occurred"))
+		return
+	}
+
+	hsNotice(rb, fmt.Sprintf(client.t("Successfully approved vhost request for %s"), accountName))
+	hsNotifyAccount(server, accountName, func(target *Client) string {
+		return fmt.Sprintf(target.t("Your vhost request was approved; your vhost is now %s"), info.ApprovedVHost)
+	})
+	server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Operator $c[grey][$r%s$c[grey]] approved vhost $c[grey][$r%s$c[grey]] for account $c[grey][$r%s$c[grey]]"), client.Nick(), info.ApprovedVHost, accountName))
+}
+
+func hsRejectHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
+	accountName, reason := utils.ExtractParam(params)
+	if accountName == "" {
+		hsNotice(rb, client.t("Invalid parameters"))
+		return
+	}
+	reason = strings.TrimSpace(reason)
+
+	_, err := server.accounts.VHostReject(accountName, reason)
+	if err == errAccountDoesNotExist {
+		hsNotice(rb, client.t("Account does not exist"))
+		return
+	} else if err == errNoVHostRequest {
+		hsNotice(rb, client.t("That account has no pending vhost request"))
+		return
+	} else if err != nil {
+		hsNotice(rb, client.t("An error occurred"))
+		return
+	}
+
+	hsNotice(rb, fmt.Sprintf(client.t("Successfully rejected vhost request for %s"), accountName))
+	hsNotifyAccount(server, accountName, func(target *Client) string {
+		if reason != "" {
+			return fmt.Sprintf(target.t("Your vhost request was rejected: %s"), reason)
+		}
+		return target.t("Your vhost request was rejected")
+	})
+}
+
+func hsWaitingHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
+	requests := server.accounts.VHostListRequests()
+	for _, request := range requests {
+		hsNotice(rb, fmt.Sprintf(client.t("Account %[1]s requested vhost %[2]s (%[3]s ago)"), request.Account, request.RequestedVHost, time.Since(request.LastRequestTime).Truncate(time.Second)))
+	}
+	hsNotice(rb, fmt.Sprintf(client.t("Total number of pending requests: %d"), len(requests)))
+}
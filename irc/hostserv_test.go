@@ -0,0 +1,83 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oragono/oragono/irc/passwd"
+)
+
+// addTestOper adds an operator to the config, with its own class holding the
+// given capabilities. Its password is its name followed by "pass".
+func addTestOper(t *testing.T, config *Config, name string, capabilities ...string) {
+	password, err := passwd.GenerateEncodedPassword(name + "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.OperClasses == nil {
+		config.OperClasses = make(map[string]*OperClassConfig)
+		config.Opers = make(map[string]*OperConfig)
+	}
+	config.OperClasses[name] = &OperClassConfig{Title: "Tester", Capabilities: capabilities}
+	config.Opers[name] = &OperConfig{Class: name, Password: password}
+}
+
+// newOperTestClient registers a client and opers it up as the given operator.
+func newOperTestClient(t *testing.T, server *Server, name string) *testClient {
+	tc := newTestClient(t, server, name)
+	tc.send("OPER " + name + " " + name + "pass")
+	tc.expect(t, " 381 ")
+	return tc
+}
+
+func TestHostServRequestAndApprove(t *testing.T) {
+	server, shutdown := newTestServer(t, func(config *Config) {
+		config.Accounts.VHosts.Enabled = true
+		config.Accounts.VHosts.MaxLength = 64
+		config.Accounts.VHosts.UserRequests.Enabled = true
+		config.Accounts.VHosts.UserRequests.Cooldown = time.Hour
+		addTestOper(t, config, "admin", "vhosts")
+	})
+	defer shutdown()
+
+	alice := openTestClient(server)
+	alice.registerAccount(t, server, "alice", "alicepass")
+	alice.register(t, "alice")
+	alice.send("PRIVMSG HostServ :REQUEST bad!vhost")
+	alice.expect(t, "HostServ", "Invalid vhost")
+	alice.send("PRIVMSG HostServ :REQUEST alice.example")
+	alice.expect(t, "HostServ", "will be reviewed")
+	alice.send("PRIVMSG HostServ :REQUEST other.example")
+	alice.expect(t, "HostServ", "must wait longer")
+
+	// only opers with the vhosts capability can approve requests
+	alice.send("PRIVMSG HostServ :APPROVE alice")
+	alice.expect(t, "HostServ")
+	if info, _ := server.accounts.LoadVHostInfo("alice"); info.ApprovedVHost != "" {
+		t.Fatalf("request was approved by a user")
+	}
+
+	admin := newOperTestClient(t, server, "admin")
+	admin.send("PRIVMSG HostServ :WAITING")
+	admin.expect(t, "HostServ", "alice", "alice.example")
+	admin.send("PRIVMSG HostServ :APPROVE alice")
+	admin.expect(t, "HostServ", "Successfully approved vhost request for alice")
+	alice.expect(t, "HostServ", "approved", "alice.example")
+	if mask := alice.client.NickMaskString(); mask != "alice!~u@alice.example" {
+		t.Errorf("vhost wasn't applied to the logged-in client: %s", mask)
+	}
+	admin.send("PRIVMSG HostServ :APPROVE alice")
+	admin.expect(t, "HostServ", "no pending vhost request")
+
+	// the vhost is used when logging in
+	phone := openTestClient(server)
+	phone.login(t, server, "alice")
+	phone.register(t, "alice_phone")
+	phone.send("JOIN #test")
+	phone.expect(t, ":alice_phone!~u@alice.example JOIN #test")
+	phone.send("PRIVMSG HostServ :STATUS")
+	phone.expect(t, "HostServ", "alice.example")
+}
@@ -121,7 +121,7 @@ func (it *IdleTimer) processTimeout() {
 		it.client.Ping()
 	} else {
 		it.client.Quit(it.quitMessage(previousState))
-		it.client.destroy(false)
+		it.client.closeConnection()
 	}
 }
 
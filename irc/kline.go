@@ -5,6 +5,8 @@ package irc
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
 	"sync"
 
 	"github.com/goshuirc/irc-go/ircmatch"
@@ -147,3 +149,59 @@ func (s *Server) loadKLines() {
 		return nil
 	})
 }
+
+// canonicalizeKlineMask lowercases a mask and expands a partial one like "nick" or
+// "nick!user" into a full nickmask, so that adding and removing K-Lines agree.
+func canonicalizeKlineMask(mask string) string {
+	mask = strings.ToLower(mask)
+	if !strings.Contains(mask, "!") && !strings.Contains(mask, "@") {
+		return mask + "!*@*"
+	} else if !strings.Contains(mask, "@") {
+		return mask + "@*"
+	}
+	return mask
+}
+
+// addKline saves a K-Line to the datastore and applies it.
+func (server *Server) addKline(mask string, info IPBanInfo) error {
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		// assemble json from ban info
+		b, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+
+		tx.Set(fmt.Sprintf(keyKlineEntry, mask), string(b), nil)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	server.klines.AddMask(mask, info.Time, info.Reason, info.OperReason, info.OperName)
+	return nil
+}
+
+// removeKline deletes a K-Line from the datastore and lifts it.
+func (server *Server) removeKline(mask string) error {
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		klineKey := fmt.Sprintf(keyKlineEntry, mask)
+
+		// check if it exists or not
+		val, err := tx.Get(klineKey)
+		if val == "" {
+			return errNoExistingBan
+		} else if err != nil {
+			return err
+		}
+
+		tx.Delete(klineKey)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	server.klines.RemoveMask(mask)
+	return nil
+}
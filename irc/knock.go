@@ -0,0 +1,107 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/oragono/oragono/irc/modes"
+)
+
+const (
+	// how long a client must wait between KNOCKs (on any channel)
+	knockUserDelay = 5 * time.Minute
+	// how long a channel can't be knocked on after a KNOCK
+	knockChannelDelay = time.Minute
+	// how long a KNOCK can be answered with a (halfop) INVITE
+	knockExpiry = time.Hour
+)
+
+// Knock asks the operators of an otherwise unjoinable channel for an invite.
+func (channel *Channel) Knock(client *Client, reason string, rb *ResponseBuffer) {
+	server := client.server
+	nick := client.Nick()
+	chname := channel.Name()
+
+	if channel.hasClient(client) {
+		rb.Add(nil, server.name, ERR_KNOCKONCHAN, nick, chname, client.t("You're already on that channel"))
+		return
+	}
+	if channel.flags[modes.NoKnock] {
+		rb.Add(nil, server.name, ERR_CANNOTKNOCK, nick, fmt.Sprintf(client.t("Cannot knock on %s (+%s is set)"), chname, modes.NoKnock.String()))
+		return
+	}
+	if !channel.flags[modes.InviteOnly] && channel.Key() == "" && !channel.IsFull() {
+		rb.Add(nil, server.name, ERR_CHANOPEN, nick, chname, client.t("Channel is open"))
+		return
+	}
+	if channel.lists[modes.BanMask].MatchClient(client) && !channel.lists[modes.ExceptMask].MatchClient(client) {
+		rb.Add(nil, server.name, ERR_CANNOTKNOCK, nick, fmt.Sprintf(client.t("Cannot knock on %s (you're banned)"), chname))
+		return
+	}
+
+	now := time.Now()
+	client.stateMutex.Lock()
+	userThrottled := now.Sub(client.lastKnock) < knockUserDelay
+	if !userThrottled {
+		client.lastKnock = now
+	}
+	client.stateMutex.Unlock()
+	if userThrottled {
+		rb.Add(nil, server.name, ERR_TOOMANYKNOCK, nick, chname, client.t("Too many KNOCKs (user)"))
+		return
+	}
+
+	nickCasefolded := client.NickCasefolded()
+	channel.stateMutex.Lock()
+	channelThrottled := now.Sub(channel.lastKnock) < knockChannelDelay
+	if !channelThrottled {
+		channel.lastKnock = now
+		if channel.knocks == nil {
+			channel.knocks = make(map[string]time.Time)
+		}
+		for knocker, knockTime := range channel.knocks {
+			if knockExpiry < now.Sub(knockTime) {
+				delete(channel.knocks, knocker)
+			}
+		}
+		channel.knocks[nickCasefolded] = now
+	}
+	channel.stateMutex.Unlock()
+	if channelThrottled {
+		rb.Add(nil, server.name, ERR_TOOMANYKNOCK, nick, chname, client.t("Too many KNOCKs (channel)"))
+		return
+	}
+
+	nickMask := client.NickMaskString()
+	for _, member := range channel.Members() {
+		if !channel.ClientIsAtLeast(member, modes.Halfop) {
+			continue
+		}
+		text := member.t("has asked for an invite")
+		if reason != "" {
+			text = fmt.Sprintf(member.t("has asked for an invite (%s)"), reason)
+		}
+		member.Send(nil, server.name, RPL_KNOCK, member.Nick(), chname, nickMask, text)
+	}
+	rb.Add(nil, server.name, RPL_KNOCKDLVR, nick, chname, client.t("Your KNOCK has been delivered"))
+}
+
+// hasPendingKnock returns true if the given client has KNOCKed on the channel recently.
+func (channel *Channel) hasPendingKnock(client *Client) bool {
+	nickCasefolded := client.NickCasefolded()
+	channel.stateMutex.RLock()
+	defer channel.stateMutex.RUnlock()
+	knockTime, exists := channel.knocks[nickCasefolded]
+	return exists && time.Since(knockTime) < knockExpiry
+}
+
+// clearKnock removes any pending KNOCK from the given client.
+func (channel *Channel) clearKnock(client *Client) {
+	nickCasefolded := client.NickCasefolded()
+	channel.stateMutex.Lock()
+	defer channel.stateMutex.Unlock()
+	delete(channel.knocks, nickCasefolded)
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+)
+
+func TestKnock(t *testing.T) {
+	server, shutdown := newTestServer(t, nil)
+	defer shutdown()
+
+	alice := newTestClient(t, server, "alice")
+	carol := newTestClient(t, server, "carol")
+	dave := newTestClient(t, server, "dave")
+	alice.send("JOIN #test")
+	alice.expect(t, "JOIN #test")
+	alice.send("JOIN #open")
+	alice.expect(t, "JOIN #open")
+	for _, tc := range []*testClient{carol, dave} {
+		tc.send("JOIN #test")
+		tc.expect(t, " 366 ")
+	}
+	alice.send("MODE #test +ih carol")
+	carol.expect(t, "MODE #test +ih carol")
+
+	bob := newTestClient(t, server, "bob")
+	bob.send("KNOCK #nowhere")
+	bob.expect(t, " 403 bob #nowhere ")
+	bob.send("KNOCK #open")
+	bob.expect(t, " 713 bob #open ")
+	alice.send("KNOCK #test")
+	alice.expect(t, " 714 alice #test ")
+
+	bob.send("KNOCK #test :please")
+	bob.expect(t, " 711 bob #test ")
+	alice.expect(t, " 710 alice #test bob!~u@pipe :has asked for an invite (please)")
+	carol.expect(t, " 710 carol #test bob!~u@pipe ")
+	dave.expectNone(t, " 710 ")
+
+	// knocks are throttled per user and per channel
+	bob.send("KNOCK #test")
+	bob.expect(t, " 712 bob #test :Too many KNOCKs (user)")
+	eve := newTestClient(t, server, "eve")
+	eve.send("KNOCK #test")
+	eve.expect(t, " 712 eve #test :Too many KNOCKs (channel)")
+
+	// halfops can only invite clients that knocked
+	carol.send("INVITE eve #test")
+	carol.expect(t, " 482 ")
+	carol.send("INVITE bob #test")
+	bob.expect(t, ":carol!~u@pipe INVITE bob #test")
+	bob.send("JOIN #test")
+	bob.expect(t, "JOIN #test")
+	// and the knock is used up
+	bob.send("PART #test")
+	bob.expect(t, "PART #test")
+	carol.send("INVITE bob #test")
+	carol.expect(t, " 482 ")
+
+	alice.send("MODE #test +K")
+	alice.expect(t, "MODE #test +K")
+	frank := newTestClient(t, server, "frank")
+	frank.send("KNOCK #test")
+	frank.expect(t, " 480 frank :Cannot knock on #test (+K is set)")
+}
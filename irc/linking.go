@@ -0,0 +1,1979 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/caps"
+	"github.com/oragono/oragono/irc/history"
+	"github.com/oragono/oragono/irc/modes"
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/oragono/oragono/irc/utils"
+)
+
+// Servers are linked together in a spanning tree: every server keeps the full
+// state of the network (clients, channels and bans), and each message is passed
+// on to every link except the one it came in from. Clients are identified over
+// links by a UID, which is the SID of their server followed by a counter, so
+// renames can't race with other messages about them. Conflicts (nicknames, and
+// channels created on both sides of a split) are resolved with timestamps, and
+// the older one wins.
+
+const (
+	// how often we PING our links
+	linkPingInterval = time.Minute
+	// how long a link can be silent before we drop it
+	linkTimeout = 3 * time.Minute
+	// how many lines we'll queue for a link before dropping it
+	linkSendQLines = 16384
+	// the longest line we'll accept from a link (bursts can have long lines)
+	linkMaxLineLen = 16384
+	// how often we try to reconnect auto-connect links
+	linkReconnectInterval = 30 * time.Second
+	// how many members we put in each SJOIN line of a burst
+	linkSJOINChunkSize = 50
+)
+
+// RemoteServer is a server on the network other than us.
+type RemoteServer struct {
+	name   string
+	sid    string
+	uplink *RemoteServer // nil if it's linked directly to us
+	hops   int
+	link   *ServerLink // our link that leads to it
+}
+
+// uplinkName returns the name of the server this one is linked to.
+func (rs *RemoteServer) uplinkName(ourName string) string {
+	if rs.uplink == nil {
+		return ourName
+	}
+	return rs.uplink.name
+}
+
+// LinkManager keeps track of our links to other servers, and what's on the
+// other side of them.
+type LinkManager struct {
+	sync.RWMutex // tier 2
+	server       *Server
+	sid          string
+	uidCounter   uint64 // accessed atomically
+
+	config             LinkingConfig
+	tlsConfig          *tls.Config
+	listener           net.Listener
+	listenAddr         string
+	autoConnectStarted bool
+
+	connecting map[string]bool          // casefolded server name -> outgoing connection in progress
+	links      map[string]*ServerLink   // casefolded server name -> direct link
+	servers    map[string]*RemoteServer // casefolded server name -> every other server on the network
+	uids       map[string]*Client       // UID -> every client on the network
+}
+
+// NewLinkManager returns a new LinkManager.
+func NewLinkManager(server *Server) *LinkManager {
+	return &LinkManager{
+		server:     server,
+		connecting: make(map[string]bool),
+		links:      make(map[string]*ServerLink),
+		servers:    make(map[string]*RemoteServer),
+		uids:       make(map[string]*Client),
+	}
+}
+
+// makeSID derives a server ID from the server name, in the usual format of a
+// digit followed by two alphanumerics.
+func makeSID(name string) string {
+	const alphanumerics = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	sum := hash.Sum32()
+	return string([]byte{'0' + byte(sum%10), alphanumerics[(sum/10)%36], alphanumerics[(sum/360)%36]})
+}
+
+// newUID returns a new network-unique ID for one of our clients.
+func (lm *LinkManager) newUID() string {
+	counter := atomic.AddUint64(&lm.uidCounter, 1)
+	return lm.sid + strings.ToUpper(strconv.FormatUint(counter, 36))
+}
+
+// ApplyConfig applies the linking config, starting or stopping the listener as
+// required.
+func (lm *LinkManager) ApplyConfig(config *LinkingConfig) error {
+	var tlsConfig *tls.Config
+	if config.TLS.Cert != "" && config.TLS.Key != "" {
+		var err error
+		tlsConfig, err = config.TLS.Config()
+		if err != nil {
+			return err
+		}
+		// certificates are checked against the link block's certfp, not a CA
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	}
+
+	var listenAddr string
+	if config.Enabled {
+		listenAddr = config.Listen
+	}
+
+	lm.Lock()
+	if lm.sid == "" {
+		lm.sid = makeSID(lm.server.name)
+	}
+	lm.config = *config
+	lm.tlsConfig = tlsConfig
+	var oldListener net.Listener
+	if lm.listener != nil && lm.listenAddr != listenAddr {
+		oldListener = lm.listener
+		lm.listener = nil
+		lm.listenAddr = ""
+	}
+	startListener := lm.listener == nil && listenAddr != ""
+	startAutoConnect := config.Enabled && !lm.autoConnectStarted
+	if startAutoConnect {
+		lm.autoConnectStarted = true
+	}
+	lm.Unlock()
+
+	if oldListener != nil {
+		oldListener.Close()
+		lm.server.logger.Info("linking", "Stopped listening for links on", lm.listenAddr)
+	}
+	if startListener {
+		listener, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			return err
+		}
+		lm.Lock()
+		lm.listener = listener
+		lm.listenAddr = listenAddr
+		lm.Unlock()
+		go lm.acceptLinks(listener)
+		lm.server.logger.Info("linking", "Listening for links on", listenAddr)
+	}
+	if startAutoConnect {
+		go lm.autoConnect()
+	}
+	return nil
+}
+
+// acceptLinks accepts incoming links until the listener is closed.
+func (lm *LinkManager) acceptLinks(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		lm.RLock()
+		tlsConfig := lm.tlsConfig
+		lm.RUnlock()
+		if tlsConfig == nil {
+			conn.Close()
+			continue
+		}
+		go lm.newLink(tls.Server(conn, tlsConfig), "").run()
+	}
+}
+
+// autoConnect keeps trying to connect to the auto-connect links that aren't linked.
+func (lm *LinkManager) autoConnect() {
+	for {
+		lm.RLock()
+		var names []string
+		if lm.config.Enabled {
+			for name, block := range lm.config.Links {
+				if block.AutoConnect && block.Address != "" && lm.links[name] == nil && !lm.connecting[name] {
+					names = append(names, name)
+				}
+			}
+		}
+		lm.RUnlock()
+
+		for _, name := range names {
+			lm.Connect(name)
+		}
+		time.Sleep(linkReconnectInterval)
+	}
+}
+
+// Connect starts connecting to the given server, which must have a link block.
+func (lm *LinkManager) Connect(name string) error {
+	cfname, err := Casefold(name)
+	if err != nil {
+		return errLinkNoSuchServer
+	}
+
+	lm.Lock()
+	block := lm.config.Links[cfname]
+	if block == nil || block.Address == "" || !lm.config.Enabled {
+		lm.Unlock()
+		return errLinkNoSuchServer
+	}
+	if lm.links[cfname] != nil || lm.servers[cfname] != nil || lm.connecting[cfname] {
+		lm.Unlock()
+		return errLinkAlreadyExists
+	}
+	lm.connecting[cfname] = true
+	// the peer's certificate is checked against the link block's certfp instead
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if lm.tlsConfig != nil {
+		tlsConfig.Certificates = lm.tlsConfig.Certificates
+	}
+	lm.Unlock()
+
+	go func() {
+		dialer := &net.Dialer{Timeout: linkTimeout}
+		conn, err := tls.DialWithDialer(dialer, "tcp", block.Address, tlsConfig)
+		if err == nil && linkCertFP(conn) != block.Certfp {
+			// drop the link before the password is sent to a server we can't verify
+			conn.Close()
+			err = errLinkBadCertfp
+		}
+		if err != nil {
+			lm.Lock()
+			delete(lm.connecting, cfname)
+			lm.Unlock()
+			lm.server.logger.Warning("linking", fmt.Sprintf("Could not connect to %s: %v", name, err))
+			lm.server.snomasks.Send(sno.Links, fmt.Sprintf(ircfmt.Unescape("Could not connect to $c[grey][$r%s$c[grey]]: %v"), name, err))
+			return
+		}
+		lm.newLink(conn, cfname).run()
+	}()
+	return nil
+}
+
+// Disconnect closes our link to the given server.
+func (lm *LinkManager) Disconnect(name string, reason string) error {
+	cfname, err := Casefold(name)
+	if err != nil {
+		return errLinkNoSuchServer
+	}
+
+	lm.Lock()
+	link := lm.links[cfname]
+	if link != nil && link.closeReason == "" {
+		link.closeReason = reason
+	}
+	lm.Unlock()
+
+	if link == nil {
+		return errLinkNoSuchServer
+	}
+	link.Send(nil, "", "ERROR", reason)
+	link.close()
+	return nil
+}
+
+// Servers returns every other server on the network.
+func (lm *LinkManager) Servers() (result []*RemoteServer) {
+	lm.RLock()
+	defer lm.RUnlock()
+	for _, rs := range lm.servers {
+		result = append(result, rs)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].hops < result[j].hops })
+	return
+}
+
+// LinkCount returns how many servers we're directly linked to.
+func (lm *LinkManager) LinkCount() int {
+	lm.RLock()
+	defer lm.RUnlock()
+	return len(lm.links)
+}
+
+// getUID returns the client with the given UID, or nil.
+func (lm *LinkManager) getUID(uid string) *Client {
+	lm.RLock()
+	defer lm.RUnlock()
+	return lm.uids[uid]
+}
+
+// getServer returns the server with the given name, or nil.
+func (lm *LinkManager) getServer(name string) *RemoteServer {
+	cfname, err := Casefold(name)
+	if err != nil {
+		return nil
+	}
+	lm.RLock()
+	defer lm.RUnlock()
+	return lm.servers[cfname]
+}
+
+// sidInUse returns true if the given SID belongs to a server on the network.
+// It must be called while holding the lock.
+func (lm *LinkManager) sidInUse(sid string) bool {
+	if sid == lm.sid {
+		return true
+	}
+	for _, rs := range lm.servers {
+		if rs.sid == sid {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceMask returns how a message prefix from a link should be shown to our clients.
+func (lm *LinkManager) sourceMask(prefix string) string {
+	if client := lm.getUID(prefix); client != nil {
+		return client.NickMaskString()
+	}
+	return prefix
+}
+
+// sendAll sends a message to every linked server except `except`.
+func (lm *LinkManager) sendAll(except *ServerLink, tags *map[string]ircmsg.TagValue, prefix string, command string, params ...string) {
+	lm.RLock()
+	links := make([]*ServerLink, 0, len(lm.links))
+	for _, link := range lm.links {
+		if link != except {
+			links = append(links, link)
+		}
+	}
+	lm.RUnlock()
+
+	if len(links) == 0 {
+		return
+	}
+	message := ircmsg.MakeMessage(tags, prefix, command, params...)
+	line, err := message.Line()
+	if err != nil {
+		lm.server.logger.Error("internal", fmt.Sprintf("Could not assemble %s line for links: %v", command, err))
+		return
+	}
+	for _, link := range links {
+		link.sendLine(line)
+	}
+}
+
+// forward passes a message from one of our links on to the others.
+func (lm *LinkManager) forward(from *ServerLink, msg ircmsg.IrcMessage) {
+	lm.sendAll(from, &msg.Tags, msg.Prefix, msg.Command, msg.Params...)
+}
+
+// newLink returns a link over the given connection. If `expected` is set, it's
+// the (casefolded) name of the server we connected to.
+func (lm *LinkManager) newLink(conn net.Conn, expected string) *ServerLink {
+	return &ServerLink{
+		manager:  lm,
+		conn:     conn,
+		expected: expected,
+		sendq:    make(chan string, linkSendQLines),
+		closed:   make(chan bool),
+	}
+}
+
+// addLink registers a link once its handshake has completed.
+func (lm *LinkManager) addLink(link *ServerLink) error {
+	lm.Lock()
+	defer lm.Unlock()
+
+	if link.nameCasefolded == lm.server.nameCasefolded || lm.links[link.nameCasefolded] != nil || lm.servers[link.nameCasefolded] != nil {
+		return errLinkAlreadyExists
+	}
+	if lm.sidInUse(link.sid) {
+		return errLinkSIDCollision
+	}
+	delete(lm.connecting, link.expected)
+	lm.links[link.nameCasefolded] = link
+	lm.servers[link.nameCasefolded] = &RemoteServer{
+		name: link.name,
+		sid:  link.sid,
+		hops: 1,
+		link: link,
+	}
+	return nil
+}
+
+// removeLink cleans up after a link has closed, splitting off the servers behind it.
+func (lm *LinkManager) removeLink(link *ServerLink, reason string) {
+	server := lm.server
+
+	lm.Lock()
+	if link.closeReason != "" {
+		reason = link.closeReason
+	}
+	if link.expected != "" && lm.links[link.expected] == nil {
+		delete(lm.connecting, link.expected)
+	}
+	registered := link.nameCasefolded != "" && lm.links[link.nameCasefolded] == link
+	var rs *RemoteServer
+	if registered {
+		delete(lm.links, link.nameCasefolded)
+		rs = lm.servers[link.nameCasefolded]
+	}
+	lm.Unlock()
+
+	if !registered {
+		name := link.name
+		if name == "" {
+			name = link.expected
+		}
+		if name == "" {
+			name = link.conn.RemoteAddr().String()
+		}
+		server.logger.Info("linking", fmt.Sprintf("Link with %s failed: %s", name, reason))
+		server.snomasks.Send(sno.Links, fmt.Sprintf(ircfmt.Unescape("Link with $c[grey][$r%s$c[grey]] failed: %s"), name, reason))
+		return
+	}
+
+	link.endBurst()
+	server.logger.Info("linking", fmt.Sprintf("Link with %s closed: %s", link.name, reason))
+	server.snomasks.Send(sno.Links, fmt.Sprintf(ircfmt.Unescape("Link with $c[grey][$r%s$c[grey]] closed: %s"), link.name, reason))
+	lm.sendAll(nil, nil, server.name, "SQUIT", link.name, reason)
+	if rs != nil {
+		lm.splitServers(rs)
+	}
+}
+
+// splitServers removes the given server, every server linked through it, and
+// all of their clients.
+func (lm *LinkManager) splitServers(top *RemoteServer) {
+	lm.Lock()
+	gone := map[*RemoteServer]bool{top: true}
+	for changed := true; changed; {
+		changed = false
+		for _, rs := range lm.servers {
+			if !gone[rs] && gone[rs.uplink] {
+				gone[rs] = true
+				changed = true
+			}
+		}
+	}
+	goneNames := make(map[string]bool)
+	for cfname, rs := range lm.servers {
+		if gone[rs] {
+			delete(lm.servers, cfname)
+			goneNames[rs.name] = true
+		}
+	}
+	var quitting []*Client
+	for _, client := range lm.uids {
+		if client.IsRemote() && goneNames[client.remoteServer] {
+			quitting = append(quitting, client)
+		}
+	}
+	lm.Unlock()
+
+	lm.netsplit(top.uplinkName(lm.server.name), top.name, quitting)
+}
+
+// netsplit quits the given remote clients, whose servers have split from the
+// network. Local clients who could see them get the QUITs in a netsplit batch.
+func (lm *LinkManager) netsplit(server1, server2 string, quitting []*Client) {
+	server := lm.server
+	message := server1 + " " + server2
+	batches := make(map[*Client]*Batch)
+	batchTags := func(friend *Client) *map[string]ircmsg.TagValue {
+		if !friend.capabilities.Has(caps.Batch) {
+			return nil
+		}
+		batch := batches[friend]
+		if batch == nil {
+			batch = server.batches.New("netsplit", server1, server2)
+			batch.Start(friend, nil)
+			batches[friend] = batch
+		}
+		return ircmsg.MakeTags("batch", batch.ID)
+	}
+
+	for _, client := range quitting {
+		lm.removeRemoteClient(client, message, batchTags)
+	}
+	for friend, batch := range batches {
+		batch.End(friend)
+	}
+
+	server.snomasks.Send(sno.Links, fmt.Sprintf(ircfmt.Unescape("Netsplit $c[grey][$r%s$c[grey]] <-> $c[grey][$r%s$c[grey]], %d clients lost"), server1, server2, len(quitting)))
+}
+
+// newRemoteClient returns a client on another server, from the params of a UID message.
+func newRemoteClient(server *Server, link *ServerLink, rs *RemoteServer, params []string) *Client {
+	now := time.Now()
+	client := &Client{
+		accepted:       make(map[string]bool),
+		atime:          now,
+		capabilities:   caps.NewSet(),
+		channels:       make(ChannelSet),
+		ctime:          now,
+		flags:          make(map[modes.Mode]bool),
+		hops:           rs.hops,
+		link:           link,
+		rawHostname:    params[5],
+		realname:       params[9],
+		registered:     true,
+		remoteServer:   rs.name,
+		server:         server,
+		silence:        NewUserMaskSet(),
+		uid:            params[0],
+		username:       params[4],
+		nick:           "*",
+		nickCasefolded: "*",
+		nickMaskString: "*",
+	}
+	client.languages = server.languages.Default()
+	if params[6] != "*" {
+		client.vhost = params[6]
+	}
+	client.proxiedIP = net.ParseIP(params[7])
+	if client.proxiedIP == nil {
+		client.proxiedIP = net.IPv4zero
+	}
+	if params[8] != "*" {
+		client.SetAccountName(params[8])
+	}
+	for _, mode := range strings.TrimPrefix(params[3], "+") {
+		client.flags[modes.Mode(mode)] = true
+	}
+	return client
+}
+
+// uidParams returns the params of the UID message introducing the given client.
+func (lm *LinkManager) uidParams(client *Client) []string {
+	ip := client.IPString()
+	realname := client.Realname()
+
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	umodes := "+"
+	for mode, enabled := range client.flags {
+		// away messages aren't propagated, so neither is the mode
+		if enabled && mode != modes.Away {
+			umodes += mode.String()
+		}
+	}
+	// other servers show the same hostname we do, cloaked or not
+	vhost := client.hostname
+	if vhost == client.rawHostname {
+		vhost = "*"
+	}
+	account := client.accountName
+	if account == "" {
+		account = "*"
+	}
+	return []string{client.uid, client.nick, strconv.FormatInt(client.nickTime.Unix(), 10), umodes, client.username, client.rawHostname, vhost, ip, account, realname}
+}
+
+// setNickTime sets the time the client's nick was set, for remote nick changes.
+func (client *Client) setNickTime(nickTime time.Time) {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	client.nickTime = nickTime
+}
+
+// changeNick applies a nick change that was made elsewhere on the network.
+func (lm *LinkManager) changeNick(client *Client, newNick string, nickTime time.Time) {
+	server := lm.server
+	origNickMask := client.NickMaskString()
+	server.whoWas.Append(client)
+	if err := server.clients.SetRemoteNick(client, newNick); err != nil {
+		return
+	}
+	client.setNickTime(nickTime)
+	for friend := range client.Friends() {
+		friend.Send(nil, origNickMask, "NICK", newNick)
+	}
+	server.monitorManager.AlertAbout(client, true)
+}
+
+// removeRemoteClient removes a remote client from our state, telling the local
+// clients who could see them that they quit. tagsFor can add tags to the QUITs.
+func (lm *LinkManager) removeRemoteClient(client *Client, message string, tagsFor func(*Client) *map[string]ircmsg.TagValue) {
+	server := lm.server
+
+	client.stateMutex.Lock()
+	alreadyDestroyed := client.isDestroyed
+	client.isDestroyed = true
+	client.quitMessage = message
+	client.stateMutex.Unlock()
+	if alreadyDestroyed {
+		return
+	}
+
+	lm.Lock()
+	if lm.uids[client.uid] == client {
+		delete(lm.uids, client.uid)
+	}
+	lm.Unlock()
+
+	friends := client.Friends()
+	friends.Remove(client)
+	for _, channel := range client.Channels() {
+		channel.Quit(client)
+	}
+	server.clients.Remove(client)
+	server.whoWas.Append(client)
+	server.monitorManager.AlertAbout(client, false)
+
+	nickMask := client.NickMaskString()
+	for friend := range friends {
+		if friend.IsRemote() {
+			continue
+		}
+		var tags *map[string]ircmsg.TagValue
+		if tagsFor != nil {
+			tags = tagsFor(friend)
+		}
+		friend.Send(tags, nickMask, "QUIT", message)
+	}
+}
+
+// killForCollision disconnects a client that lost a nick collision.
+func (lm *LinkManager) killForCollision(client *Client) {
+	if client.IsRemote() {
+		lm.sendAll(nil, nil, lm.server.name, "KILL", client.uid, "Nick collision")
+		lm.removeRemoteClient(client, "Nick collision", nil)
+	} else {
+		client.exitedSnomaskSent = true
+		client.Quit(client.t("Nick collision"))
+		client.destroy(false)
+	}
+}
+
+// resolveCollision settles a collision between a client that has a nick, and a
+// remote client (which may not have been introduced yet) claiming it as of
+// incomingTime. The client who took the nick first keeps it; if that's a draw,
+// both of them are killed. It returns true if the incoming client wins.
+func (lm *LinkManager) resolveCollision(existing *Client, incomingUID string, incoming *Client, incomingTime time.Time) bool {
+	existingTS := existing.NickTime().Unix()
+	incomingTS := incomingTime.Unix()
+	lm.server.snomasks.Send(sno.LocalKills, fmt.Sprintf(ircfmt.Unescape("Nick collision on $c[grey][$r%s$c[grey]]"), existing.Nick()))
+
+	// unregistered clients haven't been introduced to the network, so they always lose
+	if incomingTS <= existingTS || !existing.Registered() {
+		lm.killForCollision(existing)
+	}
+	if existingTS <= incomingTS && existing.Registered() {
+		// the incoming client may already be known elsewhere, so tell everyone
+		lm.sendAll(nil, nil, lm.server.name, "KILL", incomingUID, "Nick collision")
+		if incoming != nil {
+			lm.removeRemoteClient(incoming, "Nick collision", nil)
+		}
+		return false
+	}
+	return true
+}
+
+// Introduce tells the network about one of our clients that has just registered.
+func (lm *LinkManager) Introduce(client *Client) {
+	lm.Lock()
+	_, resumed := lm.uids[client.uid]
+	lm.uids[client.uid] = client
+	lm.Unlock()
+
+	// resumed clients take over the UID of the client they replaced, so the
+	// rest of the network already knows about them
+	if resumed {
+		return
+	}
+
+	lm.sendAll(nil, nil, lm.server.name, "UID", lm.uidParams(client)...)
+	// the client may already be on channels
+	for _, channel := range client.Channels() {
+		lm.sendAll(nil, nil, lm.server.name, "SJOIN", channel.sjoinParams(client, false)...)
+	}
+}
+
+// introduced returns true if the client is known to the rest of the network.
+func (lm *LinkManager) introduced(client *Client) bool {
+	lm.RLock()
+	defer lm.RUnlock()
+	return lm.uids[client.uid] == client
+}
+
+// Quit tells the network that one of our clients has quit.
+func (lm *LinkManager) Quit(client *Client, message string) {
+	lm.Lock()
+	introduced := lm.uids[client.uid] == client
+	if introduced {
+		delete(lm.uids, client.uid)
+	}
+	lm.Unlock()
+
+	if introduced {
+		lm.sendAll(nil, nil, client.uid, "QUIT", message)
+	}
+}
+
+// NickChange tells the network that a client has changed their nick.
+func (lm *LinkManager) NickChange(client *Client) {
+	if lm.introduced(client) {
+		lm.sendAll(nil, nil, client.uid, "NICK", client.Nick(), strconv.FormatInt(client.NickTime().Unix(), 10))
+	}
+}
+
+// Kill disconnects a client on another server.
+func (lm *LinkManager) Kill(source *Client, target *Client, reason string) {
+	prefix := lm.server.name
+	if source != nil {
+		prefix = source.uid
+	}
+	lm.sendAll(nil, nil, prefix, "KILL", target.uid, reason)
+	lm.removeRemoteClient(target, reason, nil)
+}
+
+// Join tells the network that one of our clients joined a channel. If they
+// created it, its modes are sent along with them.
+func (lm *LinkManager) Join(channel *Channel, client *Client, created bool) {
+	lm.sendAll(nil, nil, lm.server.name, "SJOIN", channel.sjoinParams(client, created)...)
+}
+
+// Part tells the network that one of our clients left a channel.
+func (lm *LinkManager) Part(channel *Channel, client *Client, message string) {
+	lm.sendAll(nil, nil, client.uid, "PART", channel.Name(), message)
+}
+
+// Kick tells the network that a client was kicked from a channel.
+func (lm *LinkManager) Kick(channel *Channel, client *Client, target *Client, comment string) {
+	lm.sendAll(nil, nil, client.uid, "KICK", channel.Name(), target.uid, comment)
+}
+
+// Topic tells the network that a client changed a channel's topic.
+func (lm *LinkManager) Topic(channel *Channel, client *Client, topic string) {
+	lm.sendAll(nil, nil, client.uid, "TOPIC", channel.Name(), topic)
+}
+
+// ChannelModes tells the network about mode changes applied to a channel. The
+// source is nil for changes made by the server itself.
+func (lm *LinkManager) ChannelModes(channel *Channel, source *Client, changes modes.ModeChanges) {
+	if len(changes) == 0 {
+		return
+	}
+	translated := make(modes.ModeChanges, 0, len(changes))
+	for _, change := range changes {
+		if _, isPrefix := modes.ChannelModePrefixes[change.Mode]; isPrefix {
+			target := lm.server.clients.Get(change.Arg)
+			if target == nil {
+				continue
+			}
+			change.Arg = target.uid
+		}
+		translated = append(translated, change)
+	}
+	if len(translated) == 0 {
+		return
+	}
+
+	prefix := lm.server.name
+	if source != nil {
+		prefix = source.uid
+	}
+	params := append([]string{channel.timestamp(), channel.Name()}, strings.Split(translated.String(), " ")...)
+	lm.sendAll(nil, nil, prefix, "TMODE", params...)
+}
+
+// messageTags returns the tags we send a message over our links with.
+func messageTags(msgid string, clientOnlyTags *map[string]ircmsg.TagValue) *map[string]ircmsg.TagValue {
+	tags := ircmsg.MakeTags("msgid", msgid)
+	if clientOnlyTags != nil {
+		for name, value := range *clientOnlyTags {
+			(*tags)[name] = value
+		}
+	}
+	return tags
+}
+
+// ChannelMessage tells the network about a PRIVMSG or NOTICE one of our clients
+// sent to a channel. The target can have a STATUSMSG prefix.
+func (lm *LinkManager) ChannelMessage(msgid string, client *Client, command string, target string, clientOnlyTags *map[string]ircmsg.TagValue, message string) {
+	lm.sendAll(nil, messageTags(msgid, clientOnlyTags), client.uid, command, target, message)
+}
+
+// DirectMessage sends a PRIVMSG or NOTICE from one of our clients to a remote client.
+func (lm *LinkManager) DirectMessage(msgid string, client *Client, command string, target *Client, clientOnlyTags *map[string]ircmsg.TagValue, message string) {
+	target.link.Send(messageTags(msgid, clientOnlyTags), client.uid, command, target.uid, message)
+}
+
+// AddBan tells the network about a new K-Line ("K") or D-Line ("D").
+func (lm *LinkManager) AddBan(banType string, mask string, info IPBanInfo) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return
+	}
+	lm.sendAll(nil, nil, lm.server.name, "BAN", banType, mask, string(data))
+}
+
+// RemoveBan tells the network that a K-Line ("K") or D-Line ("D") was removed.
+func (lm *LinkManager) RemoveBan(banType string, mask string) {
+	lm.sendAll(nil, nil, lm.server.name, "UNBAN", banType, mask)
+}
+
+// timestamp returns the channel's creation time as sent over links.
+func (channel *Channel) timestamp() string {
+	return strconv.FormatInt(channel.CreatedTime().Unix(), 10)
+}
+
+// linkModeStrings returns all of the channel's modes, including the key, as
+// sent over links.
+func (channel *Channel) linkModeStrings() []string {
+	floodLimits := channel.FloodLimits().String()
+
+	channel.stateMutex.RLock()
+	defer channel.stateMutex.RUnlock()
+
+	modeString := "+"
+	var args []string
+	for mode, enabled := range channel.flags {
+		if enabled {
+			modeString += mode.String()
+		}
+	}
+	if channel.key != "" {
+		modeString += modes.Key.String()
+		args = append(args, channel.key)
+	}
+	if channel.userLimit > 0 {
+		modeString += modes.UserLimit.String()
+		args = append(args, strconv.FormatUint(channel.userLimit, 10))
+	}
+	if floodLimits != "" {
+		modeString += modes.FloodLimit.String()
+		args = append(args, floodLimits)
+	}
+	return append([]string{modeString}, args...)
+}
+
+// sjoinParams returns the params of an SJOIN message for a single member.
+func (channel *Channel) sjoinParams(client *Client, withModes bool) []string {
+	modeParams := []string{"+"}
+	if withModes {
+		modeParams = channel.linkModeStrings()
+	}
+	params := append([]string{channel.timestamp(), channel.Name()}, modeParams...)
+	return append(params, channel.ClientPrefixes(client, true)+client.uid)
+}
+
+// sendModeChanges tells our members about mode changes made elsewhere on the network.
+func (channel *Channel) sendModeChanges(source string, changes modes.ModeChanges) {
+	if len(changes) == 0 {
+		return
+	}
+	args := append([]string{channel.Name()}, strings.Split(changes.String(), " ")...)
+	for _, member := range channel.Members() {
+		member.Send(nil, source, "MODE", args...)
+	}
+}
+
+// resetModes clears the channel's modes and member prefixes, because the other
+// side of a netjoin has an older channel. It returns the changes it made.
+func (channel *Channel) resetModes() (changes modes.ModeChanges) {
+	channel.stateMutex.Lock()
+	for mode, enabled := range channel.flags {
+		if enabled {
+			changes = append(changes, modes.ModeChange{Op: modes.Remove, Mode: mode})
+		}
+	}
+	channel.flags = make(modes.ModeSet)
+	channel.floodLockouts = make(map[modes.Mode]bool)
+	if channel.key != "" {
+		changes = append(changes, modes.ModeChange{Op: modes.Remove, Mode: modes.Key})
+		channel.key = ""
+	}
+	if channel.userLimit != 0 {
+		changes = append(changes, modes.ModeChange{Op: modes.Remove, Mode: modes.UserLimit})
+		channel.userLimit = 0
+	}
+	var demoted []*Client
+	var demotedModes []modes.Mode
+	for member, modeSet := range channel.members {
+		for mode := range modes.ChannelModePrefixes {
+			if modeSet[mode] {
+				delete(modeSet, mode)
+				demoted = append(demoted, member)
+				demotedModes = append(demotedModes, mode)
+			}
+		}
+	}
+	channel.stateMutex.Unlock()
+
+	if channel.FloodLimits().String() != "" {
+		channel.setFloodLimits(ChannelFloodLimits{})
+		changes = append(changes, modes.ModeChange{Op: modes.Remove, Mode: modes.FloodLimit})
+	}
+	for i, member := range demoted {
+		changes = append(changes, modes.ModeChange{Op: modes.Remove, Mode: demotedModes[i], Arg: member.Nick()})
+	}
+	return
+}
+
+// applyRemoteModeChanges applies mode changes made elsewhere on the network,
+// which have already been checked by the server they came from. Membership
+// modes take UIDs. It returns the applied changes, with nicks in place of UIDs.
+func (channel *Channel) applyRemoteModeChanges(lm *LinkManager, changes modes.ModeChanges) (applied modes.ModeChanges) {
+	for _, change := range changes {
+		if change.Op == modes.List {
+			continue
+		}
+		switch change.Mode {
+		case modes.BanMask, modes.ExceptMask, modes.InviteMask, modes.QuietMask:
+			mask, err := casefoldMask(change.Arg)
+			if err != nil || mask == "" {
+				continue
+			}
+			var changed bool
+			if change.Op == modes.Add {
+				changed = channel.lists[change.Mode].Add(mask)
+			} else {
+				changed = channel.lists[change.Mode].Remove(mask)
+			}
+			if changed {
+				applied = append(applied, change)
+			}
+
+		case modes.UserLimit:
+			if change.Op == modes.Add {
+				val, err := strconv.ParseUint(change.Arg, 10, 64)
+				if err != nil {
+					continue
+				}
+				channel.setUserLimit(val)
+			} else {
+				channel.setUserLimit(0)
+			}
+			applied = append(applied, change)
+
+		case modes.FloodLimit:
+			if change.Op == modes.Add {
+				limits, err := ParseChannelFloodLimits(change.Arg)
+				if err != nil {
+					continue
+				}
+				channel.setFloodLimits(limits)
+			} else {
+				channel.setFloodLimits(ChannelFloodLimits{})
+			}
+			applied = append(applied, change)
+
+		case modes.Key:
+			if change.Op == modes.Add {
+				channel.setKey(change.Arg)
+			} else {
+				channel.setKey("")
+			}
+			applied = append(applied, change)
+
+		case modes.ChannelFounder, modes.ChannelAdmin, modes.ChannelOperator, modes.Halfop, modes.Voice:
+			target := lm.getUID(change.Arg)
+			if target == nil {
+				continue
+			}
+			enable := change.Op == modes.Add
+			channel.stateMutex.Lock()
+			modeSet, exists := channel.members[target]
+			already := exists && modeSet[change.Mode] == enable
+			if exists {
+				modeSet[change.Mode] = enable
+			}
+			channel.stateMutex.Unlock()
+			if exists && !already {
+				change.Arg = target.Nick()
+				applied = append(applied, change)
+			}
+
+		default:
+			if !channel.setMode(change.Mode, change.Op == modes.Add) {
+				applied = append(applied, change)
+			}
+		}
+	}
+	return
+}
+
+// joinRemote handles an SJOIN, joining clients from the other side of the link
+// to the channel. If our channel is older than theirs, their modes and prefixes
+// are ignored; if it's newer, ours are cleared; if they're the same age (or ours
+// was just created), they're merged.
+func (channel *Channel) joinRemote(link *ServerLink, source string, ts time.Time, modeParams []string, memberTokens []string) {
+	lm := link.manager
+	server := channel.server
+
+	channel.stateMutex.Lock()
+	isNew := len(channel.members) == 0
+	ourTS := channel.createdTime.Unix()
+	theirTS := ts.Unix()
+	if isNew {
+		// nobody can see our modes, so just take theirs
+		channel.flags = make(modes.ModeSet)
+	}
+	if isNew || theirTS < ourTS {
+		channel.createdTime = ts
+	}
+	channel.stateMutex.Unlock()
+
+	acceptModes := isNew || theirTS <= ourTS
+	if !isNew && theirTS < ourTS {
+		channel.sendModeChanges(server.name, channel.resetModes())
+	}
+	if acceptModes && len(modeParams) > 0 {
+		changes, _ := ParseChannelModeChanges(modeParams...)
+		channel.sendModeChanges(source, channel.applyRemoteModeChanges(lm, changes))
+	}
+
+	chname := channel.Name()
+	var given modes.ModeChanges
+	for _, token := range memberTokens {
+		prefixes, uid := modes.SplitChannelMembershipPrefixes(token)
+		client := lm.getUID(uid)
+		if client == nil || client.link != link {
+			continue
+		}
+
+		var givenModes []modes.Mode
+		channel.stateMutex.Lock()
+		_, alreadyJoined := channel.members[client]
+		if !alreadyJoined {
+			channel.members.Add(client)
+		}
+		if acceptModes {
+			for mode, prefix := range modes.ChannelModePrefixes {
+				if strings.Contains(prefixes, prefix) && !channel.members[client][mode] {
+					channel.members[client][mode] = true
+					givenModes = append(givenModes, mode)
+				}
+			}
+		}
+		channel.stateMutex.Unlock()
+
+		if !alreadyJoined {
+			channel.regenerateMembersCache(false)
+			client.addChannel(channel)
+
+			nickMask := client.NickMaskString()
+			accountName := client.AccountName()
+			realname := client.Realname()
+			for _, member := range channel.Members() {
+				if member.IsRemote() {
+					continue
+				}
+				tags := link.netjoinTags(member)
+				if member.capabilities.Has(caps.ExtendedJoin) {
+					member.Send(tags, nickMask, "JOIN", chname, accountName, realname)
+				} else {
+					member.Send(tags, nickMask, "JOIN", chname)
+				}
+			}
+			channel.history.Add(history.Item{
+				Type:        history.Join,
+				Nick:        nickMask,
+				AccountName: accountName,
+				Msgid:       server.generateMessageID(),
+				Message:     realname,
+			})
+		}
+
+		for _, mode := range givenModes {
+			given = append(given, modes.ModeChange{Op: modes.Add, Mode: mode, Arg: client.Nick()})
+		}
+	}
+	channel.sendModeChanges(source, given)
+}
+
+// ServerLink is a direct link to another server.
+type ServerLink struct {
+	manager  *LinkManager
+	conn     net.Conn
+	expected string // for outgoing links, the casefolded name of the server we connected to
+	password string
+
+	// these are only touched by the link's own goroutine
+	registered bool
+	bursting   bool
+	netjoins   map[*Client]*Batch
+
+	// these are set once the link has registered
+	name           string
+	nameCasefolded string
+	sid            string
+
+	closeReason string // protected by the manager's lock
+	sendq       chan string
+	closeOnce   sync.Once
+	closed      chan bool
+}
+
+// run handles the link until it closes.
+func (link *ServerLink) run() {
+	lm := link.manager
+	server := lm.server
+	var reason string
+
+	defer func() {
+		if r := recover(); r != nil {
+			server.logger.Error("internal", fmt.Sprintf("Server link caused panic: %v\n%s", r, debug.Stack()))
+			if !server.RecoverFromErrors() {
+				panic(r)
+			}
+			reason = "Internal error"
+		}
+		link.close()
+		lm.removeLink(link, reason)
+	}()
+
+	go link.runWriter()
+
+	if link.expected != "" {
+		link.sendHandshake(link.expected)
+	}
+
+	scanner := bufio.NewScanner(link.conn)
+	scanner.Buffer(make([]byte, 0, 4096), linkMaxLineLen)
+	for {
+		link.conn.SetReadDeadline(time.Now().Add(linkTimeout))
+		if !scanner.Scan() {
+			reason = "Connection closed"
+			if err := scanner.Err(); err != nil {
+				reason = err.Error()
+			}
+			return
+		}
+		line := scanner.Text()
+		server.logger.Debug("linkinput", link.name, line)
+
+		msg, err := ircmsg.ParseLine(line)
+		if err == ircmsg.ErrorLineIsEmpty {
+			continue
+		} else if err != nil {
+			reason = errLinkProtocol.Error()
+			link.Send(nil, "", "ERROR", reason)
+			return
+		}
+
+		if err := link.handle(msg); err != nil {
+			reason = err.Error()
+			link.Send(nil, "", "ERROR", reason)
+			return
+		}
+	}
+}
+
+// runWriter writes queued lines to the link and PINGs it regularly.
+func (link *ServerLink) runWriter() {
+	ticker := time.NewTicker(linkPingInterval)
+	defer ticker.Stop()
+	defer link.conn.Close()
+
+	for {
+		select {
+		case line := <-link.sendq:
+			if !link.write(line) {
+				return
+			}
+		case <-ticker.C:
+			link.Send(nil, "", "PING", link.manager.server.name)
+		case <-link.closed:
+			// flush whatever's left, e.g., an ERROR
+			for {
+				select {
+				case line := <-link.sendq:
+					if !link.write(line) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write writes a line to the connection, returning false if that failed.
+func (link *ServerLink) write(line string) bool {
+	link.manager.server.logger.Debug("linkoutput", link.name, strings.TrimRight(line, "\r\n"))
+	link.conn.SetWriteDeadline(time.Now().Add(linkTimeout))
+	_, err := io.WriteString(link.conn, line)
+	return err == nil
+}
+
+// close closes the link, after sending anything that's already queued.
+func (link *ServerLink) close() {
+	link.closeOnce.Do(func() {
+		close(link.closed)
+	})
+}
+
+// sendLine queues a line to be sent; if too many lines are queued, the link is closed.
+func (link *ServerLink) sendLine(line string) {
+	select {
+	case link.sendq <- line:
+	default:
+		link.close()
+	}
+}
+
+// Send sends a message over the link.
+func (link *ServerLink) Send(tags *map[string]ircmsg.TagValue, prefix string, command string, params ...string) {
+	message := ircmsg.MakeMessage(tags, prefix, command, params...)
+	line, err := message.Line()
+	if err != nil {
+		link.manager.server.logger.Error("internal", fmt.Sprintf("Could not assemble %s line for link: %v", command, err))
+		return
+	}
+	link.sendLine(line)
+}
+
+// sendHandshake sends our PASS and SERVER lines to the server with the given
+// (casefolded) name.
+func (link *ServerLink) sendHandshake(name string) {
+	lm := link.manager
+	lm.RLock()
+	block := lm.config.Links[name]
+	lm.RUnlock()
+	if block == nil {
+		link.close()
+		return
+	}
+	link.Send(nil, "", "PASS", block.Password)
+	link.Send(nil, "", "SERVER", lm.server.name, lm.sid, lm.server.NetworkName())
+}
+
+// linkCertFP returns the fingerprint of the certificate the other side of the
+// connection presented, if any.
+func linkCertFP(conn net.Conn) string {
+	tlsConn, isTLS := conn.(*tls.Conn)
+	if !isTLS {
+		return ""
+	}
+	peerCerts := tlsConn.ConnectionState().PeerCertificates
+	if len(peerCerts) < 1 {
+		return ""
+	}
+	sum := sha256.Sum256(peerCerts[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// handlePreregistration handles the messages that make up the link handshake.
+func (link *ServerLink) handlePreregistration(msg ircmsg.IrcMessage) error {
+	switch strings.ToUpper(msg.Command) {
+	case "PASS":
+		if len(msg.Params) < 1 {
+			return errLinkProtocol
+		}
+		link.password = msg.Params[0]
+		return nil
+	case "SERVER":
+		return link.register(msg)
+	case "PING", "PONG":
+		return nil
+	case "ERROR":
+		if len(msg.Params) < 1 {
+			return errLinkProtocol
+		}
+		return fmt.Errorf("Remote error: %s", msg.Params[0])
+	default:
+		return errLinkProtocol
+	}
+}
+
+// register completes the handshake, checking the other server against its link block.
+// SERVER <name> <sid> :<network name>
+func (link *ServerLink) register(msg ircmsg.IrcMessage) error {
+	lm := link.manager
+	server := lm.server
+	if len(msg.Params) < 3 {
+		return errLinkProtocol
+	}
+	name, sid, network := msg.Params[0], msg.Params[1], msg.Params[2]
+	cfname, err := Casefold(name)
+	if err != nil || !utils.IsHostname(name) || len(sid) != 3 {
+		return errLinkProtocol
+	}
+
+	lm.RLock()
+	block := lm.config.Links[cfname]
+	enabled := lm.config.Enabled
+	lm.RUnlock()
+	if block == nil || !enabled || (link.expected != "" && link.expected != cfname) {
+		return errLinkNoSuchServer
+	}
+	if subtle.ConstantTimeCompare([]byte(link.password), []byte(block.Password)) != 1 {
+		return errLinkBadPassword
+	}
+	if block.Certfp != "" && linkCertFP(link.conn) != block.Certfp {
+		return errLinkBadCertfp
+	}
+	if network != server.NetworkName() {
+		return errLinkNetworkMismatch
+	}
+
+	link.name, link.nameCasefolded, link.sid = name, cfname, sid
+	if link.expected == "" {
+		link.sendHandshake(cfname)
+	}
+	if err := lm.addLink(link); err != nil {
+		return err
+	}
+	link.registered = true
+
+	server.logger.Info("linking", fmt.Sprintf("Linked with %s [%s]", name, sid))
+	server.snomasks.Send(sno.Links, fmt.Sprintf(ircfmt.Unescape("Linked with $c[grey][$r%s$c[grey]], synchronizing"), name))
+	lm.sendAll(link, nil, server.name, "SERVER", name, sid, "1", network)
+
+	link.bursting = true
+	link.sendBurst()
+	return nil
+}
+
+// sendBurst sends our view of the network to a newly linked server.
+func (link *ServerLink) sendBurst() {
+	lm := link.manager
+	server := lm.server
+
+	lm.RLock()
+	var servers []*RemoteServer
+	for _, rs := range lm.servers {
+		if rs.link != link {
+			servers = append(servers, rs)
+		}
+	}
+	var clients []*Client
+	for _, client := range lm.uids {
+		if client.link != link {
+			clients = append(clients, client)
+		}
+	}
+	lm.RUnlock()
+
+	// servers have to be introduced after the servers they're linked to
+	sort.Slice(servers, func(i, j int) bool { return servers[i].hops < servers[j].hops })
+	networkName := server.NetworkName()
+	for _, rs := range servers {
+		link.Send(nil, rs.uplinkName(server.name), "SERVER", rs.name, rs.sid, strconv.Itoa(rs.hops), networkName)
+	}
+
+	for _, client := range clients {
+		link.Send(nil, client.ServerName(), "UID", lm.uidParams(client)...)
+	}
+
+	for banType, bans := range map[string]map[string]IPBanInfo{"K": server.klines.AllBans(), "D": server.dlines.AllBans()} {
+		for mask, info := range bans {
+			if info.Time != nil && info.Time.IsExpired() {
+				continue
+			}
+			data, err := json.Marshal(info)
+			if err == nil {
+				link.Send(nil, server.name, "BAN", banType, mask, string(data))
+			}
+		}
+	}
+
+	for _, channel := range server.channels.Channels() {
+		link.burstChannel(channel)
+	}
+
+	link.Send(nil, server.name, "EOB")
+}
+
+// burstChannel sends a channel's members, modes, lists and topic.
+func (link *ServerLink) burstChannel(channel *Channel) {
+	server := link.manager.server
+
+	channel.stateMutex.RLock()
+	var members []string
+	for member, modeSet := range channel.members {
+		if member.link != link {
+			members = append(members, modeSet.Prefixes(true)+member.uid)
+		}
+	}
+	topic, topicSetBy, topicSetTime := channel.topic, channel.topicSetBy, channel.topicSetTime
+	channel.stateMutex.RUnlock()
+
+	if len(members) == 0 {
+		return
+	}
+
+	name := channel.Name()
+	ts := channel.timestamp()
+	modeParams := channel.linkModeStrings()
+	for 0 < len(members) {
+		count := linkSJOINChunkSize
+		if len(members) < count {
+			count = len(members)
+		}
+		params := append([]string{ts, name}, modeParams...)
+		params = append(params, strings.Join(members[:count], " "))
+		link.Send(nil, server.name, "SJOIN", params...)
+		members = members[count:]
+	}
+
+	for _, mode := range []modes.Mode{modes.BanMask, modes.ExceptMask, modes.InviteMask, modes.QuietMask} {
+		if masks := channel.lists[mode].String(); masks != "" {
+			link.Send(nil, server.name, "BMASK", ts, name, mode.String(), masks)
+		}
+	}
+
+	if topic != "" {
+		link.Send(nil, server.name, "TB", name, strconv.FormatInt(topicSetTime.Unix(), 10), topicSetBy, topic)
+	}
+}
+
+// netjoinTags returns the tags for a JOIN sent to a local member because of this
+// link's burst, starting a netjoin batch for them if necessary.
+func (link *ServerLink) netjoinTags(member *Client) *map[string]ircmsg.TagValue {
+	if !link.bursting || !member.capabilities.Has(caps.Batch) {
+		return nil
+	}
+	if link.netjoins == nil {
+		link.netjoins = make(map[*Client]*Batch)
+	}
+	batch := link.netjoins[member]
+	if batch == nil {
+		server := link.manager.server
+		batch = server.batches.New("netjoin", server.name, link.name)
+		batch.Start(member, nil)
+		link.netjoins[member] = batch
+	}
+	return ircmsg.MakeTags("batch", batch.ID)
+}
+
+// endBurst ends the link's burst, closing any netjoin batches.
+func (link *ServerLink) endBurst() {
+	for member, batch := range link.netjoins {
+		batch.End(member)
+	}
+	link.netjoins = nil
+	link.bursting = false
+}
+
+// linkCommand is a message a linked server can send us.
+type linkCommand struct {
+	handler   func(link *ServerLink, msg ircmsg.IrcMessage) error
+	minParams int
+}
+
+// linkCommands holds the messages we understand from linked servers.
+var linkCommands map[string]linkCommand
+
+func init() {
+	linkCommands = map[string]linkCommand{
+		"BAN":     {handler: (*ServerLink).handleBan, minParams: 3},
+		"BMASK":   {handler: (*ServerLink).handleBmask, minParams: 4},
+		"EOB":     {handler: (*ServerLink).handleEOB, minParams: 0},
+		"ERROR":   {handler: (*ServerLink).handleError, minParams: 1},
+		"KICK":    {handler: (*ServerLink).handleKick, minParams: 3},
+		"KILL":    {handler: (*ServerLink).handleKill, minParams: 2},
+		"NICK":    {handler: (*ServerLink).handleNick, minParams: 2},
+		"NOTICE":  {handler: (*ServerLink).handleMessage, minParams: 2},
+		"PART":    {handler: (*ServerLink).handlePart, minParams: 2},
+		"PING":    {handler: (*ServerLink).handlePing, minParams: 0},
+		"PONG":    {handler: (*ServerLink).handlePong, minParams: 0},
+		"PRIVMSG": {handler: (*ServerLink).handleMessage, minParams: 2},
+		"QUIT":    {handler: (*ServerLink).handleQuit, minParams: 1},
+		"SERVER":  {handler: (*ServerLink).handleServer, minParams: 4},
+		"SJOIN":   {handler: (*ServerLink).handleSjoin, minParams: 4},
+		"SQUIT":   {handler: (*ServerLink).handleSquit, minParams: 2},
+		"TB":      {handler: (*ServerLink).handleTB, minParams: 4},
+		"TMODE":   {handler: (*ServerLink).handleTmode, minParams: 3},
+		"TOPIC":   {handler: (*ServerLink).handleTopic, minParams: 2},
+		"UID":     {handler: (*ServerLink).handleUID, minParams: 10},
+		"UNBAN":   {handler: (*ServerLink).handleUnban, minParams: 2},
+	}
+}
+
+// handle handles a message from the link. Returning an error closes the link.
+func (link *ServerLink) handle(msg ircmsg.IrcMessage) error {
+	if !link.registered {
+		return link.handlePreregistration(msg)
+	}
+	command, exists := linkCommands[strings.ToUpper(msg.Command)]
+	if !exists {
+		// newer servers may send things we don't know about
+		return nil
+	}
+	if len(msg.Params) < command.minParams {
+		return fmt.Errorf("Not enough parameters for %s", msg.Command)
+	}
+	return command.handler(link, msg)
+}
+
+// sourceClient returns the client with the given UID, if they're behind this
+// link. Messages from anyone else can't have come from this link, so they're
+// ignored rather than letting a peer act on behalf of other servers' clients.
+func (link *ServerLink) sourceClient(uid string) *Client {
+	client := link.manager.getUID(uid)
+	if client == nil || client.link != link {
+		return nil
+	}
+	return client
+}
+
+// validSource returns false if the given message prefix is a client or server
+// we know isn't behind this link.
+func (link *ServerLink) validSource(prefix string) bool {
+	lm := link.manager
+	if prefix == lm.server.name {
+		return false
+	}
+	if client := lm.getUID(prefix); client != nil {
+		return client.link == link
+	}
+	if rs := lm.getServer(prefix); rs != nil {
+		return rs.link == link
+	}
+	return true
+}
+
+// :<source> BAN <K|D> <mask> :<ban info json>
+func (link *ServerLink) handleBan(msg ircmsg.IrcMessage) error {
+	lm := link.manager
+	server := lm.server
+	var info IPBanInfo
+	if !link.validSource(msg.Prefix) || json.Unmarshal([]byte(msg.Params[2]), &info) != nil {
+		return nil
+	}
+	mask := msg.Params[1]
+	switch msg.Params[0] {
+	case "K":
+		if err := server.addKline(mask, info); err != nil {
+			return nil
+		}
+		server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("$c[grey][$r%s$c[grey]] added K-Line for $c[grey][$r%s$c[grey]]"), msg.Prefix, mask))
+	case "D":
+		if _, err := server.addDline(mask, info); err != nil {
+			return nil
+		}
+		server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("$c[grey][$r%s$c[grey]] added D-Line for $c[grey][$r%s$c[grey]]"), msg.Prefix, mask))
+	default:
+		return nil
+	}
+	lm.forward(link, msg)
+	return nil
+}
+
+// :<source> UNBAN <K|D> <mask>
+func (link *ServerLink) handleUnban(msg ircmsg.IrcMessage) error {
+	lm := link.manager
+	server := lm.server
+	if !link.validSource(msg.Prefix) {
+		return nil
+	}
+	mask := msg.Params[1]
+	switch msg.Params[0] {
+	case "K":
+		if err := server.removeKline(mask); err != nil {
+			return nil
+		}
+		server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("$c[grey][$r%s$c[grey]] removed K-Line for $c[grey][$r%s$c[grey]]"), msg.Prefix, mask))
+	case "D":
+		if _, err := server.removeDline(mask); err != nil {
+			return nil
+		}
+		server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("$c[grey][$r%s$c[grey]] removed D-Line for $c[grey][$r%s$c[grey]]"), msg.Prefix, mask))
+	default:
+		return nil
+	}
+	lm.forward(link, msg)
+	return nil
+}
+
+// :<server> BMASK <ts> <channel> <mode> :<masks>
+func (link *ServerLink) handleBmask(msg ircmsg.IrcMessage) error {
+	lm := link.manager
+	lm.forward(link, msg)
+
+	channel := lm.server.channels.Get(msg.Params[1])
+	ts, err := strconv.ParseInt(msg.Params[0], 10, 64)
+	if channel == nil || err != nil || len(msg.Params[2]) != 1 {
+		return nil
+	}
+	// the list belongs to the older channel
+	if ts > channel.CreatedTime().Unix() {
+		return nil
+	}
+	mode := modes.Mode(msg.Params[2][0])
+	if channel.lists[mode] == nil {
+		return nil
+	}
+	var changes modes.ModeChanges
+	for _, mask := range strings.Fields(msg.Params[3]) {
+		changes = append(changes, modes.ModeChange{Op: modes.Add, Mode: mode, Arg: mask})
+	}
+	channel.sendModeChanges(msg.Prefix, channel.applyRemoteModeChanges(lm, changes))
+	return nil
+}
+
+// :<server> EOB
+func (link *ServerLink) handleEOB(msg ircmsg.IrcMessage) error {
+	// only the end of our peer's own burst matters
+	if link.bursting && msg.Prefix == link.name {
+		link.endBurst()
+		server := link.manager.server
+		server.snomasks.Send(sno.Links, fmt.Sprintf(ircfmt.Unescape("Finished synchronizing with $c[grey][$r%s$c[grey]]"), link.name))
+	}
+	return nil
+}
+
+// ERROR :<reason>
+func (link *ServerLink) handleError(msg ircmsg.IrcMessage) error {
+	return fmt.Errorf("Remote error: %s", msg.Params[0])
+}
+
+// :<uid> KICK <channel> <target uid> :<comment>
+func (link *ServerLink) handleKick(msg ircmsg.IrcMessage) error {
+	lm := link.manager
+	client := link.sourceClient(msg.Prefix)
+	if client == nil {
+		return nil
+	}
+	lm.forward(link, msg)
+
+	target := lm.getUID(msg.Params[1])
+	channel := lm.server.channels.Get(msg.Params[0])
+	if target != nil && channel != nil && channel.hasClient(target) {
+		channel.kick(client, target, msg.Params[2])
+	}
+	return nil
+}
+
+// :<source> KILL <uid> :<reason>
+func (link *ServerLink) handleKill(msg ircmsg.IrcMessage) error {
+	lm := link.manager
+	server := lm.server
+	if !link.validSource(msg.Prefix) {
+		return nil
+	}
+	lm.forward(link, msg)
+
+	target := lm.getUID(msg.Params[0])
+	if target == nil {
+		return nil
+	}
+	reason := msg.Params[1]
+	if target.IsRemote() {
+		lm.removeRemoteClient(target, reason, nil)
+	} else {
+		server.snomasks.Send(sno.LocalKills, fmt.Sprintf(ircfmt.Unescape("%s was killed by %s $c[grey][$r%s$c[grey]]"), target.Nick(), lm.sourceMask(msg.Prefix), reason))
+		target.exitedSnomaskSent = true
+		target.Quit(reason)
+		target.destroy(false)
+	}
+	return nil
+}
+
+// :<uid> NICK <nick> <nick ts>
+func (link *ServerLink) handleNick(msg ircmsg.IrcMessage) error {
+	lm := link.manager
+	client := link.sourceClient(msg.Prefix)
+	ts, err := strconv.ParseInt(msg.Params[1], 10, 64)
+	if client == nil || err != nil {
+		return nil
+	}
+	newNick := msg.Params[0]
+	if _, err := CasefoldName(newNick); err != nil {
+		return errLinkProtocol
+	}
+	nickTime := time.Unix(ts, 0)
+
+	if existing := lm.server.clients.Get(newNick); existing != nil && existing != client {
+		if !lm.resolveCollision(existing, client.uid, client, nickTime) {
+			return nil
+		}
+	}
+	lm.changeNick(client, newNick, nickTime)
+	lm.forward(link, msg)
+	return nil
+}
+
+// :<uid> PRIVMSG <target> :<message>
+// :<uid> NOTICE <target> :<message>
+func (link *ServerLink) handleMessage(msg ircmsg.IrcMessage) error {
+	lm := link.manager
+	server := lm.server
+	client := link.sourceClient(msg.Prefix)
+	if client == nil {
+		return nil
+	}
+
+	command := strings.ToUpper(msg.Command)
+	target, text := msg.Params[0], msg.Params[1]
+	msgid := msg.Tags["msgid"].Value
+	if msgid == "" {
+		msgid = server.generateMessageID()
+	}
+	clientOnlyTags := utils.GetClientOnlyTags(msg.Tags)
+	splitMsg := server.splitMessage(text, false)
+
+	prefixes, chname := modes.SplitChannelMembershipPrefixes(target)
+	if _, err := CasefoldChannel(chname); err == nil {
+		lm.forward(link, msg)
+		if channel := server.channels.Get(chname); channel != nil {
+			channel.distributeMessage(msgid, command, modes.GetLowestChannelModePrefix(prefixes), clientOnlyTags, client, &splitMsg)
+		}
+		return nil
+	}
+
+	user := lm.getUID(target)
+	if user == nil {
+		return nil
+	}
+	if user.IsRemote() {
+		// it's for someone further along
+		if user.link != link {
+			user.link.Send(&msg.Tags, msg.Prefix, msg.Command, msg.Params...)
+		}
+		return nil
+	}
+	if !user.checkIgnores(client, nil) {
+		return nil
+	}
+	tags := clientOnlyTags
+	if !user.capabilities.Has(caps.MessageTags) {
+		tags = nil
+	}
+	user.SendSplitMsgFromClient(msgid, client, tags, command, user.Nick(), splitMsg)
+	return nil
+}
+
+// :<uid> PART <channel> :<message>
+func (link *ServerLink) handlePart(msg ircmsg.IrcMessage) error {
+	lm := link.manager
+	client := link.sourceClient(msg.Prefix)
+	if client == nil {
+		return nil
+	}
+	lm.forward(link, msg)
+
+	channel := lm.server.channels.Get(msg.Params[0])
+	if channel != nil && channel.hasClient(client) {
+		channel.Part(client, msg.Params[1], NewResponseBuffer(client))
+	}
+	return nil
+}
+
+// PING <server>
+func (link *ServerLink) handlePing(msg ircmsg.IrcMessage) error {
+	link.Send(nil, "", "PONG", link.manager.server.name)
+	return nil
+}
+
+// PONG <server>
+func (link *ServerLink) handlePong(msg ircmsg.IrcMessage) error {
+	// the read deadline has already been extended
+	return nil
+}
+
+// :<uid> QUIT :<message>
+func (link *ServerLink) handleQuit(msg ircmsg.IrcMessage) error {
+	lm := link.manager
+	client := link.sourceClient(msg.Prefix)
+	if client == nil {
+		return nil
+	}
+	lm.removeRemoteClient(client, msg.Params[0], nil)
+	lm.forward(link, msg)
+	return nil
+}
+
+// :<uplink> SERVER <name> <sid> <hops> :<network name>
+func (link *ServerLink) handleServer(msg ircmsg.IrcMessage) error {
+	lm := link.manager
+	server := lm.server
+	name, sid := msg.Params[0], msg.Params[1]
+	hops, err := strconv.Atoi(msg.Params[2])
+	cfname, cfErr := Casefold(name)
+	if err != nil || cfErr != nil || len(sid) != 3 {
+		return errLinkProtocol
+	}
+
+	var uplink *RemoteServer
+	if msg.Prefix != server.name {
+		uplink = lm.getServer(msg.Prefix)
+		if uplink == nil || uplink.link != link {
+			return errLinkProtocol
+		}
+	}
+	rs := &RemoteServer{
+		name:   name,
+		sid:    sid,
+		uplink: uplink,
+		hops:   hops + 1,
+		link:   link,
+	}
+
+	lm.Lock()
+	exists := cfname == server.nameCasefolded || lm.servers[cfname] != nil || lm.sidInUse(sid)
+	if !exists {
+		lm.servers[cfname] = rs
+	}
+	lm.Unlock()
+	if exists {
+		// two servers with the same name or SID, or a loop in the network
+		return fmt.Errorf("Server %s [%s] already exists", name, sid)
+	}
+
+	server.snomasks.Send(sno.Links, fmt.Sprintf(ircfmt.Unescape("Server $c[grey][$r%s$c[grey]] linked to $c[grey][$r%s$c[grey]]"), name, msg.Prefix))
+	lm.sendAll(link, nil, msg.Prefix, "SERVER", name, sid, strconv.Itoa(rs.hops), msg.Params[3])
+	return nil
+}
+
+// :<server> SJOIN <ts> <channel> <modes> [<mode args>...] :<members>
+func (link *ServerLink) handleSjoin(msg ircmsg.IrcMessage) error {
+	lm := link.manager
+	ts, err := strconv.ParseInt(msg.Params[0], 10, 64)
+	if err != nil {
+		return errLinkProtocol
+	}
+	modeParams := msg.Params[2 : len(msg.Params)-1]
+	members := strings.Fields(msg.Params[len(msg.Params)-1])
+	err = lm.server.channels.JoinRemote(lm.server, msg.Params[1], func(channel *Channel) {
+		channel.joinRemote(link, msg.Prefix, time.Unix(ts, 0), modeParams, members)
+	})
+	if err != nil {
+		return nil
+	}
+	lm.forward(link, msg)
+	return nil
+}
+
+// :<source> SQUIT <server> :<reason>
+func (link *ServerLink) handleSquit(msg ircmsg.IrcMessage) error {
+	lm := link.manager
+	rs := lm.getServer(msg.Params[0])
+	// only servers behind this link can be split off by it
+	if rs == nil || rs.link != link || rs.hops == 1 {
+		return nil
+	}
+	lm.forward(link, msg)
+	lm.server.snomasks.Send(sno.Links, fmt.Sprintf(ircfmt.Unescape("Server $c[grey][$r%s$c[grey]] split: %s"), rs.name, msg.Params[1]))
+	lm.splitServers(rs)
+	return nil
+}
+
+// :<server> TB <channel> <topic ts> <set by> :<topic>
+func (link *ServerLink) handleTB(msg ircmsg.IrcMessage) error {
+	lm := link.manager
+	lm.forward(link, msg)
+
+	channel := lm.server.channels.Get(msg.Params[0])
+	ts, err := strconv.ParseInt(msg.Params[1], 10, 64)
+	if channel == nil || err != nil {
+		return nil
+	}
+	topicSetBy, topic := msg.Params[2], msg.Params[3]
+
+	// a topic we already have takes precedence
+	channel.stateMutex.Lock()
+	apply := channel.topic == ""
+	if apply {
+		channel.topic = topic
+		channel.topicSetBy = topicSetBy
+		channel.topicSetTime = time.Unix(ts, 0)
+	}
+	channel.stateMutex.Unlock()
+
+	if apply {
+		for _, member := range channel.Members() {
+			member.Send(nil, msg.Prefix, "TOPIC", channel.Name(), topic)
+		}
+	}
+	return nil
+}
+
+// :<source> TMODE <ts> <channel> <modes> [<mode args>...]
+func (link *ServerLink) handleTmode(msg ircmsg.IrcMessage) error {
+	lm := link.manager
+	server := lm.server
+	if !link.validSource(msg.Prefix) {
+		return nil
+	}
+	lm.forward(link, msg)
+
+	channel := server.channels.Get(msg.Params[1])
+	ts, err := strconv.ParseInt(msg.Params[0], 10, 64)
+	if channel == nil || err != nil {
+		return nil
+	}
+	// changes to a newer incarnation of the channel are ignored
+	if ts > channel.CreatedTime().Unix() {
+		return nil
+	}
+	changes, _ := ParseChannelModeChanges(msg.Params[2:]...)
+	applied := channel.applyRemoteModeChanges(lm, changes)
+	channel.sendModeChanges(lm.sourceMask(msg.Prefix), applied)
+	if len(applied) > 0 && channel.IsRegistered() {
+		go server.channelRegistry.StoreChannel(channel, IncludeModes|IncludeLists)
+	}
+	return nil
+}
+
+// :<uid> TOPIC <channel> :<topic>
+func (link *ServerLink) handleTopic(msg ircmsg.IrcMessage) error {
+	lm := link.manager
+	client := link.sourceClient(msg.Prefix)
+	if client == nil {
+		return nil
+	}
+	lm.forward(link, msg)
+
+	channel := lm.server.channels.Get(msg.Params[0])
+	if channel != nil {
+		channel.setTopic(client, msg.Params[1], NewResponseBuffer(client))
+	}
+	return nil
+}
+
+// :<server> UID <uid> <nick> <nick ts> <umodes> <username> <hostname> <vhost> <ip> <account> :<realname>
+func (link *ServerLink) handleUID(msg ircmsg.IrcMessage) error {
+	lm := link.manager
+	server := lm.server
+	uid, nick := msg.Params[0], msg.Params[1]
+	ts, err := strconv.ParseInt(msg.Params[2], 10, 64)
+	if err != nil {
+		return errLinkProtocol
+	}
+	nickTime := time.Unix(ts, 0)
+
+	rs := lm.getServer(msg.Prefix)
+	if rs == nil || rs.link != link || !strings.HasPrefix(uid, rs.sid) {
+		return errLinkProtocol
+	}
+	if lm.getUID(uid) != nil {
+		return nil
+	}
+	if _, err := CasefoldName(nick); err != nil {
+		lm.sendAll(nil, nil, server.name, "KILL", uid, "Invalid nickname")
+		return nil
+	}
+
+	if existing := server.clients.Get(nick); existing != nil {
+		if !lm.resolveCollision(existing, uid, nil, nickTime) {
+			return nil
+		}
+	}
+
+	client := newRemoteClient(server, link, rs, msg.Params)
+	if err := server.clients.SetRemoteNick(client, nick); err != nil {
+		lm.sendAll(nil, nil, server.name, "KILL", uid, "Nick collision")
+		return nil
+	}
+	client.setNickTime(nickTime)
+
+	lm.Lock()
+	lm.uids[uid] = client
+	lm.Unlock()
+
+	server.monitorManager.AlertAbout(client, true)
+	lm.forward(link, msg)
+	return nil
+}
@@ -0,0 +1,346 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/mkcerts"
+	"github.com/oragono/oragono/irc/modes"
+)
+
+func newLinkTestServer(t *testing.T, name, peer string) (*Server, func()) {
+	return newNamedTestServer(t, name, func(config *Config) {
+		config.Network.Name = "LinkNet"
+		config.Linking.Enabled = true
+		config.Linking.Links = map[string]*LinkConfig{
+			peer: {Password: "hunter2"},
+		}
+	})
+}
+
+// linkTestServers links the two servers over a pipe, returning a function that
+// splits them again.
+func linkTestServers(t *testing.T, one, two *Server) (split func()) {
+	connOne, connTwo := net.Pipe()
+	go one.links.newLink(connOne, two.nameCasefolded).run()
+	go two.links.newLink(connTwo, "").run()
+	waitFor(t, "link", func() bool {
+		return one.links.LinkCount() == 1 && two.links.LinkCount() == 1
+	})
+	return func() {
+		one.links.Disconnect(two.name, "test split")
+		waitFor(t, "split", func() bool {
+			return one.links.LinkCount() == 0 && two.links.LinkCount() == 0
+		})
+	}
+}
+
+func linkTestSetup(t *testing.T) (one, two *Server, cleanup func()) {
+	one, cleanupOne := newLinkTestServer(t, "one.test", "two.test")
+	two, cleanupTwo := newLinkTestServer(t, "two.test", "one.test")
+	return one, two, func() {
+		cleanupTwo()
+		cleanupOne()
+	}
+}
+
+func TestLinkingPropagation(t *testing.T) {
+	one, two, cleanup := linkTestSetup(t)
+	defer cleanup()
+
+	alice := newTestClient(t, one, "alice")
+	alice.send("JOIN #test")
+	alice.expect(t, "JOIN #test")
+
+	linkTestServers(t, one, two)
+	waitFor(t, "burst", func() bool {
+		channel := two.channels.Get("#test")
+		return two.clients.Get("alice") != nil && channel != nil && channel.ClientIsAtLeast(two.clients.Get("alice"), modes.ChannelOperator)
+	})
+
+	bob := newTestClient(t, two, "bob")
+	waitFor(t, "bob", func() bool { return one.clients.Get("bob") != nil })
+	bob.send("JOIN #test")
+	alice.expect(t, ":bob!", "JOIN #test")
+
+	alice.send("PRIVMSG #test :hello")
+	bob.expect(t, ":alice!", "PRIVMSG #test :hello")
+	bob.send("PRIVMSG alice :hi there")
+	alice.expect(t, ":bob!", "PRIVMSG alice :hi there")
+
+	alice.send("MODE #test +v bob")
+	bob.expect(t, "MODE #test +v bob")
+	alice.send("TOPIC #test :linked up")
+	bob.expect(t, "TOPIC #test :linked up")
+
+	alice.send("NICK alicia")
+	bob.expect(t, ":alice!", "NICK alicia")
+	if two.clients.Get("alicia") == nil || two.clients.Get("alice") != nil {
+		t.Error("nick change wasn't applied on the other server")
+	}
+
+	bob.send("PART #test :bye")
+	alice.expect(t, ":bob!", "PART #test")
+	bob.send("QUIT :gone")
+	waitFor(t, "quit", func() bool { return one.clients.Get("bob") == nil })
+}
+
+func TestLinkingNickCollision(t *testing.T) {
+	one, two, cleanup := linkTestSetup(t)
+	defer cleanup()
+
+	older := newTestClient(t, one, "carol")
+	newer := newTestClient(t, two, "carol")
+	one.clients.Get("carol").setNickTime(time.Now().Add(-time.Hour))
+
+	split := linkTestServers(t, one, two)
+	newer.expect(t, "Nick collision")
+	waitFor(t, "collision", func() bool {
+		remote := two.clients.Get("carol")
+		return remote != nil && remote.IsRemote()
+	})
+	if local := one.clients.Get("carol"); local == nil || local.IsRemote() {
+		t.Error("the older client should have kept their nick")
+	}
+	older.send("PING :still here")
+	older.expect(t, "PONG", "still here")
+	split()
+
+	// with equal timestamps, both clients lose
+	first := newTestClient(t, one, "dave")
+	second := newTestClient(t, two, "dave")
+	nickTime := time.Now().Add(-time.Minute)
+	one.clients.Get("dave").setNickTime(nickTime)
+	two.clients.Get("dave").setNickTime(nickTime)
+
+	linkTestServers(t, one, two)
+	first.expect(t, "Nick collision")
+	second.expect(t, "Nick collision")
+	waitFor(t, "collision", func() bool {
+		return one.clients.Get("dave") == nil && two.clients.Get("dave") == nil
+	})
+}
+
+func TestLinkingNetsplit(t *testing.T) {
+	one, two, cleanup := linkTestSetup(t)
+	defer cleanup()
+
+	alice := newTestClient(t, one, "alice", "batch")
+	alice.send("JOIN #test")
+	alice.expect(t, "JOIN #test")
+	bob := newTestClient(t, two, "bob")
+	bob.send("JOIN #test")
+	bob.expect(t, "JOIN #test")
+
+	split := linkTestServers(t, one, two)
+	line := alice.expect(t, "BATCH +", "netjoin one.test two.test")
+	batchID := strings.Fields(line)[2][1:]
+	alice.expect(t, "@batch="+batchID, ":bob!", "JOIN #test")
+	alice.expect(t, "BATCH -"+batchID)
+
+	split()
+	line = alice.expect(t, "BATCH +", "netsplit one.test two.test")
+	batchID = strings.Fields(line)[2][1:]
+	alice.expect(t, "@batch="+batchID, ":bob!", "QUIT :one.test two.test")
+	alice.expect(t, "BATCH -"+batchID)
+	if one.clients.Get("bob") != nil || two.clients.Get("alice") != nil {
+		t.Error("clients from the other side weren't removed")
+	}
+	if channel := one.channels.Get("#test"); channel == nil || len(channel.Members()) != 1 {
+		t.Error("the netsplit should have left alice alone in #test")
+	}
+}
+
+func TestLinkingOperCommandsOnRemoteClients(t *testing.T) {
+	one, two, cleanup := linkTestSetup(t)
+	defer cleanup()
+
+	linkTestServers(t, one, two)
+	newTestClient(t, one, "alice")
+	bob := newTestClient(t, two, "bob")
+	waitFor(t, "bob", func() bool { return one.clients.Get("bob") != nil })
+	alice := one.clients.Get("alice")
+
+	rb := NewResponseBuffer(alice)
+	chghostHandler(one, alice, ircmsg.MakeMessage(nil, "", "CHGHOST", "bob", "example.com"), rb)
+	if len(rb.messages) != 1 || !strings.Contains(rb.messages[0].Params[1], "another server") {
+		t.Errorf("CHGHOST on a remote client should be refused, got %v", rb.messages)
+	}
+
+	// SAQUIT is routed to the client's own server
+	saquitHandler(one, alice, ircmsg.MakeMessage(nil, "", "SAQUIT", "bob", "so long"), NewResponseBuffer(alice))
+	bob.expect(t, "ERROR", "so long")
+	waitFor(t, "quit", func() bool {
+		return one.clients.Get("bob") == nil && two.clients.Get("bob") == nil
+	})
+}
+
+func TestLinkingOutgoingCertfpMismatch(t *testing.T) {
+	certBytes, keyBytes, err := mkcerts.CreateCertBytes("oragono test", "peer.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certBytes, keyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		received <- data
+	}()
+
+	server, cleanup := newTestServer(t, func(config *Config) {
+		config.Linking.Enabled = true
+		config.Linking.Links = map[string]*LinkConfig{
+			"peer.test": {Address: listener.Addr().String(), Password: "hunter2", Certfp: strings.Repeat("00", 32)},
+		}
+	})
+	defer cleanup()
+
+	if err := server.links.Connect("peer.test"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-received:
+		if len(data) != 0 {
+			t.Errorf("sent %q to a server with the wrong certfp", data)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for the link to be dropped")
+	}
+	waitFor(t, "connect attempt", func() bool {
+		server.links.RLock()
+		defer server.links.RUnlock()
+		return !server.links.connecting["peer.test"]
+	})
+	if server.links.LinkCount() != 0 {
+		t.Error("the link should have been dropped")
+	}
+}
+
+func TestLinkingGhostRemoteClient(t *testing.T) {
+	one, two, cleanup := linkTestSetup(t)
+	defer cleanup()
+
+	linkTestServers(t, one, two)
+	ghost := openTestClient(two)
+	ghost.login(t, two, "bob")
+	ghost.register(t, "bob", "cap-notify")
+	waitFor(t, "bob", func() bool { return one.clients.Get("bob") != nil })
+
+	bob := openTestClient(one)
+	bob.login(t, one, "bob")
+	bob.register(t, "bobby", "cap-notify")
+	bob.send("NS GHOST bob")
+	ghost.expect(t, "ERROR", "GHOSTed by bobby")
+	waitFor(t, "ghost", func() bool {
+		return one.clients.Get("bob") == nil && two.clients.Get("bob") == nil
+	})
+}
+
+func TestLinkingSpoofedSources(t *testing.T) {
+	one, cleanupOne := newNamedTestServer(t, "one.test", func(config *Config) {
+		config.Network.Name = "LinkNet"
+		config.Linking.Enabled = true
+		config.Linking.Links = map[string]*LinkConfig{
+			"two.test":  {Password: "hunter2"},
+			"fake.test": {Password: "hunter2"},
+		}
+	})
+	defer cleanupOne()
+	two, cleanupTwo := newLinkTestServer(t, "two.test", "one.test")
+	defer cleanupTwo()
+	linkTestServers(t, one, two)
+
+	alice := newTestClient(t, one, "alice")
+	alice.send("JOIN #test")
+	alice.expect(t, "JOIN #test")
+	bob := newTestClient(t, two, "bob")
+	bob.send("JOIN #test")
+	alice.expect(t, ":bob!", "JOIN #test")
+
+	// a peer that claims to speak for clients that aren't behind it
+	connOurs, connTheirs := net.Pipe()
+	go one.links.newLink(connTheirs, "").run()
+	go io.Copy(ioutil.Discard, connOurs)
+	io.WriteString(connOurs, "PASS hunter2\r\nSERVER fake.test 9ZZ :LinkNet\r\n")
+	waitFor(t, "fake link", func() bool { return one.links.LinkCount() == 2 })
+
+	bobUID := one.clients.Get("bob").uid
+	aliceUID := one.clients.Get("alice").uid
+	for _, line := range []string{
+		":" + bobUID + " NICK mallory 1",
+		":" + bobUID + " TOPIC #test :spoofed topic",
+		":" + bobUID + " KICK #test " + aliceUID + " :spoofed kick",
+		":" + bobUID + " PART #test :spoofed part",
+		":" + aliceUID + " PRIVMSG #test :spoofed message",
+		":" + bobUID + " QUIT :spoofed quit",
+		":" + bobUID + " KILL " + aliceUID + " :spoofed kill",
+	} {
+		io.WriteString(connOurs, line+"\r\n")
+	}
+	alice.expectNone(t, "spoofed")
+	if one.clients.Get("bob") == nil || one.clients.Get("mallory") != nil {
+		t.Error("bob's nick shouldn't have changed")
+	}
+	if channel := one.channels.Get("#test"); channel == nil || len(channel.Members()) != 2 {
+		t.Error("both clients should still be in #test")
+	}
+	if channel := two.channels.Get("#test"); channel == nil || channel.Topic() != "" {
+		t.Error("the spoofed topic shouldn't have been passed on")
+	}
+}
+
+func TestLinkingOutgoingCertfpRequired(t *testing.T) {
+	base, err := ioutil.ReadFile("../oragono.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, removeDir := newTestDir(t)
+	defer removeDir()
+
+	loadWithLink := func(block string) error {
+		yaml := strings.Replace(string(base), "    links:\n", "    links:\n        \"two.oragono.test\":\n"+block, 1)
+		yaml = strings.Replace(yaml, "    path: languages\n", "    path: ../languages\n", 1)
+		filename := filepath.Join(dir, "ircd.yaml")
+		if err := ioutil.WriteFile(filename, []byte(yaml), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadConfig(filename)
+		return err
+	}
+
+	// incoming-only links are checked by password (and optionally certfp)
+	if err := loadWithLink("            password: \"changeme\"\n"); err != nil {
+		t.Errorf("incoming link without certfp should be accepted, got %v", err)
+	}
+	// but we'd send our password to anyone who answers at the address
+	if err := loadWithLink("            address: \"two.oragono.test:7000\"\n            password: \"changeme\"\n"); err == nil || !strings.Contains(err.Error(), "certfp") {
+		t.Errorf("outgoing link without certfp should be refused, got %v", err)
+	}
+	if err := loadWithLink("            address: \"two.oragono.test:7000\"\n            password: \"changeme\"\n            certfp: \"" + strings.Repeat("ab", 32) + "\"\n"); err != nil {
+		t.Errorf("outgoing link with certfp should be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds (in seconds) of the buckets in the command latency histograms
+var commandLatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Metrics holds counters about the server's operation, which are exposed
+// in the Prometheus text format by the metrics listener.
+type Metrics struct {
+	// these are all accessed atomically
+	connections         int64
+	sendqExceeded       uint64
+	fakelagActivations  uint64
+	limiterRejections   uint64
+	throttlerRejections uint64
+	dlineHits           uint64
+	klineHits           uint64
+	dnsblRejections     uint64
+
+	sync.Mutex // tier 1; protects commands
+	commands   map[string]*commandMetrics
+}
+
+// commandMetrics is the latency histogram of a single command.
+type commandMetrics struct {
+	count   uint64
+	sum     float64
+	buckets []uint64 // buckets[i] counts executions that took <= commandLatencyBuckets[i]
+}
+
+// NewMetrics returns a new, empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		commands: make(map[string]*commandMetrics),
+	}
+}
+
+// ConnectionOpened records a new client connection.
+func (metrics *Metrics) ConnectionOpened() {
+	atomic.AddInt64(&metrics.connections, 1)
+}
+
+// ConnectionClosed records that a client connection has gone away.
+func (metrics *Metrics) ConnectionClosed() {
+	atomic.AddInt64(&metrics.connections, -1)
+}
+
+// SendQExceeded records a client being disconnected for exceeding its SendQ.
+func (metrics *Metrics) SendQExceeded() {
+	atomic.AddUint64(&metrics.sendqExceeded, 1)
+}
+
+// FakelagActivated records a client going from bursting to being throttled by fakelag.
+func (metrics *Metrics) FakelagActivated() {
+	atomic.AddUint64(&metrics.fakelagActivations, 1)
+}
+
+// LimiterRejected records a connection rejected by the connection limiter.
+func (metrics *Metrics) LimiterRejected() {
+	atomic.AddUint64(&metrics.limiterRejections, 1)
+}
+
+// ThrottlerRejected records a connection rejected by the connection throttler.
+func (metrics *Metrics) ThrottlerRejected() {
+	atomic.AddUint64(&metrics.throttlerRejections, 1)
+}
+
+// DlineHit records a connection rejected by a D-Line.
+func (metrics *Metrics) DlineHit() {
+	atomic.AddUint64(&metrics.dlineHits, 1)
+}
+
+// KlineHit records a client rejected by a K-Line.
+func (metrics *Metrics) KlineHit() {
+	atomic.AddUint64(&metrics.klineHits, 1)
+}
+
+// DNSBLRejected records a connection rejected because its IP is listed in a DNSBL.
+func (metrics *Metrics) DNSBLRejected() {
+	atomic.AddUint64(&metrics.dnsblRejections, 1)
+}
+
+// CommandCompleted records an execution of the given command and how long it took.
+func (metrics *Metrics) CommandCompleted(command string, duration time.Duration) {
+	seconds := duration.Seconds()
+
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	cm := metrics.commands[command]
+	if cm == nil {
+		cm = &commandMetrics{
+			buckets: make([]uint64, len(commandLatencyBuckets)),
+		}
+		metrics.commands[command] = cm
+	}
+	cm.count++
+	cm.sum += seconds
+	for i, bound := range commandLatencyBuckets {
+		if seconds <= bound {
+			cm.buckets[i]++
+		}
+	}
+}
+
+// CommandCounts returns the number of times each command has been executed.
+func (metrics *Metrics) CommandCounts() map[string]uint64 {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	counts := make(map[string]uint64, len(metrics.commands))
+	for command, cm := range metrics.commands {
+		counts[command] = cm.count
+	}
+	return counts
+}
+
+// writeMetric writes a single unlabelled sample, along with its HELP and TYPE lines.
+func writeMetric(w io.Writer, name, metricType, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, metricType, name, value)
+}
+
+// WriteCommandMetrics writes the per-command counters and latency histograms.
+func (metrics *Metrics) WriteCommandMetrics(w io.Writer) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	commands := make([]string, 0, len(metrics.commands))
+	for command := range metrics.commands {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+
+	fmt.Fprint(w, "# HELP oragono_commands_total Number of commands executed.\n# TYPE oragono_commands_total counter\n")
+	for _, command := range commands {
+		fmt.Fprintf(w, "oragono_commands_total{command=%q} %d\n", command, metrics.commands[command].count)
+	}
+
+	fmt.Fprint(w, "# HELP oragono_command_duration_seconds Time taken to execute commands.\n# TYPE oragono_command_duration_seconds histogram\n")
+	for _, command := range commands {
+		cm := metrics.commands[command]
+		for i, bound := range commandLatencyBuckets {
+			fmt.Fprintf(w, "oragono_command_duration_seconds_bucket{command=%q,le=\"%v\"} %d\n", command, bound, cm.buckets[i])
+		}
+		fmt.Fprintf(w, "oragono_command_duration_seconds_bucket{command=%q,le=\"+Inf\"} %d\n", command, cm.count)
+		fmt.Fprintf(w, "oragono_command_duration_seconds_sum{command=%q} %v\n", command, cm.sum)
+		fmt.Fprintf(w, "oragono_command_duration_seconds_count{command=%q} %d\n", command, cm.count)
+	}
+}
+
+// metricsHandler serves the server's metrics in the Prometheus text format.
+func (server *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metrics := server.metrics
+	var buf bytes.Buffer
+
+	writeMetric(&buf, "oragono_clients_connected", "gauge", "Number of open client connections.", atomic.LoadInt64(&metrics.connections))
+	writeMetric(&buf, "oragono_clients_registered", "gauge", "Number of clients that have completed registration.", server.clients.Count())
+	writeMetric(&buf, "oragono_channels", "gauge", "Number of channels.", server.channels.Len())
+	writeMetric(&buf, "oragono_accounts_logged_in", "gauge", "Number of accounts with at least one client logged in.", server.accounts.LoggedInCount())
+	writeMetric(&buf, "oragono_sendq_exceeded_total", "counter", "Clients disconnected for exceeding their SendQ.", atomic.LoadUint64(&metrics.sendqExceeded))
+	writeMetric(&buf, "oragono_fakelag_activations_total", "counter", "Times a client started being throttled by fakelag.", atomic.LoadUint64(&metrics.fakelagActivations))
+	writeMetric(&buf, "oragono_connection_limiter_rejections_total", "counter", "Connections rejected by the connection limiter.", atomic.LoadUint64(&metrics.limiterRejections))
+	writeMetric(&buf, "oragono_connection_throttler_rejections_total", "counter", "Connections rejected by the connection throttler.", atomic.LoadUint64(&metrics.throttlerRejections))
+	writeMetric(&buf, "oragono_dline_hits_total", "counter", "Connections rejected by D-Lines.", atomic.LoadUint64(&metrics.dlineHits))
+	writeMetric(&buf, "oragono_kline_hits_total", "counter", "Clients rejected by K-Lines.", atomic.LoadUint64(&metrics.klineHits))
+	writeMetric(&buf, "oragono_dnsbl_rejections_total", "counter", "Connections rejected because their IP is listed in a DNSBL.", atomic.LoadUint64(&metrics.dnsblRejections))
+	metrics.WriteCommandMetrics(&buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.CommandCompleted("PRIVMSG", 2*time.Millisecond)
+	metrics.CommandCompleted("PRIVMSG", 2*time.Second)
+	metrics.CommandCompleted("JOIN", 50*time.Microsecond)
+
+	var buf bytes.Buffer
+	metrics.WriteCommandMetrics(&buf)
+	output := buf.String()
+
+	expected := []string{
+		`oragono_commands_total{command="JOIN"} 1`,
+		`oragono_commands_total{command="PRIVMSG"} 2`,
+		`oragono_command_duration_seconds_bucket{command="JOIN",le="0.0001"} 1`,
+		`oragono_command_duration_seconds_bucket{command="PRIVMSG",le="0.001"} 0`,
+		`oragono_command_duration_seconds_bucket{command="PRIVMSG",le="0.005"} 1`,
+		`oragono_command_duration_seconds_bucket{command="PRIVMSG",le="1"} 1`,
+		`oragono_command_duration_seconds_bucket{command="PRIVMSG",le="5"} 2`,
+		`oragono_command_duration_seconds_bucket{command="PRIVMSG",le="+Inf"} 2`,
+		`oragono_command_duration_seconds_count{command="PRIVMSG"} 2`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("metrics output is missing %s:\n%s", line, output)
+		}
+	}
+
+	if strings.Index(output, `command="JOIN"`) > strings.Index(output, `command="PRIVMSG"`) {
+		t.Error("commands should be sorted")
+	}
+}
+
+func TestFakelagActivation(t *testing.T) {
+	window, _ := time.ParseDuration("1s")
+	fl, _ := newFakelagForTesting(window, 2, 2, window)
+
+	if fl.Touch() || fl.Touch() {
+		t.Error("should still be bursting")
+	}
+	if !fl.Touch() {
+		t.Error("should have started throttling")
+	}
+	if fl.Touch() {
+		t.Error("should only report the transition once")
+	}
+}
@@ -27,7 +27,7 @@ func (client *Client) applyUserModeChanges(force bool, changes modes.ModeChanges
 
 	for _, change := range changes {
 		switch change.Mode {
-		case modes.Bot, modes.Invisible, modes.WallOps, modes.UserRoleplaying, modes.Operator, modes.LocalOperator, modes.RegisteredOnly:
+		case modes.Bot, modes.CallerID, modes.Invisible, modes.WallOps, modes.UserRoleplaying, modes.Operator, modes.LocalOperator, modes.RegisteredOnly:
 			switch change.Op {
 			case modes.Add:
 				if !force && (change.Mode == modes.Operator || change.Mode == modes.LocalOperator) {
@@ -120,7 +120,7 @@ func ParseChannelModeChanges(params ...string) (modes.ModeChanges, map[rune]bool
 
 			// put arg into modechange if needed
 			switch modes.Mode(mode) {
-			case modes.BanMask, modes.ExceptMask, modes.InviteMask:
+			case modes.BanMask, modes.ExceptMask, modes.InviteMask, modes.QuietMask:
 				if len(params) > skipArgs {
 					change.Arg = params[skipArgs]
 					skipArgs++
@@ -134,7 +134,7 @@ func ParseChannelModeChanges(params ...string) (modes.ModeChanges, map[rune]bool
 				} else {
 					continue
 				}
-			case modes.Key, modes.UserLimit:
+			case modes.Key, modes.UserLimit, modes.FloodLimit:
 				// don't require value when removing
 				if change.Op == modes.Add {
 					if len(params) > skipArgs {
@@ -226,17 +226,22 @@ func (channel *Channel) ApplyChannelModeChanges(client *Client, isSamode bool, c
 		}
 
 		switch change.Mode {
-		case modes.BanMask, modes.ExceptMask, modes.InviteMask:
+		case modes.BanMask, modes.ExceptMask, modes.InviteMask, modes.QuietMask:
 			if isListOp(change) {
 				channel.ShowMaskList(client, change.Mode, rb)
 				continue
 			}
 
 			// confirm mask looks valid
-			mask, err := Casefold(change.Arg)
+			mask, err := casefoldMask(change.Arg)
 			if err != nil {
 				continue
 			}
+			if isExtban(mask) {
+				if _, err := parseExtban(mask); err != nil {
+					continue
+				}
+			}
 
 			switch change.Op {
 			case modes.Add:
@@ -270,6 +275,21 @@ func (channel *Channel) ApplyChannelModeChanges(client *Client, isSamode bool, c
 				applied = append(applied, change)
 			}
 
+		case modes.FloodLimit:
+			switch change.Op {
+			case modes.Add:
+				limits, err := ParseChannelFloodLimits(change.Arg)
+				if err == nil {
+					channel.setFloodLimits(limits)
+					change.Arg = limits.String()
+					applied = append(applied, change)
+				}
+
+			case modes.Remove:
+				channel.setFloodLimits(ChannelFloodLimits{})
+				applied = append(applied, change)
+			}
+
 		case modes.Key:
 			switch change.Op {
 			case modes.Add:
@@ -280,7 +300,7 @@ func (channel *Channel) ApplyChannelModeChanges(client *Client, isSamode bool, c
 			}
 			applied = append(applied, change)
 
-		case modes.InviteOnly, modes.Moderated, modes.NoOutside, modes.OpOnlyTopic, modes.RegisteredOnly, modes.Secret, modes.ChanRoleplaying:
+		case modes.InviteOnly, modes.Moderated, modes.NoKnock, modes.NoOutside, modes.OpOnlyTopic, modes.RegisteredOnly, modes.Secret, modes.ChanRoleplaying:
 			if change.Op == modes.List {
 				continue
 			}
@@ -12,13 +12,13 @@ import (
 var (
 	// SupportedUserModes are the user modes that we actually support (modifying).
 	SupportedUserModes = Modes{
-		Away, Bot, Invisible, Operator, RegisteredOnly, ServerNotice, UserRoleplaying,
+		Away, Bot, CallerID, Invisible, Operator, RegisteredOnly, ServerNotice, UserRoleplaying, WallOps,
 	}
 
 	// SupportedChannelModes are the channel modes that we support.
 	SupportedChannelModes = Modes{
-		BanMask, ChanRoleplaying, ExceptMask, InviteMask, InviteOnly, Key,
-		Moderated, NoOutside, OpOnlyTopic, RegisteredOnly, Secret, UserLimit,
+		BanMask, ChanRoleplaying, ExceptMask, FloodLimit, InviteMask, InviteOnly, Key,
+		Moderated, NoKnock, NoOutside, OpOnlyTopic, QuietMask, RegisteredOnly, Secret, UserLimit,
 	}
 )
 
@@ -106,6 +106,7 @@ func (modes Modes) String() string {
 const (
 	Away            Mode = 'a'
 	Bot             Mode = 'B'
+	CallerID        Mode = 'g'
 	Invisible       Mode = 'i'
 	LocalOperator   Mode = 'O'
 	Operator        Mode = 'o'
@@ -122,12 +123,15 @@ const (
 	BanMask         Mode = 'b' // arg
 	ChanRoleplaying Mode = 'E' // flag
 	ExceptMask      Mode = 'e' // arg
+	FloodLimit      Mode = 'f' // flag arg
 	InviteMask      Mode = 'I' // arg
 	InviteOnly      Mode = 'i' // flag
 	Key             Mode = 'k' // flag arg
 	Moderated       Mode = 'm' // flag
+	NoKnock         Mode = 'K' // flag
 	NoOutside       Mode = 'n' // flag
 	OpOnlyTopic     Mode = 't' // flag
+	QuietMask       Mode = 'Q' // arg
 	// RegisteredOnly mode is reused here from umode definition
 	Secret    Mode = 's' // flag
 	UserLimit Mode = 'l' // flag arg
@@ -70,6 +70,8 @@ func performNickChange(server *Server, client *Client, target *Client, newnick s
 
 	if target.Registered() {
 		client.server.monitorManager.AlertAbout(target, true)
+		client.server.links.NickChange(target)
+		target.updateSessionNicks()
 	}
 	// else: Run() will attempt registration immediately after this
 	return true
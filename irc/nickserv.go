@@ -7,10 +7,13 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/goshuirc/irc-go/ircfmt"
 
+	"github.com/oragono/oragono/irc/custime"
 	"github.com/oragono/oragono/irc/modes"
+	"github.com/oragono/oragono/irc/sno"
 	"github.com/oragono/oragono/irc/utils"
 )
 
@@ -33,6 +36,16 @@ type nsCommand struct {
 
 var (
 	nickservCommands = map[string]*nsCommand{
+		"cert": {
+			handler: nsCertHandler,
+			help: `Syntax: $bCERT <ADD | DEL | LIST> [fingerprint]$b
+
+CERT manages the TLS client certificate fingerprints that can be used to login
+to your account. $bCERT ADD$b authorizes the given fingerprint (or the one of
+the certificate you're currently using), $bCERT DEL$b removes the given
+fingerprint, and $bCERT LIST$b shows the fingerprints currently authorized.`,
+			helpShort: `$bCERT$b manages the TLS certificates that can login to your account.`,
+		},
 		"drop": {
 			handler: nsDropHandler,
 			help: `Syntax: $bDROP [nickname]$b
@@ -79,6 +92,13 @@ certfp (your client certificate) if a password is not given.`,
 INFO gives you information about the given (or your own) user account.`,
 			helpShort: `$bINFO$b gives you information on a user account.`,
 		},
+		"passwd": {
+			handler: nsPasswdHandler,
+			help: `Syntax: $bPASSWD <current password> <new password>$b
+
+PASSWD changes the password of the account you're logged into.`,
+			helpShort: `$bPASSWD$b changes your account password.`,
+		},
 		"register": {
 			handler: nsRegisterHandler,
 			// TODO: "email" is an oversimplification here; it's actually any callback, e.g.,
@@ -92,6 +112,17 @@ If the password is left out, your account will be registered to your TLS client
 certificate (and you will need to use that certificate to login in future).`,
 			helpShort: `$bREGISTER$b lets you register a user account.`,
 		},
+		"resetpass": {
+			handler: nsResetPassHandler,
+			help: `Syntax: $bRESETPASS <username>$b
+        $bRESETPASS <username> <code> <new password>$b
+
+RESETPASS lets you choose a new password if you've forgotten yours. The first
+form e-mails a reset code to the address the account was registered with, and
+the second form uses that code to set the new password. Reset codes expire
+after an hour, and only one can be requested every ten minutes.`,
+			helpShort: `$bRESETPASS$b lets you reset a forgotten account password.`,
+		},
 		"sadrop": {
 			handler: nsDropHandler,
 			help: `Syntax: $bSADROP <nickname>$b
@@ -101,6 +132,40 @@ SADROP foribly de-links the given nickname from the attached user account.`,
 			nickReservation: true,
 			capabs:          []string{"unregister"},
 		},
+		"sapasswd": {
+			handler: nsSapasswdHandler,
+			help: `Syntax: $bSAPASSWD <username> <new password>$b
+
+SAPASSWD forcibly changes the password of the given user account.`,
+			helpShort: `$bSAPASSWD$b forcibly changes the password of a user account.`,
+			capabs:    []string{"accreg"},
+		},
+		"set": {
+			handler: nsSetHandler,
+			help: `Syntax: $bSET <setting> [value]$b
+
+SET changes the settings of the account you're logged into, or shows the current
+value of a setting if no value is given. The settings are:
+
+$bALWAYS-ON <ON | OFF>$b
+If enabled, your client stays on the server when you disconnect, and is marked
+as away. It keeps your nickname and channels (even across server restarts), and
+the next connection that logs into your account is attached to it and sent the
+messages you missed. To quit for good, disable this and then disconnect.`,
+			helpShort: `$bSET$b changes your account settings.`,
+		},
+		"suspend": {
+			handler: nsSuspendHandler,
+			help: `Syntax: $bSUSPEND <username> [duration] [reason]$b
+        $bSUSPEND LIST$b
+
+SUSPEND prevents anyone from logging into the given user account, and
+disconnects any clients that are currently logged into it. If a duration
+(like 1h or 7d) is given, the suspension is lifted automatically once it
+expires. $bSUSPEND LIST$b shows the accounts that are currently suspended.`,
+			helpShort: `$bSUSPEND$b prevents a user account from being used.`,
+			capabs:    []string{"oper:local_ban"},
+		},
 		"unregister": {
 			handler: nsUnregisterHandler,
 			help: `Syntax: $bUNREGISTER [username]$b
@@ -109,6 +174,14 @@ UNREGISTER lets you delete your user account (or the given one, if you're an
 IRC operator with the correct permissions).`,
 			helpShort: `$bUNREGISTER$b lets you delete your user account.`,
 		},
+		"unsuspend": {
+			handler: nsUnsuspendHandler,
+			help: `Syntax: $bUNSUSPEND <username>$b
+
+UNSUSPEND lifts the suspension of the given user account.`,
+			helpShort: `$bUNSUSPEND$b lifts the suspension of a user account.`,
+			capabs:    []string{"oper:local_unban"},
+		},
 		"verify": {
 			handler: nsVerifyHandler,
 			help: `Syntax: $bVERIFY <username> <code>$b
@@ -213,6 +286,10 @@ func nsGhostHandler(server *Server, client *Client, command, params string, rb *
 		return
 	}
 
+	if ghost.IsRemote() {
+		server.links.Kill(client, ghost, fmt.Sprintf("GHOSTed by %s", client.Nick()))
+		return
+	}
 	ghost.Quit(fmt.Sprintf(ghost.t("GHOSTed by %s"), client.Nick()))
 	ghost.destroy(false)
 }
@@ -294,20 +371,24 @@ func nsIdentifyHandler(server *Server, client *Client, command, params string, r
 
 	username, passphrase := utils.ExtractParam(params)
 
+	var err error
+
 	// try passphrase
 	if username != "" && passphrase != "" {
-		err := server.accounts.AuthenticateByPassphrase(client, username, passphrase)
+		err = server.accounts.AuthenticateByPassphrase(client, username, passphrase)
 		loginSuccessful = (err == nil)
 	}
 
 	// try certfp
-	if !loginSuccessful && client.certfp != "" {
-		err := server.accounts.AuthenticateByCertFP(client)
+	if !loginSuccessful && client.certfp != "" && err != errAccountSuspended {
+		err = server.accounts.AuthenticateByCertFP(client)
 		loginSuccessful = (err == nil)
 	}
 
 	if loginSuccessful {
 		sendSuccessfulSaslAuth(client, rb, true)
+	} else if err == errAccountSuspended {
+		nsNotice(rb, client.t("Your account has been suspended"))
 	} else {
 		nsNotice(rb, client.t("Could not login with your TLS certificate or supplied username/password"))
 	}
@@ -482,3 +563,305 @@ func nsVerifyHandler(server *Server, client *Client, command, params string, rb
 
 	sendSuccessfulRegResponse(client, rb, true)
 }
+
+func nsPasswdHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
+	oldPassphrase, newPassphrase := utils.ExtractParam(params)
+	newPassphrase = strings.TrimSpace(newPassphrase)
+
+	account := client.Account()
+	if account == "" {
+		nsNotice(rb, client.t("You're not logged into an account"))
+		return
+	}
+	if oldPassphrase == "" || newPassphrase == "" {
+		nsNotice(rb, ircfmt.Unescape(client.t("Syntax: $bPASSWD <current password> <new password>$b")))
+		return
+	}
+
+	err := server.accounts.ChangePassphrase(account, oldPassphrase, newPassphrase)
+	if err == errAccountInvalidCredentials {
+		nsNotice(rb, client.t("Password incorrect"))
+	} else if err != nil {
+		nsNotice(rb, client.t("Could not change password"))
+	} else {
+		nsNotice(rb, client.t("Password changed"))
+	}
+}
+
+func nsSapasswdHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
+	username, newPassphrase := utils.ExtractParam(params)
+	newPassphrase = strings.TrimSpace(newPassphrase)
+
+	if username == "" || newPassphrase == "" {
+		nsNotice(rb, ircfmt.Unescape(client.t("Syntax: $bSAPASSWD <username> <new password>$b")))
+		return
+	}
+
+	err := server.accounts.SetPassphrase(username, newPassphrase)
+	if err == errAccountDoesNotExist || err == errAccountUnverified {
+		nsNotice(rb, client.t(err.Error()))
+	} else if err != nil {
+		nsNotice(rb, client.t("Could not change password"))
+	} else {
+		nsNotice(rb, fmt.Sprintf(client.t("Changed password of account %s"), username))
+		server.logger.Info("nickserv", fmt.Sprintf("Client %s changed the password of account %s", client.Nick(), username))
+	}
+}
+
+func nsResetPassHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
+	username, params := utils.ExtractParam(params)
+	code, newPassphrase := utils.ExtractParam(params)
+	newPassphrase = strings.TrimSpace(newPassphrase)
+
+	if username == "" || (code != "" && newPassphrase == "") {
+		nsNotice(rb, ircfmt.Unescape(client.t("Syntax: $bRESETPASS <username> [<code> <new password>]$b")))
+		return
+	}
+
+	if code == "" {
+		err := server.accounts.StartPassphraseReset(client, username)
+		if err == errAccountDoesNotExist || err == errAccountUnverified || err == errAccountNoResetCallback || err == errAccountResetThrottled {
+			nsNotice(rb, client.t(err.Error()))
+		} else if err != nil {
+			nsNotice(rb, client.t("Could not send a reset code"))
+		} else {
+			nsNotice(rb, client.t("A reset code has been sent to the e-mail address the account was registered with"))
+		}
+		return
+	}
+
+	err := server.accounts.ResetPassphrase(username, code, newPassphrase)
+	if err == errAccountVerificationInvalidCode {
+		nsNotice(rb, client.t("Invalid reset code"))
+	} else if err != nil {
+		nsNotice(rb, client.t("Could not change password"))
+	} else {
+		nsNotice(rb, client.t("Password changed"))
+	}
+}
+
+func nsCertHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
+	subcommand, params := utils.ExtractParam(params)
+	certfp, _ := utils.ExtractParam(params)
+	subcommand = strings.ToLower(subcommand)
+
+	account := client.Account()
+	if account == "" {
+		nsNotice(rb, client.t("You're not logged into an account"))
+		return
+	}
+
+	var err error
+	switch subcommand {
+	case "list":
+		accountInfo, err := server.accounts.LoadAccount(account)
+		if err != nil {
+			nsNotice(rb, client.t("Could not load your account"))
+			return
+		}
+		nsNotice(rb, fmt.Sprintf(client.t("There are %d certificate fingerprint(s) authorized for your account"), len(accountInfo.Credentials.Certificates)))
+		for i, certfp := range accountInfo.Credentials.Certificates {
+			nsNotice(rb, fmt.Sprintf("%d: %s", i+1, certfp))
+		}
+		return
+	case "add":
+		if certfp == "" {
+			certfp = client.certfp
+		}
+		if certfp == "" {
+			nsNotice(rb, client.t("You must supply a fingerprint, or connect with a TLS client certificate"))
+			return
+		}
+		err = server.accounts.AddCertfp(account, certfp)
+	case "del":
+		if certfp == "" {
+			nsNotice(rb, ircfmt.Unescape(client.t("Syntax: $bCERT DEL <fingerprint>$b")))
+			return
+		}
+		err = server.accounts.RemoveCertfp(account, certfp)
+	default:
+		nsNotice(rb, ircfmt.Unescape(client.t("Syntax: $bCERT <ADD | DEL | LIST> [fingerprint]$b")))
+		return
+	}
+
+	if err == nil {
+		// echo back the fingerprint in the form it was stored
+		certfp, _ = normalizeCertfp(certfp)
+	}
+
+	switch err {
+	case nil:
+		if subcommand == "add" {
+			nsNotice(rb, fmt.Sprintf(client.t("Certificate fingerprint %s successfully added"), certfp))
+		} else {
+			nsNotice(rb, fmt.Sprintf(client.t("Certificate fingerprint %s successfully removed"), certfp))
+		}
+	case errCertfpAlreadyExists, errCertfpAlreadyYours, errInvalidCertfp, errAccountTooManyCertfps, errNoSuchCertfp, errAccountCantRemoveLastCredential:
+		nsNotice(rb, client.t(err.Error()))
+	default:
+		nsNotice(rb, client.t("Could not modify certificate fingerprints"))
+	}
+}
+
+func nsSetHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
+	setting, params := utils.ExtractParam(params)
+	value, _ := utils.ExtractParam(params)
+	setting = strings.ToLower(setting)
+	value = strings.ToLower(value)
+
+	account := client.Account()
+	if account == "" {
+		nsNotice(rb, client.t("You're not logged into an account"))
+		return
+	}
+
+	switch setting {
+	case "always-on":
+		if !server.AccountConfig().Multiclient.AllowAlwaysOn {
+			nsNotice(rb, client.t("Always-on is disabled on this server"))
+			return
+		}
+		var alwaysOn bool
+		switch value {
+		case "":
+			if server.accounts.LoadAlwaysOn(account) {
+				nsNotice(rb, client.t("Always-on is enabled for your account"))
+			} else {
+				nsNotice(rb, client.t("Always-on is disabled for your account"))
+			}
+			return
+		case "on":
+			alwaysOn = true
+		case "off":
+			alwaysOn = false
+		default:
+			nsNotice(rb, ircfmt.Unescape(client.t("Syntax: $bSET ALWAYS-ON <ON | OFF>$b")))
+			return
+		}
+
+		if err := server.accounts.StoreAlwaysOn(account, alwaysOn); err != nil {
+			nsNotice(rb, client.t("Could not change your account settings"))
+			return
+		}
+		for _, accountClient := range server.accounts.AccountToClients(account) {
+			if accountClient.Primary() != nil {
+				continue
+			}
+			accountClient.SetAlwaysOn(alwaysOn)
+			if alwaysOn {
+				accountClient.storeAlwaysOnState()
+			} else if accountClient.detached() {
+				accountClient.Quit("Always-on was disabled")
+				accountClient.destroy(false)
+			}
+		}
+
+		if alwaysOn {
+			nsNotice(rb, client.t("Always-on is now enabled for your account"))
+		} else {
+			nsNotice(rb, client.t("Always-on is now disabled for your account"))
+		}
+	default:
+		nsNotice(rb, ircfmt.Unescape(client.t("Syntax: $bSET <setting> [value]$b")))
+	}
+}
+
+func nsSuspendHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
+	accountName, params := utils.ExtractParam(params)
+
+	if strings.ToLower(accountName) == "list" && params == "" {
+		suspensions := server.accounts.AllSuspensions()
+		if len(suspensions) == 0 {
+			nsNotice(rb, client.t("No accounts have been suspended"))
+		}
+		for account, info := range suspensions {
+			nsNotice(rb, formatSuspension(client, account, info))
+		}
+		return
+	}
+
+	if accountName == "" {
+		nsNotice(rb, ircfmt.Unescape(client.t("Syntax: $bSUSPEND <username> [duration] [reason]$b")))
+		return
+	}
+	if cfname, err := CasefoldName(accountName); err == nil && cfname == client.Account() {
+		nsNotice(rb, client.t("You can't suspend your own account"))
+		return
+	}
+
+	var banTime *IPRestrictTime
+	durationString, reason := utils.ExtractParam(params)
+	if duration, err := custime.ParseDuration(durationString); err == nil {
+		banTime = &IPRestrictTime{
+			Duration: duration,
+			Expires:  time.Now().Add(duration),
+		}
+	} else {
+		reason = params
+	}
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		reason = "No reason given"
+	}
+
+	operName := client.operName
+	if operName == "" {
+		operName = server.name
+	}
+
+	info := IPBanInfo{
+		Reason:     reason,
+		OperReason: reason,
+		OperName:   operName,
+		Time:       banTime,
+	}
+	clients, err := server.accounts.Suspend(accountName, info)
+	if err == errAccountDoesNotExist {
+		nsNotice(rb, client.t(err.Error()))
+		return
+	} else if err != nil {
+		nsNotice(rb, client.t("Could not suspend account"))
+		return
+	}
+
+	if banTime != nil {
+		nsNotice(rb, fmt.Sprintf(client.t("Suspended account %[1]s for %[2]s"), accountName, banTime.Duration.String()))
+		server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("%s [%s]$r added temporary (%s) suspension for account %s"), client.Nick(), operName, banTime.Duration.String(), accountName))
+	} else {
+		nsNotice(rb, fmt.Sprintf(client.t("Suspended account %s"), accountName))
+		server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("%s [%s]$r added suspension for account %s"), client.Nick(), operName, accountName))
+	}
+
+	// existing sessions are disconnected, so they can't keep using the account
+	var killedClientNicks []string
+	for _, mcl := range clients {
+		killedClientNicks = append(killedClientNicks, mcl.Nick())
+		mcl.exitedSnomaskSent = true
+		mcl.Quit(fmt.Sprintf(mcl.t("Your account has been suspended (%s)"), reason))
+		mcl.destroy(false)
+	}
+	if len(killedClientNicks) != 0 {
+		sort.Strings(killedClientNicks)
+		server.snomasks.Send(sno.LocalKills, fmt.Sprintf(ircfmt.Unescape("%s [%s] killed %d clients with a suspension $c[grey][$r%s$c[grey]]"), client.Nick(), operName, len(killedClientNicks), strings.Join(killedClientNicks, ", ")))
+	}
+}
+
+func nsUnsuspendHandler(server *Server, client *Client, command, params string, rb *ResponseBuffer) {
+	accountName, _ := utils.ExtractParam(params)
+	if accountName == "" {
+		nsNotice(rb, ircfmt.Unescape(client.t("Syntax: $bUNSUSPEND <username>$b")))
+		return
+	}
+
+	err := server.accounts.Unsuspend(accountName)
+	if err == errAccountDoesNotExist || err == errNoExistingBan {
+		nsNotice(rb, client.t("That account is not suspended"))
+		return
+	} else if err != nil {
+		nsNotice(rb, client.t("Could not lift suspension"))
+		return
+	}
+
+	nsNotice(rb, fmt.Sprintf(client.t("Lifted the suspension of account %s"), accountName))
+	server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("%s$r removed suspension for account %s"), client.Nick(), accountName))
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestMailServer starts a minimal SMTP server, returning its port and a
+// channel that receives the body of every message sent through it.
+func newTestMailServer(t *testing.T) (port int, messages chan string, stop func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages = make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestMail(conn, messages)
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, messages, func() {
+		listener.Close()
+	}
+}
+
+func serveTestMail(conn net.Conn, messages chan<- string) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		io.WriteString(conn, line+"\r\n")
+	}
+
+	reply("220 mail.test ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.TrimSpace(line))
+		if space := strings.IndexByte(verb, ' '); space != -1 {
+			verb = verb[:space]
+		}
+		switch verb {
+		case "DATA":
+			reply("354 go ahead")
+			var body []string
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				line = strings.TrimRight(line, "\r\n")
+				if line == "." {
+					break
+				}
+				body = append(body, line)
+			}
+			messages <- strings.Join(body, "\n")
+			reply("250 OK")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+// expectMailCode returns the code after `label` in the next message sent to the
+// test mail server.
+func expectMailCode(t *testing.T, messages chan string, label string) string {
+	select {
+	case message := <-messages:
+		match := regexp.MustCompile(label + `: (\S+)`).FindStringSubmatch(message)
+		if match == nil {
+			t.Fatalf("no %s in message: %s", label, message)
+		}
+		return match[1]
+	case <-time.After(testTimeout):
+		t.Fatalf("timed out waiting for %s", label)
+	}
+	return ""
+}
+
+func checkPassphrase(server *Server, account, passphrase string) bool {
+	return server.accounts.AuthenticateByPassphrase(openTestClient(server).client, account, passphrase) == nil
+}
+
+func TestNickServPasswd(t *testing.T) {
+	server, shutdown := newTestServer(t, nil)
+	defer shutdown()
+
+	alice := openTestClient(server)
+	alice.registerAccount(t, server, "alice", "alicepass")
+	alice.register(t, "alice")
+
+	alice.send("PRIVMSG NickServ :PASSWD wrongpass newpass")
+	alice.expect(t, "NickServ", "Password incorrect")
+	alice.send("PRIVMSG NickServ :PASSWD alicepass newpass")
+	alice.expect(t, "NickServ", "Password changed")
+	if checkPassphrase(server, "alice", "alicepass") || !checkPassphrase(server, "alice", "newpass") {
+		t.Errorf("password wasn't changed")
+	}
+
+	bob := newTestClient(t, server, "bob")
+	bob.send("PRIVMSG NickServ :PASSWD newpass bobpass")
+	bob.expect(t, "NickServ", "not logged into an account")
+}
+
+func TestNickServResetPass(t *testing.T) {
+	port, messages, stop := newTestMailServer(t)
+	defer stop()
+	server, shutdown := newTestServer(t, func(config *Config) {
+		config.Accounts.Registration.EnabledCallbacks = []string{"none", "mailto"}
+		config.Accounts.Registration.Callbacks.Mailto.Server = "127.0.0.1"
+		config.Accounts.Registration.Callbacks.Mailto.Port = port
+		config.Accounts.Registration.Callbacks.Mailto.Sender = "services@irc.test"
+	})
+	defer shutdown()
+
+	alice := openTestClient(server)
+	if err := server.accounts.Register(alice.client, "alice", "mailto", "alice@example.com", "alicepass", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.accounts.Verify(alice.client, "alice", expectMailCode(t, messages, "Verification code")); err != nil {
+		t.Fatal(err)
+	}
+
+	bob := newTestClient(t, server, "bob")
+	bob.send("PRIVMSG NickServ :RESETPASS alice")
+	bob.expect(t, "NickServ", "A reset code has been sent")
+	code := expectMailCode(t, messages, "Reset code")
+
+	// another code can't be requested straight away
+	bob.send("PRIVMSG NickServ :RESETPASS alice")
+	bob.expect(t, "NickServ", "please wait")
+
+	bob.send("PRIVMSG NickServ :RESETPASS alice 0" + code + " newpass")
+	bob.expect(t, "NickServ", "Invalid reset code")
+	bob.send("PRIVMSG NickServ :RESETPASS alice " + code + " newpass")
+	bob.expect(t, "NickServ", "Password changed")
+	if checkPassphrase(server, "alice", "alicepass") || !checkPassphrase(server, "alice", "newpass") {
+		t.Errorf("password wasn't reset")
+	}
+
+	// codes only work once
+	bob.send("PRIVMSG NickServ :RESETPASS alice " + code + " otherpass")
+	bob.expect(t, "NickServ", "Invalid reset code")
+
+	// and are only sent to e-mail addresses
+	carol := openTestClient(server)
+	carol.registerAccount(t, server, "carol", "carolpass")
+	bob.send("PRIVMSG NickServ :RESETPASS carol")
+	bob.expect(t, "NickServ", "no e-mail address")
+}
+
+func TestNickServCert(t *testing.T) {
+	server, shutdown := newTestServer(t, nil)
+	defer shutdown()
+
+	certfp := func(i int) string {
+		return fmt.Sprintf("%064x", i)
+	}
+
+	alice := openTestClient(server)
+	alice.registerAccount(t, server, "alice", "alicepass")
+	alice.register(t, "alice")
+
+	alice.send("PRIVMSG NickServ :CERT ADD")
+	alice.expect(t, "NickServ", "You must supply a fingerprint")
+	alice.send("PRIVMSG NickServ :CERT ADD zz")
+	alice.expect(t, "NickServ", "Invalid certificate fingerprint")
+
+	// colon-separated fingerprints are normalized
+	colons := strings.ToUpper(regexp.MustCompile("(..)").ReplaceAllString(certfp(1), "$1:"))
+	alice.send("PRIVMSG NickServ :CERT ADD " + strings.TrimSuffix(colons, ":"))
+	alice.expect(t, "NickServ", "Certificate fingerprint "+certfp(1)+" successfully added")
+	alice.send("PRIVMSG NickServ :CERT ADD " + certfp(1))
+	alice.expect(t, "NickServ", "already authorized")
+	alice.send("PRIVMSG NickServ :CERT LIST")
+	alice.expect(t, "NickServ", "There are 1 certificate")
+	alice.expect(t, "NickServ", "1: "+certfp(1))
+
+	other := newTestClient(t, server, "other")
+	other.client.certfp = certfp(1)
+	if err := server.accounts.AuthenticateByCertFP(other.client); err != nil || other.client.Account() != "alice" {
+		t.Errorf("couldn't login with the added certificate: %v", err)
+	}
+
+	// fingerprints can only belong to one account
+	bob := openTestClient(server)
+	bob.registerAccount(t, server, "bob", "bobpass")
+	bob.register(t, "bob")
+	bob.send("PRIVMSG NickServ :CERT ADD " + certfp(1))
+	bob.expect(t, "NickServ", "An account already exists with your certificate")
+
+	alice.send("PRIVMSG NickServ :CERT DEL " + certfp(1))
+	alice.expect(t, "NickServ", "successfully removed")
+	alice.send("PRIVMSG NickServ :CERT DEL " + certfp(1))
+	alice.expect(t, "NickServ", "not associated with the account")
+	removed := newTestClient(t, server, "removed")
+	removed.client.certfp = certfp(1)
+	if err := server.accounts.AuthenticateByCertFP(removed.client); err == nil {
+		t.Errorf("removed certificate can still login")
+	}
+
+	for i := 1; i <= maxCertfpsPerAccount; i++ {
+		alice.send("PRIVMSG NickServ :CERT ADD " + certfp(i))
+		alice.expect(t, "NickServ", "successfully added")
+	}
+	alice.send("PRIVMSG NickServ :CERT ADD " + certfp(maxCertfpsPerAccount+1))
+	alice.expect(t, "NickServ", "too many certificate fingerprints")
+
+	// accounts can't be left without any way to login
+	carol := newTestClient(t, server, "carol")
+	if err := server.accounts.Register(carol.client, "carol", "none", "", "", certfp(100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.accounts.Verify(carol.client, "carol", ""); err != nil {
+		t.Fatal(err)
+	}
+	carol.send("PRIVMSG NickServ :CERT DEL " + certfp(100))
+	carol.expect(t, "NickServ", "only credential")
+}
@@ -32,12 +32,15 @@ const (
 	RPL_TRACERECONNECT              = "210"
 	RPL_STATSLINKINFO               = "211"
 	RPL_STATSCOMMANDS               = "212"
+	RPL_STATSKLINE                  = "216"
 	RPL_ENDOFSTATS                  = "219"
 	RPL_UMODEIS                     = "221"
+	RPL_STATSDLINE                  = "225"
 	RPL_SERVLIST                    = "234"
 	RPL_SERVLISTEND                 = "235"
 	RPL_STATSUPTIME                 = "242"
 	RPL_STATSOLINE                  = "243"
+	RPL_STATSDEBUG                  = "249"
 	RPL_LUSERCLIENT                 = "251"
 	RPL_LUSEROP                     = "252"
 	RPL_LUSERUNKNOWN                = "253"
@@ -50,7 +53,11 @@ const (
 	RPL_TRACELOG                    = "261"
 	RPL_TRACEEND                    = "262"
 	RPL_TRYAGAIN                    = "263"
+	RPL_SILELIST                    = "271"
+	RPL_ENDOFSILELIST               = "272"
 	RPL_WHOISCERTFP                 = "276"
+	RPL_ACCEPTLIST                  = "281"
+	RPL_ENDOFACCEPT                 = "282"
 	RPL_AWAY                        = "301"
 	RPL_USERHOST                    = "302"
 	RPL_ISON                        = "303"
@@ -64,6 +71,7 @@ const (
 	RPL_WHOISIDLE                   = "317"
 	RPL_ENDOFWHOIS                  = "318"
 	RPL_WHOISCHANNELS               = "319"
+	RPL_WHOISSPECIAL                = "320"
 	RPL_LIST                        = "322"
 	RPL_LISTEND                     = "323"
 	RPL_CHANNELMODEIS               = "324"
@@ -136,6 +144,9 @@ const (
 	ERR_SUMMONDISABLED              = "445"
 	ERR_USERSDISABLED               = "446"
 	ERR_NOTREGISTERED               = "451"
+	ERR_ACCEPTFULL                  = "456"
+	ERR_ACCEPTEXIST                 = "457"
+	ERR_ACCEPTNOT                   = "458"
 	ERR_NEEDMOREPARAMS              = "461"
 	ERR_ALREADYREGISTRED            = "462"
 	ERR_NOPERMFORHOST               = "463"
@@ -151,6 +162,7 @@ const (
 	ERR_BADCHANMASK                 = "476"
 	ERR_NOCHANMODES                 = "477"
 	ERR_BANLISTFULL                 = "478"
+	ERR_CANNOTKNOCK                 = "480"
 	ERR_NOPRIVILEGES                = "481"
 	ERR_CHANOPRIVSNEEDED            = "482"
 	ERR_CANTKILLSERVER              = "483"
@@ -159,6 +171,7 @@ const (
 	ERR_NOOPERHOST                  = "491"
 	ERR_UMODEUNKNOWNFLAG            = "501"
 	ERR_USERSDONTMATCH              = "502"
+	ERR_SILELISTFULL                = "511"
 	ERR_HELPNOTFOUND                = "524"
 	ERR_CANNOTSENDRP                = "573"
 	RPL_WHOISSECURE                 = "671"
@@ -167,7 +180,17 @@ const (
 	RPL_HELPSTART                   = "704"
 	RPL_HELPTXT                     = "705"
 	RPL_ENDOFHELP                   = "706"
+	RPL_KNOCK                       = "710"
+	RPL_KNOCKDLVR                   = "711"
+	ERR_TOOMANYKNOCK                = "712"
+	ERR_CHANOPEN                    = "713"
+	ERR_KNOCKONCHAN                 = "714"
+	ERR_TARGUMODEG                  = "716"
+	RPL_TARGNOTIFY                  = "717"
+	RPL_UMODEGMSG                   = "718"
 	ERR_NOPRIVS                     = "723"
+	RPL_QUIETLIST                   = "728"
+	RPL_ENDOFQUIETLIST              = "729"
 	RPL_MONONLINE                   = "730"
 	RPL_MONOFFLINE                  = "731"
 	RPL_MONLIST                     = "732"
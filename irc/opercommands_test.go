@@ -0,0 +1,60 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+)
+
+func TestOperUserCommands(t *testing.T) {
+	server, shutdown := newTestServer(t, func(config *Config) {
+		config.Accounts.VHosts.MaxLength = 64
+		addTestOper(t, config, "admin", "chghost", "chgident", "chgname", "sajoin", "sapart", "saquit")
+	})
+	defer shutdown()
+
+	alice := newTestClient(t, server, "alice")
+	bob := newTestClient(t, server, "bob", "chghost")
+	alice.send("JOIN #test")
+	alice.expect(t, "JOIN #test")
+	bob.send("JOIN #test")
+	bob.expect(t, " 366 bob #test ")
+
+	alice.send("CHGHOST bob bob.example")
+	alice.expect(t, " 481 alice ")
+
+	admin := newOperTestClient(t, server, "admin")
+	admin.send("CHGHOST alice bad!host")
+	admin.expect(t, "Invalid vhost")
+	admin.send("CHGHOST alice alice.example")
+	bob.expect(t, ":alice!~u@pipe CHGHOST ~u alice.example")
+	admin.send("CHGIDENT alice newident")
+	bob.expect(t, ":alice!~u@alice.example CHGHOST newident alice.example")
+	admin.send("CHGNAME alice :New Name")
+	admin.send("CHGNAME nobody :New Name")
+	admin.expect(t, " 401 admin nobody ")
+	bob.send("WHOIS alice")
+	bob.expect(t, " 311 bob alice newident alice.example * :New Name")
+
+	// SAJOIN ignores the channel's restrictions
+	bob.send("JOIN #locked")
+	bob.expect(t, " 366 bob #locked ")
+	bob.send("MODE #locked +i")
+	bob.expect(t, "MODE #locked +i")
+	admin.send("SAJOIN alice #locked,nochannel")
+	admin.expect(t, " 403 admin nochannel ")
+	alice.expect(t, ":alice!newident@alice.example JOIN #locked")
+	bob.expect(t, ":alice!newident@alice.example JOIN #locked")
+
+	admin.send("SAPART alice #locked,#test :go away")
+	alice.expect(t, "PART #locked :go away")
+	alice.expect(t, "PART #test :go away")
+	admin.send("SAPART alice #test")
+	admin.expect(t, " 441 admin alice #test ")
+
+	admin.send("SAQUIT bob :goodbye")
+	bob.expect(t, "goodbye")
+	admin.send("SAQUIT bob :goodbye")
+	admin.expect(t, " 401 admin bob ")
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package passwd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// DefaultScramIterations is the PBKDF2 iteration count used for new SCRAM credentials.
+	DefaultScramIterations = 4096
+	// scramSaltLen is how many bytes long newly-generated SCRAM salts are.
+	scramSaltLen = 16
+	// scramNonceLen is how many random bytes make up the server's part of the nonce.
+	scramNonceLen = 18
+)
+
+var (
+	// ErrScramInvalidMessage means that the client sent a malformed SCRAM message.
+	ErrScramInvalidMessage = errors.New("invalid SCRAM message")
+	// ErrScramChannelBinding means that the client requested channel binding, which we don't support.
+	ErrScramChannelBinding = errors.New("SCRAM channel binding is not supported")
+	// ErrScramInvalidProof means that the client's proof didn't match the stored credentials.
+	ErrScramInvalidProof = errors.New("invalid SCRAM proof")
+)
+
+// ScramCredentials are the salted keys needed to verify a SCRAM-SHA-256 exchange,
+// as described in RFC 5802. They can't be used to recover the password.
+type ScramCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramCredentials derives SCRAM-SHA-256 credentials from a password, with a new salt.
+// Note that the password is used as-is, without SASLprep normalization.
+func NewScramCredentials(password string, iterations int) (creds ScramCredentials, err error) {
+	salt := make([]byte, scramSaltLen)
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+	return newScramCredentials(password, salt, iterations), nil
+}
+
+func newScramCredentials(password string, salt []byte, iterations int) ScramCredentials {
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return ScramCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(saltedPassword, "Server Key"),
+	}
+}
+
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// ScramConversation is the server side of a single SCRAM-SHA-256 exchange.
+type ScramConversation struct {
+	// lookup returns the credentials for the given username
+	lookup func(username string) (ScramCredentials, error)
+	// nonce returns the server's part of the nonce; replaced in tests
+	nonce func() string
+
+	step            int
+	username        string
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	fullNonce       string
+	creds           ScramCredentials
+}
+
+// NewScramConversation returns a new conversation, using `lookup` to find the
+// SCRAM credentials of the account the client is authenticating as.
+func NewScramConversation(lookup func(username string) (ScramCredentials, error)) *ScramConversation {
+	return &ScramConversation{
+		lookup: lookup,
+		nonce:  newScramNonce,
+	}
+}
+
+func newScramNonce() string {
+	buf := make([]byte, scramNonceLen)
+	rand.Read(buf)
+	return base64.RawStdEncoding.EncodeToString(buf)
+}
+
+// Username returns the username the client is authenticating as, once it's known.
+func (sc *ScramConversation) Username() string {
+	return sc.username
+}
+
+// Step processes a message from the client, returning the response to send back.
+// Once the client's proof has been verified, the final server message is returned,
+// and the client acknowledges it with an empty message; `done` is then true.
+// Any error ends the conversation.
+func (sc *ScramConversation) Step(message []byte) (response []byte, done bool, err error) {
+	switch sc.step {
+	case 0:
+		response, err = sc.processClientFirst(string(message))
+	case 1:
+		response, err = sc.processClientFinal(string(message))
+	case 2:
+		if len(message) != 0 {
+			err = ErrScramInvalidMessage
+		}
+		done = err == nil
+	default:
+		err = ErrScramInvalidMessage
+	}
+	sc.step++
+	return
+}
+
+func (sc *ScramConversation) processClientFirst(message string) (response []byte, err error) {
+	// gs2-header is: channel binding flag, optional authzid, then client-first-message-bare
+	pieces := strings.SplitN(message, ",", 3)
+	if len(pieces) != 3 {
+		return nil, ErrScramInvalidMessage
+	}
+	switch {
+	case pieces[0] == "n" || pieces[0] == "y":
+	case strings.HasPrefix(pieces[0], "p="):
+		return nil, ErrScramChannelBinding
+	default:
+		return nil, ErrScramInvalidMessage
+	}
+
+	var authzid string
+	if pieces[1] != "" {
+		if !strings.HasPrefix(pieces[1], "a=") {
+			return nil, ErrScramInvalidMessage
+		}
+		if authzid, err = scramUnescape(pieces[1][2:]); err != nil {
+			return nil, err
+		}
+	}
+
+	sc.gs2Header = pieces[0] + "," + pieces[1] + ","
+	sc.clientFirstBare = pieces[2]
+
+	attrs := strings.Split(sc.clientFirstBare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") || len(attrs[1]) == 2 {
+		return nil, ErrScramInvalidMessage
+	}
+	if sc.username, err = scramUnescape(attrs[0][2:]); err != nil {
+		return nil, err
+	}
+	if sc.username == "" || (authzid != "" && authzid != sc.username) {
+		return nil, ErrScramInvalidMessage
+	}
+
+	sc.creds, err = sc.lookup(sc.username)
+	if err != nil {
+		return nil, err
+	}
+
+	sc.fullNonce = attrs[1][2:] + sc.nonce()
+	sc.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", sc.fullNonce, base64.StdEncoding.EncodeToString(sc.creds.Salt), sc.creds.Iterations)
+	return []byte(sc.serverFirst), nil
+}
+
+func (sc *ScramConversation) processClientFinal(message string) (response []byte, err error) {
+	proofIndex := strings.LastIndex(message, ",p=")
+	if proofIndex == -1 {
+		return nil, ErrScramInvalidMessage
+	}
+	clientFinalWithoutProof := message[:proofIndex]
+	proof, err := base64.StdEncoding.DecodeString(message[proofIndex+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, ErrScramInvalidMessage
+	}
+
+	attrs := strings.Split(clientFinalWithoutProof, ",")
+	if len(attrs) < 2 || attrs[0] != "c="+base64.StdEncoding.EncodeToString([]byte(sc.gs2Header)) || attrs[1] != "r="+sc.fullNonce {
+		return nil, ErrScramInvalidMessage
+	}
+
+	authMessage := sc.clientFirstBare + "," + sc.serverFirst + "," + clientFinalWithoutProof
+	clientSignature := scramHMAC(sc.creds.StoredKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], sc.creds.StoredKey) != 1 {
+		return nil, ErrScramInvalidProof
+	}
+
+	serverSignature := scramHMAC(sc.creds.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// scramUnescape decodes a SCRAM saslname, where ',' and '=' are sent as "=2C" and "=3D".
+func scramUnescape(name string) (string, error) {
+	if !strings.Contains(name, "=") {
+		return name, nil
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			buf.WriteByte(name[i])
+			continue
+		}
+		if len(name) < i+3 {
+			return "", ErrScramInvalidMessage
+		}
+		switch name[i+1 : i+3] {
+		case "2C":
+			buf.WriteByte(',')
+		case "3D":
+			buf.WriteByte('=')
+		default:
+			return "", ErrScramInvalidMessage
+		}
+		i += 2
+	}
+	return buf.String(), nil
+}
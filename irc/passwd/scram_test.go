@@ -0,0 +1,114 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package passwd
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+// example exchange from RFC 7677, section 3
+const (
+	rfc7677Salt        = "W22ZaJ0SNY7soEsUEjb6gQ=="
+	rfc7677ClientFirst = "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"
+	rfc7677ServerNonce = "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	rfc7677ServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	rfc7677ClientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfc7677ServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+func rfc7677Conversation(t *testing.T, password string) *ScramConversation {
+	salt, err := base64.StdEncoding.DecodeString(rfc7677Salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := newScramCredentials(password, salt, 4096)
+
+	sc := NewScramConversation(func(username string) (ScramCredentials, error) {
+		if username != "user" {
+			return ScramCredentials{}, errors.New("no such user")
+		}
+		return creds, nil
+	})
+	sc.nonce = func() string { return rfc7677ServerNonce }
+	return sc
+}
+
+func TestScramExchange(t *testing.T) {
+	sc := rfc7677Conversation(t, "pencil")
+
+	response, done, err := sc.Step([]byte(rfc7677ClientFirst))
+	if err != nil || done {
+		t.Fatalf("unexpected result from client-first: %v %v", done, err)
+	}
+	if string(response) != rfc7677ServerFirst {
+		t.Errorf("incorrect server-first: %s", response)
+	}
+	if sc.Username() != "user" {
+		t.Errorf("incorrect username: %s", sc.Username())
+	}
+
+	response, done, err = sc.Step([]byte(rfc7677ClientFinal))
+	if err != nil || done {
+		t.Fatalf("unexpected result from client-final: %v %v", done, err)
+	}
+	if string(response) != rfc7677ServerFinal {
+		t.Errorf("incorrect server-final: %s", response)
+	}
+
+	response, done, err = sc.Step(nil)
+	if err != nil || !done || len(response) != 0 {
+		t.Fatalf("unexpected result from acknowledgement: %v %v", done, err)
+	}
+
+	_, _, err = sc.Step([]byte(rfc7677ClientFinal))
+	if err == nil {
+		t.Error("conversation should be over")
+	}
+}
+
+func TestScramWrongPassword(t *testing.T) {
+	sc := rfc7677Conversation(t, "pen")
+
+	if _, _, err := sc.Step([]byte(rfc7677ClientFirst)); err != nil {
+		t.Fatal(err)
+	}
+	if _, done, err := sc.Step([]byte(rfc7677ClientFinal)); err != ErrScramInvalidProof || done {
+		t.Errorf("expected an invalid proof, got %v %v", done, err)
+	}
+}
+
+func TestScramInvalidMessages(t *testing.T) {
+	invalid := map[string]error{
+		"n,,r=rOprNGfwEbeRWgbNEkqO":                   ErrScramInvalidMessage,
+		"p=tls-unique,,n=user,r=rOprNGfwEbeRWgbNEkqO": ErrScramChannelBinding,
+		"n,a=other,n=user,r=rOprNGfwEbeRWgbNEkqO":     ErrScramInvalidMessage,
+		"n,,n=us=2Xer,r=rOprNGfwEbeRWgbNEkqO":         ErrScramInvalidMessage,
+		"garbage":                                     ErrScramInvalidMessage,
+	}
+	for message, expected := range invalid {
+		sc := rfc7677Conversation(t, "pencil")
+		if _, _, err := sc.Step([]byte(message)); err != expected {
+			t.Errorf("expected %v for %s, got %v", expected, message, err)
+		}
+	}
+
+	// the client-final message must repeat the nonce
+	sc := rfc7677Conversation(t, "pencil")
+	sc.Step([]byte(rfc7677ClientFirst))
+	if _, _, err := sc.Step([]byte("c=biws,r=rOprNGfwEbeRWgbNEkqO,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=")); err != ErrScramInvalidMessage {
+		t.Errorf("expected a nonce mismatch, got %v", err)
+	}
+}
+
+func TestScramUnescape(t *testing.T) {
+	name, err := scramUnescape("a=2Cb=3Dc")
+	if err != nil || name != "a,b=c" {
+		t.Errorf("incorrect unescaping: %s %v", name, err)
+	}
+	if _, err := scramUnescape("abc="); err == nil {
+		t.Error("truncated escape should fail")
+	}
+}
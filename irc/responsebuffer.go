@@ -42,12 +42,23 @@ func (rb *ResponseBuffer) Add(tags *map[string]ircmsg.TagValue, prefix string, c
 
 // AddFromClient adds a new message from a specific client to our queue.
 func (rb *ResponseBuffer) AddFromClient(msgid string, from *Client, tags *map[string]ircmsg.TagValue, command string, params ...string) {
+	var account string
+	if from.LoggedIntoAccount() {
+		account = from.AccountName()
+	}
+	rb.AddFromNickmask(time.Time{}, msgid, from.NickMaskString(), account, tags, command, params...)
+}
+
+// AddFromNickmask adds a new message from the given nickmask (e.g., one that was
+// recorded in a history buffer) to our queue. If `serverTime` is zero, the time
+// the message is sent is used for the server-time tag.
+func (rb *ResponseBuffer) AddFromNickmask(serverTime time.Time, msgid string, fromNickmask string, fromAccount string, tags *map[string]ircmsg.TagValue, command string, params ...string) {
 	// attach account-tag
-	if rb.target.capabilities.Has(caps.AccountTag) && from.LoggedIntoAccount() {
+	if rb.target.capabilities.Has(caps.AccountTag) && fromAccount != "" {
 		if tags == nil {
-			tags = ircmsg.MakeTags("account", from.AccountName())
+			tags = ircmsg.MakeTags("account", fromAccount)
 		} else {
-			(*tags)["account"] = ircmsg.MakeTagValue(from.AccountName())
+			(*tags)["account"] = ircmsg.MakeTagValue(fromAccount)
 		}
 	}
 	// attach message-id
@@ -58,8 +69,16 @@ func (rb *ResponseBuffer) AddFromClient(msgid string, from *Client, tags *map[st
 			(*tags)["draft/msgid"] = ircmsg.MakeTagValue(msgid)
 		}
 	}
+	// attach original server-time
+	if !serverTime.IsZero() && rb.target.capabilities.Has(caps.ServerTime) {
+		if tags == nil {
+			tags = ircmsg.MakeTags("time", serverTime.UTC().Format(IRCv3TimestampFormat))
+		} else {
+			(*tags)["time"] = ircmsg.MakeTagValue(serverTime.UTC().Format(IRCv3TimestampFormat))
+		}
+	}
 
-	rb.Add(tags, from.nickMaskString, command, params...)
+	rb.Add(tags, fromNickmask, command, params...)
 }
 
 // AddSplitMessageFromClient adds a new split message from a specific client to our queue.
@@ -96,29 +115,48 @@ func (rb *ResponseBuffer) Send() error {
 
 	// start batch if required
 	if batch != nil {
-		batch.Start(rb.target, ircmsg.MakeTags(caps.LabelTagName, rb.Label))
+		rb.target.sendToConnection(ircmsg.MakeTags(caps.LabelTagName, rb.Label), rb.target.server.name, "BATCH", "+"+batch.ID, batch.Type)
+	}
+
+	// replies to a session were generated for the client it's attached to, and the
+	// client's other connections are told about the things they did themselves
+	primary := rb.target.Primary()
+	if primary == nil {
+		primary = rb.target
 	}
+	ownNickMask := primary.NickMaskString()
 
 	// send each message out
 	for _, message := range rb.messages {
-		// attach server-time if needed
-		if rb.target.capabilities.Has(caps.ServerTime) {
-			t := time.Now().UTC().Format("2006-01-02T15:04:05.999Z")
+		// attach server-time if needed, unless the message is being replayed
+		// and already has its original time attached
+		if _, exists := message.Tags["time"]; !exists && rb.target.capabilities.Has(caps.ServerTime) {
+			t := time.Now().UTC().Format(IRCv3TimestampFormat)
 			message.Tags["time"] = ircmsg.MakeTagValue(t)
 		}
 
-		// attach batch ID
-		if batch != nil {
+		if _, inBatch := message.Tags["batch"]; !inBatch && message.Prefix == ownNickMask && sessionStateCommands[message.Command] {
+			primary.sendToConnections(message, rb.target)
+		}
+
+		// attach batch ID, unless the message is already part of a nested batch
+		if _, exists := message.Tags["batch"]; !exists && batch != nil {
 			message.Tags["batch"] = ircmsg.MakeTagValue(batch.ID)
 		}
 
 		// send message out
-		rb.target.SendRawMessage(message)
+		if rb.target != primary {
+			var ok bool
+			if message, ok = rb.target.adaptMessage(message); !ok {
+				continue
+			}
+		}
+		rb.target.writeMessage(message)
 	}
 
 	// end batch if required
 	if batch != nil {
-		batch.End(rb.target)
+		rb.target.sendToConnection(nil, rb.target.server.name, "BATCH", "-"+batch.ID)
 	}
 
 	// clear out any existing messages
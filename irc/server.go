@@ -27,6 +27,7 @@ import (
 	"github.com/goshuirc/irc-go/ircmsg"
 	"github.com/oragono/oragono/irc/caps"
 	"github.com/oragono/oragono/irc/connection_limits"
+	"github.com/oragono/oragono/irc/dnsbl"
 	"github.com/oragono/oragono/irc/isupport"
 	"github.com/oragono/oragono/irc/languages"
 	"github.com/oragono/oragono/irc/logger"
@@ -51,7 +52,7 @@ var (
 
 	// SupportedCapabilities are the caps we advertise.
 	// MaxLine, SASL and STS are set during server startup.
-	SupportedCapabilities = caps.NewSet(caps.AccountTag, caps.AccountNotify, caps.AwayNotify, caps.Batch, caps.CapNotify, caps.ChgHost, caps.EchoMessage, caps.ExtendedJoin, caps.InviteNotify, caps.LabeledResponse, caps.Languages, caps.MessageTags, caps.MultiPrefix, caps.Rename, caps.Resume, caps.ServerTime, caps.UserhostInNames)
+	SupportedCapabilities = caps.NewSet(caps.AccountTag, caps.AccountNotify, caps.AwayNotify, caps.Batch, caps.CapNotify, caps.ChgHost, caps.EchoMessage, caps.ExtendedJoin, caps.InviteNotify, caps.LabeledResponse, caps.Languages, caps.MessageTags, caps.MultiPrefix, caps.Rename, caps.Resume, caps.ServerTime, caps.SetName, caps.UserhostInNames)
 
 	// CapValues are the actual values we advertise to v3.2 clients.
 	// actual values are set during server startup.
@@ -60,14 +61,18 @@ var (
 
 // Limits holds the maximum limits for various things such as topic lengths.
 type Limits struct {
-	AwayLen        int
-	ChannelLen     int
-	KickLen        int
-	MonitorEntries int
-	NickLen        int
-	TopicLen       int
-	ChanListModes  int
-	LineLen        LineLenLimits
+	AwayLen           int
+	BroadcastCooldown time.Duration
+	ChannelLen        int
+	KickLen           int
+	MonitorEntries    int
+	NickLen           int
+	RealnameLen       int
+	SilenceEntries    int
+	AcceptEntries     int
+	TopicLen          int
+	ChanListModes     int
+	LineLen           LineLenLimits
 }
 
 // LineLenLimits holds the maximum limits for IRC lines.
@@ -88,6 +93,7 @@ type ListenerWrapper struct {
 // Server is the main Oragono server.
 type Server struct {
 	accounts                   *AccountManager
+	apiServer                  *http.Server
 	batches                    *BatchManager
 	channelRegistrationEnabled bool
 	channels                   *ChannelManager
@@ -99,6 +105,7 @@ type Server struct {
 	configurableStateMutex     sync.RWMutex // tier 1; generic protection for server state modified by rehash()
 	connectionLimiter          *connection_limits.Limiter
 	connectionThrottler        *connection_limits.Throttler
+	dnsbl                      *dnsbl.Checker
 	ctime                      time.Time
 	defaultChannelModes        modes.Modes
 	dlines                     *DLineManager
@@ -107,9 +114,12 @@ type Server struct {
 	klines                     *KLineManager
 	languages                  *languages.Manager
 	limits                     Limits
+	links                      *LinkManager
 	listeners                  map[string]*ListenerWrapper
 	logger                     *logger.Manager
 	maxSendQBytes              uint32
+	metrics                    *Metrics
+	metricsServer              *http.Server
 	monitorManager             *MonitorManager
 	motdLines                  []string
 	name                       string
@@ -131,6 +141,7 @@ type Server struct {
 	stsEnabled                 bool
 	webirc                     []webircConfig
 	whoWas                     *WhoWasList
+	wsListeners                map[string]*wsListener
 }
 
 var (
@@ -156,16 +167,21 @@ func NewServer(config *Config, logger *logger.Manager) (*Server, error) {
 		clients:             NewClientManager(),
 		connectionLimiter:   connection_limits.NewLimiter(),
 		connectionThrottler: connection_limits.NewThrottler(),
+		dnsbl:               dnsbl.NewChecker(),
 		languages:           languages.NewManager(config.Languages.Default, config.Languages.Data),
 		listeners:           make(map[string]*ListenerWrapper),
 		logger:              logger,
+		metrics:             NewMetrics(),
 		monitorManager:      NewMonitorManager(),
 		rehashSignal:        make(chan os.Signal, 1),
 		signals:             make(chan os.Signal, len(ServerExitSignals)),
 		snomasks:            NewSnoManager(),
 		whoWas:              NewWhoWasList(config.Limits.WhowasEntries),
+		wsListeners:         make(map[string]*wsListener),
 	}
 
+	server.links = NewLinkManager(server)
+
 	if err := server.applyConfig(config, true); err != nil {
 		return nil, err
 	}
@@ -191,6 +207,14 @@ func NewServer(config *Config, logger *logger.Manager) (*Server, error) {
 		}
 	}
 
+	// confirm help entries for HostServ exist.
+	// this forces people to write help entries for every single HS command.
+	for commandName, commandInfo := range hostservCommands {
+		if commandInfo.help == "" || commandInfo.helpShort == "" {
+			return nil, fmt.Errorf("Help entry does not exist for HostServ command %s", commandName)
+		}
+	}
+
 	// Attempt to clean up when receiving these signals.
 	signal.Notify(server.signals, ServerExitSignals...)
 	signal.Notify(server.rehashSignal, syscall.SIGHUP)
@@ -206,16 +230,20 @@ func (server *Server) setISupport() {
 
 	// add RPL_ISUPPORT tokens
 	isupport := isupport.NewList()
+	isupport.Add("ACCEPT", strconv.Itoa(server.limits.AcceptEntries))
 	isupport.Add("AWAYLEN", strconv.Itoa(server.limits.AwayLen))
+	isupport.Add("CALLERID", modes.CallerID.String())
 	isupport.Add("CASEMAPPING", "ascii")
-	isupport.Add("CHANMODES", strings.Join([]string{modes.Modes{modes.BanMask, modes.ExceptMask, modes.InviteMask}.String(), "", modes.Modes{modes.UserLimit, modes.Key}.String(), modes.Modes{modes.InviteOnly, modes.Moderated, modes.NoOutside, modes.OpOnlyTopic, modes.ChanRoleplaying, modes.Secret}.String()}, ","))
+	isupport.Add("CHANMODES", strings.Join([]string{modes.Modes{modes.BanMask, modes.ExceptMask, modes.InviteMask, modes.QuietMask}.String(), "", modes.Modes{modes.UserLimit, modes.Key, modes.FloodLimit}.String(), modes.Modes{modes.InviteOnly, modes.Moderated, modes.NoKnock, modes.NoOutside, modes.OpOnlyTopic, modes.ChanRoleplaying, modes.Secret}.String()}, ","))
 	isupport.Add("CHANNELLEN", strconv.Itoa(server.limits.ChannelLen))
 	isupport.Add("CHANTYPES", "#")
 	isupport.Add("ELIST", "U")
 	isupport.Add("EXCEPTS", "")
+	isupport.Add("EXTBAN", fmt.Sprintf("%s,%s", extbanPrefix, extbanTypes))
 	isupport.Add("INVEX", "")
 	isupport.Add("KICKLEN", strconv.Itoa(server.limits.KickLen))
-	isupport.Add("MAXLIST", fmt.Sprintf("beI:%s", strconv.Itoa(server.limits.ChanListModes)))
+	isupport.Add("KNOCK", "")
+	isupport.Add("MAXLIST", fmt.Sprintf("beIQ:%s", strconv.Itoa(server.limits.ChanListModes)))
 	isupport.Add("MAXTARGETS", maxTargetsString)
 	isupport.Add("MODES", "")
 	isupport.Add("MONITOR", strconv.Itoa(server.limits.MonitorEntries))
@@ -224,11 +252,19 @@ func (server *Server) setISupport() {
 	isupport.Add("PREFIX", "(qaohv)~&@%+")
 	isupport.Add("RPCHAN", "E")
 	isupport.Add("RPUSER", "E")
+	isupport.Add("SILENCE", strconv.Itoa(server.limits.SilenceEntries))
 	isupport.Add("STATUSMSG", "~&@%+")
 	isupport.Add("TARGMAX", fmt.Sprintf("NAMES:1,LIST:1,KICK:1,WHOIS:1,USERHOST:10,PRIVMSG:%s,TAGMSG:%s,NOTICE:%s,MONITOR:", maxTargetsString, maxTargetsString, maxTargetsString))
 	isupport.Add("TOPICLEN", strconv.Itoa(server.limits.TopicLen))
 	isupport.Add("UTF8MAPPING", casemappingName)
 
+	// channel and direct message history
+	if server.config.Channels.History.Enabled {
+		isupport.Add("CHATHISTORY", strconv.Itoa(server.config.Channels.History.ChathistoryMaxMessages))
+	} else if server.config.Accounts.DirectMessageHistory.Enabled {
+		isupport.Add("CHATHISTORY", strconv.Itoa(server.config.directMessageHistoryLimit()))
+	}
+
 	// account registration
 	if server.config.Accounts.Registration.Enabled {
 		// 'none' isn't shown in the REGCALLBACKS vars
@@ -265,6 +301,8 @@ func (server *Server) Shutdown() {
 	//TODO(dan): Make sure we disallow new nicks
 	for _, client := range server.clients.AllClients() {
 		client.Notice("Server is shutting down")
+		// so that it can be restored when the server comes back
+		client.storeAlwaysOnState()
 	}
 
 	if err := server.store.Close(); err != nil {
@@ -298,8 +336,11 @@ func (server *Server) Run() {
 func (server *Server) acceptClient(conn clientConn) {
 	// check IP address
 	ipaddr := utils.AddrToIP(conn.Conn.RemoteAddr())
+	var listing dnsbl.Result
 	if ipaddr != nil {
-		isBanned, banMsg := server.checkBans(ipaddr)
+		var isBanned bool
+		var banMsg string
+		isBanned, banMsg, listing = server.checkBans(ipaddr)
 		if isBanned {
 			// this might not show up properly on some clients, but our objective here is just to close the connection out before it has a load impact on us
 			conn.Conn.Write([]byte(fmt.Sprintf(errorMsg, banMsg)))
@@ -311,15 +352,19 @@ func (server *Server) acceptClient(conn clientConn) {
 	server.logger.Debug("localconnect-ip", fmt.Sprintf("Client connecting from %v", ipaddr))
 	// prolly don't need to alert snomasks on this, only on connection reg
 
-	NewClient(server, conn.Conn, conn.IsTLS)
+	NewClient(server, conn.Conn, conn.IsTLS, listing)
 }
 
-func (server *Server) checkBans(ipaddr net.IP) (banned bool, message string) {
+// checkBans checks whether the given IP can connect. IPs listed in a DNSBL
+// that can still connect are returned with the listing, to be applied to the
+// client.
+func (server *Server) checkBans(ipaddr net.IP) (banned bool, message string, listing dnsbl.Result) {
 	// check DLINEs
 	isBanned, info := server.dlines.CheckIP(ipaddr)
 	if isBanned {
 		server.logger.Info("localconnect-ip", fmt.Sprintf("Client from %v rejected by d-line", ipaddr))
-		return true, info.BanMessage("You are banned from this server (%s)")
+		server.metrics.DlineHit()
+		return true, info.BanMessage("You are banned from this server (%s)"), listing
 	}
 
 	// check connection limits
@@ -327,7 +372,8 @@ func (server *Server) checkBans(ipaddr net.IP) (banned bool, message string) {
 	if err != nil {
 		// too many connections from one client, tell the client and close the connection
 		server.logger.Info("localconnect-ip", fmt.Sprintf("Client from %v rejected for connection limit", ipaddr))
-		return true, "Too many clients from your network"
+		server.metrics.LimiterRejected()
+		return true, "Too many clients from your network", listing
 	}
 
 	// check connection throttle
@@ -344,15 +390,44 @@ func (server *Server) checkBans(ipaddr net.IP) (banned bool, message string) {
 		// they're DLINE'd for 15 minutes or whatever, so we can reset the connection throttle now,
 		// and once their temporary DLINE is finished they can fill up the throttler again
 		server.connectionThrottler.ResetFor(ipaddr)
+		server.metrics.ThrottlerRejected()
 
 		// this might not show up properly on some clients, but our objective here is just to close it out before it has a load impact on us
 		server.logger.Info(
 			"localconnect-ip",
 			fmt.Sprintf("Client from %v exceeded connection throttle, d-lining for %v", ipaddr, duration))
-		return true, server.connectionThrottler.BanMessage()
+		return true, server.connectionThrottler.BanMessage(), listing
+	}
+
+	// check DNSBLs
+	listing = server.checkDNSBL(ipaddr)
+	if listing.Action == dnsbl.ActionReject {
+		// the connection was counted by the limiter above, but it isn't going anywhere
+		server.connectionLimiter.RemoveClient(ipaddr)
+		server.metrics.DNSBLRejected()
+		message = "Your IP is listed in a DNS blocklist"
+		if listing.Reason != "" {
+			message = fmt.Sprintf("%s (%s)", message, listing.Reason)
+		}
+		return true, message, listing
 	}
 
-	return false, ""
+	return false, "", listing
+}
+
+// checkDNSBL looks the given IP up in the DNSBLs, telling opers about any listing.
+func (server *Server) checkDNSBL(ipaddr net.IP) (listing dnsbl.Result) {
+	listing, err := server.dnsbl.Check(ipaddr)
+	if err != nil {
+		server.logger.Warning("localconnect-ip", fmt.Sprintf("Could not check %v against DNSBLs: %v", ipaddr, err))
+	}
+	if listing.Action == dnsbl.ActionNone {
+		return
+	}
+
+	server.logger.Info("localconnect-ip", fmt.Sprintf("Client from %v is listed in DNSBL %s (%s), action: %s", ipaddr, listing.List, listing.Reply, listing.Action))
+	server.snomasks.Send(sno.LocalDNSBL, fmt.Sprintf(ircfmt.Unescape("Client from $c[grey][$r%v$c[grey]] is listed in DNSBL $c[grey][$r%s$c[grey]] [reply:$r%s$c[grey]] [action:$r%s$c[grey]]"), ipaddr, listing.List, listing.Reply, listing.Action))
+	return
 }
 
 //
@@ -452,17 +527,36 @@ func (server *Server) tryRegister(c *Client) {
 		return
 	}
 
-	rb := NewResponseBuffer(c)
-	nickAssigned := performNickChange(server, c, c, preregNick, rb)
-	rb.Send()
-	if !nickAssigned {
-		c.SetPreregNick("")
+	// clients listed in some DNSBLs must log in with SASL
+	if c.dnsblListing.Action == dnsbl.ActionRequireSASL && !c.LoggedIntoAccount() {
+		message := c.t("Your IP is listed in a DNS blocklist, so you must log in with SASL to connect")
+		if c.dnsblListing.Reason != "" {
+			message = fmt.Sprintf("%s (%s)", message, c.dnsblListing.Reason)
+		}
+		c.Quit(message)
+		c.destroy(false)
 		return
 	}
 
+	// a client with the same account may already be using the nick, in which
+	// case we become another one of their sessions
+	primary := server.sessionTarget(c, preregNick)
+	if primary != nil {
+		c.updateNickMask(primary.Nick())
+	} else {
+		rb := NewResponseBuffer(c)
+		nickAssigned := performNickChange(server, c, c, preregNick, rb)
+		rb.Send()
+		if !nickAssigned {
+			c.SetPreregNick("")
+			return
+		}
+	}
+
 	// check KLINEs
 	isBanned, info := server.klines.CheckMasks(c.AllNickmasks()...)
 	if isBanned {
+		server.metrics.KlineHit()
 		reason := info.Reason
 		if info.Time != nil {
 			reason += fmt.Sprintf(" [%s]", info.Time.Duration.String())
@@ -472,35 +566,28 @@ func (server *Server) tryRegister(c *Client) {
 		return
 	}
 
+	if primary != nil {
+		server.attachSession(primary, c)
+		return
+	}
+
 	// continue registration
-	server.logger.Debug("localconnect", fmt.Sprintf("Client registered [%s] [u:%s] [r:%s]", c.nick, c.username, c.realname))
-	server.snomasks.Send(sno.LocalConnects, fmt.Sprintf(ircfmt.Unescape("Client registered $c[grey][$r%s$c[grey]] [u:$r%s$c[grey]] [h:$r%s$c[grey]] [r:$r%s$c[grey]]"), c.nick, c.username, c.rawHostname, c.realname))
+	realname := c.Realname()
+	server.logger.Debug("localconnect", fmt.Sprintf("Client registered [%s] [u:%s] [r:%s]", c.nick, c.username, realname))
+	server.snomasks.Send(sno.LocalConnects, fmt.Sprintf(ircfmt.Unescape("Client registered $c[grey][$r%s$c[grey]] [u:$r%s$c[grey]] [h:$r%s$c[grey]] [r:$r%s$c[grey]]"), c.nick, c.username, c.rawHostname, realname))
 	c.Register()
+	server.links.Introduce(c)
 
-	// send welcome text
-	//NOTE(dan): we specifically use the NICK here instead of the nickmask
-	// see http://modern.ircdocs.horse/#rplwelcome-001 for details on why we avoid using the nickmask
-	c.Send(nil, server.name, RPL_WELCOME, c.nick, fmt.Sprintf(c.t("Welcome to the Internet Relay Network %s"), c.nick))
-	c.Send(nil, server.name, RPL_YOURHOST, c.nick, fmt.Sprintf(c.t("Your host is %[1]s, running version %[2]s"), server.name, Ver))
-	c.Send(nil, server.name, RPL_CREATED, c.nick, fmt.Sprintf(c.t("This server was created %s"), server.ctime.Format(time.RFC1123)))
-	//TODO(dan): Look at adding last optional [<channel modes with a parameter>] parameter
-	c.Send(nil, server.name, RPL_MYINFO, c.nick, server.name, Ver, supportedUserModesString, supportedChannelModesString)
-
-	rb = NewResponseBuffer(c)
-	c.RplISupport(rb)
-	server.MOTD(c, rb)
-	rb.Send()
+	server.sendWelcome(c)
 
 	modestring := c.ModeString()
 	if modestring != "+" {
 		c.Send(nil, c.nickMaskString, RPL_UMODEIS, c.nick, c.ModeString())
 	}
-	if server.logger.IsLoggingRawIO() {
-		c.Notice(c.t("This server is in debug mode and is logging all user I/O. If you do not wish for everything you send to be readable by the server owner(s), please disconnect."))
-	}
 
 	// if resumed, send fake channel joins
 	if c.resumeDetails != nil {
+		rb := NewResponseBuffer(c)
 		for _, name := range c.resumeDetails.SendFakeJoinsFor {
 			channel := server.channels.Get(name)
 			if channel == nil {
@@ -508,11 +595,10 @@ func (server *Server) tryRegister(c *Client) {
 			}
 
 			if c.capabilities.Has(caps.ExtendedJoin) {
-				c.Send(nil, c.nickMaskString, "JOIN", channel.name, c.AccountName(), c.realname)
+				c.Send(nil, c.nickMaskString, "JOIN", channel.name, c.AccountName(), c.Realname())
 			} else {
 				c.Send(nil, c.nickMaskString, "JOIN", channel.name)
 			}
-			// reuse the last rb
 			channel.SendTopic(c, rb)
 			channel.Names(c, rb)
 			rb.Send()
@@ -521,17 +607,28 @@ func (server *Server) tryRegister(c *Client) {
 			c.stateMutex.RLock()
 			myModes := channel.members[c]
 			c.stateMutex.RUnlock()
-			if myModes == nil {
-				continue
-			}
-			oldModes := myModes.String()
-			if 0 < len(oldModes) {
-				params := []string{channel.name, "+" + oldModes}
-				for range oldModes {
-					params = append(params, c.nick)
+			if myModes != nil {
+				oldModes := myModes.String()
+				if 0 < len(oldModes) {
+					params := []string{channel.name, "+" + oldModes}
+					for range oldModes {
+						params = append(params, c.nick)
+					}
+
+					c.Send(nil, server.name, "MODE", params...)
 				}
+			}
 
-				c.Send(nil, server.name, "MODE", params...)
+			// replay what the client missed since the timestamp it gave us
+			if c.resumeDetails.Timestamp != nil {
+				items, complete := channel.history.Between(*c.resumeDetails.Timestamp, time.Time{}, false, server.ChannelHistoryConfig().ChathistoryMaxMessages)
+				if 0 < len(items) {
+					channel.replayHistoryItems(rb, items)
+				}
+				if !complete && channel.history.Enabled() {
+					rb.Add(nil, server.name, "NOTICE", c.nick, fmt.Sprintf(c.t("Some messages sent to %s while you were disconnected could not be replayed"), channel.name))
+				}
+				rb.Send()
 			}
 		}
 	}
@@ -546,6 +643,26 @@ func (client *Client) t(originalString string) string {
 	return client.server.languages.Translate(client.languages, originalString)
 }
 
+// sendWelcome sends the welcome numerics, ISUPPORT and MOTD to a newly-registered connection.
+func (server *Server) sendWelcome(c *Client) {
+	//NOTE(dan): we specifically use the NICK here instead of the nickmask
+	// see http://modern.ircdocs.horse/#rplwelcome-001 for details on why we avoid using the nickmask
+	c.Send(nil, server.name, RPL_WELCOME, c.nick, fmt.Sprintf(c.t("Welcome to the Internet Relay Network %s"), c.nick))
+	c.Send(nil, server.name, RPL_YOURHOST, c.nick, fmt.Sprintf(c.t("Your host is %[1]s, running version %[2]s"), server.name, Ver))
+	c.Send(nil, server.name, RPL_CREATED, c.nick, fmt.Sprintf(c.t("This server was created %s"), server.ctime.Format(time.RFC1123)))
+	//TODO(dan): Look at adding last optional [<channel modes with a parameter>] parameter
+	c.Send(nil, server.name, RPL_MYINFO, c.nick, server.name, Ver, supportedUserModesString, supportedChannelModesString)
+
+	rb := NewResponseBuffer(c)
+	c.RplISupport(rb)
+	server.MOTD(c, rb)
+	rb.Send()
+
+	if server.logger.IsLoggingRawIO() {
+		c.Notice(c.t("This server is in debug mode and is logging all user I/O. If you do not wish for everything you send to be readable by the server owner(s), please disconnect."))
+	}
+}
+
 // MOTD serves the Message of the Day.
 func (server *Server) MOTD(client *Client, rb *ResponseBuffer) {
 	server.configurableStateMutex.RLock()
@@ -648,6 +765,7 @@ func (client *Client) getWhoisOf(target *Client, rb *ResponseBuffer) {
 	defer target.stateMutex.RUnlock()
 
 	rb.Add(nil, client.server.name, RPL_WHOISUSER, client.nick, target.nick, target.username, target.hostname, "*", target.realname)
+	rb.Add(nil, client.server.name, RPL_WHOISSERVER, client.nick, target.nick, target.ServerName(), client.server.networkName)
 
 	whoischannels := client.WhoisChannelsNames(target)
 	if whoischannels != nil {
@@ -656,9 +774,12 @@ func (client *Client) getWhoisOf(target *Client, rb *ResponseBuffer) {
 	if target.class != nil {
 		rb.Add(nil, client.server.name, RPL_WHOISOPERATOR, client.nick, target.nick, target.whoisLine)
 	}
-	if client.flags[modes.Operator] || client == target {
+	if client == target || client.canSeeRealHost() {
 		rb.Add(nil, client.server.name, RPL_WHOISACTUALLY, client.nick, target.nick, fmt.Sprintf("%s@%s", target.username, utils.LookupHostname(target.IPString())), target.IPString(), client.t("Actual user@host, Actual IP"))
 	}
+	if target.dnsblListing.Action != dnsbl.ActionNone && client.flags[modes.Operator] {
+		rb.Add(nil, client.server.name, RPL_WHOISSPECIAL, client.nick, target.nick, fmt.Sprintf(client.t("is connecting from an IP listed in DNSBL %[1]s (%[2]s)"), target.dnsblListing.List, target.dnsblListing.Reply))
+	}
 	if target.flags[modes.TLS] {
 		rb.Add(nil, client.server.name, RPL_WHOISSECURE, client.nick, target.nick, client.t("is using a secure connection"))
 	}
@@ -704,7 +825,7 @@ func (target *Client) rplWhoReply(channel *Channel, client *Client, rb *Response
 		flags += channel.ClientPrefixes(client, target.capabilities.Has(caps.MultiPrefix))
 		channelName = channel.name
 	}
-	rb.Add(nil, target.server.name, RPL_WHOREPLY, target.nick, channelName, client.Username(), client.Hostname(), client.server.name, client.Nick(), flags, strconv.Itoa(client.hops)+" "+client.Realname())
+	rb.Add(nil, target.server.name, RPL_WHOREPLY, target.nick, channelName, client.Username(), client.Hostname(), client.ServerName(), client.Nick(), flags, strconv.Itoa(client.hops)+" "+client.Realname())
 }
 
 func whoChannel(client *Client, channel *Channel, friends ClientSet, rb *ResponseBuffer) {
@@ -806,6 +927,11 @@ func (server *Server) applyConfig(config *Config, initial bool) error {
 		return err
 	}
 
+	err = server.dnsbl.ApplyConfig(config.Server.DNSBL)
+	if err != nil {
+		return err
+	}
+
 	// setup new and removed caps
 	addedCaps := caps.NewSet()
 	removedCaps := caps.NewSet()
@@ -843,7 +969,7 @@ func (server *Server) applyConfig(config *Config, initial bool) error {
 	if config.Accounts.AuthenticationEnabled && !authPreviouslyEnabled {
 		// enabling SASL
 		SupportedCapabilities.Enable(caps.SASL)
-		CapValues.Set(caps.SASL, "PLAIN,EXTERNAL")
+		CapValues.Set(caps.SASL, "PLAIN,EXTERNAL,SCRAM-SHA-256")
 		addedCaps.Add(caps.SASL)
 	} else if !config.Accounts.AuthenticationEnabled && authPreviouslyEnabled {
 		// disabling SASL
@@ -929,14 +1055,18 @@ func (server *Server) applyConfig(config *Config, initial bool) error {
 		Rest: config.Limits.LineLen.Rest,
 	}
 	server.limits = Limits{
-		AwayLen:        int(config.Limits.AwayLen),
-		ChannelLen:     int(config.Limits.ChannelLen),
-		KickLen:        int(config.Limits.KickLen),
-		MonitorEntries: int(config.Limits.MonitorEntries),
-		NickLen:        int(config.Limits.NickLen),
-		TopicLen:       int(config.Limits.TopicLen),
-		ChanListModes:  int(config.Limits.ChanListModes),
-		LineLen:        lineLenConfig,
+		AwayLen:           int(config.Limits.AwayLen),
+		BroadcastCooldown: config.Limits.BroadcastCooldown,
+		ChannelLen:        int(config.Limits.ChannelLen),
+		KickLen:           int(config.Limits.KickLen),
+		MonitorEntries:    int(config.Limits.MonitorEntries),
+		NickLen:           int(config.Limits.NickLen),
+		RealnameLen:       int(config.Limits.RealnameLen),
+		SilenceEntries:    int(config.Limits.SilenceEntries),
+		AcceptEntries:     int(config.Limits.AcceptEntries),
+		TopicLen:          int(config.Limits.TopicLen),
+		ChanListModes:     int(config.Limits.ChanListModes),
+		LineLen:           lineLenConfig,
 	}
 	server.operclasses = *operclasses
 	server.operators = opers
@@ -968,6 +1098,13 @@ func (server *Server) applyConfig(config *Config, initial bool) error {
 	server.config = config
 	server.configurableStateMutex.Unlock()
 
+	// resize the history buffers of existing channels
+	if !initial {
+		for _, channel := range server.channels.Channels() {
+			channel.history.Resize(config.Channels.History.ChannelLength, config.Channels.History.MaxAge)
+		}
+	}
+
 	server.storeFilename = config.Datastore.Path
 	server.logger.Info("rehash", "Using datastore", server.storeFilename)
 	if initial {
@@ -976,7 +1113,15 @@ func (server *Server) applyConfig(config *Config, initial bool) error {
 		}
 	}
 
-	server.setupPprofListener(config)
+	server.accounts.SetAuthProvider(newScriptAuthProvider(&config.Accounts.AuthScript))
+
+	if initial {
+		server.restoreAlwaysOnClients()
+	}
+
+	server.setupHTTPListener("pprof", config.Debug.PprofListener, &server.pprofServer, nil)
+	server.setupHTTPListener("API", config.Debug.APIListener, &server.apiServer, server.apiHandler())
+	server.setupHTTPListener("metrics", config.Debug.MetricsListener, &server.metricsServer, http.HandlerFunc(server.metricsHandler))
 
 	// set RPL_ISUPPORT
 	var newISupportReplies [][]string
@@ -986,8 +1131,13 @@ func (server *Server) applyConfig(config *Config, initial bool) error {
 		newISupportReplies = oldISupportList.GetDifference(server.ISupport())
 	}
 
+	if err := server.links.ApplyConfig(&config.Linking); err != nil {
+		return err
+	}
+
 	// we are now open for business
 	server.setupListeners(config)
+	server.setupWebSocketListeners(config)
 
 	if !initial {
 		// push new info to all of our clients
@@ -1005,29 +1155,32 @@ func (server *Server) applyConfig(config *Config, initial bool) error {
 	return nil
 }
 
-func (server *Server) setupPprofListener(config *Config) {
-	pprofListener := ""
-	if config.Debug.PprofListener != nil {
-		pprofListener = *config.Debug.PprofListener
-	}
-	if server.pprofServer != nil {
-		if pprofListener == "" || (pprofListener != server.pprofServer.Addr) {
-			server.logger.Info("rehash", "Stopping pprof listener", server.pprofServer.Addr)
-			server.pprofServer.Close()
-			server.pprofServer = nil
+// setupHTTPListener starts, moves or stops one of the optional debugging HTTP listeners,
+// so that it matches the configured address. `handler` may be nil to use http.DefaultServeMux.
+func (server *Server) setupHTTPListener(name string, address *string, current **http.Server, handler http.Handler) {
+	listener := ""
+	if address != nil {
+		listener = *address
+	}
+	if *current != nil {
+		if listener == "" || (listener != (*current).Addr) {
+			server.logger.Info("rehash", fmt.Sprintf("Stopping %s listener", name), (*current).Addr)
+			(*current).Close()
+			*current = nil
 		}
 	}
-	if pprofListener != "" && server.pprofServer == nil {
-		ps := http.Server{
-			Addr: pprofListener,
+	if listener != "" && *current == nil {
+		hs := http.Server{
+			Addr:    listener,
+			Handler: handler,
 		}
 		go func() {
-			if err := ps.ListenAndServe(); err != nil {
-				server.logger.Error("rehash", fmt.Sprintf("pprof listener failed: %v", err))
+			if err := hs.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				server.logger.Error("rehash", fmt.Sprintf("%s listener failed: %v", name, err))
 			}
 		}()
-		server.pprofServer = &ps
-		server.logger.Info("rehash", "Started pprof listener", server.pprofServer.Addr)
+		*current = &hs
+		server.logger.Info("rehash", fmt.Sprintf("Started %s listener", name), hs.Addr)
 	}
 }
 
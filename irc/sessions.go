@@ -0,0 +1,366 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/caps"
+	"github.com/oragono/oragono/irc/modes"
+	"github.com/oragono/oragono/irc/sno"
+)
+
+// Sessions let several connections (say, a phone and a laptop) share a single
+// client. When a connection that's logged into an account registers with the nick
+// of a client logged into the same account, it's attached to that client as a
+// session instead of being refused. A session is a *Client of its own, with its own
+// socket and capabilities, but it never appears in the client or channel lists:
+// the commands it sends are run as the client it's attached to, and everything
+// sent to that client is also sent to each of its sessions. The client only quits
+// once its last connection (its own, or any session's) has closed, and not even
+// then if it's always-on (see alwayson.go).
+
+// sessionTarget returns the client that the given registering connection should be
+// attached to as a session, or nil if it should register normally.
+func (server *Server) sessionTarget(client *Client, nick string) *Client {
+	if !server.AccountConfig().Multiclient.Enabled {
+		return nil
+	}
+	account := client.Account()
+	if account == "" {
+		return nil
+	}
+	target := server.clients.Get(nick)
+	if target == nil || target == client || target.IsRemote() || !target.Registered() || target.Destroyed() ||
+		target.Account() != account || target.Primary() != nil {
+		// connections of always-on clients may use any nick
+		return server.alwaysOnClient(account)
+	}
+	return target
+}
+
+// attachSession attaches a newly-registered connection to the given client, and
+// sends it everything it needs to catch up with the client's current state.
+func (server *Server) attachSession(primary, session *Client) {
+	session.stateMutex.Lock()
+	session.primary = primary
+	session.registered = true
+	session.stateMutex.Unlock()
+
+	primary.stateMutex.Lock()
+	primary.sessions = append(primary.sessions, session)
+	primary.stateMutex.Unlock()
+	primary.setAutoAway(false)
+
+	session.updateNickMask(primary.Nick())
+
+	server.logger.Debug("localconnect", fmt.Sprintf("Session attached to %s [u:%s] [h:%s]", primary.Nick(), session.username, session.rawHostname))
+	server.snomasks.Send(sno.LocalConnects, fmt.Sprintf(ircfmt.Unescape("Client $c[grey][$r%s$c[grey]] attached a new session [u:$r%s$c[grey]] [h:$r%s$c[grey]]"), primary.Nick(), session.username, session.rawHostname))
+
+	server.sendWelcome(session)
+	nick := primary.Nick()
+	nickMask := primary.NickMaskString()
+	if modestring := primary.ModeString(); modestring != "+" {
+		session.Send(nil, nickMask, RPL_UMODEIS, nick, modestring)
+	}
+
+	for _, channel := range primary.Channels() {
+		if session.capabilities.Has(caps.ExtendedJoin) {
+			session.Send(nil, nickMask, "JOIN", channel.Name(), primary.AccountName(), primary.Realname())
+		} else {
+			session.Send(nil, nickMask, "JOIN", channel.Name())
+		}
+		rb := NewResponseBuffer(session)
+		channel.SendTopic(primary, rb)
+		channel.Names(primary, rb)
+		rb.Send()
+	}
+
+	primary.sendReplay(session)
+}
+
+// closeConnection cleans up after one of a client's connections has closed. The
+// client itself is only destroyed once it has no connections left.
+func (client *Client) closeConnection() {
+	client.Quit("Connection closed")
+
+	if primary := client.Primary(); primary != nil {
+		client.releaseConnection()
+		client.nickTimer.Stop()
+		client.server.accounts.Logout(client)
+		client.server.logger.Debug("quit", fmt.Sprintf("Session of %s detached", primary.Nick()))
+		if primary.removeSession(client) {
+			if primary.AlwaysOn() {
+				primary.detachAlwaysOn()
+			} else {
+				primary.Quit(client.QuitMessage())
+				primary.destroy(false)
+			}
+		}
+		return
+	}
+
+	client.stateMutex.Lock()
+	detaching := len(client.sessions) == 0
+	keepClient := (!detaching || client.alwaysOn) && !client.isDestroyed && !client.connectionClosed
+	if keepClient {
+		client.connectionClosed = true
+		// the client can still quit through their other sessions
+		client.isQuitting = false
+		client.quitMessage = ""
+	}
+	client.stateMutex.Unlock()
+
+	if keepClient {
+		client.cleanupConnection()
+		if detaching {
+			client.detachAlwaysOn()
+		} else {
+			client.server.logger.Debug("quit", fmt.Sprintf("%s closed a connection, but has other sessions", client.Nick()))
+		}
+	} else {
+		client.destroy(false)
+	}
+}
+
+// releaseConnection closes the client's own connection, if it's still open.
+func (client *Client) releaseConnection() {
+	client.stateMutex.Lock()
+	alreadyClosed := client.connectionClosed
+	client.connectionClosed = true
+	client.stateMutex.Unlock()
+
+	if !alreadyClosed {
+		client.cleanupConnection()
+	}
+}
+
+// cleanupConnection closes the client's socket and releases the resources tied to it.
+func (client *Client) cleanupConnection() {
+	// clients on other servers have no connection to us
+	if client.IsRemote() {
+		return
+	}
+
+	// remove from connection limits
+	ipaddr := client.IP()
+	// this check shouldn't be required but eh
+	if ipaddr != nil {
+		client.server.connectionLimiter.RemoveClient(ipaddr)
+	}
+
+	client.idletimer.Stop()
+	client.socket.Close()
+	client.server.metrics.ConnectionClosed()
+	if client.socket.SendQExceeded() {
+		client.server.metrics.SendQExceeded()
+	}
+}
+
+// removeSession detaches the given session from the client, returning true if the
+// client has no connections left.
+func (client *Client) removeSession(session *Client) (last bool) {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	for i, current := range client.sessions {
+		if current == session {
+			client.sessions = append(client.sessions[:i:i], client.sessions[i+1:]...)
+			return len(client.sessions) == 0 && client.connectionClosed && !client.isDestroyed
+		}
+	}
+	return false
+}
+
+// detachSessions detaches and returns all of the client's sessions.
+func (client *Client) detachSessions() (sessions []*Client) {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	sessions = client.sessions
+	client.sessions = nil
+	return
+}
+
+// updateSessionNicks tells the client's sessions about a change of nick.
+func (client *Client) updateSessionNicks() {
+	nick := client.Nick()
+	for _, session := range client.Sessions() {
+		session.updateNickMask(nick)
+	}
+}
+
+// connections returns the client objects for each of the client's open connections:
+// their own, and their sessions.
+func (client *Client) connections() (result []*Client) {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	if !client.connectionClosed {
+		result = append(result, client)
+	}
+	return append(result, client.sessions...)
+}
+
+// sendToConnections sends the given message (generated for the client) to every
+// one of the client's connections except `except`, adjusting it for each one's
+// capabilities.
+func (client *Client) sendToConnections(message ircmsg.IrcMessage, except *Client) {
+	for _, conn := range client.connections() {
+		if conn == except {
+			continue
+		}
+		if adapted, ok := conn.adaptMessage(message); ok {
+			// labels only make sense to the connection that sent the command
+			delete(adapted.Tags, caps.LabelTagName)
+			conn.writeMessage(adapted)
+		}
+	}
+}
+
+// echoToSessions sends a message that the client sent from one of their connections
+// to the others, so that every connection sees the whole conversation whether or
+// not it has echo-message. `message` is nil for TAGMSG.
+func (client *Client) echoToSessions(sender *Client, msgid string, tags *map[string]ircmsg.TagValue, command, target string, message *SplitMessage) {
+	if len(client.Sessions()) == 0 {
+		return
+	}
+
+	nickMask := client.NickMaskString()
+	makeLine := func(params ...string) ircmsg.IrcMessage {
+		lineTags := copyTags(tags)
+		if lineTags == nil {
+			lineTags = ircmsg.MakeTags("time", time.Now().UTC().Format(IRCv3TimestampFormat))
+		} else {
+			(*lineTags)["time"] = ircmsg.MakeTagValue(time.Now().UTC().Format(IRCv3TimestampFormat))
+		}
+		if msgid != "" {
+			(*lineTags)["draft/msgid"] = ircmsg.MakeTagValue(msgid)
+		}
+		if client.LoggedIntoAccount() {
+			(*lineTags)["account"] = ircmsg.MakeTagValue(client.AccountName())
+		}
+		return ircmsg.MakeMessage(lineTags, nickMask, command, params...)
+	}
+
+	for _, conn := range client.connections() {
+		if conn == sender {
+			continue
+		}
+		var lines []ircmsg.IrcMessage
+		if message == nil {
+			lines = append(lines, makeLine(target))
+		} else if conn.capabilities.Has(caps.MaxLine) {
+			lines = append(lines, makeLine(target, message.ForMaxLine))
+		} else {
+			for _, str := range message.For512 {
+				lines = append(lines, makeLine(target, str))
+			}
+		}
+		for _, line := range lines {
+			if adapted, ok := conn.adaptMessage(line); ok {
+				conn.writeMessage(adapted)
+			}
+		}
+	}
+}
+
+// sendToConnection sends an IRC line to this connection only, and not to any of the
+// client's other sessions.
+func (client *Client) sendToConnection(tags *map[string]ircmsg.TagValue, prefix string, command string, params ...string) {
+	if client.capabilities.Has(caps.ServerTime) {
+		t := time.Now().UTC().Format(IRCv3TimestampFormat)
+		if tags == nil {
+			tags = ircmsg.MakeTags("time", t)
+		} else {
+			(*tags)["time"] = ircmsg.MakeTagValue(t)
+		}
+	}
+	client.writeMessage(ircmsg.MakeMessage(tags, prefix, command, params...))
+}
+
+var (
+	// replies about the client's own actions that are also sent to their other
+	// connections, so that they all stay in sync
+	sessionStateCommands = map[string]bool{
+		"CHGHOST": true,
+		"JOIN":    true,
+		"KICK":    true,
+		"MODE":    true,
+		"NICK":    true,
+		"PART":    true,
+		"SETNAME": true,
+		"TOPIC":   true,
+	}
+
+	// commands that are only sent to clients with the given capability
+	sessionCapCommands = map[string]caps.Capability{
+		"ACCOUNT": caps.AccountNotify,
+		"AWAY":    caps.AwayNotify,
+		"BATCH":   caps.Batch,
+		"CAP":     caps.CapNotify,
+		"CHGHOST": caps.ChgHost,
+		"RESUMED": caps.Resume,
+		"SETNAME": caps.SetName,
+		"TAGMSG":  caps.MessageTags,
+	}
+)
+
+// adaptMessage adjusts a message that was generated for the client a session is
+// attached to (or that has every tag attached) to the capabilities this connection
+// negotiated. ok is false if the connection shouldn't see the message at all.
+func (client *Client) adaptMessage(message ircmsg.IrcMessage) (result ircmsg.IrcMessage, ok bool) {
+	capabilities := client.capabilities
+	command := strings.ToUpper(message.Command)
+	if capab, exists := sessionCapCommands[command]; exists && !capabilities.Has(capab) {
+		return
+	}
+	// other people being invited are only shown with invite-notify
+	if command == "INVITE" && 0 < len(message.Params) && message.Params[0] != client.Nick() && !capabilities.Has(caps.InviteNotify) {
+		return
+	}
+
+	// drop the tags this connection didn't ask for
+	tags := make(map[string]ircmsg.TagValue, len(message.Tags)+1)
+	for name, value := range message.Tags {
+		switch {
+		case name == "time" && !capabilities.Has(caps.ServerTime):
+		case name == "account" && !capabilities.Has(caps.AccountTag):
+		case name == "batch" && !capabilities.Has(caps.Batch):
+		case (name == "draft/msgid" || strings.HasPrefix(name, "+")) && !capabilities.Has(caps.MessageTags):
+		default:
+			tags[name] = value
+		}
+	}
+	if _, exists := tags["time"]; !exists && capabilities.Has(caps.ServerTime) {
+		tags["time"] = ircmsg.MakeTagValue(time.Now().UTC().Format(IRCv3TimestampFormat))
+	}
+
+	params := make([]string, len(message.Params))
+	copy(params, message.Params)
+	switch command {
+	case "JOIN":
+		if 1 < len(params) && !capabilities.Has(caps.ExtendedJoin) {
+			params = params[:1]
+		}
+	case RPL_NAMREPLY:
+		if 0 < len(params) {
+			names := strings.Fields(params[len(params)-1])
+			for i, name := range names {
+				if !capabilities.Has(caps.UserhostInNames) {
+					name = strings.SplitN(name, "!", 2)[0]
+				}
+				if prefixes, nick := modes.SplitChannelMembershipPrefixes(name); 1 < len(prefixes) && !capabilities.Has(caps.MultiPrefix) {
+					name = prefixes[:1] + nick
+				}
+				names[i] = name
+			}
+			params[len(params)-1] = strings.Join(names, " ")
+		}
+	}
+
+	result = ircmsg.MakeMessage(&tags, message.Prefix, message.Command, params...)
+	return result, true
+}
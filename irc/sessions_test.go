@@ -0,0 +1,73 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+)
+
+func newSessionTestClient(t *testing.T, server *Server, account, nick string, caps ...string) *testClient {
+	tc := openTestClient(server)
+	tc.login(t, server, account)
+	tc.register(t, nick, append(caps, "cap-notify")...)
+	return tc
+}
+
+func TestSessions(t *testing.T) {
+	server, cleanup := newTestServer(t, func(config *Config) {
+		config.Accounts.Multiclient.Enabled = true
+	})
+	defer cleanup()
+
+	laptop := newSessionTestClient(t, server, "alice", "alice")
+	laptop.send("JOIN #test")
+	laptop.expect(t, "JOIN", "#test")
+
+	phone := newSessionTestClient(t, server, "alice", "alice", "server-time")
+	phone.expect(t, ":alice!", "JOIN", "#test")
+	phone.expect(t, " 366 ", "#test")
+	if server.clients.Count() != 1 {
+		t.Fatalf("sessions should not be counted as clients, have %d", server.clients.Count())
+	}
+
+	// connections on other accounts can't take the nick
+	mallory := openTestClient(server)
+	mallory.login(t, server, "mallory")
+	mallory.send("CAP END")
+	mallory.send("NICK alice")
+	mallory.send("USER u 0 * :Test User")
+	mallory.expect(t, " 433 ")
+	mallory.send("NICK mallory")
+	mallory.expect(t, " 001 ", "mallory")
+
+	bob := newTestClient(t, server, "bob")
+	bob.send("JOIN #test")
+	bob.expect(t, " 366 ")
+	bob.send("PRIVMSG #test :hi alice")
+	laptop.expect(t, ":bob!", "PRIVMSG #test :hi alice")
+	phone.expect(t, "time=", ":bob!", "PRIVMSG #test :hi alice")
+
+	// messages from one connection are shown on the other
+	phone.send("PRIVMSG #test :hi bob")
+	bob.expect(t, ":alice!", "PRIVMSG #test :hi bob")
+	laptop.expect(t, ":alice!", "PRIVMSG #test :hi bob")
+
+	// and so are changes to the client's state
+	laptop.send("PART #test")
+	phone.expect(t, ":alice!", "PART #test")
+
+	// the client stays until its last connection closes
+	laptop.send("QUIT")
+	laptop.expect(t, "ERROR")
+	waitFor(t, "laptop to detach", func() bool {
+		return server.clients.Get("alice").connections()[0] == phone.client
+	})
+	phone.send("PRIVMSG bob :still here")
+	bob.expect(t, ":alice!", "PRIVMSG bob :still here")
+
+	phone.send("QUIT :bye")
+	waitFor(t, "alice to quit", func() bool {
+		return server.clients.Get("alice") == nil
+	})
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetname(t *testing.T) {
+	server, shutdown := newTestServer(t, func(config *Config) {
+		config.Limits.RealnameLen = 20
+		addTestOper(t, config, "admin", "chgname")
+	})
+	defer shutdown()
+
+	alice := newTestClient(t, server, "alice", "draft/setname")
+	bob := newTestClient(t, server, "bob", "draft/setname")
+	carol := newTestClient(t, server, "carol")
+	dave := newTestClient(t, server, "dave", "draft/setname")
+	for _, tc := range []*testClient{alice, bob, carol} {
+		tc.send("JOIN #test")
+		tc.expect(t, "JOIN #test")
+	}
+
+	alice.send("SETNAME :" + strings.Repeat("a", 21))
+	alice.expect(t, "FAIL SETNAME INVALID_REALNAME")
+
+	// the change goes to the client itself and everyone sharing a channel with
+	// them who has the capability
+	alice.send("SETNAME :New Name")
+	alice.expect(t, ":alice!~u@pipe SETNAME :New Name")
+	bob.expect(t, ":alice!~u@pipe SETNAME :New Name")
+	carol.expectNone(t, "SETNAME")
+	dave.expectNone(t, "SETNAME")
+	carol.send("WHOIS alice")
+	carol.expect(t, " 311 carol alice ~u pipe * :New Name")
+
+	admin := newOperTestClient(t, server, "admin")
+	admin.send("CHGNAME alice :" + strings.Repeat("a", 21))
+	admin.expect(t, "Invalid realname")
+	admin.send("CHGNAME alice :Other Name")
+	alice.expect(t, ":alice!~u@pipe SETNAME :Other Name")
+	bob.expect(t, ":alice!~u@pipe SETNAME :Other Name")
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"strings"
+	"time"
+
+	"github.com/oragono/oragono/irc/modes"
+)
+
+const (
+	// how often a +g client is told about messages they've blocked
+	callerIDNotifyInterval = time.Minute
+)
+
+// IgnoreLists are a client's SILENCE and ACCEPT lists, persisted for accounts.
+type IgnoreLists struct {
+	Silence []string
+	Accept  []string
+}
+
+// SilenceMasks returns the masks on the client's SILENCE list.
+func (client *Client) SilenceMasks() []string {
+	return strings.Fields(client.silence.String())
+}
+
+// AcceptedNicks returns the nicknames on the client's ACCEPT list.
+func (client *Client) AcceptedNicks() (result []string) {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	for nick := range client.accepted {
+		result = append(result, nick)
+	}
+	return
+}
+
+// addAccepted adds the given (casefolded) nickname to the client's ACCEPT list.
+func (client *Client) addAccepted(nick string, limit int) error {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	if client.accepted[nick] {
+		return errAcceptExists
+	}
+	if limit <= len(client.accepted) {
+		return errAcceptListFull
+	}
+	client.accepted[nick] = true
+	return nil
+}
+
+// removeAccepted removes the given (casefolded) nickname from the client's ACCEPT list.
+func (client *Client) removeAccepted(nick string) error {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	if !client.accepted[nick] {
+		return errAcceptNotFound
+	}
+	delete(client.accepted, nick)
+	return nil
+}
+
+// applyIgnoreLists adds the given (stored) lists to the client's current ones.
+func (client *Client) applyIgnoreLists(lists IgnoreLists) {
+	client.silence.AddAll(lists.Silence)
+
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	for _, nick := range lists.Accept {
+		client.accepted[nick] = true
+	}
+}
+
+// storeIgnoreLists persists the client's SILENCE and ACCEPT lists, if they're
+// logged into an account.
+func (client *Client) storeIgnoreLists() {
+	account := client.Account()
+	if account == "" {
+		return
+	}
+	lists := IgnoreLists{
+		Silence: client.SilenceMasks(),
+		Accept:  client.AcceptedNicks(),
+	}
+	err := client.server.accounts.StoreIgnoreLists(account, lists)
+	if err != nil {
+		client.server.logger.Error("accounts", "could not store ignore lists for", account, err.Error())
+	}
+}
+
+// checkIgnores returns true if the client is willing to receive a private message
+// (or invite, etc.) from the given sender. If the sender is blocked by caller-ID
+// and rb is given, the sender is told so, and the client is (occasionally)
+// told about the attempt.
+func (client *Client) checkIgnores(sender *Client, rb *ResponseBuffer) bool {
+	// clients on other servers are checked by their own server
+	if client.IsRemote() {
+		return true
+	}
+	if client == sender || sender.HasMode(modes.Operator) {
+		return true
+	}
+	if client.silence.MatchClient(sender) {
+		return false
+	}
+	if !client.HasMode(modes.CallerID) {
+		return true
+	}
+
+	senderNick := sender.NickCasefolded()
+	client.stateMutex.Lock()
+	accepted := client.accepted[senderNick]
+	notify := false
+	if !accepted {
+		now := time.Now()
+		if callerIDNotifyInterval <= now.Sub(client.lastCallerIDNotify) {
+			client.lastCallerIDNotify = now
+			notify = true
+		}
+	}
+	client.stateMutex.Unlock()
+
+	if accepted {
+		return true
+	}
+	if rb != nil {
+		nick := client.Nick()
+		rb.Add(nil, client.server.name, ERR_TARGUMODEG, sender.Nick(), nick, sender.t("is in +g mode (server-side ignore)"))
+		if notify {
+			rb.Add(nil, client.server.name, RPL_TARGNOTIFY, sender.Nick(), nick, sender.t("has been informed that you messaged them"))
+			client.Send(nil, client.server.name, RPL_UMODEGMSG, nick, sender.Nick(), sender.Username()+"@"+sender.Hostname(), client.t("is messaging you, and you have user mode +g set. Use /ACCEPT +nick to allow"))
+		}
+	}
+	return false
+}
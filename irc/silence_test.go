@@ -0,0 +1,83 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"strings"
+	"testing"
+)
+
+// expectListed fails the test unless each of the given strings is contained in
+// one of the lines, in any order.
+func expectListed(t *testing.T, lines []string, substrings ...string) {
+	for _, substring := range substrings {
+		found := false
+		for _, line := range lines {
+			if strings.Contains(line, substring) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected a line containing %s", substring)
+		}
+	}
+}
+
+func TestSilenceAndCallerID(t *testing.T) {
+	server, shutdown := newTestServer(t, func(config *Config) {
+		config.Limits.SilenceEntries = 2
+		config.Limits.AcceptEntries = 2
+	})
+	defer shutdown()
+
+	alice := openTestClient(server)
+	alice.registerAccount(t, server, "alice", "alicepass")
+	alice.register(t, "alice")
+	bob := newTestClient(t, server, "bob")
+	carol := newTestClient(t, server, "carol")
+	dave := newTestClient(t, server, "dave")
+
+	alice.send("SILENCE +bob,+*!*@spam.example,+*!*@more.example")
+	alice.expect(t, " 511 alice *!*@more.example ")
+	alice.send("SILENCE")
+	expectListed(t, alice.drain(t), " 271 alice bob!*@*", " 271 alice *!*@spam.example", " 272 alice ")
+
+	alice.send("ACCEPT carol")
+	alice.send("ACCEPT carol")
+	alice.expect(t, " 457 alice carol ")
+	alice.send("MODE alice +g")
+	alice.expect(t, "MODE alice +g")
+
+	// silenced senders are dropped without telling them
+	bob.send("PRIVMSG alice :hello")
+	bob.expectNone(t, "alice")
+	// accepted ones get through caller-ID
+	carol.send("PRIVMSG alice :hello from carol")
+	alice.expect(t, ":carol!~u@pipe PRIVMSG alice :hello from carol")
+	// and everyone else is told about it, with alice being told once
+	dave.send("PRIVMSG alice :hello from dave")
+	dave.expect(t, " 716 dave alice ")
+	dave.expect(t, " 717 dave alice ")
+	alice.expect(t, " 718 alice dave ~u@pipe ")
+	dave.send("PRIVMSG alice :hello again")
+	dave.expect(t, " 716 dave alice ")
+	alice.expectNone(t, "dave")
+
+	alice.send("ACCEPT -carol,-carol")
+	alice.expect(t, " 458 alice carol ")
+	alice.send("ACCEPT dave")
+	dave.send("PRIVMSG alice :hello at last")
+	alice.expect(t, ":dave!~u@pipe PRIVMSG alice :hello at last")
+
+	// the lists are restored on the next login to the account
+	again := openTestClient(server)
+	again.login(t, server, "alice")
+	again.register(t, "alice2")
+	again.send("SILENCE")
+	expectListed(t, again.drain(t), " 271 alice2 bob!*@*", " 271 alice2 *!*@spam.example", " 272 alice2 ")
+	again.send("ACCEPT *")
+	again.expect(t, " 281 alice2 dave")
+	again.expect(t, " 282 alice2 ")
+	again.expectNone(t, "carol")
+}
@@ -11,8 +11,10 @@ type Mask rune
 const (
 	LocalAccouncements Mask = 'a'
 	LocalConnects      Mask = 'c'
+	LocalDNSBL         Mask = 'd'
 	LocalChannels      Mask = 'j'
 	LocalKills         Mask = 'k'
+	Links              Mask = 'l'
 	LocalNicks         Mask = 'n'
 	LocalOpers         Mask = 'o'
 	LocalQuits         Mask = 'q'
@@ -26,8 +28,10 @@ var (
 	NoticeMaskNames = map[Mask]string{
 		LocalAccouncements: "ANNOUNCEMENT",
 		LocalConnects:      "CONNECT",
+		LocalDNSBL:         "DNSBL",
 		LocalChannels:      "CHANNEL",
 		LocalKills:         "KILL",
+		Links:              "LINK",
 		LocalNicks:         "NICK",
 		LocalOpers:         "OPER",
 		LocalQuits:         "QUIT",
@@ -40,8 +44,10 @@ var (
 	ValidMasks = map[Mask]bool{
 		LocalAccouncements: true,
 		LocalConnects:      true,
+		LocalDNSBL:         true,
 		LocalChannels:      true,
 		LocalKills:         true,
+		Links:              true,
 		LocalNicks:         true,
 		LocalOpers:         true,
 		LocalQuits:         true,
@@ -61,6 +61,14 @@ func (socket *Socket) Close() {
 
 // CertFP returns the fingerprint of the certificate provided by the client.
 func (socket *Socket) CertFP() (string, error) {
+	// websocket connections have already done their TLS handshake
+	if wc, isWebSocket := socket.conn.(*wsConn); isWebSocket {
+		if wc.certfp == "" {
+			return "", errNoPeerCerts
+		}
+		return wc.certfp, nil
+	}
+
 	var tlsConn, isTLS = socket.conn.(*tls.Conn)
 	if !isTLS {
 		return "", errNotTLS
@@ -147,6 +155,13 @@ func (socket *Socket) SetFinalData(data string) {
 	socket.finalData = data
 }
 
+// SendQExceeded returns whether the socket was closed because its SendQ filled up.
+func (socket *Socket) SendQExceeded() bool {
+	socket.Lock()
+	defer socket.Unlock()
+	return socket.sendQExceeded
+}
+
 // IsClosed returns whether the socket is closed.
 func (socket *Socket) IsClosed() bool {
 	socket.Lock()
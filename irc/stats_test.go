@@ -0,0 +1,60 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	server, shutdown := newTestServer(t, func(config *Config) {
+		config.Accounts.AuthenticationEnabled = true
+		addTestOper(t, config, "admin")
+	})
+	defer shutdown()
+
+	alice := openTestClient(server)
+	alice.registerAccount(t, server, "alice", "alicepass")
+	alice.register(t, "alice")
+
+	// uptime and command usage are public
+	alice.send("STATS u")
+	alice.expect(t, " 242 alice :Server Up 0 days 0:")
+	alice.expect(t, " 219 alice u ")
+	alice.send("PING :one")
+	alice.expect(t, "PONG")
+	alice.send("STATS m")
+	alice.expect(t, " 212 alice PING 1 0 0")
+	alice.expect(t, " 219 alice m ")
+
+	// the rest needs an oper
+	alice.send("STATS o")
+	alice.expect(t, " 481 alice ")
+	alice.expect(t, " 219 alice o ")
+
+	server.klines.AddMask("*!*@bad.example", nil, "go away", "", "admin")
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	server.dlines.AddNetwork(*network, nil, "go away too", "", "admin")
+	if _, err := server.accounts.Suspend("alice", IPBanInfo{Reason: "spamming", OperName: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := newOperTestClient(t, server, "admin")
+	for _, test := range []struct {
+		letter   string
+		expected string
+	}{
+		{"o", " 243 admin O * * admin admin"},
+		{"p", " 249 admin p :admin (admin) idle "},
+		{"K", " 216 admin K *!*@bad.example admin :go away"},
+		{"d", " 225 admin D 192.0.2.0/24 admin :go away too"},
+		{"S", " 249 admin S :Suspension - alice - added by admin - spamming"},
+		{"P", " 249 admin P :"},
+	} {
+		admin.send("STATS " + test.letter)
+		admin.expect(t, test.expected)
+		admin.expect(t, " 219 admin "+test.letter+" ")
+	}
+}
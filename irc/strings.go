@@ -7,8 +7,13 @@ package irc
 
 import (
 	"strings"
+	"unicode/utf8"
 
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
 	"golang.org/x/text/secure/precis"
+	"golang.org/x/text/unicode/norm"
+	"golang.org/x/text/width"
 )
 
 const (
@@ -37,6 +42,25 @@ func Casefold(str string) (string, error) {
 	return str, nil
 }
 
+// foldText applies the same width, case and normalization mappings as Casefold,
+// but never fails, for text like realnames that can contain characters Casefold rejects.
+func foldText(text string) string {
+	text = width.Fold.String(text)
+	text = cases.Lower(language.Und, cases.HandleFinalSigma(false)).String(text)
+	return norm.NFC.String(text)
+}
+
+// truncateUTF8 truncates str to at most length bytes, without splitting a UTF-8 sequence.
+func truncateUTF8(str string, length int) string {
+	if len(str) <= length {
+		return str
+	}
+	for 0 < length && !utf8.RuneStart(str[length]) {
+		length--
+	}
+	return str[:length]
+}
+
 // CasefoldChannel returns a casefolded version of a channel name.
 func CasefoldChannel(name string) (string, error) {
 	lowered, err := Casefold(name)
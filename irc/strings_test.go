@@ -108,3 +108,23 @@ func TestCasefoldName(t *testing.T) {
 		})
 	}
 }
+
+func TestTruncateUTF8(t *testing.T) {
+	cases := []struct {
+		str    string
+		length int
+		result string
+	}{
+		{"realname", 20, "realname"},
+		{"realname", 4, "real"},
+		{"naïve", 3, "na"},
+		{"naïve", 4, "naï"},
+		{"日本語", 5, "日"},
+		{"日本語", 2, ""},
+	}
+	for _, c := range cases {
+		if result := truncateUTF8(c.str, c.length); result != c.result {
+			t.Errorf("truncating %q to %d bytes gave %q, expected %q", c.str, c.length, result, c.result)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const testCertfp = "abababababababababababababababababababababababababababababababab"
+
+// saslExternal authenticates the connection with SASL EXTERNAL, as if it had
+// connected with a certificate with the given fingerprint. It returns the numeric
+// the server finished with, and leaves CAP negotiation open.
+func (tc *testClient) saslExternal(t *testing.T, certfp string) string {
+	tc.client.certfp = certfp
+	tc.send("CAP LS 302")
+	tc.send("CAP REQ :sasl")
+	tc.expect(t, "CAP", "ACK")
+	tc.send("AUTHENTICATE EXTERNAL")
+	tc.expect(t, "AUTHENTICATE +")
+	tc.send("AUTHENTICATE +")
+	for {
+		line := tc.expect(t, " 90")
+		if numeric := line[len(":irc.test "):][:3]; numeric != RPL_LOGGEDIN {
+			return numeric
+		}
+	}
+}
+
+// saslScram authenticates the connection with SASL SCRAM-SHA-256, returning the
+// numeric the server finished with. CAP negotiation is left open.
+func (tc *testClient) saslScram(t *testing.T, account, passphrase string) string {
+	tc.send("CAP LS 302")
+	tc.send("CAP REQ :sasl")
+	tc.expect(t, "CAP", "ACK")
+	tc.send("AUTHENTICATE SCRAM-SHA-256")
+	tc.expect(t, "AUTHENTICATE +")
+
+	clientFirstBare := "n=" + account + ",r=testclientnonce"
+	tc.send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("n,,"+clientFirstBare)))
+	serverFirst := tc.scramResponse(t)
+	attrs := strings.Split(serverFirst, ",")
+	if len(attrs) != 3 || !strings.HasPrefix(attrs[0], "r=testclientnonce") {
+		t.Fatalf("unexpected server-first message %s", serverFirst)
+	}
+	salt, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(attrs[1], "s="))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iterations, err := strconv.Atoi(strings.TrimPrefix(attrs[2], "i="))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(passphrase), salt, iterations, sha256.Size, sha256.New)
+	clientKey := testHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	clientFinalWithoutProof := "c=biws," + attrs[0]
+	clientSignature := testHMAC(storedKey[:], clientFirstBare+","+serverFirst+","+clientFinalWithoutProof)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	tc.send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte(clientFinalWithoutProof+",p="+base64.StdEncoding.EncodeToString(proof))))
+	if serverFinal := tc.scramResponse(t); !strings.HasPrefix(serverFinal, "v=") {
+		t.Fatalf("unexpected server-final message %s", serverFinal)
+	}
+	tc.send("AUTHENTICATE +")
+	for {
+		line := tc.expect(t, " 90")
+		if numeric := line[len(":irc.test "):][:3]; numeric != RPL_LOGGEDIN {
+			return numeric
+		}
+	}
+}
+
+// scramResponse returns the next SCRAM message from the server, decoded.
+func (tc *testClient) scramResponse(t *testing.T) string {
+	line := tc.expect(t, "AUTHENTICATE ")
+	fields := strings.Fields(line)
+	decoded, err := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+	if err != nil {
+		t.Fatalf("invalid AUTHENTICATE response %s", line)
+	}
+	return string(decoded)
+}
+
+func testHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+func TestNickServSuspend(t *testing.T) {
+	server, shutdown := newTestServer(t, func(config *Config) {
+		config.Accounts.AuthenticationEnabled = true
+		addTestOper(t, config, "admin", "oper:local_ban", "oper:local_unban")
+	})
+	defer shutdown()
+
+	alice := openTestClient(server)
+	alice.registerAccount(t, server, "alice", "alicepass")
+	alice.register(t, "alice")
+	if err := server.accounts.AddCertfp("alice", testCertfp); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := newOperTestClient(t, server, "admin")
+	admin.send("PRIVMSG NickServ :SUSPEND alice 1h spamming")
+	admin.expect(t, "NickServ", "Suspended account alice for 1h0m0s")
+	// the logged-in session is disconnected
+	alice.expect(t, "suspended (spamming)")
+	admin.send("PRIVMSG NickServ :SUSPEND LIST")
+	admin.expect(t, "NickServ", "Suspension - alice - added by admin")
+
+	// none of the login mechanisms work
+	plain := openTestClient(server)
+	if numeric := plain.saslPlain(t, "alice", "alicepass"); numeric != ERR_SASLFAIL {
+		t.Errorf("expected PLAIN to fail, got %s", numeric)
+	}
+	scram := openTestClient(server)
+	if numeric := scram.saslScram(t, "alice", "alicepass"); numeric != ERR_SASLFAIL {
+		t.Errorf("expected SCRAM to fail, got %s", numeric)
+	}
+	external := openTestClient(server)
+	if numeric := external.saslExternal(t, testCertfp); numeric != ERR_SASLFAIL {
+		t.Errorf("expected EXTERNAL to fail, got %s", numeric)
+	}
+	ns := newTestClient(t, server, "ns")
+	ns.send("PRIVMSG NickServ :IDENTIFY alice alicepass")
+	ns.expect(t, "NickServ", "account has been suspended")
+
+	admin.send("PRIVMSG NickServ :UNSUSPEND alice")
+	admin.expect(t, "NickServ", "Lifted the suspension of account alice")
+	admin.send("PRIVMSG NickServ :UNSUSPEND alice")
+	admin.expect(t, "NickServ", "not suspended")
+
+	for _, numeric := range []string{
+		openTestClient(server).saslPlain(t, "alice", "alicepass"),
+		openTestClient(server).saslScram(t, "alice", "alicepass"),
+		openTestClient(server).saslExternal(t, testCertfp),
+	} {
+		if numeric != RPL_SASLSUCCESS {
+			t.Errorf("expected login to work after unsuspending, got %s", numeric)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oragono/oragono/irc/dnsbl"
+	"github.com/oragono/oragono/irc/logger"
+)
+
+// helpers for tests that run a real server, with clients connected over pipes.
+
+const testTimeout = 30 * time.Second
+
+// testConfig returns a minimal config for a server with the given name, storing
+// its datastore in dir.
+func testConfig(dir, name string) *Config {
+	config := &Config{}
+	config.Network.Name = "TestNet"
+	config.Server.Name = name
+	config.Server.MaxSendQBytes = 1 << 20
+	config.Datastore.Path = filepath.Join(dir, name+".db")
+	config.Languages.Default = "en"
+	config.Limits.AwayLen = 200
+	config.Limits.ChannelLen = 64
+	config.Limits.ChanListModes = 60
+	config.Limits.KickLen = 390
+	config.Limits.MonitorEntries = 100
+	config.Limits.NickLen = 32
+	config.Limits.RealnameLen = 200
+	config.Limits.TopicLen = 390
+	config.Limits.WhowasEntries = 100
+	config.Limits.LineLen.Tags = 2048
+	config.Limits.LineLen.Rest = 512
+	return config
+}
+
+// startTestServer creates the datastore for the given config and starts a server with it.
+// The caller is responsible for shutting the server down.
+func startTestServer(t *testing.T, config *Config) *Server {
+	InitDB(config.Datastore.Path)
+
+	logManager, err := logger.NewManager(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config, logManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// newTestDir creates a temporary directory for datastores, returning a function
+// that removes it.
+func newTestDir(t *testing.T) (dir string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "oragono-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+// newNamedTestServer starts a server with the given name and its datastore in a
+// new temporary directory. If configure isn't nil, it can change the config
+// before the server starts. The returned function shuts the server down and
+// removes the directory.
+func newNamedTestServer(t *testing.T, name string, configure func(config *Config)) (*Server, func()) {
+	dir, removeDir := newTestDir(t)
+	config := testConfig(dir, name)
+	if configure != nil {
+		configure(config)
+	}
+	server := startTestServer(t, config)
+	return server, func() {
+		server.Shutdown()
+		removeDir()
+	}
+}
+
+// newTestServer starts a standalone server, as with newNamedTestServer.
+func newTestServer(t *testing.T, configure func(config *Config)) (*Server, func()) {
+	return newNamedTestServer(t, "irc.test", configure)
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(testTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type testClient struct {
+	client *Client
+	conn   net.Conn
+	lines  chan string
+}
+
+func newTestClient(t *testing.T, server *Server, nick string, caps ...string) *testClient {
+	tc := openTestClient(server)
+	tc.register(t, nick, caps...)
+	return tc
+}
+
+// openTestClient connects a new client to the server without registering it.
+func openTestClient(server *Server) *testClient {
+	return openListedTestClient(server, dnsbl.Result{})
+}
+
+// openListedTestClient connects a new client to the server, as if its IP was
+// listed in a DNSBL.
+func openListedTestClient(server *Server, listing dnsbl.Result) *testClient {
+	connOurs, connTheirs := net.Pipe()
+	tc := &testClient{
+		client: NewClient(server, connTheirs, false, listing),
+		conn:   connOurs,
+		lines:  make(chan string, 1000),
+	}
+	go func() {
+		scanner := bufio.NewScanner(connOurs)
+		for scanner.Scan() {
+			tc.lines <- scanner.Text()
+		}
+		close(tc.lines)
+	}()
+	return tc
+}
+
+// login logs the connection into the given account, waiting for it to be set up
+// first. CAP negotiation is left open, so it has to be ended before registering.
+func (tc *testClient) login(t *testing.T, server *Server, account string) {
+	tc.send("CAP LS 302")
+	tc.expect(t, "CAP * LS")
+	server.accounts.Login(tc.client, account)
+}
+
+// registerAccount registers and verifies an account with the given passphrase,
+// logging the connection into it. As with login, CAP negotiation is left open.
+func (tc *testClient) registerAccount(t *testing.T, server *Server, account, passphrase string) {
+	tc.send("CAP LS 302")
+	tc.expect(t, "CAP * LS")
+	if err := server.accounts.Register(tc.client, account, "none", "", passphrase, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.accounts.Verify(tc.client, account, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (tc *testClient) register(t *testing.T, nick string, caps ...string) {
+	if 0 < len(caps) {
+		tc.send("CAP LS 302")
+		tc.send("CAP REQ :" + strings.Join(caps, " "))
+	}
+	// this also ends any negotiation left open by login or registerAccount
+	tc.send("CAP END")
+	tc.send("NICK " + nick)
+	tc.send("USER u 0 * :Test User")
+	tc.expect(t, " 001 ")
+}
+
+func (tc *testClient) send(line string) {
+	io.WriteString(tc.conn, line+"\r\n")
+}
+
+// expect returns the next line containing all the given strings, failing the
+// test if there isn't one.
+func (tc *testClient) expect(t *testing.T, substrings ...string) string {
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case line, ok := <-tc.lines:
+			if !ok {
+				t.Fatalf("connection closed while waiting for %v", substrings)
+			}
+			matched := true
+			for _, substring := range substrings {
+				if !strings.Contains(line, substring) {
+					matched = false
+				}
+			}
+			if matched {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %v", substrings)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2018 Oragono contributors
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/goshuirc/irc-go/ircmatch"
+)
+
+// subprotocols from the IRCv3 websocket spec. with the binary one, lines are sent
+// as binary messages and may contain any bytes; with the text one (which is also
+// what we use if the client doesn't ask for either), lines must be valid UTF-8.
+const (
+	wsBinarySubprotocol = "binary.ircv3.net"
+	wsTextSubprotocol   = "text.ircv3.net"
+)
+
+// wsListener serves websocket connections on a single address.
+type wsListener struct {
+	httpServer *http.Server
+	isTLS      bool
+	// protects atomic update of tlsConfig:
+	configMutex sync.Mutex // tier 1
+	tlsConfig   *tls.Config
+}
+
+func (wl *wsListener) getTLSConfig() *tls.Config {
+	wl.configMutex.Lock()
+	defer wl.configMutex.Unlock()
+	return wl.tlsConfig
+}
+
+func (wl *wsListener) setTLSConfig(tlsConfig *tls.Config) {
+	wl.configMutex.Lock()
+	defer wl.configMutex.Unlock()
+	wl.tlsConfig = tlsConfig
+}
+
+// setupWebSocketListeners starts and stops websocket listeners to match the config.
+func (server *Server) setupWebSocketListeners(config *Config) {
+	listenAddrs := config.Server.WebSockets.Listen
+	tlsListeners := config.WebSocketTLSListeners()
+
+	// stop listeners that are no longer configured, or that switched between plaintext and TLS
+	for addr, listener := range server.wsListeners {
+		tlsConfig := tlsListeners[addr]
+		if containsString(listenAddrs, addr) && listener.isTLS == (tlsConfig != nil) {
+			// certificates are picked up by the next TLS handshake
+			listener.setTLSConfig(tlsConfig)
+			continue
+		}
+		listener.httpServer.Close()
+		delete(server.wsListeners, addr)
+		server.logger.Info("listeners", fmt.Sprintf("stopped listening for websockets on %s.", addr))
+	}
+
+	for _, addr := range listenAddrs {
+		if _, exists := server.wsListeners[addr]; exists {
+			continue
+		}
+		tlsConfig := tlsListeners[addr]
+		listener, err := server.createWebSocketListener(addr, tlsConfig)
+		if err != nil {
+			server.logger.Error("listeners", fmt.Sprintf("could not listen for websockets on %s: %v", addr, err))
+			continue
+		}
+		server.wsListeners[addr] = listener
+		server.logger.Info("listeners", fmt.Sprintf("now listening for websockets on %s, tls=%t.", addr, tlsConfig != nil))
+	}
+}
+
+func (server *Server) createWebSocketListener(addr string, tlsConfig *tls.Config) (*wsListener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	wl := &wsListener{
+		isTLS:     tlsConfig != nil,
+		tlsConfig: tlsConfig,
+	}
+	if wl.isTLS {
+		listener = tls.NewListener(listener, &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return wl.getTLSConfig(), nil
+			},
+		})
+	}
+	wl.httpServer = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			server.handleWebSocket(w, r, wl.isTLS)
+		}),
+	}
+
+	go func() {
+		err := wl.httpServer.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			server.logger.Error("listeners", fmt.Sprintf("websocket listener on %s failed: %v", addr, err))
+		}
+	}()
+	return wl, nil
+}
+
+// handleWebSocket upgrades an HTTP request to a websocket connection, and hands it
+// off to be treated like any other client connection.
+func (server *Server) handleWebSocket(w http.ResponseWriter, r *http.Request, isTLS bool) {
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{wsBinarySubprotocol, wsTextSubprotocol},
+		CheckOrigin:  server.webSocketOriginAllowed,
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		server.logger.Debug("localconnect-ip", fmt.Sprintf("Websocket upgrade from %s failed: %v", r.RemoteAddr, err))
+		return
+	}
+
+	// gateways in proxy-allowed-from can tell us the real client IP
+	remoteAddr := conn.RemoteAddr()
+	for _, gateway := range server.ProxyAllowedFrom() {
+		if isGatewayAllowed(remoteAddr, gateway) {
+			if proxiedIP := forwardedIP(r); proxiedIP != nil {
+				remoteAddr = &net.TCPAddr{IP: proxiedIP}
+			}
+			if r.Header.Get("X-Forwarded-Proto") == "https" {
+				isTLS = true
+			}
+			break
+		}
+	}
+
+	var certfp string
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		rawCert := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+		certfp = hex.EncodeToString(rawCert[:])
+	}
+
+	messageType := websocket.TextMessage
+	if conn.Subprotocol() == wsBinarySubprotocol {
+		messageType = websocket.BinaryMessage
+	}
+
+	limits := server.Limits()
+	conn.SetReadLimit(int64(limits.LineLen.Tags+limits.LineLen.Rest) * 2)
+
+	server.acceptClient(clientConn{
+		Conn: &wsConn{
+			conn:        conn,
+			messageType: messageType,
+			remoteAddr:  remoteAddr,
+			certfp:      certfp,
+		},
+		IsTLS: isTLS,
+	})
+}
+
+// webSocketOriginAllowed checks the Origin header of a websocket handshake
+// against the allowed-origins list, which denies every page when it's empty.
+// clients that aren't browsers generally don't send an Origin, and are always
+// allowed.
+func (server *Server) webSocketOriginAllowed(r *http.Request) bool {
+	origin := strings.ToLower(r.Header.Get("Origin"))
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range server.WebSocketAllowedOrigins() {
+		matcher := ircmatch.MakeMatch(strings.ToLower(allowed))
+		if matcher.Match(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedIP returns the client IP reported by a reverse proxy, which is the
+// last address in the X-Forwarded-For header.
+func forwardedIP(r *http.Request) net.IP {
+	forwardedFor := r.Header.Get("X-Forwarded-For")
+	if forwardedFor == "" {
+		return nil
+	}
+	addrs := strings.Split(forwardedFor, ",")
+	return net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1]))
+}
+
+// wsConn adapts a websocket connection to a net.Conn, so it can be used by Socket.
+// each incoming message is read as one or more lines, and each outgoing line is
+// written as a single message.
+type wsConn struct {
+	conn        *websocket.Conn
+	messageType int
+	remoteAddr  net.Addr
+	certfp      string
+
+	// what's left of the last message we read, with its lines terminated by \r\n
+	pending []byte
+}
+
+// Read implements net.Conn.
+func (wc *wsConn) Read(p []byte) (n int, err error) {
+	for len(wc.pending) == 0 {
+		_, message, err := wc.conn.ReadMessage()
+		if err != nil {
+			if _, isClose := err.(*websocket.CloseError); isClose {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		// clients should send one line per message, but may send several
+		for _, line := range bytes.Split(message, []byte("\n")) {
+			line = bytes.TrimSuffix(line, []byte("\r"))
+			if len(line) != 0 {
+				wc.pending = append(append(wc.pending, line...), '\r', '\n')
+			}
+		}
+	}
+	n = copy(p, wc.pending)
+	wc.pending = wc.pending[n:]
+	return n, nil
+}
+
+// Write implements net.Conn. Socket only ever writes complete lines.
+func (wc *wsConn) Write(p []byte) (n int, err error) {
+	for _, line := range bytes.Split(p, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			continue
+		}
+		if wc.messageType == websocket.TextMessage && !utf8.Valid(line) {
+			// converting to runes replaces each invalid byte with U+FFFD
+			line = []byte(string([]rune(string(line))))
+		}
+		err = wc.conn.WriteMessage(wc.messageType, line)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close implements net.Conn.
+func (wc *wsConn) Close() error {
+	wc.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return wc.conn.Close()
+}
+
+// LocalAddr implements net.Conn.
+func (wc *wsConn) LocalAddr() net.Addr {
+	return wc.conn.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn. It returns the proxied address, if there is one.
+func (wc *wsConn) RemoteAddr() net.Addr {
+	return wc.remoteAddr
+}
+
+// SetDeadline implements net.Conn.
+func (wc *wsConn) SetDeadline(t time.Time) error {
+	if err := wc.conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return wc.conn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn.
+func (wc *wsConn) SetReadDeadline(t time.Time) error {
+	return wc.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements net.Conn.
+func (wc *wsConn) SetWriteDeadline(t time.Time) error {
+	return wc.conn.SetWriteDeadline(t)
+}
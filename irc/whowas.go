@@ -43,7 +43,7 @@ func (list *WhoWasList) Append(client *Client) {
 		nickname:           client.nick,
 		username:           client.username,
 		hostname:           client.hostname,
-		realname:           client.realname,
+		realname:           client.Realname(),
 	}
 	list.end = (list.end + 1) % len(list.buffer)
 	if list.end == list.start {